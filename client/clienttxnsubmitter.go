@@ -33,6 +33,10 @@ func (cts *ClientTxnSubmitter) Status(sc *server.StatusConsumer) {
 	sc.Join()
 }
 
+func (cts *ClientTxnSubmitter) TxnLive() bool {
+	return cts.txnLive
+}
+
 func (cts *ClientTxnSubmitter) SubmitClientTransaction(ctxnCap *msgs.ClientTxn, continuation ClientTxnCompletionConsumer) {
 	if cts.txnLive {
 		continuation(nil, fmt.Errorf("Cannot submit client as a live txn already exists"))
@@ -276,6 +276,9 @@ func (sts *SimpleTxnSubmitter) translateActions(outgoingSeg *capn.Segment, picke
 		case msgs.CLIENTACTION_ROLL:
 			sts.translateRoll(outgoingSeg, &referencesInNeedOfPositions, &action, &clientAction)
 
+		case msgs.CLIENTACTION_DELETE:
+			sts.translateDelete(&action, &clientAction)
+
 		default:
 			panic(fmt.Sprintf("Unexpected action type: %v", clientAction.Which()))
 		}
@@ -332,6 +335,18 @@ func (sts *SimpleTxnSubmitter) translateRead(action *msgs.Action, clientAction *
 	read.SetVersion(clientRead.Version())
 }
 
+// A delete is voted on exactly as a write, but has no value or
+// references. Within txns, it is represented by ACTION_MISSING, which
+// is also what readers of the var will be sent in updates. A delete
+// which gives a version is voted on as a readwrite instead: it aborts
+// if the var has been written since that version.
+func (sts *SimpleTxnSubmitter) translateDelete(action *msgs.Action, clientAction *msgs.ClientAction) {
+	action.SetMissing()
+	if version := clientAction.Delete().Version(); len(version) != 0 {
+		action.Missing().SetVersion(version)
+	}
+}
+
 func (sts *SimpleTxnSubmitter) translateWrite(outgoingSeg *capn.Segment, referencesInNeedOfPositions *[]*msgs.VarIdPos, action *msgs.Action, clientAction *msgs.ClientAction) {
 	action.SetWrite()
 	clientWrite := clientAction.Write()
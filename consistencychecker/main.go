@@ -3,24 +3,22 @@ package main
 import (
 	"flag"
 	"fmt"
-	capn "github.com/glycerine/go-capnproto"
-	mdb "github.com/msackman/gomdb"
-	mdbs "github.com/msackman/gomdb/server"
 	"goshawkdb.io/common"
-	msgs "goshawkdb.io/common/capnp"
 	"goshawkdb.io/server"
 	"goshawkdb.io/server/db"
 	eng "goshawkdb.io/server/txnengine"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"time"
 )
 
 func main() {
 	log.SetPrefix(common.ProductName + " ")
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
-	log.Println(os.Args)
+	log.Println(server.RedactArgs(os.Args))
 
 	procs := runtime.NumCPU()
 	if procs < 2 {
@@ -28,100 +26,308 @@ func main() {
 	}
 	runtime.GOMAXPROCS(procs)
 
-	var vUUIdStr string
+	var vUUIdStr, hosts, username, password, passwordFile, caFile, journalPath, undoPath, reportPath, prefix, kinds string
+	var repair bool
+	var recheckDelay time.Duration
 	flag.StringVar(&vUUIdStr, "var", "", "var to interrogate")
+	flag.StringVar(&reportPath, "report", "", "`Path` to which to write a JSON report of the vars, stores and problems found, or - for stdout")
+	flag.StringVar(&prefix, "prefix", "", "Only report vars, and problems with vars, whose hex encoded id starts with this `prefix`")
+	flag.StringVar(&kinds, "errors", "", "Comma separated `list` of the types of problem to report: "+strings.Join(problemKinds, ", ")+" (default all)")
+	flag.StringVar(&hosts, "host", "", "Comma separated host:port list of the HTTP interfaces of the nodes of a running cluster to check, instead of data directories")
+	flag.StringVar(&username, "user", "", "Admin account username (with -host)")
+	flag.StringVar(&password, "password", "", "Admin account password (with -host)")
+	flag.StringVar(&passwordFile, "passwordfile", "", "`Path` to file containing admin account password (with -host)")
+	flag.StringVar(&caFile, "cacert", "", "`Path` to CA certificate with which to verify the nodes' TLS certificates (with -host)")
+	flag.DurationVar(&recheckDelay, "recheckdelay", 5*time.Second, "Time to wait before fetching suspect vars again from a running cluster (with -host)")
+	flag.BoolVar(&repair, "repair", false, "Repair divergent and missing vars, and txn refcounts, in the data directories, which are locked against servers meanwhile")
+	flag.StringVar(&journalPath, "journal", "", "`Path` to the journal to which every change made by -repair is appended (required with -repair)")
+	flag.StringVar(&undoPath, "undo", "", "`Path` to a journal written by -repair: undo its changes to the data directories, which are locked against servers meanwhile, and exit")
+	lmdbConfig := db.DefaultLMDBConfig()
+	lmdbConfig.RegisterFlags(flag.CommandLine)
+	encryption := &db.EncryptionConfig{}
+	encryption.RegisterFlags(flag.CommandLine)
 	flag.Parse()
+	if err := lmdbConfig.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	if err := encryption.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	r, err := newReport(prefix, kinds)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	dirs := flag.Args()
-	if len(dirs) == 0 {
+	vars := make(map[common.VarUUId]*varstate)
+	switch {
+	case hosts != "" && len(dirs) != 0:
+		log.Fatal("Both -host and dirs supplied. Only one can be supplied.")
+	case hosts != "":
+		clients := []*adminClient{}
+		for _, host := range strings.Split(hosts, ",") {
+			ac, err := newAdminClient(host, username, password, passwordFile, caFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			clients = append(clients, ac)
+		}
+		if err := checkOnline(clients, recheckDelay, vars, r); err != nil {
+			log.Fatal(err)
+		}
+	case len(dirs) == 0:
 		log.Fatal("No dirs supplied")
+	case repair && undoPath != "":
+		log.Fatal("Both -repair and -undo supplied. Only one can be supplied.")
+	case repair && journalPath == "":
+		log.Fatal("No journal supplied (missing -journal parameter)")
+	}
+	if hosts != "" && (repair || undoPath != "") {
+		log.Fatal("Running clusters can not be repaired: -repair and -undo require dirs.")
+	}
+	var j *journal
+	if repair {
+		if j, err = newJournal(journalPath); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	vars := make(map[common.VarUUId]*varstate)
+	var topology *server.Topology
+	stores := []*store{}
+	txns := newTxnStates()
 	for _, d := range dirs {
 		dir := d
 		log.Printf("...loading from %v\n", dir)
-		disk, err := mdbs.NewMDBServer(dir, 0, 0600, server.OneTB, 1, time.Millisecond, db.DB)
+		var lock *db.DirLock
+		if repair || undoPath != "" {
+			// A server must not be using the dir whilst we change it,
+			// nor start to until we're done.
+			if lock, err = db.LockDir(dir); err != nil {
+				log.Fatalf("Refusing to change %v: %v", dir, err)
+			}
+		}
+		lmdb, err := db.NewLMDBStore(dir, lmdbConfig)
 		if err != nil {
-			log.Println(err)
+			r.problem(problemDamaged, &store{name: dir}, nil, nil, "%v", err)
+			if lock != nil {
+				lock.Unlock()
+			}
+			continue
+		}
+		disk, err := encryption.Wrap(lmdb)
+		if err != nil {
+			r.problem(problemDamaged, &store{name: dir}, nil, nil, "%v", err)
+			lmdb.Shutdown()
+			if lock != nil {
+				lock.Unlock()
+			}
 			continue
 		}
-		loadVars(disk, vars)
-		disk.Shutdown()
+		st := &store{name: dir, disk: disk, lock: lock}
+		if es, ok := disk.(*db.EncryptedStore); ok {
+			st.keyring = es.Keyring()
+		}
+		if rmId, err := db.ReadIdentityFile(filepath.Join(dir, db.RMIdFile)); err == nil {
+			st.rmId = common.RMId(rmId)
+		} else {
+			log.Printf("Unable to read rmid of %v, so its placement will not be checked, nor can it be repaired: %v\n", dir, err)
+		}
+		stores = append(stores, st)
+		topology = loadTopology(st, topology, r)
+		if undoPath != "" {
+			continue
+		}
+		loadVars(st, vars, r)
+		checkTxns(st, txns, r)
+	}
+
+	if undoPath != "" {
+		err := undo(undoPath, stores)
+		shutdown(stores)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
 	log.Printf("Found %v unique vars", len(vars))
 
+	if len(stores) != 0 {
+		checkStuck(txns, r)
+	}
+	if topology != nil {
+		checkPlacement(topology, stores, vars, r)
+		checkReferences(topology, vars, r)
+	} else if len(dirs) != 0 {
+		log.Println("No topology found, so placement and references will not be checked")
+	}
+
+	if j != nil && len(stores) != 0 {
+		repairVars(topology, stores, vars, j, r)
+		for _, st := range stores {
+			repairTxns(st, j, r)
+		}
+		log.Printf("Journaled %v changes to %v\n", j.entries, journalPath)
+	}
+
 	if vUUIdStr != "" {
 		vUUId := common.MakeVarUUIdFromStr(vUUIdStr)
 		if vUUId == nil {
 			log.Printf("Unable to parse %v as vUUId\n", vUUIdStr)
-		}
-		if state, found := vars[*vUUId]; found {
+		} else if state, found := vars[*vUUId]; found {
 			log.Println(state)
 		} else {
 			log.Printf("Unable to find %v\n", vUUId)
 		}
 	}
+
+	// We exit with 2 if any problems were reported, and with 1 if we
+	// were unable to complete the check.
+	if len(r.Problems) != 0 {
+		log.Printf("Found %v problems: %v\n", len(r.Problems), r.Counts)
+	}
+	status := r.status()
+	r.finish(topology, stores, vars)
+	if reportPath != "" {
+		if err := r.write(reportPath); err != nil {
+			log.Println(err)
+			status = 1
+		}
+	}
+	if j != nil {
+		if err := j.Close(); err != nil {
+			log.Println(err)
+			status = 1
+		}
+	}
+	shutdown(stores)
+	os.Exit(status)
 }
 
-func loadVars(disk *mdbs.MDBServer, vars map[common.VarUUId]*varstate) {
-	_, err := disk.ReadonlyTransaction(func(rtxn *mdbs.RTxn) (interface{}, error) {
-		return rtxn.WithCursor(db.DB.Vars, func(cursor *mdb.Cursor) (interface{}, error) {
-			key, data, err := cursor.Get(nil, nil, mdb.FIRST)
-			for ; err == nil; key, data, err = cursor.Get(nil, nil, mdb.NEXT) {
-				vUUId := common.MakeVarUUId(key)
-				seg, _, err := capn.ReadFromMemoryZeroCopy(data)
-				if err != nil {
-					log.Println(err)
-					continue
-				}
+func shutdown(stores []*store) {
+	for _, st := range stores {
+		st.disk.Shutdown()
+		if st.lock != nil {
+			st.lock.Unlock()
+		}
+	}
+}
 
-				varCap := msgs.ReadRootVar(seg)
-				pos := varCap.Positions()
-				positions := (*common.Positions)(&pos)
-				writeTxnId := common.MakeTxnId(varCap.WriteTxnId())
-				writeTxnClock := eng.VectorClockFromCap(varCap.WriteTxnClock())
-				writesClock := eng.VectorClockFromCap(varCap.WritesClock())
-
-				if state, found := vars[*vUUId]; found {
-					if err := state.matches(disk, writeTxnId, writeTxnClock, writesClock, positions); err != nil {
-						log.Println(err)
-					}
-				} else {
-					state = &varstate{
-						vUUId:            vUUId,
-						disks:            []*mdbs.MDBServer{disk},
-						writeTxnId:       writeTxnId,
-						writeTxnClock:    writeTxnClock,
-						writeWritesClock: writesClock,
-						positions:        positions,
-					}
-					vars[*vUUId] = state
-				}
+// loadTopology returns whichever of best and the topology held by st
+// is the more recent.
+func loadTopology(st *store, best *server.Topology, r *report) *server.Topology {
+	result, err := st.disk.ReadonlyTransaction(func(rtxn db.RTxn) (interface{}, error) {
+		return db.ReadTopologyFromDisk(rtxn)
+	}).ResultError()
+	if err != nil {
+		r.problem(problemTopology, st, nil, nil, "Unable to read topology from %v: %v", st, err)
+		return best
+	}
+	topology := result.(*server.Topology)
+	st.clusterId = topology.ClusterId
+	switch {
+	case best == nil:
+		return topology
+	case topology.Version > best.Version:
+		r.problem(problemTopology, st, nil, nil, "%v has topology version %v, but others have %v", st, topology.Version, best.Version)
+		return topology
+	case topology.Version < best.Version:
+		r.problem(problemTopology, st, nil, nil, "%v has topology version %v, but others have %v", st, topology.Version, best.Version)
+	}
+	return best
+}
+
+func loadVars(st *store, vars map[common.VarUUId]*varstate, r *report) {
+	_, err := st.disk.ReadonlyTransaction(func(rtxn db.RTxn) (interface{}, error) {
+		return nil, rtxn.ForEach(db.Vars, func(key, data []byte) error {
+			vUUId := common.MakeVarUUId(key)
+			varCap, err := db.DecodeVar(key, data)
+			if err != nil {
+				r.problem(problemDamaged, st, vUUId, nil, "%v %v", st, err)
+				return nil
 			}
-			if err == mdb.NotFound {
-				return nil, nil
-			} else {
-				return nil, err
+
+			pos := varCap.Positions()
+			positions := (*common.Positions)(&pos)
+			writeTxnId := common.MakeTxnId(varCap.WriteTxnId())
+			writeTxnClock := eng.VectorClockFromCap(varCap.WriteTxnClock())
+			writesClock := eng.VectorClockFromCap(varCap.WritesClock())
+
+			if err := addVar(vars, st, vUUId, writeTxnId, writeTxnClock, writesClock, positions); err != nil {
+				r.problem(problemDiverged, st, vUUId, nil, "%v", err)
+			} else if state := vars[*vUUId]; state.references == nil {
+				if state.references, err = readReferences(rtxn, vUUId, writeTxnId); err != nil {
+					r.problem(problemReferences, st, vUUId, nil, "%v %v", st, err)
+				}
 			}
+			return nil
 		})
 	}).ResultError()
 	if err != nil {
-		log.Println(err)
+		r.problem(problemDamaged, st, nil, nil, "%v %v", st, err)
 	}
 }
 
+// addVar records that st holds the var at the given version. If
+// another store holds a different version, st is not recorded and the
+// divergence is returned.
+func addVar(vars map[common.VarUUId]*varstate, st *store, vUUId *common.VarUUId, writeTxnId *common.TxnId, writeTxnClock, writesClock *eng.VectorClock, positions *common.Positions) error {
+	if state, found := vars[*vUUId]; found {
+		return state.matches(st, writeTxnId, writeTxnClock, writesClock, positions)
+	}
+	vars[*vUUId] = &varstate{
+		vUUId:            vUUId,
+		stores:           []*store{st},
+		writeTxnId:       writeTxnId,
+		writeTxnClock:    writeTxnClock,
+		writeWritesClock: writesClock,
+		positions:        positions,
+	}
+	return nil
+}
+
+// store is a data directory or, when checking a running cluster, a
+// node. disk is nil for the latter. keyring is set if disk is
+// encrypted, and lock if we're to change disk.
+type store struct {
+	name      string
+	rmId      common.RMId
+	clusterId string
+	disk      db.Store
+	keyring   *db.Keyring
+	lock      *db.DirLock
+}
+
+func (st *store) String() string {
+	if st.rmId == common.RMIdEmpty {
+		return st.name
+	}
+	return fmt.Sprintf("%v (%v)", st.name, st.rmId)
+}
+
 type varstate struct {
 	vUUId            *common.VarUUId
-	disks            []*mdbs.MDBServer
+	stores           []*store
+	diverged         []*store
+	expected         []common.RMId
+	references       []*reference
 	writeTxnId       *common.TxnId
 	writeTxnClock    *eng.VectorClock
 	writeWritesClock *eng.VectorClock
 	positions        *common.Positions
 }
 
-func (vs *varstate) matches(disk *mdbs.MDBServer, writeTxnId *common.TxnId, writeTxnClock, writesClock *eng.VectorClock, positions *common.Positions) error {
+func (vs *varstate) matches(st *store, writeTxnId *common.TxnId, writeTxnClock, writesClock *eng.VectorClock, positions *common.Positions) error {
+	err := vs.divergence(writeTxnId, writeTxnClock, writesClock, positions)
+	if err == nil {
+		vs.stores = append(vs.stores, st)
+	} else {
+		vs.diverged = append(vs.diverged, st)
+	}
+	return err
+}
+
+func (vs *varstate) divergence(writeTxnId *common.TxnId, writeTxnClock, writesClock *eng.VectorClock, positions *common.Positions) error {
 	if !vs.writeTxnId.Equal(writeTxnId) {
 		return fmt.Errorf("%v TxnId divergence: %v vs %v", vs.vUUId, vs.writeTxnId, writeTxnId)
 	}
@@ -134,10 +340,9 @@ func (vs *varstate) matches(disk *mdbs.MDBServer, writeTxnId *common.TxnId, writ
 	if !vs.writeWritesClock.Equal(writesClock) {
 		return fmt.Errorf("%v Txn %v WritesClock divergence: %v vs %v", vs.vUUId, vs.writeTxnId, vs.writeWritesClock, writesClock)
 	}
-	vs.disks = append(vs.disks, disk)
 	return nil
 }
 
 func (vs *varstate) String() string {
-	return fmt.Sprintf("%v found in %v stores:\n positions:\t%v\n writeTxnId:\t%v\n writeTxnClock:\t%v\n writesClock:\t%v\n", vs.vUUId, len(vs.disks), vs.positions, vs.writeTxnId, vs.writeTxnClock, vs.writeWritesClock)
+	return fmt.Sprintf("%v found in %v stores %v:\n diverged in:\t%v\n expected on:\t%v\n references:\t%v\n positions:\t%v\n writeTxnId:\t%v\n writeTxnClock:\t%v\n writesClock:\t%v\n", vs.vUUId, len(vs.stores), vs.stores, vs.diverged, vs.expected, len(vs.references), vs.positions, vs.writeTxnId, vs.writeTxnClock, vs.writeWritesClock)
 }
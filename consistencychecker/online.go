@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server"
+	eng "goshawkdb.io/server/txnengine"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// In online mode, we connect to the HTTP admin interface of every node
+// of a running cluster, and page through the metadata of the vars each
+// holds. Vars change whilst we do so, so a var which diverges, or is
+// found on fewer RMs than its positions say it should be, is fetched
+// again from every node after recheckDelay, and is only reported if
+// it's still wrong.
+
+func checkOnline(clients []*adminClient, recheckDelay time.Duration, vars map[common.VarUUId]*varstate, r *report) error {
+	topology := &struct {
+		F      uint8
+		AllRMs []string
+	}{}
+	if err := clients[0].get("/admin/topology", nil, topology); err != nil {
+		return err
+	}
+	expected := 2*int(topology.F) + 1
+	if expected > len(topology.AllRMs) {
+		expected = len(topology.AllRMs)
+	}
+
+	suspects := make(map[common.VarUUId]server.EmptyStruct)
+	for _, ac := range clients {
+		log.Printf("...loading from %v\n", ac.host)
+		err := loadVarsOnline(ac, vars, func(kind string, st *store, vUUId *common.VarUUId, err error) {
+			if vUUId == nil {
+				r.problem(kind, st, nil, nil, "%v", err)
+			} else {
+				suspects[*vUUId] = server.EmptyStructVal
+			}
+		})
+		if err != nil {
+			r.problem(problemNode, &store{name: ac.host}, nil, nil, "%v", err)
+		}
+	}
+	for vUUId, state := range vars {
+		if len(state.stores) < expected {
+			suspects[vUUId] = server.EmptyStructVal
+		}
+	}
+	if len(suspects) == 0 {
+		return nil
+	}
+
+	log.Printf("Rechecking %v suspect vars in %v\n", len(suspects), recheckDelay)
+	time.Sleep(recheckDelay)
+	for vUUId := range suspects {
+		fresh := make(map[common.VarUUId]*varstate, 1)
+		query := url.Values{"var": {hex.EncodeToString(vUUId[:])}}
+		for _, ac := range clients {
+			page := &eng.VarMetadataPage{}
+			if err := ac.get("/admin/vars", query, page); err != nil {
+				r.problem(problemNode, &store{name: ac.host}, &vUUId, nil, "%v", err)
+				continue
+			}
+			addPage(&store{name: ac.host, rmId: page.RMId}, page, fresh, func(kind string, st *store, vUUId *common.VarUUId, err error) {
+				r.problem(kind, st, vUUId, nil, "%v", err)
+			})
+		}
+		state, found := fresh[vUUId]
+		if !found {
+			// It's been collected since we first saw it.
+			delete(vars, vUUId)
+			continue
+		}
+		vars[vUUId] = state
+		if len(state.stores) < expected {
+			r.problem(problemMissing, nil, state.vUUId, nil, "%v found on %v RMs %v; positions say it should be on %v", state.vUUId, len(state.stores), state.stores, expected)
+		}
+	}
+	return nil
+}
+
+// loadVarsOnline pages through the vars held by the node, calling
+// problem with each var which is damaged or diverges from another
+// node's copy.
+func loadVarsOnline(ac *adminClient, vars map[common.VarUUId]*varstate, problem func(string, *store, *common.VarUUId, error)) error {
+	var st *store
+	query := url.Values{}
+	for {
+		page := &eng.VarMetadataPage{}
+		if err := ac.get("/admin/vars", query, page); err != nil {
+			return err
+		}
+		if st == nil {
+			st = &store{name: ac.host, rmId: page.RMId}
+		}
+		addPage(st, page, vars, problem)
+		if page.Next == "" {
+			return nil
+		}
+		query.Set("after", page.Next)
+	}
+}
+
+// addPage records that st holds the vars in page. problem is called
+// with the kind of each problem found. If the id of a var can't be
+// parsed, problem is called with a nil vUUId.
+func addPage(st *store, page *eng.VarMetadataPage, vars map[common.VarUUId]*varstate, problem func(string, *store, *common.VarUUId, error)) {
+	for _, md := range page.Vars {
+		vUUId, positions, writeTxnId, err := md.Parse()
+		if err != nil {
+			problem(problemDamaged, st, vUUId, fmt.Errorf("%v: %v", st, err))
+			continue
+		}
+		writeTxnClock, writesClock, err := md.Clocks()
+		if err != nil {
+			problem(problemDamaged, st, vUUId, fmt.Errorf("%v: %v %v", st, vUUId, err))
+			continue
+		}
+		if err := addVar(vars, st, vUUId, writeTxnId, writeTxnClock, writesClock, positions); err != nil {
+			problem(problemDiverged, st, vUUId, err)
+		}
+	}
+}
+
+type adminClient struct {
+	client   *http.Client
+	host     string
+	username string
+	password string
+}
+
+// newAdminClient returns a client which always uses TLS: every request
+// carries the admin account's credentials, which must never be sent in
+// the clear.
+func newAdminClient(host, username, password, passwordFile, caFile string) (*adminClient, error) {
+	if username == "" {
+		return nil, fmt.Errorf("No admin account supplied (missing -user parameter)")
+	}
+	switch {
+	case password == "" && passwordFile == "":
+		return nil, fmt.Errorf("Password must be supplied with either -password or -passwordfile")
+	case password != "" && passwordFile != "":
+		return nil, fmt.Errorf("Both -password and -passwordfile supplied. Only one can be supplied.")
+	case passwordFile != "":
+		passwordFileBytes, err := ioutil.ReadFile(passwordFile)
+		if err != nil {
+			return nil, err
+		}
+		password = strings.TrimRight(string(passwordFileBytes), "\r\n")
+	}
+
+	tlsConfig := &tls.Config{}
+	if caFile != "" {
+		caBytes, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBytes) {
+			return nil, fmt.Errorf("Unable to parse any certificates from %v", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return &adminClient{
+		client: &http.Client{
+			Transport:     &http.Transport{TLSClientConfig: tlsConfig},
+			CheckRedirect: refuseInsecureRedirect,
+		},
+		host:     host,
+		username: username,
+		password: password,
+	}, nil
+}
+
+// refuseInsecureRedirect stops the credentials from following a
+// redirect off TLS.
+func refuseInsecureRedirect(req *http.Request, via []*http.Request) error {
+	if req.URL.Scheme != "https" {
+		return fmt.Errorf("Refusing to follow redirect to %v: admin credentials are only sent over TLS", req.URL)
+	}
+	if len(via) >= 10 {
+		return fmt.Errorf("Stopped after %v redirects", len(via))
+	}
+	return nil
+}
+
+// get issues a GET request and decodes the JSON response into result.
+func (ac *adminClient) get(path string, query url.Values, result interface{}) error {
+	u := url.URL{Scheme: "https", Host: ac.host, Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(ac.username, ac.password)
+	resp, err := ac.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v: %s: %s", ac.host, resp.Status, bytes.TrimSpace(body))
+	}
+	return json.Unmarshal(body, result)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	capn "github.com/glycerine/go-capnproto"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server"
+	ch "goshawkdb.io/server/consistenthash"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// checkPlacement checks that each var is held by exactly the RMs its
+// positions resolve to under topology: the first 2F+1 of the
+// permutation. Only stores whose RMId is known are considered, and a
+// var can only be missing from an RM if that RM's store was supplied.
+// Stores holding a divergent copy of a var still count as holding it.
+func checkPlacement(topology *server.Topology, stores []*store, vars map[common.VarUUId]*varstate, r *report) {
+	supplied := make(map[common.RMId]*store, len(stores))
+	for _, st := range stores {
+		if st.rmId != common.RMIdEmpty {
+			supplied[st.rmId] = st
+		}
+	}
+	resolver := ch.NewResolver(rand.New(rand.NewSource(time.Now().UnixNano())), topology.AllRMs)
+	permLen := topology.AllRMs.NonEmptyLen()
+
+	misplaced := 0
+	for _, state := range vars {
+		positions := (*capn.UInt8List)(state.positions)
+		if positions.Len() == 0 {
+			// The topology var is held by every RM.
+			continue
+		}
+		hashCodes, err := resolver.ResolveHashCodes(positions.ToArray(), permLen)
+		if err != nil {
+			r.problem(problemMisplaced, nil, state.vUUId, nil, "%v Unable to resolve positions %v: %v", state.vUUId, state.positions, err)
+			misplaced++
+			continue
+		}
+		if len(hashCodes) > int(topology.TwoFInc) {
+			hashCodes = hashCodes[:topology.TwoFInc]
+		}
+		state.expected = hashCodes
+
+		holders := make(map[common.RMId]*store, len(state.stores)+len(state.diverged))
+		for _, sts := range [][]*store{state.stores, state.diverged} {
+			for _, st := range sts {
+				if st.rmId != common.RMIdEmpty {
+					holders[st.rmId] = st
+				}
+			}
+		}
+		wrong := false
+		for _, rmId := range hashCodes {
+			if st, found := supplied[rmId]; found {
+				if _, found := holders[rmId]; !found {
+					r.problem(problemMissing, st, state.vUUId, nil, "%v missing from %v: expected on %v", state.vUUId, st, hashCodes)
+					wrong = true
+				}
+			}
+			delete(holders, rmId)
+		}
+		for _, st := range holders {
+			r.problem(problemMisplaced, st, state.vUUId, nil, "%v present on unexpected %v: expected on %v", state.vUUId, st, hashCodes)
+			wrong = true
+		}
+		if wrong {
+			misplaced++
+		}
+	}
+	log.Printf("Checked placement of vars against topology version %v: %v misplaced\n", topology.Version, misplaced)
+}
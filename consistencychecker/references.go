@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"goshawkdb.io/common"
+	msgs "goshawkdb.io/common/capnp"
+	"goshawkdb.io/server"
+	"goshawkdb.io/server/db"
+	"log"
+)
+
+type reference struct {
+	vUUId     *common.VarUUId
+	positions *common.Positions
+}
+
+// readReferences returns the references written to the var by the txn
+// which last wrote it.
+func readReferences(rtxn db.RTxn, vUUId *common.VarUUId, writeTxnId *common.TxnId) ([]*reference, error) {
+	txn, err := db.ReadTxnFromDisk(rtxn, writeTxnId)
+	if err != nil {
+		return nil, err
+	} else if txn == nil {
+		return nil, fmt.Errorf("%v Txn %v which last wrote it is missing", vUUId, writeTxnId)
+	}
+	actions := txn.Actions()
+	for idx, l := 0, actions.Len(); idx < l; idx++ {
+		action := actions.At(idx)
+		if !bytes.Equal(action.VarId(), vUUId[:]) {
+			continue
+		}
+		var refs msgs.VarIdPos_List
+		switch action.Which() {
+		case msgs.ACTION_WRITE:
+			refs = action.Write().References()
+		case msgs.ACTION_READWRITE:
+			refs = action.Readwrite().References()
+		case msgs.ACTION_CREATE:
+			refs = action.Create().References()
+		case msgs.ACTION_ROLL:
+			refs = action.Roll().References()
+		default:
+			return nil, fmt.Errorf("%v Txn %v which last wrote it has unexpected action type: %v", vUUId, writeTxnId, action.Which())
+		}
+		references := make([]*reference, refs.Len())
+		for idy := range references {
+			ref := refs.At(idy)
+			positions := common.Positions(ref.Positions())
+			references[idy] = &reference{vUUId: common.MakeVarUUId(ref.Id()), positions: &positions}
+		}
+		return references, nil
+	}
+	return nil, fmt.Errorf("%v Txn %v which last wrote it has no action for it", vUUId, writeTxnId)
+}
+
+// checkReferences follows references from the root across every store,
+// and reports references to vars which no store holds, references
+// whose positions differ from those of the var they refer to, and vars
+// which can't be reached from the root. Vars whose references couldn't
+// be read are treated as having none, so anything only they refer to
+// is reported as unreachable.
+func checkReferences(topology *server.Topology, vars map[common.VarUUId]*varstate, r *report) {
+	if topology.RootVarUUId == nil {
+		log.Println("Topology has no root, so references will not be checked")
+		return
+	}
+	reachable := map[common.VarUUId]server.EmptyStruct{
+		*server.TopologyVarUUId: server.EmptyStructVal,
+	}
+	dangling, mismatched := 0, 0
+	pending := []*reference{{vUUId: topology.RootVarUUId, positions: topology.RootPositions}}
+	from := []*common.VarUUId{server.TopologyVarUUId}
+	for len(pending) != 0 {
+		ref, referrer := pending[0], from[0]
+		pending, from = pending[1:], from[1:]
+		state, found := vars[*ref.vUUId]
+		if !found {
+			r.problem(problemDangling, nil, referrer, nil, "%v references %v, which no store holds", referrer, ref.vUUId)
+			dangling++
+			continue
+		}
+		if !state.positions.Equal(ref.positions) {
+			r.problem(problemPositions, nil, referrer, nil, "%v references %v with positions %v, but it has positions %v", referrer, ref.vUUId, ref.positions, state.positions)
+			mismatched++
+		}
+		if _, found := reachable[*ref.vUUId]; found {
+			continue
+		}
+		reachable[*ref.vUUId] = server.EmptyStructVal
+		for _, next := range state.references {
+			pending = append(pending, next)
+			from = append(from, ref.vUUId)
+		}
+	}
+
+	unreachable := 0
+	for vUUId, state := range vars {
+		if _, found := reachable[vUUId]; !found {
+			r.problem(problemUnreachable, nil, state.vUUId, nil, "%v is unreachable from the root %v", state.vUUId, topology.RootVarUUId)
+			unreachable++
+		}
+	}
+	log.Printf("Checked references from the root: %v reachable vars; %v dangling references; %v position mismatches; %v unreachable vars\n", len(reachable), dangling, mismatched, unreachable)
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"goshawkdb.io/common"
+	msgs "goshawkdb.io/common/capnp"
+	"goshawkdb.io/server"
+	"goshawkdb.io/server/db"
+	eng "goshawkdb.io/server/txnengine"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Repairs are only made to stores which are not in use by a running
+// server: the data directories are locked, as a server locks them,
+// for -repair and -undo. Every change is recorded in the journal, with
+// the record's value before and after, before it's made: undo replays
+// the journal backwards. If a store's txn fails after changes have
+// been journaled, those entries are skipped by undo as the record
+// won't hold their New value.
+//
+// Entries identify their store by cluster id and rmid, rather than by
+// path, so a store can't be mistaken for another found at the same
+// path, and only stores with both can be repaired. The values of an
+// encrypted store are journaled sealed with the store's keys, so the
+// journal is no less protected than the store.
+
+type journalEntry struct {
+	Time      time.Time
+	Store     string
+	ClusterId string
+	RMId      common.RMId
+	Table     string
+	Key       []byte
+	Old       []byte // nil if the record didn't exist
+	New       []byte // nil if the record was deleted
+	Reason    string
+}
+
+type journal struct {
+	sync.Mutex
+	file    *os.File
+	entries int
+}
+
+func newJournal(path string) (*journal, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &journal{file: file}, nil
+}
+
+func (j *journal) record(entry *journalEntry) error {
+	bites, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	j.Lock()
+	defer j.Unlock()
+	if _, err = j.file.Write(append(bites, '\n')); err != nil {
+		return err
+	}
+	j.entries++
+	return j.file.Sync()
+}
+
+func (j *journal) Close() error {
+	return j.file.Close()
+}
+
+// journalTxn journals every change made through it.
+type journalTxn struct {
+	db.RWTxn
+	journal *journal
+	store   *store
+	reason  string
+}
+
+func (jt *journalTxn) Put(table db.Table, key, value []byte) error {
+	old, err := jt.Get(table, key)
+	if err != nil && err != db.NotFound {
+		return err
+	}
+	if err = jt.record(table, key, old, value); err != nil {
+		return err
+	}
+	return jt.RWTxn.Put(table, key, value)
+}
+
+func (jt *journalTxn) Del(table db.Table, key []byte) error {
+	old, err := jt.Get(table, key)
+	if err != nil {
+		return err
+	}
+	if err = jt.record(table, key, old, nil); err != nil {
+		return err
+	}
+	return jt.RWTxn.Del(table, key)
+}
+
+func (jt *journalTxn) record(table db.Table, key, old, value []byte) error {
+	st := jt.store
+	if st.rmId == common.RMIdEmpty || st.clusterId == "" {
+		return fmt.Errorf("%v has no rmid or cluster id, so changes to it could not be undone", st)
+	}
+	var err error
+	if old, err = st.seal(table, key, old); err != nil {
+		return err
+	}
+	if value, err = st.seal(table, key, value); err != nil {
+		return err
+	}
+	return jt.journal.record(&journalEntry{
+		Time:      time.Now(),
+		Store:     st.name,
+		ClusterId: st.clusterId,
+		RMId:      st.rmId,
+		Table:     table.String(),
+		Key:       key,
+		Old:       old,
+		New:       value,
+		Reason:    jt.reason,
+	})
+}
+
+// seal encrypts a value to be journaled if st is encrypted. nil stays
+// nil: it means the record is absent.
+func (st *store) seal(table db.Table, key, value []byte) ([]byte, error) {
+	if st.keyring == nil || value == nil {
+		return value, nil
+	}
+	return st.keyring.Seal(table, key, value)
+}
+
+// open decrypts a journaled value if it was sealed.
+func (st *store) open(table db.Table, key, value []byte) ([]byte, error) {
+	if _, encrypted := db.SealedKeyId(value); !encrypted {
+		return value, nil
+	} else if st.keyring == nil {
+		return nil, fmt.Errorf("The journal is encrypted: the encryption keys of %v are needed to undo it", st)
+	}
+	return st.keyring.Open(table, key, value)
+}
+
+// repairVars copies the majority version of each var which diverges,
+// or is missing from a store which should hold it, to the lagging
+// stores, along with the txn which last wrote it. The majority must be
+// F+1 stores, or, without a topology, more than half of the stores
+// which hold the var. A var is only copied to a store which doesn't
+// hold it at all if the majority version is a tombstone: otherwise
+// the store may well have collected the var, and copying it would
+// resurrect it.
+func repairVars(topology *server.Topology, stores []*store, vars map[common.VarUUId]*varstate, j *journal, r *report) {
+	byRMId := make(map[common.RMId]*store, len(stores))
+	for _, st := range stores {
+		if st.rmId != common.RMIdEmpty {
+			byRMId[st.rmId] = st
+		}
+	}
+	repaired, unrepairable := 0, 0
+	for _, state := range vars {
+		holders := append(append([]*store{}, state.stores...), state.diverged...)
+		absent := []*store{}
+		for _, rmId := range state.expected {
+			if st, found := byRMId[rmId]; found && !containsStore(holders, st) {
+				absent = append(absent, st)
+			}
+		}
+		if len(state.diverged) == 0 && len(absent) == 0 {
+			continue
+		}
+
+		versions, err := varVersions(state.vUUId, holders)
+		if err != nil {
+			r.problem(problemUnrepaired, nil, state.vUUId, nil, "%v", err)
+			unrepairable++
+			continue
+		}
+		majority := versions[0]
+		for _, version := range versions[1:] {
+			if len(version.stores) > len(majority.stores) {
+				majority = version
+			}
+		}
+		need := len(holders)/2 + 1
+		if topology != nil {
+			need = int(topology.FInc)
+		}
+		if len(majority.stores) < need {
+			r.problem(problemUnrepaired, nil, state.vUUId, nil, "%v has no majority version: the largest is held by %v of the %v needed", state.vUUId, len(majority.stores), need)
+			unrepairable++
+			continue
+		}
+
+		varBites, txnBites, tombstone, err := readVersion(majority.stores[0], state.vUUId, majority.writeTxnId)
+		if err != nil {
+			r.problem(problemUnrepaired, majority.stores[0], state.vUUId, nil, "%v", err)
+			unrepairable++
+			continue
+		}
+		lagging := []*store{}
+		if tombstone {
+			lagging = append(lagging, absent...)
+		} else {
+			for _, st := range absent {
+				r.problem(problemUnrepaired, st, state.vUUId, nil, "%v Not copying %v: it may have been collected here, and only a tombstone is copied to a store which doesn't hold the var", st, state.vUUId)
+				unrepairable++
+			}
+		}
+		for _, version := range versions {
+			if version != majority {
+				lagging = append(lagging, version.stores...)
+			}
+		}
+		for _, st := range lagging {
+			reason := fmt.Sprintf("Copy majority version of var %v, written by txn %v, from %v", state.vUUId, majority.writeTxnId, majority.stores[0])
+			if err := copyVersion(st, j, reason, state.vUUId, varBites, majority.writeTxnId, txnBites); err != nil {
+				r.problem(problemUnrepaired, st, state.vUUId, nil, "%v Unable to repair %v: %v", st, state.vUUId, err)
+				unrepairable++
+			} else {
+				log.Printf("%v Repaired %v\n", st, state.vUUId)
+				repaired++
+			}
+		}
+	}
+	log.Printf("Repaired %v copies of vars; %v could not be repaired\n", repaired, unrepairable)
+}
+
+func containsStore(stores []*store, st *store) bool {
+	for _, s := range stores {
+		if s == st {
+			return true
+		}
+	}
+	return false
+}
+
+// varVersions groups the stores by the version of the var they hold.
+func varVersions(vUUId *common.VarUUId, holders []*store) ([]*varstate, error) {
+	versions := []*varstate{}
+	for _, st := range holders {
+		result, err := st.disk.ReadonlyTransaction(func(rtxn db.RTxn) (interface{}, error) {
+			return db.ReadVarFromDisk(rtxn, vUUId[:])
+		}).ResultError()
+		if err != nil {
+			return nil, fmt.Errorf("%v Unable to read %v: %v", st, vUUId, err)
+		}
+		varCap := result.(*msgs.Var)
+		pos := varCap.Positions()
+		positions := (*common.Positions)(&pos)
+		writeTxnId := common.MakeTxnId(varCap.WriteTxnId())
+		writeTxnClock := eng.VectorClockFromCap(varCap.WriteTxnClock())
+		writesClock := eng.VectorClockFromCap(varCap.WritesClock())
+		found := false
+		for _, version := range versions {
+			if version.divergence(writeTxnId, writeTxnClock, writesClock, positions) == nil {
+				version.stores = append(version.stores, st)
+				found = true
+				break
+			}
+		}
+		if !found {
+			versions = append(versions, &varstate{
+				vUUId:            vUUId,
+				stores:           []*store{st},
+				writeTxnId:       writeTxnId,
+				writeTxnClock:    writeTxnClock,
+				writeWritesClock: writesClock,
+				positions:        positions,
+			})
+		}
+	}
+	return versions, nil
+}
+
+// readVersion returns the payloads of the var, and of the txn which
+// last wrote it, as held by st, and whether that txn deleted the var.
+func readVersion(st *store, vUUId *common.VarUUId, writeTxnId *common.TxnId) (varBites, txnBites []byte, tombstone bool, err error) {
+	_, err = st.disk.ReadonlyTransaction(func(rtxn db.RTxn) (interface{}, error) {
+		record, err := rtxn.Get(db.Vars, vUUId[:])
+		if err != nil {
+			return nil, err
+		}
+		if varBites, err = db.VerifyChecksum(db.Vars, vUUId[:], record); err != nil {
+			return nil, err
+		}
+		if record, err = rtxn.Get(db.Transactions, writeTxnId[:]); err != nil {
+			return nil, fmt.Errorf("Txn %v: %v", writeTxnId, err)
+		}
+		txn, err := db.DecodeTxn(writeTxnId, record)
+		if err != nil {
+			return nil, err
+		}
+		actions := txn.Actions()
+		tombstone = eng.Deletes(&actions, vUUId)
+		txnBites, err = db.VerifyChecksum(db.Transactions, writeTxnId[:], record)
+		return nil, err
+	}).ResultError()
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("%v Unable to read majority version of %v: %v", st, vUUId, err)
+	}
+	return varBites, txnBites, tombstone, nil
+}
+
+// copyVersion writes the var and the txn which last wrote it to st,
+// dropping st's reference to the txn which last wrote its own copy.
+func copyVersion(st *store, j *journal, reason string, vUUId *common.VarUUId, varBites []byte, writeTxnId *common.TxnId, txnBites []byte) error {
+	_, err := st.disk.ReadWriteTransaction(true, func(rwtxn db.RWTxn) (interface{}, error) {
+		jt := &journalTxn{RWTxn: rwtxn, journal: j, store: st, reason: reason}
+		varCap, err := db.ReadVarFromDisk(jt, vUUId[:])
+		switch {
+		case err == db.NotFound:
+		case err != nil:
+			return nil, err
+		default:
+			oldTxnId := common.MakeTxnId(varCap.WriteTxnId())
+			if oldTxnId.Equal(writeTxnId) {
+				return nil, db.WriteVarToDisk(jt, vUUId[:], varBites)
+			}
+			if err = db.DeleteTxnFromDisk(jt, oldTxnId); err != nil {
+				return nil, err
+			}
+		}
+		if err = db.WriteTxnToDisk(jt, writeTxnId, txnBites); err != nil {
+			return nil, err
+		}
+		return nil, db.WriteVarToDisk(jt, vUUId[:], varBites)
+	}).ResultError()
+	return err
+}
+
+// repairTxns sets the refcount of every txn in st to the number of
+// vars which it last wrote, and deletes txns which no var references.
+func repairTxns(st *store, j *journal, r *report) {
+	result, err := st.disk.ReadWriteTransaction(true, func(rwtxn db.RWTxn) (interface{}, error) {
+		jt := &journalTxn{RWTxn: rwtxn, journal: j, store: st}
+		referenced := make(map[common.TxnId]uint32)
+		err := jt.ForEach(db.Vars, func(key, data []byte) error {
+			if varCap, err := db.DecodeVar(key, data); err == nil {
+				referenced[*common.MakeTxnId(varCap.WriteTxnId())]++
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		// Collect the keys first: we mustn't change a table whilst
+		// iterating over it.
+		refKeys, txnKeys := [][]byte{}, [][]byte{}
+		if err = jt.ForEach(db.TransactionRefs, func(key, data []byte) error {
+			refKeys = append(refKeys, key)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+		if err = jt.ForEach(db.Transactions, func(key, data []byte) error {
+			txnKeys = append(txnKeys, key)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+
+		changes := 0
+		for _, key := range txnKeys {
+			if referenced[*common.MakeTxnId(key)] == 0 {
+				jt.reason = fmt.Sprintf("Delete orphaned txn %v", common.MakeTxnId(key))
+				if err = jt.Del(db.Transactions, key); err != nil {
+					return nil, err
+				}
+				changes++
+			}
+		}
+		counted := make(map[common.TxnId]bool, len(refKeys))
+		for _, key := range refKeys {
+			txnId := common.MakeTxnId(key)
+			counted[*txnId] = true
+			count := referenced[*txnId]
+			if count == 0 {
+				jt.reason = fmt.Sprintf("Delete refcount of orphaned txn %v", txnId)
+				if err = jt.Del(db.TransactionRefs, key); err != nil {
+					return nil, err
+				}
+				changes++
+				continue
+			}
+			data, err := jt.Get(db.TransactionRefs, key)
+			if err != nil {
+				return nil, err
+			}
+			if len(data) == 4 && binary.BigEndian.Uint32(data) == count {
+				continue
+			}
+			jt.reason = fmt.Sprintf("Set refcount of txn %v to the %v vars which reference it", txnId, count)
+			if err = jt.Put(db.TransactionRefs, key, refcount(count)); err != nil {
+				return nil, err
+			}
+			changes++
+		}
+		for txnId, count := range referenced {
+			if counted[txnId] {
+				continue
+			}
+			if _, err := jt.Get(db.Transactions, txnId[:]); err == db.NotFound {
+				// Nothing we can do here: the txn must be fetched from
+				// another store.
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			jt.reason = fmt.Sprintf("Add refcount of txn %v for the %v vars which reference it", &txnId, count)
+			if err = jt.Put(db.TransactionRefs, txnId[:], refcount(count)); err != nil {
+				return nil, err
+			}
+			changes++
+		}
+		return changes, nil
+	}).ResultError()
+	if err != nil {
+		r.problem(problemUnrepaired, st, nil, nil, "%v Unable to repair txns: %v", st, err)
+	} else {
+		log.Printf("%v Made %v changes to txns and refcounts\n", st, result.(int))
+	}
+}
+
+func refcount(count uint32) []byte {
+	bites := make([]byte, 4)
+	binary.BigEndian.PutUint32(bites, count)
+	return bites
+}
+
+// storeIdentity is how the journal identifies a store.
+type storeIdentity struct {
+	clusterId string
+	rmId      common.RMId
+}
+
+// undo reverts the changes in the journal at path, latest first, to
+// those stores which were supplied. A record which no longer holds the
+// value the journal says it was changed to is left alone.
+func undo(path string, stores []*store) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	entries := []*journalEntry{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<30)
+	for scanner.Scan() {
+		entry := &journalEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			return fmt.Errorf("Unable to parse journal entry %v: %v", len(entries)+1, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	byIdentity := make(map[storeIdentity]*store, len(stores))
+	for _, st := range stores {
+		if st.rmId == common.RMIdEmpty || st.clusterId == "" {
+			log.Printf("%v has no rmid or cluster id, so no changes to it will be undone\n", st)
+			continue
+		}
+		id := storeIdentity{clusterId: st.clusterId, rmId: st.rmId}
+		if other, found := byIdentity[id]; found {
+			return fmt.Errorf("Both %v and %v are rmid %v of cluster %v: supply only one", other, st, st.rmId, st.clusterId)
+		}
+		byIdentity[id] = st
+	}
+	undone, skipped := 0, 0
+	for idx := len(entries) - 1; idx >= 0; idx-- {
+		entry := entries[idx]
+		st, found := byIdentity[storeIdentity{clusterId: entry.ClusterId, rmId: entry.RMId}]
+		if !found {
+			continue
+		}
+		table, err := db.ParseTable(entry.Table)
+		if err != nil {
+			return err
+		}
+		old, err := st.open(table, entry.Key, entry.Old)
+		if err != nil {
+			return err
+		}
+		value, err := st.open(table, entry.Key, entry.New)
+		if err != nil {
+			return err
+		}
+		_, err = st.disk.ReadWriteTransaction(true, func(rwtxn db.RWTxn) (interface{}, error) {
+			current, err := rwtxn.Get(table, entry.Key)
+			if err == db.NotFound {
+				current, err = nil, nil
+			} else if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(current, value) || (current == nil) != (value == nil) {
+				log.Printf("%v Not undoing change to %v %x (%v): it has changed since\n", st, table, entry.Key, entry.Reason)
+				skipped++
+				return nil, nil
+			}
+			undone++
+			if old == nil {
+				return nil, rwtxn.Del(table, entry.Key)
+			}
+			return nil, rwtxn.Put(table, entry.Key, old)
+		}).ResultError()
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("Undid %v changes; skipped %v\n", undone, skipped)
+	return nil
+}
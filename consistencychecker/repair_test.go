@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	capn "github.com/glycerine/go-capnproto"
+	"goshawkdb.io/common"
+	msgs "goshawkdb.io/common/capnp"
+	"goshawkdb.io/server"
+	"goshawkdb.io/server/db"
+	eng "goshawkdb.io/server/txnengine"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type testKeys []db.Key
+
+func (tk testKeys) LoadKeys() ([]db.Key, error) { return tk, nil }
+func (tk testKeys) String() string              { return "test keys" }
+
+func newTestStore(t *testing.T, name string, rmId common.RMId, keys db.KeySource) *store {
+	st := &store{name: name, rmId: rmId, clusterId: "test", disk: db.NewMemoryStore()}
+	if keys != nil {
+		es, err := db.NewEncryptedStore(st.disk, keys, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st.disk, st.keyring = es, es.Keyring()
+	}
+	return st
+}
+
+func testVarUUId(n byte) *common.VarUUId {
+	b := make([]byte, common.KeyLen)
+	b[0] = n
+	return common.MakeVarUUId(b)
+}
+
+func testTxnId(n byte) *common.TxnId {
+	b := make([]byte, common.KeyLen)
+	b[common.KeyLen-1] = n
+	return common.MakeTxnId(b)
+}
+
+// commit writes the var to st, as last written by txn n, which writes
+// value to it or, if value is nil, deletes it.
+func commit(t *testing.T, st *store, vUUId *common.VarUUId, n byte, value []byte) {
+	txnId := testTxnId(n)
+	seg := capn.NewBuffer(nil)
+	txnCap := msgs.NewRootTxn(seg)
+	txnCap.SetId(txnId[:])
+	actions := msgs.NewActionList(seg, 1)
+	txnCap.SetActions(actions)
+	action := actions.At(0)
+	action.SetVarId(vUUId[:])
+	if value == nil {
+		action.SetMissing()
+	} else {
+		action.SetWrite()
+		write := action.Write()
+		write.SetValue(value)
+		write.SetReferences(msgs.NewVarIdPosList(seg, 0))
+	}
+	txnBites := server.SegToBytes(seg)
+
+	varSeg := capn.NewBuffer(nil)
+	varCap := msgs.NewRootVar(varSeg)
+	varCap.SetId(vUUId[:])
+	varCap.SetPositions(varSeg.NewUInt8List(1))
+	varCap.SetWriteTxnId(txnId[:])
+	clock := eng.NewVectorClock().Bump(*vUUId, uint64(n))
+	varCap.SetWriteTxnClock(clock.AddToSeg(varSeg))
+	varCap.SetWritesClock(clock.AddToSeg(varSeg))
+	varBites := server.SegToBytes(varSeg)
+
+	_, err := st.disk.ReadWriteTransaction(false, func(rwtxn db.RWTxn) (interface{}, error) {
+		if old, err := db.ReadVarFromDisk(rwtxn, vUUId[:]); err == nil {
+			if err = db.DeleteTxnFromDisk(rwtxn, common.MakeTxnId(old.WriteTxnId())); err != nil {
+				return nil, err
+			}
+		} else if err != db.NotFound {
+			return nil, err
+		}
+		if err := db.WriteTxnToDisk(rwtxn, txnId, txnBites); err != nil {
+			return nil, err
+		}
+		return nil, db.WriteVarToDisk(rwtxn, vUUId[:], varBites)
+	}).ResultError()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// heldBy returns the txn which last wrote the var held by st, or nil
+// if st doesn't hold it.
+func heldBy(t *testing.T, st *store, vUUId *common.VarUUId) *common.TxnId {
+	result, err := st.disk.ReadonlyTransaction(func(rtxn db.RTxn) (interface{}, error) {
+		return db.ReadVarFromDisk(rtxn, vUUId[:])
+	}).ResultError()
+	if err == db.NotFound {
+		return nil
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return common.MakeTxnId(result.(*msgs.Var).WriteTxnId())
+}
+
+func checkHeldBy(t *testing.T, st *store, vUUId *common.VarUUId, expected *common.TxnId) {
+	if txnId := heldBy(t, st, vUUId); (txnId == nil) != (expected == nil) || (txnId != nil && !txnId.Equal(expected)) {
+		t.Fatalf("Expected %v to hold %v as written by %v; found %v", st, vUUId, expected, txnId)
+	}
+}
+
+func loadTestVars(t *testing.T, stores []*store, r *report) map[common.VarUUId]*varstate {
+	vars := make(map[common.VarUUId]*varstate)
+	for _, st := range stores {
+		loadVars(st, vars, r)
+	}
+	return vars
+}
+
+// repairTest repairs stores, journaling to a file in a temporary dir.
+type repairTest struct {
+	t    *testing.T
+	dir  string
+	path string
+}
+
+func newRepairTest(t *testing.T) *repairTest {
+	dir, err := ioutil.TempDir("", "consistencychecker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &repairTest{t: t, dir: dir, path: filepath.Join(dir, "journal")}
+}
+
+func (rt *repairTest) cleanup() {
+	os.RemoveAll(rt.dir)
+}
+
+func (rt *repairTest) repair(stores []*store, vars map[common.VarUUId]*varstate, r *report) *journal {
+	j, err := newJournal(rt.path)
+	if err != nil {
+		rt.t.Fatal(err)
+	}
+	repairVars(nil, stores, vars, j, r)
+	if err = j.Close(); err != nil {
+		rt.t.Fatal(err)
+	}
+	return j
+}
+
+func (rt *repairTest) entries() []*journalEntry {
+	file, err := os.Open(rt.path)
+	if err != nil {
+		rt.t.Fatal(err)
+	}
+	defer file.Close()
+	entries := []*journalEntry{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entry := &journalEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			rt.t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestRepairAndUndo(t *testing.T) {
+	rt := newRepairTest(t)
+	defer rt.cleanup()
+	v := testVarUUId(1)
+	a, b, c := newTestStore(t, "a", 1, nil), newTestStore(t, "b", 2, nil), newTestStore(t, "c", 3, nil)
+	stores := []*store{a, b, c}
+	commit(t, a, v, 1, []byte("x"))
+	commit(t, b, v, 1, []byte("x"))
+	commit(t, c, v, 2, []byte("y"))
+
+	r, _ := newReport("", "")
+	rt.repair(stores, loadTestVars(t, stores, r), r)
+	for _, st := range stores {
+		checkHeldBy(t, st, v, testTxnId(1))
+	}
+	if entries := rt.entries(); len(entries) == 0 {
+		t.Fatal("Expected the repair to be journaled")
+	} else {
+		for _, entry := range entries {
+			if entry.ClusterId != "test" || entry.RMId != 3 {
+				t.Fatalf("Expected only changes to rmid 3 of cluster test; found %v %v", entry.ClusterId, entry.RMId)
+			}
+		}
+	}
+
+	// Undo finds stores by cluster id and rmid, not by name: c with a
+	// different cluster id is left alone, even with c's name...
+	impostor := &store{name: "c", rmId: 3, clusterId: "other", disk: c.disk}
+	if err := undo(rt.path, []*store{impostor}); err != nil {
+		t.Fatal(err)
+	}
+	checkHeldBy(t, c, v, testTxnId(1))
+	// ...whereas c found elsewhere is undone.
+	moved := &store{name: "moved", rmId: 3, clusterId: "test", disk: c.disk}
+	if err := undo(rt.path, []*store{a, b, moved}); err != nil {
+		t.Fatal(err)
+	}
+	checkHeldBy(t, a, v, testTxnId(1))
+	checkHeldBy(t, b, v, testTxnId(1))
+	checkHeldBy(t, c, v, testTxnId(2))
+	if _, err := c.disk.ReadonlyTransaction(func(rtxn db.RTxn) (interface{}, error) {
+		if txn, err := db.ReadTxnFromDisk(rtxn, testTxnId(2)); err != nil || txn == nil {
+			return nil, fmt.Errorf("Expected txn 2 to be restored; got %v (err: %v)", txn, err)
+		}
+		if txn, err := db.ReadTxnFromDisk(rtxn, testTxnId(1)); err != nil || txn != nil {
+			return nil, fmt.Errorf("Expected txn 1 to be removed; got %v (err: %v)", txn, err)
+		}
+		return nil, nil
+	}).ResultError(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Undoing again changes nothing, as nothing holds the New values
+	// any more.
+	if err := undo(rt.path, []*store{a, b, moved}); err != nil {
+		t.Fatal(err)
+	}
+	checkHeldBy(t, c, v, testTxnId(2))
+
+	dup := &store{name: "dup", rmId: 3, clusterId: "test", disk: db.NewMemoryStore()}
+	if err := undo(rt.path, []*store{moved, dup}); err == nil {
+		t.Fatal("Expected undo to refuse two stores with the same identity")
+	}
+}
+
+// A var which a store should hold, but doesn't, may have been
+// collected there: only a tombstone is copied to it.
+func TestRepairDoesNotResurrect(t *testing.T) {
+	rt := newRepairTest(t)
+	defer rt.cleanup()
+	v := testVarUUId(1)
+	a, b, c := newTestStore(t, "a", 1, nil), newTestStore(t, "b", 2, nil), newTestStore(t, "c", 3, nil)
+	stores := []*store{a, b, c}
+	commit(t, a, v, 1, []byte("x"))
+	commit(t, b, v, 1, []byte("x"))
+
+	r, _ := newReport("", "")
+	vars := loadTestVars(t, stores, r)
+	vars[*v].expected = []common.RMId{1, 2, 3}
+	rt.repair(stores, vars, r)
+	checkHeldBy(t, c, v, nil)
+	if r.Counts[problemUnrepaired] != 1 {
+		t.Fatalf("Expected the absent var to be reported as unrepaired; found %v", r.Counts)
+	}
+
+	commit(t, a, v, 2, nil)
+	commit(t, b, v, 2, nil)
+	r, _ = newReport("", "")
+	vars = loadTestVars(t, stores, r)
+	vars[*v].expected = []common.RMId{1, 2, 3}
+	rt.repair(stores, vars, r)
+	checkHeldBy(t, c, v, testTxnId(2))
+	if r.Counts[problemUnrepaired] != 0 {
+		t.Fatalf("Expected the tombstone to be copied; found %v", r.Counts)
+	}
+}
+
+// A store which can't be identified can't be repaired, as its changes
+// couldn't be undone.
+func TestRepairNeedsIdentity(t *testing.T) {
+	rt := newRepairTest(t)
+	defer rt.cleanup()
+	v := testVarUUId(1)
+	a, b, c := newTestStore(t, "a", 1, nil), newTestStore(t, "b", 2, nil), newTestStore(t, "c", 3, nil)
+	c.clusterId = ""
+	stores := []*store{a, b, c}
+	commit(t, a, v, 1, []byte("x"))
+	commit(t, b, v, 1, []byte("x"))
+	commit(t, c, v, 2, []byte("y"))
+
+	r, _ := newReport("", "")
+	j := rt.repair(stores, loadTestVars(t, stores, r), r)
+	checkHeldBy(t, c, v, testTxnId(2))
+	if j.entries != 0 || r.Counts[problemUnrepaired] != 1 {
+		t.Fatalf("Expected nothing to be journaled, and the var reported as unrepaired; found %v entries, %v", j.entries, r.Counts)
+	}
+}
+
+// The journal of an encrypted store holds only sealed values, and so
+// can only be undone with the keys.
+func TestRepairJournalIsEncrypted(t *testing.T) {
+	rt := newRepairTest(t)
+	defer rt.cleanup()
+	keys := testKeys{{Id: 1, Secret: bytes.Repeat([]byte{1}, 32)}}
+	v := testVarUUId(1)
+	a, b, c := newTestStore(t, "a", 1, keys), newTestStore(t, "b", 2, keys), newTestStore(t, "c", 3, keys)
+	stores := []*store{a, b, c}
+	commit(t, a, v, 1, []byte("secret x"))
+	commit(t, b, v, 1, []byte("secret x"))
+	commit(t, c, v, 2, []byte("secret y"))
+
+	r, _ := newReport("", "")
+	rt.repair(stores, loadTestVars(t, stores, r), r)
+	checkHeldBy(t, c, v, testTxnId(1))
+	entries := rt.entries()
+	if len(entries) == 0 {
+		t.Fatal("Expected the repair to be journaled")
+	}
+	for _, entry := range entries {
+		for _, value := range [][]byte{entry.Old, entry.New} {
+			if _, sealed := db.SealedKeyId(value); value != nil && !sealed {
+				t.Fatalf("Expected journaled values to be sealed; found %q", value)
+			}
+		}
+	}
+
+	locked := &store{name: "c", rmId: 3, clusterId: "test", disk: c.disk}
+	if err := undo(rt.path, []*store{locked}); err == nil || !strings.Contains(err.Error(), "encrypted") {
+		t.Fatalf("Expected undo without the keys to fail; got %v", err)
+	}
+	checkHeldBy(t, c, v, testTxnId(1))
+	if err := undo(rt.path, stores); err != nil {
+		t.Fatal(err)
+	}
+	checkHeldBy(t, c, v, testTxnId(2))
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	capn "github.com/glycerine/go-capnproto"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server"
+	eng "goshawkdb.io/server/txnengine"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The kinds of problem which may be found.
+const (
+	problemDamaged     = "damaged"     // a record or store could not be read or decoded
+	problemDiverged    = "diverged"    // stores hold different versions of a var
+	problemMissing     = "missing"     // a var is missing from an RM its positions say should hold it
+	problemMisplaced   = "misplaced"   // a var is held by an RM its positions say should not hold it
+	problemTopology    = "topology"    // stores disagree about, or can't read, the topology
+	problemDangling    = "dangling"    // a var references a var which no store holds
+	problemPositions   = "positions"   // a reference's positions differ from those of the var
+	problemUnreachable = "unreachable" // a var can't be reached from the root
+	problemReferences  = "references"  // the references of a var could not be read
+	problemRefcount    = "refcount"    // a txn's refcount differs from the number of vars it last wrote
+	problemOrphan      = "orphan"      // a txn is referenced by no var
+	problemMissingTxn  = "missingtxn"  // a txn which last wrote a var is missing
+	problemStuck       = "stuck"       // a txn has acceptor state but no proposer state
+	problemNode        = "node"        // a node of a running cluster could not be queried
+	problemUnrepaired  = "unrepaired"  // -repair was unable to fix a problem
+)
+
+var problemKinds = []string{
+	problemDamaged, problemDiverged, problemMissing, problemMisplaced, problemTopology,
+	problemDangling, problemPositions, problemUnreachable, problemReferences,
+	problemRefcount, problemOrphan, problemMissingTxn, problemStuck, problemNode, problemUnrepaired,
+}
+
+// report collects the problems found, and describes the stores and
+// vars checked. Every problem is logged, but only those which pass the
+// filters are added to the report. When filtering by var prefix,
+// problems which don't concern a var are dropped, as are vars which
+// don't match. A node which can't be queried leaves the check
+// incomplete, whether or not its problems pass the filters.
+type report struct {
+	prefix          string
+	kinds           map[string]bool
+	incomplete      bool
+	Stores          []*storeReport
+	TopologyVersion uint32 `json:",omitempty"`
+	Vars            []*varReport
+	Problems        []*problem
+	Counts          map[string]int
+}
+
+type storeReport struct {
+	Name string
+	RMId common.RMId `json:",omitempty"`
+	Vars int
+}
+
+// varReport is the JSON form of a varstate. Ids are hex encoded, and
+// vector clocks are keyed by hex encoded var ids.
+type varReport struct {
+	VarUUId       string
+	Stores        []string
+	Diverged      []string      `json:",omitempty"`
+	Expected      []common.RMId `json:",omitempty"`
+	References    []string      `json:",omitempty"`
+	Positions     []int
+	WriteTxnId    string
+	WriteTxnClock map[string]uint64
+	WritesClock   map[string]uint64
+}
+
+type problem struct {
+	Kind    string
+	VarUUId string `json:",omitempty"`
+	TxnId   string `json:",omitempty"`
+	Store   string `json:",omitempty"`
+	Message string
+}
+
+// newReport returns a report filtered to vars whose hex encoded id
+// starts with prefix, and to the comma separated kinds of problem.
+// Either may be empty to include everything.
+func newReport(prefix, kinds string) (*report, error) {
+	prefix = strings.ToLower(prefix)
+	if strings.Trim(prefix, "0123456789abcdef") != "" {
+		return nil, fmt.Errorf("Var prefix '%s' is not hex", prefix)
+	}
+	r := &report{
+		prefix:   prefix,
+		Stores:   []*storeReport{},
+		Problems: []*problem{},
+		Counts:   make(map[string]int),
+	}
+	if kinds != "" {
+		r.kinds = make(map[string]bool)
+		for _, kind := range strings.Split(kinds, ",") {
+			if !isProblemKind(kind) {
+				return nil, fmt.Errorf("Unknown error type '%s': expected one of %v", kind, strings.Join(problemKinds, ", "))
+			}
+			r.kinds[kind] = true
+		}
+	}
+	return r, nil
+}
+
+func isProblemKind(kind string) bool {
+	for _, k := range problemKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *report) includesVar(vUUId *common.VarUUId) bool {
+	if r.prefix == "" {
+		return true
+	}
+	return vUUId != nil && strings.HasPrefix(hex.EncodeToString(vUUId[:]), r.prefix)
+}
+
+// problem logs the problem, and adds it to the report if it passes the
+// filters. st, vUUId and txnId may be nil if the problem doesn't
+// concern them.
+func (r *report) problem(kind string, st *store, vUUId *common.VarUUId, txnId *common.TxnId, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Println(msg)
+	if kind == problemNode {
+		r.incomplete = true
+	}
+	if (r.kinds != nil && !r.kinds[kind]) || !r.includesVar(vUUId) {
+		return
+	}
+	p := &problem{Kind: kind, Message: msg}
+	if vUUId != nil {
+		p.VarUUId = hex.EncodeToString(vUUId[:])
+	}
+	if txnId != nil {
+		p.TxnId = hex.EncodeToString(txnId[:])
+	}
+	if st != nil {
+		p.Store = st.name
+	}
+	r.Problems = append(r.Problems, p)
+	r.Counts[kind]++
+}
+
+// status returns the exit status: 1 if we were unable to complete the
+// check, 2 if any problems were reported, and 0 otherwise.
+func (r *report) status() int {
+	switch {
+	case r.incomplete:
+		return 1
+	case len(r.Problems) != 0:
+		return 2
+	default:
+		return 0
+	}
+}
+
+// finish describes the stores and vars in the report. Stores are
+// identified by name as, when checking a running cluster, there is a
+// store per request to each node.
+func (r *report) finish(topology *server.Topology, stores []*store, vars map[common.VarUUId]*varstate) {
+	if topology != nil {
+		r.TopologyVersion = topology.Version
+	}
+	byName := make(map[string]*storeReport, len(stores))
+	for _, st := range stores {
+		sr := &storeReport{Name: st.name, RMId: st.rmId}
+		byName[st.name] = sr
+		r.Stores = append(r.Stores, sr)
+	}
+	found := []*storeReport{}
+	r.Vars = make([]*varReport, 0, len(vars))
+	for _, state := range vars {
+		for _, sts := range [][]*store{state.stores, state.diverged} {
+			for _, st := range sts {
+				sr, ok := byName[st.name]
+				if !ok {
+					sr = &storeReport{Name: st.name, RMId: st.rmId}
+					byName[st.name] = sr
+					found = append(found, sr)
+				}
+				sr.Vars++
+			}
+		}
+		if r.includesVar(state.vUUId) {
+			r.Vars = append(r.Vars, newVarReport(state))
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].Name < found[j].Name })
+	r.Stores = append(r.Stores, found...)
+	sort.Slice(r.Vars, func(i, j int) bool { return r.Vars[i].VarUUId < r.Vars[j].VarUUId })
+}
+
+func newVarReport(state *varstate) *varReport {
+	vr := &varReport{
+		VarUUId:       hex.EncodeToString(state.vUUId[:]),
+		Stores:        storeNames(state.stores),
+		Diverged:      storeNames(state.diverged),
+		Expected:      state.expected,
+		WriteTxnId:    hex.EncodeToString(state.writeTxnId[:]),
+		WriteTxnClock: vectorClockToReport(state.writeTxnClock),
+		WritesClock:   vectorClockToReport(state.writeWritesClock),
+	}
+	for _, ref := range state.references {
+		vr.References = append(vr.References, hex.EncodeToString(ref.vUUId[:]))
+	}
+	positions := (*capn.UInt8List)(state.positions).ToArray()
+	vr.Positions = make([]int, len(positions))
+	for idx, position := range positions {
+		vr.Positions[idx] = int(position)
+	}
+	return vr
+}
+
+func storeNames(stores []*store) []string {
+	if len(stores) == 0 {
+		return nil
+	}
+	names := make([]string, len(stores))
+	for idx, st := range stores {
+		names[idx] = st.name
+	}
+	return names
+}
+
+func vectorClockToReport(vc *eng.VectorClock) map[string]uint64 {
+	result := make(map[string]uint64, len(vc.Clock))
+	for vUUId, v := range vc.Clock {
+		result[hex.EncodeToString(vUUId[:])] = v
+	}
+	return result
+}
+
+// write writes the report as JSON to path, or to stdout if path is
+// "-".
+func (r *report) write(path string) error {
+	bites, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	bites = append(bites, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(bites)
+		return err
+	}
+	return ioutil.WriteFile(path, bites, 0644)
+}
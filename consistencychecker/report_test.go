@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/hex"
+	"goshawkdb.io/common"
+	"testing"
+)
+
+func TestNewReportValidatesFilters(t *testing.T) {
+	for _, test := range []struct {
+		prefix, kinds string
+		ok            bool
+	}{
+		{"", "", true},
+		{"0aF", "", true},
+		{"", "diverged,node", true},
+		{"0g", "", false},
+		{"", "diverged,nonsense", false},
+		{"", "diverged,", false},
+	} {
+		if _, err := newReport(test.prefix, test.kinds); (err == nil) != test.ok {
+			t.Fatalf("Prefix '%v', kinds '%v': expected ok? %v; got %v", test.prefix, test.kinds, test.ok, err)
+		}
+	}
+}
+
+func TestReportIncludesVar(t *testing.T) {
+	v := testVarUUId(0xab)
+	r, err := newReport("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.includesVar(v) || !r.includesVar(nil) {
+		t.Fatal("Expected a report without a prefix to include everything")
+	}
+	for _, test := range []struct {
+		prefix   string
+		vUUId    *common.VarUUId
+		expected bool
+	}{
+		{"ab", v, true},
+		{"AB0", v, true},
+		{"ab1", v, false},
+		{"b", v, false},
+		{"ab", nil, false},
+	} {
+		r, err := newReport(test.prefix, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.includesVar(test.vUUId) != test.expected {
+			t.Fatalf("Prefix '%v': expected includesVar(%v) to be %v", test.prefix, test.vUUId, test.expected)
+		}
+	}
+}
+
+func TestReportFiltersProblems(t *testing.T) {
+	a, b := testVarUUId(0xa0), testVarUUId(0xb0)
+	st := &store{name: "dir"}
+	add := func(r *report) {
+		r.problem(problemDiverged, st, a, nil, "a diverged")
+		r.problem(problemDiverged, st, b, nil, "b diverged")
+		r.problem(problemMissing, nil, a, nil, "a missing")
+		r.problem(problemTopology, st, nil, nil, "topology")
+	}
+	for _, test := range []struct {
+		prefix, kinds string
+		expected      []string
+	}{
+		{"", "", []string{"a diverged", "b diverged", "a missing", "topology"}},
+		{"a", "", []string{"a diverged", "a missing"}},
+		{"", "diverged", []string{"a diverged", "b diverged"}},
+		{"", "topology,missing", []string{"a missing", "topology"}},
+		{"b", "missing", []string{}},
+	} {
+		r, err := newReport(test.prefix, test.kinds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		add(r)
+		if len(r.Problems) != len(test.expected) {
+			t.Fatalf("Prefix '%v', kinds '%v': expected %v; got %v problems", test.prefix, test.kinds, test.expected, len(r.Problems))
+		}
+		for idx, p := range r.Problems {
+			if p.Message != test.expected[idx] {
+				t.Fatalf("Prefix '%v', kinds '%v': expected %v; got '%v' at %v", test.prefix, test.kinds, test.expected, p.Message, idx)
+			}
+		}
+		counted := 0
+		for _, count := range r.Counts {
+			counted += count
+		}
+		if counted != len(r.Problems) {
+			t.Fatalf("Prefix '%v', kinds '%v': expected counts of %v problems", test.prefix, test.kinds, len(r.Problems))
+		}
+	}
+
+	r, _ := newReport("", "")
+	r.problem(problemDiverged, st, a, nil, "a diverged")
+	if p := r.Problems[0]; p.Kind != problemDiverged || p.VarUUId != hex.EncodeToString(a[:]) || p.Store != "dir" || p.TxnId != "" {
+		t.Fatalf("Unexpected problem: %+v", p)
+	}
+}
+
+func TestReportStatus(t *testing.T) {
+	for _, test := range []struct {
+		kinds    string
+		problems []string
+		expected int
+	}{
+		{"", nil, 0},
+		{"", []string{problemDiverged}, 2},
+		{"", []string{problemNode}, 1},
+		{"", []string{problemDiverged, problemNode}, 1},
+		// A problem which is filtered out is not reported...
+		{"missing", []string{problemDiverged}, 0},
+		// ...but the check is incomplete without every node.
+		{"missing", []string{problemNode}, 1},
+	} {
+		r, err := newReport("", test.kinds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, kind := range test.problems {
+			r.problem(kind, &store{name: "host"}, nil, nil, "%v", kind)
+		}
+		if status := r.status(); status != test.expected {
+			t.Fatalf("Kinds '%v', problems %v: expected status %v; got %v", test.kinds, test.problems, test.expected, status)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	capn "github.com/glycerine/go-capnproto"
+	"goshawkdb.io/common"
+	msgs "goshawkdb.io/common/capnp"
+	"goshawkdb.io/server/db"
+	"log"
+)
+
+// txnstates records which stores hold acceptor and proposer state for
+// each txn, so that txns which look stuck can be found once every
+// store has been loaded.
+type txnstates struct {
+	acceptors map[common.TxnId][]*store
+	proposers map[common.TxnId][]*store
+}
+
+func newTxnStates() *txnstates {
+	return &txnstates{
+		acceptors: make(map[common.TxnId][]*store),
+		proposers: make(map[common.TxnId][]*store),
+	}
+}
+
+// checkTxns checks the txn tables of st. Every var references the txn
+// which last wrote it, so the refcount of each txn must equal the
+// number of vars in st which it last wrote, and every txn record must
+// be referenced by at least one var. Acceptor and proposer state is
+// decoded and recorded in txns.
+func checkTxns(st *store, txns *txnstates, r *report) {
+	_, err := st.disk.ReadonlyTransaction(func(rtxn db.RTxn) (interface{}, error) {
+		referenced := make(map[common.TxnId]uint32)
+		err := rtxn.ForEach(db.Vars, func(key, data []byte) error {
+			if varCap, err := db.DecodeVar(key, data); err == nil {
+				referenced[*common.MakeTxnId(varCap.WriteTxnId())]++
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		wrongCounts, missing := 0, 0
+		counted := make(map[common.TxnId]uint32, len(referenced))
+		err = rtxn.ForEach(db.TransactionRefs, func(key, data []byte) error {
+			txnId := common.MakeTxnId(key)
+			if len(data) != 4 {
+				r.problem(problemRefcount, st, nil, txnId, "%v Txn %v has a refcount of %v bytes", st, txnId, len(data))
+				wrongCounts++
+				return nil
+			}
+			count := binary.BigEndian.Uint32(data)
+			counted[*txnId] = count
+			if count != referenced[*txnId] {
+				r.problem(problemRefcount, st, nil, txnId, "%v Txn %v has refcount %v, but is referenced by %v vars", st, txnId, count, referenced[*txnId])
+				wrongCounts++
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		for txnId, count := range referenced {
+			if _, found := counted[txnId]; !found {
+				txnId := txnId
+				r.problem(problemRefcount, st, nil, &txnId, "%v Txn %v is referenced by %v vars, but has no refcount", st, &txnId, count)
+				wrongCounts++
+			}
+		}
+
+		orphans, corrupt := 0, 0
+		present := make(map[common.TxnId]bool, len(referenced))
+		err = rtxn.ForEach(db.Transactions, func(key, data []byte) error {
+			txnId := common.MakeTxnId(key)
+			present[*txnId] = true
+			if _, err := db.DecodeTxn(txnId, data); err != nil {
+				r.problem(problemDamaged, st, nil, txnId, "%v %v", st, err)
+				corrupt++
+			}
+			if referenced[*txnId] == 0 {
+				r.problem(problemOrphan, st, nil, txnId, "%v Txn %v is orphaned: no var references it", st, txnId)
+				orphans++
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		for txnId := range referenced {
+			if !present[txnId] {
+				txnId := txnId
+				r.problem(problemMissingTxn, st, nil, &txnId, "%v Txn %v is referenced by %v vars, but is missing", st, &txnId, referenced[txnId])
+				missing++
+			}
+		}
+
+		acceptors := 0
+		err = rtxn.ForEach(db.BallotOutcomes, func(key, data []byte) error {
+			txnId := common.MakeTxnId(key)
+			if err := decodeAcceptorState(txnId, data); err != nil {
+				r.problem(problemDamaged, st, nil, txnId, "%v %v", st, err)
+				corrupt++
+				return nil
+			}
+			acceptors++
+			txns.acceptors[*txnId] = append(txns.acceptors[*txnId], st)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		proposers := 0
+		err = rtxn.ForEach(db.Proposers, func(key, data []byte) error {
+			txnId := common.MakeTxnId(key)
+			if err := decodeProposerState(txnId, data); err != nil {
+				r.problem(problemDamaged, st, nil, txnId, "%v %v", st, err)
+				corrupt++
+				return nil
+			}
+			proposers++
+			txns.proposers[*txnId] = append(txns.proposers[*txnId], st)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		log.Printf("%v has %v txns (%v orphaned, %v missing, %v with wrong refcounts), %v acceptors and %v proposers; %v damaged records\n",
+			st, len(present), orphans, missing, wrongCounts, acceptors, proposers, corrupt)
+		return nil, nil
+	}).ResultError()
+	if err != nil {
+		r.problem(problemDamaged, st, nil, nil, "%v %v", st, err)
+	}
+}
+
+func decodeAcceptorState(txnId *common.TxnId, record []byte) error {
+	data, err := db.VerifyChecksum(db.BallotOutcomes, txnId[:], record)
+	if err != nil {
+		return err
+	}
+	seg, _, err := capn.ReadFromMemoryZeroCopy(data)
+	if err != nil {
+		return fmt.Errorf("Unable to decode acceptor state of txn %v: %v", txnId, err)
+	}
+	state := msgs.ReadRootAcceptorState(seg)
+	if txn := state.Txn(); !txnId.Equal(common.MakeTxnId(txn.Id())) {
+		return fmt.Errorf("Acceptor state of txn %v holds txn %v", txnId, common.MakeTxnId(txn.Id()))
+	}
+	return nil
+}
+
+func decodeProposerState(txnId *common.TxnId, data []byte) error {
+	seg, _, err := capn.ReadFromMemoryZeroCopy(data)
+	if err != nil {
+		return fmt.Errorf("Unable to decode proposer state of txn %v: %v", txnId, err)
+	}
+	state := msgs.ReadRootProposerState(seg)
+	if state.Acceptors().Len() == 0 {
+		return fmt.Errorf("Proposer state of txn %v has no acceptors", txnId)
+	}
+	return nil
+}
+
+// checkStuck lists txns which have acceptor state, but no proposer
+// state in any store. The acceptors are waiting to hear that the txn
+// is locally complete, which only proposers tell them, so unless a
+// proposer in a store we weren't given still has the txn, they will
+// wait forever.
+func checkStuck(txns *txnstates, r *report) {
+	stuck := 0
+	for txnId, stores := range txns.acceptors {
+		if _, found := txns.proposers[txnId]; !found {
+			txnId := txnId
+			r.problem(problemStuck, nil, nil, &txnId, "Txn %v has acceptor state in %v, but no proposer state in any store: it may be stuck", &txnId, stores)
+			stuck++
+		}
+	}
+	log.Printf("Found %v txns with acceptor state, %v with proposer state; %v may be stuck\n", len(txns.acceptors), len(txns.proposers), stuck)
+}
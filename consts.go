@@ -18,4 +18,35 @@ const (
 	ConnectionRestartDelayRangeMS = 5000
 	ConnectionRestartDelayMin     = 3 * time.Second
 	MostRandomByteIndex           = 7 // will be the lsb of a big-endian client-n in the txnid.
+	HTTPHealthCheckTimeout        = 5 * time.Second
+	AdminRealm                    = "GoshawkDB Admin"
+	DefaultDrainTimeout           = 30 * time.Second
+	DrainPollInterval             = 100 * time.Millisecond
+	DefaultClientTxnsPauseTimeout = 30 * time.Second
+	ImportBatchSize               = 64
+	GCMarkBatchSize               = 64
+	DefaultGCGracePeriod          = time.Minute
+	GCSweepBatchSize              = 64
+	GCBarrierTimeout              = 5 * time.Minute
+	GCBarrierDrainInterval        = time.Minute
+	TombstoneGracePeriod          = 10 * time.Minute
+	DiskWriteRetryMin             = 10 * time.Millisecond
+	DiskWriteRetryMax             = 5 * time.Second
+	DiskWriteMaxAttempts          = 30
+	DefaultMinDiskFree            = 512 * 1024 * 1024
+	DefaultMaxMapUsage            = 0.95
+	DefaultMapGrowAt              = 0.8
+	SpaceCheckInterval            = 5 * time.Second
+	ReencryptBatchSize            = 256
+	CorruptionRepairRetryMin      = time.Second
+	CorruptionRepairRetryMax      = time.Minute
+	CorruptionRepairMaxAttempts   = 10
+	PeerAuthWindow                = time.Minute
+	PeerRequestTimeout            = 10 * time.Second
+	AntiEntropyBuckets            = 256
+	AntiEntropyRecheckDelay       = 5 * time.Second
+	AntiEntropyIndexMaxAge        = 2 * time.Second
+	AntiEntropyMaxReported        = 100
+	DefaultAntiEntropyInterval    = time.Hour
+	VarMetadataPageSize           = 1024
 )
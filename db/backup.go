@@ -0,0 +1,379 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	mdb "github.com/msackman/gomdb"
+	mdbs "github.com/msackman/gomdb/server"
+	"goshawkdb.io/common"
+	msgs "goshawkdb.io/common/capnp"
+	"goshawkdb.io/server"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	BackupInfoFile  = "backup.json"
+	backupBatchSize = 1024
+)
+
+// BackupInfo is written alongside the copied data so that a backup can
+// be validated before it is restored.
+type BackupInfo struct {
+	ClusterId         string
+	TopologyVersion   uint32
+	TopologyDBVersion string
+	RMId              common.RMId
+	BootCount         uint32
+	Created           time.Time
+	Counts            map[string]int
+}
+
+type kv struct {
+	key, value []byte
+}
+
+func newBackupDatabases(flags uint) *Databases {
+	return &Databases{
+		Vars:            &mdbs.DBISettings{Flags: flags},
+		Proposers:       &mdbs.DBISettings{Flags: flags},
+		BallotOutcomes:  &mdbs.DBISettings{Flags: flags},
+		Transactions:    &mdbs.DBISettings{Flags: flags},
+		TransactionRefs: &mdbs.DBISettings{Flags: flags},
+	}
+}
+
+// Backup copies the contents of disk into a new LMDB store in dir. All
+// tables are read within a single read-only txn so the copy is
+// consistent, and the node can carry on serving whilst the copy is
+// made: if disk is held in LMDB, growth of its map is held off until
+// the copy is done, and the copy is opened with disk's settings and a
+// map no smaller than disk's. The cluster id, version and DBVersion
+// of the topology, and the counts of each table, are taken from the
+// same txn and recorded in info, which is written to dir along with
+// the rmid and bootcount files. If disk is encrypted, so is the copy, with the same keys.
+func Backup(disk Store, dir string, info *BackupInfo) error {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	if entries, err := ioutil.ReadDir(dir); err != nil {
+		return err
+	} else if len(entries) != 0 {
+		return fmt.Errorf("Backup directory %v is not empty", dir)
+	}
+
+	config := DefaultLMDBConfig()
+	if source := lmdbStoreOf(disk); source != nil {
+		defer source.HoldGrowth()()
+		sourceConfig, err := backupConfig(source)
+		if err != nil {
+			return err
+		}
+		config = sourceConfig
+	}
+	targetDisk, err := newLMDBStore(dir, config, newBackupDatabases(mdb.CREATE))
+	if err != nil {
+		return err
+	}
+	defer targetDisk.Shutdown()
+	var target Store = targetDisk
+	if es, ok := disk.(*EncryptedStore); ok {
+		target = es.Wrap(targetDisk)
+	}
+
+	info.Counts = make(map[string]int)
+	_, err = disk.ReadonlyTransaction(func(rtxn RTxn) (interface{}, error) {
+		for _, table := range Tables {
+			count, err := copyTable(rtxn, table, target)
+			if err != nil {
+				return nil, fmt.Errorf("Error when copying %v: %v", table, err)
+			}
+			info.Counts[table.String()] = count
+		}
+		topology, err := ReadTopologyFromDisk(rtxn)
+		if err == NotFound {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		info.ClusterId = topology.ClusterId
+		info.TopologyVersion = topology.Version
+		info.TopologyDBVersion = topology.DBVersion.String()
+		return nil, nil
+	}).ResultError()
+	if err != nil {
+		return err
+	}
+	// Force everything out to disk before we declare the backup done.
+	if _, err = targetDisk.ReadWriteTransaction(true, func(rwtxn RWTxn) (interface{}, error) {
+		return nil, nil
+	}).ResultError(); err != nil {
+		return err
+	}
+
+	info.Created = time.Now()
+	infoBytes, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = WriteIdentityFile(filepath.Join(dir, RMIdFile), uint32(info.RMId), 0400); err != nil {
+		return err
+	}
+	if err = WriteIdentityFile(filepath.Join(dir, BootCountFile), info.BootCount, 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, BackupInfoFile), infoBytes, 0600)
+}
+
+// backupConfig returns the settings with which to open a copy of
+// source: its own, with a map big enough to hold everything in its
+// map. Nothing grows the copy's map.
+func backupConfig(source *LMDBStore) (*LMDBConfig, error) {
+	_, size, err := source.MapUsage()
+	if err != nil {
+		return nil, err
+	}
+	config := source.config
+	config.MaxMapSize = 0
+	if size > config.MapSize {
+		config.MapSize = size
+	}
+	return &config, nil
+}
+
+// lmdbStoreOf returns the LMDBStore which disk is, or wraps, if any.
+func lmdbStoreOf(disk Store) *LMDBStore {
+	for {
+		switch s := disk.(type) {
+		case *LMDBStore:
+			return s
+		case *EncryptedStore:
+			disk = s.Store
+		case *FaultyStore:
+			disk = s.Store
+		default:
+			return nil
+		}
+	}
+}
+
+func copyTable(rtxn RTxn, table Table, targetDisk Store) (int, error) {
+	count := 0
+	batch := make([]kv, 0, backupBatchSize)
+	err := rtxn.ForEach(table, func(key, value []byte) error {
+		batch = append(batch, kv{key: key, value: value})
+		if len(batch) == backupBatchSize {
+			if err := writeBatch(targetDisk, table, batch); err != nil {
+				return err
+			}
+			count += len(batch)
+			batch = make([]kv, 0, backupBatchSize)
+		}
+		return nil
+	})
+	if err == nil {
+		err = writeBatch(targetDisk, table, batch)
+		count += len(batch)
+	}
+	return count, err
+}
+
+func writeBatch(targetDisk Store, table Table, batch []kv) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	_, err := targetDisk.ReadWriteTransaction(false, func(rwtxn RWTxn) (interface{}, error) {
+		for _, pair := range batch {
+			if err := rwtxn.Put(table, pair.key, pair.value); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	}).ResultError()
+	return err
+}
+
+// ReadTopologyFromDisk returns the topology held in the topology var,
+// or NotFound if there is none.
+func ReadTopologyFromDisk(rtxn RTxn) (*server.Topology, error) {
+	varCap, err := ReadVarFromDisk(rtxn, server.TopologyVarUUId[:])
+	if err != nil {
+		return nil, err
+	}
+	txnId := common.MakeTxnId(varCap.WriteTxnId())
+	txn, err := ReadTxnFromDisk(rtxn, txnId)
+	if err == nil && txn == nil {
+		err = NotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read topology txn %v: %v", txnId, err)
+	}
+	actions := txn.Actions()
+	value, refs, _, err := topologyAction(txnId, &actions)
+	if err != nil {
+		return nil, err
+	}
+	var root *msgs.VarIdPos
+	if refs.Len() == 1 {
+		ref := refs.At(0)
+		root = &ref
+	}
+	return server.TopologyDeserialize(txnId, root, value)
+}
+
+// topologyAction finds the action of the topology txn txnId on the
+// topology var, and returns the value it writes, its references, and
+// a func to replace that value.
+func topologyAction(txnId *common.TxnId, actions *msgs.Action_List) (value []byte, refs msgs.VarIdPos_List, setValue func([]byte), err error) {
+	for idx, l := 0, actions.Len(); idx < l; idx++ {
+		action := actions.At(idx)
+		if !bytes.Equal(action.VarId(), server.TopologyVarUUId[:]) {
+			continue
+		}
+		switch action.Which() {
+		case msgs.ACTION_WRITE:
+			write := action.Write()
+			return write.Value(), write.References(), write.SetValue, nil
+		case msgs.ACTION_READWRITE:
+			rw := action.Readwrite()
+			return rw.Value(), rw.References(), rw.SetValue, nil
+		case msgs.ACTION_CREATE:
+			create := action.Create()
+			return create.Value(), create.References(), create.SetValue, nil
+		default:
+			return nil, refs, nil, fmt.Errorf("Topology txn %v has unexpected action type for topology var: %v", txnId, action.Which())
+		}
+	}
+	return nil, refs, nil, fmt.Errorf("Topology txn %v does not write the topology var", txnId)
+}
+
+// topologyDBVersion returns the id of the txn which last wrote the
+// topology var, which is the DBVersion of the topology, or "" if there
+// is no topology var.
+func topologyDBVersion(rtxn RTxn) (string, error) {
+	varCap, err := ReadVarFromDisk(rtxn, server.TopologyVarUUId[:])
+	if err == NotFound {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return common.MakeTxnId(varCap.WriteTxnId()).String(), nil
+}
+
+// ValidateBackup checks that the backup in dir is complete and
+// self-consistent: the rmid and bootcount files must agree with the
+// recorded BackupInfo, and the store must contain the same number of
+// entries and the same topology as was recorded when the backup was
+// taken. The checksums of vars, txns and acceptor states are verified
+// too. A backup of an encrypted store is encrypted, so source must
+// supply its keys: every record is then decrypted (which authenticates
+// it) before its checksum is verified. source is nil if encryption is
+// not enabled.
+func ValidateBackup(dir string, source KeySource) (*BackupInfo, error) {
+	infoBytes, err := ioutil.ReadFile(filepath.Join(dir, BackupInfoFile))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read backup info: %v", err)
+	}
+	info := &BackupInfo{}
+	if err = json.Unmarshal(infoBytes, info); err != nil {
+		return nil, fmt.Errorf("Unable to parse backup info: %v", err)
+	}
+
+	if rmId, err := ReadIdentityFile(filepath.Join(dir, RMIdFile)); err != nil {
+		return nil, err
+	} else if common.RMId(rmId) != info.RMId {
+		return nil, fmt.Errorf("Backup rmid file does not match backup info (expected %v)", info.RMId)
+	}
+	if bootCount, err := ReadIdentityFile(filepath.Join(dir, BootCountFile)); err != nil {
+		return nil, err
+	} else if bootCount != info.BootCount {
+		return nil, fmt.Errorf("Backup bootcount file does not match backup info (expected %v)", info.BootCount)
+	}
+
+	lmdb, err := newLMDBStore(dir, DefaultLMDBConfig(), newBackupDatabases(0))
+	if err != nil {
+		return nil, err
+	}
+	defer lmdb.Shutdown()
+	var disk Store = lmdb
+	if source != nil {
+		if disk, err = NewEncryptedStore(lmdb, source, false); err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = disk.ReadonlyTransaction(func(rtxn RTxn) (interface{}, error) {
+		for _, table := range Tables {
+			count := 0
+			err := rtxn.ForEach(table, func(key, value []byte) error {
+				count++
+				if _, encrypted := SealedKeyId(value); encrypted {
+					return fmt.Errorf("Backup is encrypted: the encryption keys are needed to validate it")
+				}
+				if table == Vars || table == BallotOutcomes || table == Transactions {
+					_, err := VerifyChecksum(table, key, value)
+					return err
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			if name := table.String(); count != info.Counts[name] {
+				return nil, fmt.Errorf("Backup %v has %v entries; expected %v", name, count, info.Counts[name])
+			}
+		}
+		dbVersion, err := topologyDBVersion(rtxn)
+		if err != nil {
+			return nil, err
+		}
+		if dbVersion != info.TopologyDBVersion {
+			return nil, fmt.Errorf("Backup topology DBVersion is %v; expected %v", dbVersion, info.TopologyDBVersion)
+		}
+		return nil, nil
+	}).ResultError()
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// RewriteClusterId changes the ClusterId of the topology held in
+// disk. This is used when restoring a snapshot as a new cluster. The
+// txn which last wrote the topology var is rewritten in place: its id
+// is unchanged, so the topology's DBVersion is unchanged too.
+func RewriteClusterId(disk Store, clusterId string) error {
+	_, err := disk.ReadWriteTransaction(true, func(rwtxn RWTxn) (interface{}, error) {
+		varCap, err := ReadVarFromDisk(rwtxn, server.TopologyVarUUId[:])
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read topology var: %v", err)
+		}
+		txnId := common.MakeTxnId(varCap.WriteTxnId())
+
+		txn, err := ReadTxnFromDisk(rwtxn, txnId)
+		if err == nil && txn == nil {
+			err = NotFound
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read topology txn %v: %v", txnId, err)
+		}
+		seg, txnCap := copyTxnToRoot(txn)
+
+		actions := txnCap.Actions()
+		value, _, setValue, err := topologyAction(txnId, &actions)
+		if err != nil {
+			return nil, err
+		}
+		topology, err := server.TopologyDeserialize(txnId, nil, value)
+		if err != nil {
+			return nil, err
+		}
+		topology.ClusterId = clusterId
+		setValue(topology.Serialize())
+		return nil, ReplaceTxnOnDisk(rwtxn, txnId, server.SegToBytes(seg))
+	}).ResultError()
+	return err
+}
@@ -0,0 +1,201 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	mdb "github.com/msackman/gomdb"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func populate(t *testing.T, s Store, count int) {
+	_, err := s.ReadWriteTransaction(false, func(rwtxn RWTxn) (interface{}, error) {
+		for _, table := range Tables {
+			for idx := 0; idx < count; idx++ {
+				key := []byte(fmt.Sprintf("%v-%04d", table, idx))
+				if err := rwtxn.Put(table, key, AddChecksum(table, key, []byte("value"))); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return nil, nil
+	}).ResultError()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func backupDir(t *testing.T) (string, string) {
+	parent := tempDir(t)
+	return parent, filepath.Join(parent, "backup")
+}
+
+func TestBackupAndValidate(t *testing.T) {
+	parent, dir := backupDir(t)
+	defer os.RemoveAll(parent)
+
+	// More than a batch, so that batching is exercised.
+	count := backupBatchSize + 3
+	disk := NewMemoryStore()
+	populate(t, disk, count)
+
+	info := &BackupInfo{RMId: 7, BootCount: 3}
+	if err := Backup(disk, dir, info); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range Tables {
+		if info.Counts[table.String()] != count {
+			t.Fatalf("Expected %v entries in %v; recorded %v", count, table, info.Counts[table.String()])
+		}
+	}
+
+	validated, err := ValidateBackup(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if validated.RMId != 7 || validated.BootCount != 3 || validated.TopologyDBVersion != "" {
+		t.Fatalf("Validated backup info differs: %#v", validated)
+	}
+}
+
+// A copy of an LMDB store gets the store's settings, and a map big
+// enough for all of it, rather than the defaults.
+func TestBackupConfig(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	config := DefaultLMDBConfig()
+	config.MapSize, config.MaxMapSize, config.Mode = 1<<20, 1<<24, 0640
+	source, err := newLMDBStore(dir, config, newBackupDatabases(mdb.CREATE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Shutdown()
+	if lmdbStoreOf(NewFaultyStore(source)) != source || lmdbStoreOf(NewMemoryStore()) != nil {
+		t.Fatal("Expected to find the LMDBStore wrapped, and only that")
+	}
+
+	target, err := backupConfig(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target.MapSize != 1<<20 || target.MaxMapSize != 0 || target.Mode != 0640 {
+		t.Fatalf("Expected the source's settings, without growth; got %#v", target)
+	}
+	if _, err = source.MDBServer.WithEnv(func(env *mdb.Env) (interface{}, error) {
+		return nil, env.SetMapSize(1 << 21)
+	}).ResultError(); err != nil {
+		t.Fatal(err)
+	}
+	if target, err = backupConfig(source); err != nil {
+		t.Fatal(err)
+	} else if target.MapSize != 1<<21 {
+		t.Fatalf("Expected the source's grown map size; got %v", target.MapSize)
+	}
+}
+
+func TestValidateEncryptedBackup(t *testing.T) {
+	parent, dir := backupDir(t)
+	defer os.RemoveAll(parent)
+	keyFile := filepath.Join(parent, "keys")
+	writeKeyFile(t, keyFile, 1)
+
+	disk, err := NewEncryptedStore(NewMemoryStore(), KeyFile(keyFile), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	populate(t, disk, 5)
+	if err = Backup(disk, dir, &BackupInfo{RMId: 7, BootCount: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ValidateBackup(dir, nil); err == nil || !strings.Contains(err.Error(), "encrypted") {
+		t.Fatalf("Expected validation without the keys to fail; got %v", err)
+	}
+	if _, err = ValidateBackup(dir, KeyFile(keyFile)); err != nil {
+		t.Fatal(err)
+	}
+	writeKeyFile(t, keyFile, 2)
+	if _, err = ValidateBackup(dir, KeyFile(keyFile)); err == nil {
+		t.Fatal("Expected validation with the wrong keys to fail")
+	}
+}
+
+func TestBackupRefusesNonEmptyDir(t *testing.T) {
+	parent, dir := backupDir(t)
+	defer os.RemoveAll(parent)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "junk"), []byte("junk"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Backup(NewMemoryStore(), dir, &BackupInfo{RMId: 1}); err == nil || !strings.Contains(err.Error(), "not empty") {
+		t.Fatalf("Expected backup into non-empty dir to fail; got %v", err)
+	}
+}
+
+func TestValidateBackupDetectsMismatch(t *testing.T) {
+	disk := NewMemoryStore()
+	populate(t, disk, 5)
+
+	for _, damage := range []struct {
+		name string
+		fun  func(dir string) error
+	}{
+		{"info missing", func(dir string) error {
+			return os.Remove(filepath.Join(dir, BackupInfoFile))
+		}},
+		{"rmid differs", func(dir string) error {
+			return WriteIdentityFile(filepath.Join(dir, RMIdFile), 8, 0400)
+		}},
+		{"bootcount differs", func(dir string) error {
+			return WriteIdentityFile(filepath.Join(dir, BootCountFile), 4, 0600)
+		}},
+		{"count differs", func(dir string) error {
+			info := &BackupInfo{}
+			path := filepath.Join(dir, BackupInfoFile)
+			if bites, err := ioutil.ReadFile(path); err != nil {
+				return err
+			} else if err = json.Unmarshal(bites, info); err != nil {
+				return err
+			}
+			info.Counts[Vars.String()]++
+			bites, err := json.Marshal(info)
+			if err != nil {
+				return err
+			}
+			return ioutil.WriteFile(path, bites, 0600)
+		}},
+		{"topology differs", func(dir string) error {
+			info := &BackupInfo{}
+			path := filepath.Join(dir, BackupInfoFile)
+			if bites, err := ioutil.ReadFile(path); err != nil {
+				return err
+			} else if err = json.Unmarshal(bites, info); err != nil {
+				return err
+			}
+			info.TopologyDBVersion = "not the version"
+			bites, err := json.Marshal(info)
+			if err != nil {
+				return err
+			}
+			return ioutil.WriteFile(path, bites, 0600)
+		}},
+	} {
+		parent, dir := backupDir(t)
+		if err := Backup(disk, dir, &BackupInfo{RMId: 7, BootCount: 3}); err != nil {
+			os.RemoveAll(parent)
+			t.Fatal(err)
+		}
+		if err := damage.fun(dir); err != nil {
+			os.RemoveAll(parent)
+			t.Fatal(err)
+		}
+		if _, err := ValidateBackup(dir, nil); err == nil {
+			t.Errorf("Expected validation to fail when %v", damage.name)
+		}
+		os.RemoveAll(parent)
+	}
+}
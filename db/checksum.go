@@ -0,0 +1,281 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server"
+	"hash/crc32"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A checksummed record is checksumMagic, followed by the big-endian
+// CRC32 (Castagnoli) of the table, key and payload, followed by the
+// payload. Covering the table and key means a record which ends up
+// under the wrong key is caught as well as one which is damaged in
+// place. Records written before checksums were added start with a
+// capnp segment count instead, which never matches the magic: they
+// are accepted unverified. The count is little-endian, and we never
+// write anything like 256 segments, so its last three bytes are
+// zero, which the magic's never are, even once damaged. So a record
+// which starts with neither is a checksummed record with a damaged
+// magic.
+var checksumMagic = []byte{0xff, 'G', 'C', '1'}
+
+const checksumHeaderLen = 8
+
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+func checksum(table Table, key, payload []byte) uint32 {
+	crc := crc32.Update(0, checksumTable, []byte{byte(table)})
+	crc = crc32.Update(crc, checksumTable, key)
+	return crc32.Update(crc, checksumTable, payload)
+}
+
+// AddChecksum returns the record to store under key in table for
+// payload.
+func AddChecksum(table Table, key, payload []byte) []byte {
+	record := make([]byte, checksumHeaderLen+len(payload))
+	copy(record, checksumMagic)
+	binary.BigEndian.PutUint32(record[4:], checksum(table, key, payload))
+	copy(record[checksumHeaderLen:], payload)
+	return record
+}
+
+// VerifyChecksum checks the record held under key in table and
+// returns its payload. A damaged record gives a *CorruptionError.
+func VerifyChecksum(table Table, key, record []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(record, checksumMagic):
+	case isUnchecksummed(record):
+		return record, nil
+	default:
+		return nil, &CorruptionError{Table: table, Key: key, Reason: "damaged checksum magic"}
+	}
+	if len(record) < checksumHeaderLen {
+		return nil, &CorruptionError{Table: table, Key: key, Reason: "truncated checksum"}
+	}
+	payload := record[checksumHeaderLen:]
+	if binary.BigEndian.Uint32(record[4:]) != checksum(table, key, payload) {
+		return nil, &CorruptionError{Table: table, Key: key, Reason: "checksum mismatch"}
+	}
+	return payload, nil
+}
+
+// isUnchecksummed returns true if record starts as a capnp message we
+// would have written before checksums were added. A record which is
+// still sealed is passed through too, as it always has been, for
+// Keyring.Open to report.
+func isUnchecksummed(record []byte) bool {
+	if _, sealed := SealedKeyId(record); sealed {
+		return true
+	}
+	return len(record) >= len(checksumMagic) && record[1] == 0 && record[2] == 0 && record[3] == 0
+}
+
+// CorruptionError reports that the record held under Key in Table is
+// damaged or missing.
+type CorruptionError struct {
+	Table  Table
+	Key    []byte
+	Reason string
+}
+
+func (ce *CorruptionError) Error() string {
+	return fmt.Sprintf("Corrupt %v record %x: %v", ce.Table, ce.Key, ce.Reason)
+}
+
+func (ce *CorruptionError) id() string {
+	return ce.Table.String() + " " + hex.EncodeToString(ce.Key)
+}
+
+// IsCorruption returns the *CorruptionError if err is one.
+func IsCorruption(err error) (*CorruptionError, bool) {
+	ce, ok := err.(*CorruptionError)
+	return ce, ok
+}
+
+// A RecordFetcher fetches the payloads of the copies held by the other
+// replicas of the record under key in table, keyed by the replica
+// which holds each. Copies may differ: it's up to the caller to pick
+// between them, but no copy may be trusted unless at least quorum
+// (F+1) replicas agree on it. Returns NoReplicas if no other node can
+// hold a copy.
+type RecordFetcher func(table Table, key []byte) (copies map[common.RMId][]byte, quorum int, err error)
+
+// NoReplicas is returned by a RecordFetcher when no other node can
+// hold a copy of the record (i.e. F is 0), so there's no point in
+// trying again.
+var NoReplicas = errors.New("No other node holds a replica")
+
+// Corruptions keeps track of corrupt records found on disk, and of
+// their repair from other replicas. Corruption is found by whichever
+// var manager or acceptor manager reads the record, and repairs finish
+// in their own go-routines, so the record of outstanding corruptions
+// is kept under a lock. The fetcher is only set once the peer HTTP
+// server is up. A record which can't be repaired shuts the node down,
+// as the node can't go on without it. A nil *Corruptions, as used by
+// tests, logs what it's told but has no way of fetching replacements.
+type Corruptions struct {
+	lock         sync.Mutex
+	fetcher      RecordFetcher
+	shutdown     func(error)
+	outstanding  map[string]*CorruptionError
+	unrepairable map[string]error
+	found        uint64
+	repaired     uint64
+	lastErr      error
+	lastAt       time.Time
+}
+
+// CorruptionStats is a snapshot of a Corruptions, suitable for
+// reporting as JSON.
+type CorruptionStats struct {
+	Found       uint64
+	Repaired    uint64
+	Outstanding []string
+	// Unrepairable lists the records we've given up on repairing,
+	// and why.
+	Unrepairable []string
+	LastError    string
+	LastFoundAt  time.Time
+	CanFetch     bool
+}
+
+func NewCorruptions(shutdown func(error)) *Corruptions {
+	return &Corruptions{
+		shutdown:     shutdown,
+		outstanding:  make(map[string]*CorruptionError),
+		unrepairable: make(map[string]error),
+	}
+}
+
+// SetFetcher sets the means of fetching replacements for corrupt
+// records from other nodes.
+func (c *Corruptions) SetFetcher(fetcher RecordFetcher) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.fetcher = fetcher
+}
+
+// Fetch fetches copies of the record from the other replicas. See
+// RecordFetcher.
+func (c *Corruptions) Fetch(table Table, key []byte) (map[common.RMId][]byte, int, error) {
+	var fetcher RecordFetcher
+	if c != nil {
+		c.lock.Lock()
+		fetcher = c.fetcher
+		c.lock.Unlock()
+	}
+	if fetcher == nil {
+		return nil, 0, fmt.Errorf("Unable to fetch %v record %x: no other replicas available", table, key)
+	}
+	return fetcher(table, key)
+}
+
+// Report records that err, a *CorruptionError, has been
+// found. Reporting the same record again, before it's repaired, is
+// only counted once.
+func (c *Corruptions) Report(err *CorruptionError) {
+	if c == nil {
+		log.Println(err)
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.lastErr = err
+	c.lastAt = time.Now()
+	if _, found := c.outstanding[err.id()]; found {
+		return
+	}
+	log.Println(err)
+	c.outstanding[err.id()] = err
+	c.found++
+}
+
+// Repaired records that the record identified by err has been
+// replaced.
+func (c *Corruptions) Repaired(err *CorruptionError) {
+	if c == nil {
+		log.Printf("Repaired %v record %x\n", err.Table, err.Key)
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, found := c.outstanding[err.id()]; !found {
+		return
+	}
+	log.Printf("Repaired %v record %x\n", err.Table, err.Key)
+	delete(c.outstanding, err.id())
+	c.repaired++
+}
+
+// Unrepairable records that we've given up on repairing the record
+// identified by ce, because of err, and shuts the node down.
+func (c *Corruptions) Unrepairable(ce *CorruptionError, err error) {
+	log.Printf("Giving up on repairing %v record %x: %v\n", ce.Table, ce.Key, err)
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, found := c.unrepairable[ce.id()]; found {
+		return
+	}
+	c.unrepairable[ce.id()] = err
+	if c.shutdown != nil {
+		go c.shutdown(fmt.Errorf("Unable to repair %v: %v", ce, err))
+	}
+}
+
+func (c *Corruptions) Stats() *CorruptionStats {
+	if c == nil {
+		return &CorruptionStats{}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	stats := &CorruptionStats{
+		Found:        c.found,
+		Repaired:     c.repaired,
+		Outstanding:  make([]string, 0, len(c.outstanding)),
+		Unrepairable: make([]string, 0, len(c.unrepairable)),
+		LastFoundAt:  c.lastAt,
+		CanFetch:     c.fetcher != nil,
+	}
+	for id := range c.outstanding {
+		stats.Outstanding = append(stats.Outstanding, id)
+	}
+	sort.Strings(stats.Outstanding)
+	for id, err := range c.unrepairable {
+		stats.Unrepairable = append(stats.Unrepairable, fmt.Sprintf("%v: %v", id, err))
+	}
+	sort.Strings(stats.Unrepairable)
+	if c.lastErr != nil {
+		stats.LastError = c.lastErr.Error()
+	}
+	return stats
+}
+
+func (c *Corruptions) Status(sc *server.StatusConsumer) {
+	stats := c.Stats()
+	sc.Emit(fmt.Sprintf("Corrupt Records: %v found; %v repaired", stats.Found, stats.Repaired))
+	for _, id := range stats.Outstanding {
+		sc.Emit(fmt.Sprintf("- Outstanding: %v", id))
+	}
+	for _, unrepairable := range stats.Unrepairable {
+		sc.Emit(fmt.Sprintf("- Unrepairable: %v", unrepairable))
+	}
+	if stats.LastError != "" {
+		sc.Emit(fmt.Sprintf("- Last Error: %v (at %v)", stats.LastError, stats.LastFoundAt))
+	}
+	sc.Join()
+}
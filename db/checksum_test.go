@@ -0,0 +1,126 @@
+package db
+
+import (
+	"bytes"
+	"goshawkdb.io/common"
+	"testing"
+	"time"
+)
+
+func TestChecksumRoundTrip(t *testing.T) {
+	key, payload := []byte("key"), []byte("payload")
+	record := AddChecksum(Vars, key, payload)
+	if read, err := VerifyChecksum(Vars, key, record); err != nil || !bytes.Equal(read, payload) {
+		t.Fatalf("Expected %s; got %s (err: %v)", payload, read, err)
+	}
+
+	// Records from before checksums were added, which start with a
+	// capnp segment count, are passed through.
+	legacy := []byte{0, 0, 0, 0, 1, 0, 0, 0, 1, 2, 3, 4, 5, 6, 7, 8}
+	if read, err := VerifyChecksum(Vars, key, legacy); err != nil || !bytes.Equal(read, legacy) {
+		t.Fatalf("Expected legacy record %v; got %v (err: %v)", legacy, read, err)
+	}
+}
+
+// A damaged magic must not pass a record off as one from before
+// checksums were added.
+func TestChecksumDetectsDamagedMagic(t *testing.T) {
+	key, payload := []byte("key"), []byte("payload")
+	record := AddChecksum(Vars, key, payload)
+	for idx := range checksumMagic {
+		for bit := uint(0); bit < 8; bit++ {
+			damaged := append([]byte{}, record...)
+			damaged[idx] ^= 1 << bit
+			if _, err := VerifyChecksum(Vars, key, damaged); err == nil {
+				t.Fatalf("Expected record with bit %v of magic byte %v flipped to fail verification", bit, idx)
+			} else if _, corrupt := IsCorruption(err); !corrupt {
+				t.Fatalf("Expected corruption error; got %v", err)
+			}
+		}
+	}
+	if _, err := VerifyChecksum(Vars, key, record[:2]); err == nil {
+		t.Fatal("Expected record truncated within the magic to fail verification")
+	}
+}
+
+func TestChecksumDetectsCorruption(t *testing.T) {
+	key, payload := []byte("key"), []byte("payload")
+	record := AddChecksum(Transactions, key, payload)
+
+	damaged := append([]byte{}, record...)
+	damaged[len(damaged)-1] ^= 0xff
+	if _, err := VerifyChecksum(Transactions, key, damaged); err == nil {
+		t.Fatal("Expected damaged record to fail verification")
+	} else if ce, corrupt := IsCorruption(err); !corrupt || ce.Table != Transactions || !bytes.Equal(ce.Key, key) {
+		t.Fatalf("Expected corruption error for %v %s; got %v", Transactions, key, err)
+	}
+
+	if _, err := VerifyChecksum(Transactions, []byte("other"), record); err == nil {
+		t.Fatal("Expected record under the wrong key to fail verification")
+	}
+	if _, err := VerifyChecksum(Vars, key, record); err == nil {
+		t.Fatal("Expected record in the wrong table to fail verification")
+	}
+	if _, err := VerifyChecksum(Transactions, key, record[:6]); err == nil {
+		t.Fatal("Expected truncated record to fail verification")
+	}
+}
+
+func TestCorruptions(t *testing.T) {
+	c := NewCorruptions(nil)
+	ce := &CorruptionError{Table: Vars, Key: []byte{1, 2}, Reason: "test"}
+	if _, _, err := c.Fetch(Vars, ce.Key); err == nil {
+		t.Fatal("Expected fetch without a fetcher to fail")
+	}
+	c.Report(ce)
+	c.Report(ce)
+	if stats := c.Stats(); stats.Found != 1 || len(stats.Outstanding) != 1 || stats.CanFetch {
+		t.Fatalf("Expected 1 outstanding corruption; got %+v", stats)
+	}
+
+	c.SetFetcher(func(table Table, key []byte) (map[common.RMId][]byte, int, error) {
+		return map[common.RMId][]byte{2: []byte("copy")}, 1, nil
+	})
+	if copies, quorum, err := c.Fetch(Vars, ce.Key); err != nil || len(copies) != 1 || quorum != 1 {
+		t.Fatalf("Expected 1 copy and a quorum of 1; got %v, %v (err: %v)", copies, quorum, err)
+	}
+	c.Repaired(ce)
+	c.Repaired(ce)
+	if stats := c.Stats(); stats.Repaired != 1 || len(stats.Outstanding) != 0 || !stats.CanFetch {
+		t.Fatalf("Expected corruption to be repaired; got %+v", stats)
+	}
+
+	var nilCorruptions *Corruptions
+	nilCorruptions.Report(ce)
+	nilCorruptions.Repaired(ce)
+	nilCorruptions.Unrepairable(ce, NoReplicas)
+	if stats := nilCorruptions.Stats(); stats.Found != 0 {
+		t.Fatalf("Expected nil Corruptions to count nothing; got %+v", stats)
+	}
+}
+
+// Giving up on a record shuts the node down, once.
+func TestCorruptionsUnrepairable(t *testing.T) {
+	shutdowns := make(chan error, 2)
+	c := NewCorruptions(func(err error) { shutdowns <- err })
+	ce := &CorruptionError{Table: Vars, Key: []byte{1, 2}, Reason: "test"}
+	c.Report(ce)
+	c.Unrepairable(ce, NoReplicas)
+	c.Unrepairable(ce, NoReplicas)
+	select {
+	case err := <-shutdowns:
+		if err == nil {
+			t.Fatal("Expected shutdown with an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected node to be shut down")
+	}
+	select {
+	case <-shutdowns:
+		t.Fatal("Expected node to be shut down only once")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if stats := c.Stats(); len(stats.Unrepairable) != 1 || len(stats.Outstanding) != 1 {
+		t.Fatalf("Expected 1 unrepairable, outstanding corruption; got %+v", stats)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	mdbs "github.com/msackman/gomdb/server"
 )
 
+// Databases holds the LMDB DBIs which back each Table of an
+// LMDBStore.
 type Databases struct {
 	Vars            *mdbs.DBISettings
 	Proposers       *mdbs.DBISettings
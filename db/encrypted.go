@@ -0,0 +1,582 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"goshawkdb.io/server"
+	"io"
+	"io/ioutil"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An encrypted record is the magic, the id of the key it was sealed
+// with, a random nonce, and then the AES-256-GCM ciphertext. The table
+// and the record's key are authenticated too, so a record can't be
+// moved elsewhere undetected. The magic can't start a capnp message
+// we would write, so plaintext records can be told apart. They are
+// refused, as anyone able to write to the store could have put them
+// there, unless plaintext has been explicitly allowed whilst an
+// existing store is first encrypted.
+var encryptedMagic = [4]byte{0xff, 'G', 'E', '1'}
+
+const (
+	encryptionKeyLen = 32
+	keyIdLen         = 4
+	nonceLen         = 12
+	encryptedHeader  = len(encryptedMagic) + keyIdLen + nonceLen
+)
+
+// Key is an AES-256 key, identified by Id. Of a set of keys, the one
+// with the highest Id is current and is used to seal new records.
+type Key struct {
+	Id     uint32
+	Secret []byte
+}
+
+// KeySource supplies the set of keys for an EncryptedStore. It is
+// consulted at start up and on every rotation.
+type KeySource interface {
+	LoadKeys() ([]Key, error)
+	String() string
+}
+
+// KeyFile is a KeySource which reads keys from a file. Each
+// non-blank line which doesn't start with # is a decimal key id and
+// 64 hex digits of key, separated by whitespace.
+type KeyFile string
+
+func (kf KeyFile) LoadKeys() ([]Key, error) {
+	b, err := ioutil.ReadFile(string(kf))
+	if err != nil {
+		return nil, err
+	}
+	return parseKeys(bytes.NewReader(b), kf.String())
+}
+
+func (kf KeyFile) String() string {
+	return fmt.Sprintf("key file %v", string(kf))
+}
+
+// KeyCommand is a KeySource which runs a shell command, for example
+// a client of an external KMS, and reads keys from its output in the
+// same format as KeyFile.
+type KeyCommand string
+
+func (kc KeyCommand) LoadKeys() ([]Key, error) {
+	output, err := exec.Command("/bin/sh", "-c", string(kc)).Output()
+	if err != nil {
+		return nil, fmt.Errorf("Key command failed: %v", err)
+	}
+	return parseKeys(bytes.NewReader(output), kc.String())
+}
+
+func (kc KeyCommand) String() string {
+	return fmt.Sprintf("key command '%v'", string(kc))
+}
+
+func parseKeys(r io.Reader, source string) ([]Key, error) {
+	keys := []Key{}
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Line %v of %v: expected key id and key", lineNum, source)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Line %v of %v: illegal key id: %v", lineNum, source, err)
+		}
+		secret, err := hex.DecodeString(fields[1])
+		if err != nil || len(secret) != encryptionKeyLen {
+			return nil, fmt.Errorf("Line %v of %v: key must be %v hex digits", lineNum, source, 2*encryptionKeyLen)
+		}
+		keys = append(keys, Key{Id: uint32(id), Secret: secret})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Keyring seals and opens records with a set of keys.
+type Keyring struct {
+	currentId uint32
+	aeads     map[uint32]cipher.AEAD
+}
+
+func NewKeyring(keys []Key) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("No encryption keys supplied")
+	}
+	kr := &Keyring{aeads: make(map[uint32]cipher.AEAD, len(keys))}
+	for idx, key := range keys {
+		if _, found := kr.aeads[key.Id]; found {
+			return nil, fmt.Errorf("Duplicate encryption key id: %v", key.Id)
+		}
+		block, err := aes.NewCipher(key.Secret)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		kr.aeads[key.Id] = aead
+		if idx == 0 || key.Id > kr.currentId {
+			kr.currentId = key.Id
+		}
+	}
+	return kr, nil
+}
+
+func (kr *Keyring) CurrentId() uint32 {
+	return kr.currentId
+}
+
+func additionalData(table Table, key []byte) []byte {
+	return append([]byte{byte(table)}, key...)
+}
+
+// Seal encrypts value, which is to be stored under key in table, with
+// the current key.
+func (kr *Keyring) Seal(table Table, key, value []byte) ([]byte, error) {
+	aead := kr.aeads[kr.currentId]
+	sealed := make([]byte, encryptedHeader, encryptedHeader+len(value)+aead.Overhead())
+	copy(sealed, encryptedMagic[:])
+	binary.BigEndian.PutUint32(sealed[len(encryptedMagic):], kr.currentId)
+	nonce := sealed[encryptedHeader-nonceLen : encryptedHeader]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(sealed, nonce, value, additionalData(table, key)), nil
+}
+
+// Open decrypts value, which was read from key in table. A plaintext
+// value, or one which fails authentication, gives a
+// *CorruptionError. Only a value sealed with a key we don't have,
+// which is a matter of configuration, gives any other error.
+func (kr *Keyring) Open(table Table, key, value []byte) ([]byte, error) {
+	keyId, encrypted := SealedKeyId(value)
+	if !encrypted {
+		return nil, &CorruptionError{Table: table, Key: key, Reason: "record is not encrypted"}
+	}
+	nonce := value[encryptedHeader-nonceLen : encryptedHeader]
+	ciphertext, ad := value[encryptedHeader:], additionalData(table, key)
+	aead, found := kr.aeads[keyId]
+	if !found {
+		// The key id isn't authenticated, so if it's been damaged,
+		// it looks just like a key we don't have. In which case, one
+		// of the keys we do have will open it.
+		for _, aead := range kr.aeads {
+			if _, err := aead.Open(nil, nonce, ciphertext, ad); err == nil {
+				return nil, &CorruptionError{Table: table, Key: key, Reason: fmt.Sprintf("damaged key id %v", keyId)}
+			}
+		}
+		return nil, fmt.Errorf("Record %v in %x is encrypted with unknown key %v", table, key, keyId)
+	}
+	plain, err := aead.Open(nil, nonce, ciphertext, ad)
+	if err != nil {
+		return nil, &CorruptionError{Table: table, Key: key, Reason: fmt.Sprintf("failed authentication with key %v", keyId)}
+	}
+	return plain, nil
+}
+
+// SealedKeyId returns the id of the key with which value was sealed,
+// and false if value is plaintext.
+func SealedKeyId(value []byte) (uint32, bool) {
+	if len(value) < encryptedHeader || !bytes.Equal(value[:len(encryptedMagic)], encryptedMagic[:]) {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(value[len(encryptedMagic):]), true
+}
+
+// EncryptionConfig holds the settings for encryption at rest. At most
+// one of KeyFile and KeyCommand may be set; if neither is, the store
+// is not encrypted. AllowPlaintext is for enabling encryption on an
+// existing store: plaintext records are read as they are, and sealed
+// by the next rotation.
+type EncryptionConfig struct {
+	KeyFile        string
+	KeyCommand     string
+	AllowPlaintext bool
+}
+
+func (c *EncryptionConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.KeyFile, "encryptionkeyfile", "", "`Path` to file of keys with which to encrypt the store at rest")
+	fs.StringVar(&c.KeyCommand, "encryptionkeycmd", "", "Shell `command` which prints the keys with which to encrypt the store at rest")
+	fs.BoolVar(&c.AllowPlaintext, "encryptionallowplaintext", false, "Accept records which are not encrypted, as when first encrypting an existing store; rotate the keys to encrypt them")
+}
+
+func (c *EncryptionConfig) Validate() error {
+	if c.KeyFile != "" && c.KeyCommand != "" {
+		return fmt.Errorf("Only one of -encryptionkeyfile and -encryptionkeycmd may be supplied")
+	}
+	if c.AllowPlaintext && c.KeySource() == nil {
+		return fmt.Errorf("-encryptionallowplaintext requires -encryptionkeyfile or -encryptionkeycmd")
+	}
+	return nil
+}
+
+// KeySource returns nil if encryption is not enabled.
+func (c *EncryptionConfig) KeySource() KeySource {
+	switch {
+	case c.KeyFile != "":
+		return KeyFile(c.KeyFile)
+	case c.KeyCommand != "":
+		return KeyCommand(c.KeyCommand)
+	default:
+		return nil
+	}
+}
+
+// Wrap returns store encrypted as configured, or store itself if
+// encryption is not enabled.
+func (c *EncryptionConfig) Wrap(store Store) (Store, error) {
+	if source := c.KeySource(); source != nil {
+		es, err := NewEncryptedStore(store, source, c.AllowPlaintext)
+		if err != nil {
+			return nil, err
+		}
+		return es, nil
+	}
+	return store, nil
+}
+
+// EncryptedStore wraps a Store, encrypting every value written to it
+// and decrypting every value read from it. Keys are not encrypted.
+//
+// Rotate reloads the keys from the KeySource, after which new records
+// are sealed with the new current key, and starts re-encrypting, in
+// the background, every record sealed with an older key (or, if
+// plaintext is allowed, not sealed at all). Old keys must remain
+// available from the KeySource until that completes.
+//
+// A read-write txn seals with the keyring current when it starts, and
+// holds txns for reading until it has committed. A rotation takes txns
+// for writing before it looks for records to re-encrypt, so it can't
+// miss a record sealed with an old key by a txn still in flight.
+type EncryptedStore struct {
+	Store
+	source         KeySource
+	allowPlaintext bool
+	txns           sync.RWMutex
+	lock           sync.RWMutex
+	keyring        *Keyring
+	rotation       EncryptionStats
+}
+
+// EncryptionStats reports on an EncryptedStore and its latest
+// rotation, suitable for reporting as JSON.
+type EncryptionStats struct {
+	Source       string
+	CurrentKeyId uint32
+	Rotating     bool
+	Reencrypted  int
+	Plaintext    int
+	Started      time.Time
+	Finished     time.Time
+	Error        string
+}
+
+func NewEncryptedStore(store Store, source KeySource, allowPlaintext bool) (*EncryptedStore, error) {
+	keyring, err := loadKeyring(source)
+	if err != nil {
+		return nil, err
+	}
+	es := &EncryptedStore{
+		Store:          store,
+		source:         source,
+		allowPlaintext: allowPlaintext,
+		keyring:        keyring,
+	}
+	es.rotation.Source = source.String()
+	es.rotation.CurrentKeyId = keyring.CurrentId()
+	return es, nil
+}
+
+func loadKeyring(source KeySource) (*Keyring, error) {
+	keys, err := source.LoadKeys()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load encryption keys from %v: %v", source, err)
+	}
+	keyring, err := NewKeyring(keys)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load encryption keys from %v: %v", source, err)
+	}
+	return keyring, nil
+}
+
+func (es *EncryptedStore) currentKeyring() *Keyring {
+	es.lock.RLock()
+	defer es.lock.RUnlock()
+	return es.keyring
+}
+
+// Keyring returns the keys with which es currently seals records, and
+// opens those sealed before.
+func (es *EncryptedStore) Keyring() *Keyring {
+	return es.currentKeyring()
+}
+
+// Wrap returns target encrypted with the same keys, so that copies
+// (for example, backups) of es are no less protected than es. Every
+// record of such a copy is written through it, so plaintext is never
+// allowed.
+func (es *EncryptedStore) Wrap(target Store) Store {
+	return &EncryptedStore{Store: target, source: es.source, keyring: es.currentKeyring()}
+}
+
+func (es *EncryptedStore) ReadonlyTransaction(fun func(rtxn RTxn) (interface{}, error)) Future {
+	keyring := es.currentKeyring()
+	return es.Store.ReadonlyTransaction(func(rtxn RTxn) (interface{}, error) {
+		return fun(&encryptedRTxn{RTxn: rtxn, keyring: keyring, allowPlaintext: es.allowPlaintext})
+	})
+}
+
+func (es *EncryptedStore) ReadWriteTransaction(forceCommit bool, fun func(rwtxn RWTxn) (interface{}, error)) Future {
+	// The keyring must be chosen whilst holding txns, so that a rotation
+	// which has taken txns since can only have been started before.
+	es.txns.RLock()
+	keyring := es.currentKeyring()
+	inner := es.Store.ReadWriteTransaction(forceCommit, func(rwtxn RWTxn) (interface{}, error) {
+		return fun(&encryptedRWTxn{encryptedRTxn: encryptedRTxn{RTxn: rwtxn, keyring: keyring, allowPlaintext: es.allowPlaintext}, rwtxn: rwtxn})
+	})
+	ef := &encryptedFuture{done: make(chan struct{})}
+	go func() {
+		ef.result, ef.err = inner.ResultError()
+		es.txns.RUnlock()
+		close(ef.done)
+	}()
+	return ef
+}
+
+type encryptedFuture struct {
+	done   chan struct{}
+	result interface{}
+	err    error
+}
+
+func (ef *encryptedFuture) ResultError() (interface{}, error) {
+	<-ef.done
+	return ef.result, ef.err
+}
+
+// Rotate reloads the keys and starts re-encrypting every record not
+// sealed with the (new) current key. Only one rotation may run at a
+// time.
+func (es *EncryptedStore) Rotate() error {
+	keyring, err := loadKeyring(es.source)
+	if err != nil {
+		return err
+	}
+	es.lock.Lock()
+	defer es.lock.Unlock()
+	if es.rotation.Rotating {
+		return fmt.Errorf("Key rotation already in progress")
+	}
+	// Records are being sealed with the current key right up until
+	// the new keyring takes over, so it must still be available.
+	if _, found := keyring.aeads[es.keyring.currentId]; !found {
+		return fmt.Errorf("Encryption key %v is in use but is no longer supplied by %v", es.keyring.currentId, es.source)
+	}
+	es.keyring = keyring
+	es.rotation = EncryptionStats{
+		Source:       es.source.String(),
+		CurrentKeyId: keyring.CurrentId(),
+		Rotating:     true,
+		Started:      time.Now(),
+	}
+	log.Printf("Encryption key rotation started: re-encrypting with key %v.\n", keyring.CurrentId())
+	go es.reencrypt(keyring)
+	return nil
+}
+
+func (es *EncryptedStore) reencrypt(keyring *Keyring) {
+	// Wait for every read-write txn which may be sealing with an older
+	// keyring to commit.
+	es.txns.Lock()
+	es.txns.Unlock()
+	err := es.reencryptTables(keyring)
+	es.lock.Lock()
+	defer es.lock.Unlock()
+	es.rotation.Rotating = false
+	es.rotation.Finished = time.Now()
+	if err == nil {
+		if es.rotation.Plaintext == 0 {
+			log.Printf("Encryption key rotation complete: %v records re-encrypted with key %v. Older keys are no longer needed.\n",
+				es.rotation.Reencrypted, keyring.CurrentId())
+		} else {
+			log.Printf("Encryption key rotation complete: %v records re-encrypted with key %v, but %v records are not encrypted and have been left alone.\n",
+				es.rotation.Reencrypted, keyring.CurrentId(), es.rotation.Plaintext)
+		}
+	} else {
+		es.rotation.Error = err.Error()
+		log.Println("Encryption key rotation failed:", err)
+	}
+}
+
+func (es *EncryptedStore) reencryptTables(keyring *Keyring) error {
+	currentId := keyring.CurrentId()
+	stale := func(value []byte) bool {
+		keyId, encrypted := SealedKeyId(value)
+		return (!encrypted && es.allowPlaintext) || (encrypted && keyId != currentId)
+	}
+	for _, table := range Tables {
+		result, err := es.Store.ReadonlyTransaction(func(rtxn RTxn) (interface{}, error) {
+			keys, plaintext := [][]byte{}, 0
+			err := rtxn.ForEach(table, func(key, value []byte) error {
+				if stale(value) {
+					keys = append(keys, key)
+				} else if _, encrypted := SealedKeyId(value); !encrypted {
+					log.Printf("Encryption key rotation: record %v in %x is not encrypted.\n", table, key)
+					plaintext++
+				}
+				return nil
+			})
+			return &staleRecords{keys: keys, plaintext: plaintext}, err
+		}).ResultError()
+		if err != nil {
+			return err
+		}
+		found := result.(*staleRecords)
+		es.lock.Lock()
+		es.rotation.Plaintext += found.plaintext
+		es.lock.Unlock()
+		keys := found.keys
+		for len(keys) != 0 {
+			batch := keys
+			if len(batch) > server.ReencryptBatchSize {
+				batch = batch[:server.ReencryptBatchSize]
+			}
+			keys = keys[len(batch):]
+			result, err := es.Store.ReadWriteTransaction(false, func(rwtxn RWTxn) (interface{}, error) {
+				count := 0
+				for _, key := range batch {
+					// The record may have been rewritten or deleted since
+					// we found it.
+					value, err := rwtxn.Get(table, key)
+					if err == NotFound || (err == nil && !stale(value)) {
+						continue
+					} else if err != nil {
+						return nil, err
+					}
+					if _, encrypted := SealedKeyId(value); encrypted {
+						if value, err = keyring.Open(table, key, value); err != nil {
+							return nil, err
+						}
+					}
+					if value, err = keyring.Seal(table, key, value); err != nil {
+						return nil, err
+					}
+					if err = rwtxn.Put(table, key, value); err != nil {
+						return nil, err
+					}
+					count++
+				}
+				return count, nil
+			}).ResultError()
+			if err != nil {
+				return err
+			}
+			es.lock.Lock()
+			es.rotation.Reencrypted += result.(int)
+			es.lock.Unlock()
+		}
+	}
+	return nil
+}
+
+type staleRecords struct {
+	keys      [][]byte
+	plaintext int
+}
+
+func (es *EncryptedStore) Stats() *EncryptionStats {
+	es.lock.RLock()
+	defer es.lock.RUnlock()
+	stats := es.rotation
+	return &stats
+}
+
+func (es *EncryptedStore) Status(sc *server.StatusConsumer) {
+	stats := es.Stats()
+	sc.Emit(fmt.Sprintf("Encryption: current key %v from %v", stats.CurrentKeyId, stats.Source))
+	if !stats.Started.IsZero() {
+		sc.Emit(fmt.Sprintf("- Rotation: started %v; in progress? %v; %v records re-encrypted", stats.Started, stats.Rotating, stats.Reencrypted))
+		if stats.Plaintext != 0 {
+			sc.Emit(fmt.Sprintf("- Rotation found %v records which are not encrypted", stats.Plaintext))
+		}
+		if stats.Error != "" {
+			sc.Emit(fmt.Sprintf("- Rotation Error: %v", stats.Error))
+		}
+	}
+	sc.Join()
+}
+
+type encryptedRTxn struct {
+	RTxn
+	keyring        *Keyring
+	allowPlaintext bool
+}
+
+func (t *encryptedRTxn) open(table Table, key, value []byte) ([]byte, error) {
+	if _, encrypted := SealedKeyId(value); !encrypted && t.allowPlaintext {
+		return value, nil
+	}
+	return t.keyring.Open(table, key, value)
+}
+
+func (t *encryptedRTxn) Get(table Table, key []byte) ([]byte, error) {
+	value, err := t.RTxn.Get(table, key)
+	if err != nil {
+		return nil, err
+	}
+	return t.open(table, key, value)
+}
+
+func (t *encryptedRTxn) ForEach(table Table, fun func(key, value []byte) error) error {
+	return t.ForEachFrom(table, nil, fun)
+}
+
+func (t *encryptedRTxn) ForEachFrom(table Table, from []byte, fun func(key, value []byte) error) error {
+	return t.RTxn.ForEachFrom(table, from, func(key, value []byte) error {
+		value, err := t.open(table, key, value)
+		if err != nil {
+			return err
+		}
+		return fun(key, value)
+	})
+}
+
+type encryptedRWTxn struct {
+	encryptedRTxn
+	rwtxn RWTxn
+}
+
+func (t *encryptedRWTxn) Put(table Table, key, value []byte) error {
+	value, err := t.keyring.Seal(table, key, value)
+	if err != nil {
+		return err
+	}
+	return t.rwtxn.Put(table, key, value)
+}
+
+func (t *encryptedRWTxn) Del(table Table, key []byte) error {
+	return t.rwtxn.Del(table, key)
+}
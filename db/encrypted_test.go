@@ -0,0 +1,322 @@
+package db
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeKeyFile(t *testing.T, path string, ids ...uint32) {
+	var buf bytes.Buffer
+	buf.WriteString("# test keys\n")
+	for _, id := range ids {
+		secret := bytes.Repeat([]byte{byte(id)}, encryptionKeyLen)
+		fmt.Fprintf(&buf, "%d %s\n", id, hex.EncodeToString(secret))
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func awaitRotation(t *testing.T, es *EncryptedStore) *EncryptionStats {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := es.Stats()
+		if !stats.Rotating {
+			if stats.Error != "" {
+				t.Fatal(stats.Error)
+			}
+			return stats
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Rotation did not complete")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func rawKeyId(t *testing.T, s Store, table Table, key string) (uint32, bool) {
+	value, err := get(s, table, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return SealedKeyId([]byte(value))
+}
+
+func TestEncryptedStoreRoundTrip(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "keys")
+	writeKeyFile(t, keyFile, 1)
+
+	inner := NewMemoryStore()
+	es, err := NewEncryptedStore(inner, KeyFile(keyFile), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = put(es, Vars, "a", "secret value"); err != nil {
+		t.Fatal(err)
+	}
+	checkValue(t, es, Vars, "a", "secret value")
+	if value, _ := get(inner, Vars, "a"); strings.Contains(value, "secret") {
+		t.Fatal("Value stored in plaintext")
+	}
+	if keyId, encrypted := rawKeyId(t, inner, Vars, "a"); !encrypted || keyId != 1 {
+		t.Fatalf("Expected value sealed with key 1; got %v (encrypted? %v)", keyId, encrypted)
+	}
+
+	// Moving a record to another key must be detected.
+	value, _ := get(inner, Vars, "a")
+	if err = put(inner, Vars, "b", value); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = get(es, Vars, "b"); err == nil {
+		t.Fatal("Expected moved record to fail to decrypt")
+	} else if _, ok := IsCorruption(err); !ok {
+		t.Fatalf("Expected moved record to be reported as corrupt; got %v", err)
+	}
+
+	// As must a record which isn't encrypted at all.
+	if err = put(inner, Vars, "c", "plaintext"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = get(es, Vars, "c"); err == nil {
+		t.Fatal("Expected plaintext record to be refused")
+	} else if _, ok := IsCorruption(err); !ok {
+		t.Fatalf("Expected plaintext record to be reported as corrupt; got %v", err)
+	}
+}
+
+func testKeyring(t *testing.T, ids ...uint32) *Keyring {
+	keys := make([]Key, len(ids))
+	for idx, id := range ids {
+		keys[idx] = Key{Id: id, Secret: bytes.Repeat([]byte{byte(id)}, encryptionKeyLen)}
+	}
+	kr, err := NewKeyring(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kr
+}
+
+// Damage to a sealed record, its key id included, is corruption; only
+// a key we really don't have is not.
+func TestKeyringOpenDamaged(t *testing.T) {
+	kr := testKeyring(t, 1, 2)
+	key := []byte("a")
+	sealed, err := kr.Seal(Vars, key, []byte("secret value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := kr.Open(Vars, key, sealed); err != nil || string(plain) != "secret value" {
+		t.Fatalf("Expected to open sealed record; got '%s', %v", plain, err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		damage func([]byte)
+	}{
+		{"ciphertext", func(b []byte) { b[len(b)-1] ^= 0x01 }},
+		{"nonce", func(b []byte) { b[encryptedHeader-1] ^= 0x01 }},
+		{"key id of another key", func(b []byte) { b[len(encryptedMagic)+keyIdLen-1] = 1 }},
+		{"key id of no key", func(b []byte) { b[len(encryptedMagic)] ^= 0x80 }},
+	} {
+		damaged := append([]byte{}, sealed...)
+		test.damage(damaged)
+		if _, err := kr.Open(Vars, key, damaged); err == nil {
+			t.Fatalf("Damaged %v: expected failure to open", test.name)
+		} else if _, ok := IsCorruption(err); !ok {
+			t.Fatalf("Damaged %v: expected corruption; got %v", test.name, err)
+		}
+	}
+
+	sealed, err = testKeyring(t, 3).Seal(Vars, key, []byte("secret value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kr.Open(Vars, key, sealed); err == nil {
+		t.Fatal("Expected failure to open record sealed with a key we don't have")
+	} else if _, ok := IsCorruption(err); ok {
+		t.Fatalf("Expected a missing key not to be corruption; got %v", err)
+	}
+}
+
+func TestEncryptedStoreRotation(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "keys")
+	writeKeyFile(t, keyFile, 1)
+
+	inner := NewMemoryStore()
+	// A record from before encryption was enabled.
+	if err := put(inner, Transactions, "plain", "plaintext"); err != nil {
+		t.Fatal(err)
+	}
+	es, err := NewEncryptedStore(inner, KeyFile(keyFile), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValue(t, es, Transactions, "plain", "plaintext")
+	for idx := 0; idx < 600; idx++ {
+		if err = put(es, Vars, fmt.Sprint(idx), fmt.Sprint("value", idx)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Dropping the key in use is refused.
+	writeKeyFile(t, keyFile, 2)
+	if err = es.Rotate(); err == nil {
+		t.Fatal("Expected rotation without the current key to fail")
+	}
+
+	writeKeyFile(t, keyFile, 1, 2)
+	if err = es.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if err = put(es, Vars, "new", "new value"); err != nil {
+		t.Fatal(err)
+	}
+	stats := awaitRotation(t, es)
+	if stats.CurrentKeyId != 2 || stats.Reencrypted != 601 {
+		t.Fatalf("Expected 601 records re-encrypted with key 2; got %+v", stats)
+	}
+	for _, key := range []string{"0", "599", "new"} {
+		if keyId, encrypted := rawKeyId(t, inner, Vars, key); !encrypted || keyId != 2 {
+			t.Fatalf("Expected %v sealed with key 2; got %v (encrypted? %v)", key, keyId, encrypted)
+		}
+	}
+	if keyId, encrypted := rawKeyId(t, inner, Transactions, "plain"); !encrypted || keyId != 2 {
+		t.Fatalf("Expected plaintext record sealed with key 2; got %v (encrypted? %v)", keyId, encrypted)
+	}
+
+	// Once rotation is complete, key 1 is no longer needed, and nor is
+	// plaintext.
+	writeKeyFile(t, keyFile, 2)
+	es, err = NewEncryptedStore(inner, KeyFile(keyFile), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValue(t, es, Vars, "599", "value599")
+	checkValue(t, es, Transactions, "plain", "plaintext")
+}
+
+// Unless plaintext is allowed, rotation leaves plaintext records alone
+// rather than vouching for them by sealing them.
+func TestEncryptedStoreRotationLeavesPlaintext(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "keys")
+	writeKeyFile(t, keyFile, 1)
+
+	inner := NewMemoryStore()
+	if err := put(inner, Transactions, "plain", "plaintext"); err != nil {
+		t.Fatal(err)
+	}
+	es, err := NewEncryptedStore(inner, KeyFile(keyFile), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = put(es, Vars, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	writeKeyFile(t, keyFile, 1, 2)
+	if err = es.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	stats := awaitRotation(t, es)
+	if stats.Reencrypted != 1 || stats.Plaintext != 1 {
+		t.Fatalf("Expected 1 record re-encrypted and 1 plaintext record found; got %+v", stats)
+	}
+	if _, encrypted := rawKeyId(t, inner, Transactions, "plain"); encrypted {
+		t.Fatal("Expected plaintext record to be left alone")
+	}
+}
+
+// A read-write txn which started before a rotation seals with the old
+// key. The rotation must not look for records to re-encrypt until it
+// has committed, or the record would be left sealed with the old key.
+func TestEncryptedStoreRotationWaitsForTxns(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "keys")
+	writeKeyFile(t, keyFile, 1)
+
+	inner := NewMemoryStore()
+	es, err := NewEncryptedStore(inner, KeyFile(keyFile), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started, release := make(chan struct{}), make(chan struct{})
+	written := make(chan error, 1)
+	go func() {
+		_, err := es.ReadWriteTransaction(false, func(rwtxn RWTxn) (interface{}, error) {
+			close(started)
+			<-release
+			return nil, rwtxn.Put(Vars, []byte("a"), []byte("1"))
+		}).ResultError()
+		written <- err
+	}()
+	<-started
+
+	writeKeyFile(t, keyFile, 1, 2)
+	if err = es.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if !es.Stats().Rotating {
+		t.Fatal("Rotation finished whilst a txn sealing with the old key was in flight")
+	}
+	close(release)
+	if err = <-written; err != nil {
+		t.Fatal(err)
+	}
+	awaitRotation(t, es)
+	if keyId, encrypted := rawKeyId(t, inner, Vars, "a"); !encrypted || keyId != 2 {
+		t.Fatalf("Expected record sealed with key 2; got %v (encrypted? %v)", keyId, encrypted)
+	}
+}
+
+func TestEncryptedStoreWrap(t *testing.T) {
+	es, err := NewEncryptedStore(NewMemoryStore(), KeyCommand(fmt.Sprintf("echo 7 %s", strings.Repeat("ab", encryptionKeyLen))), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := NewMemoryStore()
+	wrapped := es.Wrap(target)
+	if err = put(wrapped, Proposers, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	checkValue(t, es.Wrap(target), Proposers, "a", "1")
+	if keyId, encrypted := rawKeyId(t, target, Proposers, "a"); !encrypted || keyId != 7 {
+		t.Fatalf("Expected copy sealed with key 7; got %v (encrypted? %v)", keyId, encrypted)
+	}
+}
+
+func TestParseKeysErrors(t *testing.T) {
+	for _, input := range []string{
+		"1",
+		"x " + strings.Repeat("00", encryptionKeyLen),
+		"1 abcd",
+		"1 " + strings.Repeat("zz", encryptionKeyLen),
+	} {
+		if _, err := parseKeys(strings.NewReader(input), "test"); err == nil {
+			t.Errorf("Expected error parsing '%v'", input)
+		}
+	}
+	if _, err := NewKeyring(nil); err == nil {
+		t.Error("Expected error creating empty keyring")
+	}
+	keys, err := parseKeys(strings.NewReader("1 "+strings.Repeat("00", encryptionKeyLen)+"\n1 "+strings.Repeat("11", encryptionKeyLen)), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewKeyring(keys); err == nil {
+		t.Error("Expected error creating keyring with duplicate ids")
+	}
+}
@@ -0,0 +1,254 @@
+package db
+
+import (
+	"fmt"
+	"goshawkdb.io/server"
+	"log"
+	"sync"
+	"time"
+)
+
+// WritePolicy determines what happens to the node when a read-write
+// txn against the Store fails. Whatever the policy, the write itself
+// is retried until it succeeds, or until it has been attempted
+// server.DiskWriteMaxAttempts times: the writes we make are of txns
+// which have already committed, so they can't be abandoned without
+// leaving this node behind the rest of the cluster. Giving up on a
+// write therefore shuts the node down, whatever the policy.
+type WritePolicy uint8
+
+const (
+	// RetryWrites just retries, with exponential backoff.
+	RetryWrites WritePolicy = iota
+	// ReadOnlyOnWriteFailure retries, and whilst any write is failing,
+	// marks the node read-only and unready: client txns which would
+	// write are rejected.
+	ReadOnlyOnWriteFailure
+	// ShutdownOnWriteFailure shuts the node down on the first failure.
+	ShutdownOnWriteFailure
+)
+
+func ParseWritePolicy(str string) (WritePolicy, error) {
+	switch str {
+	case "retry":
+		return RetryWrites, nil
+	case "readonly":
+		return ReadOnlyOnWriteFailure, nil
+	case "shutdown":
+		return ShutdownOnWriteFailure, nil
+	default:
+		return RetryWrites, fmt.Errorf("Unknown disk write failure policy: '%v'. Must be one of retry, readonly or shutdown", str)
+	}
+}
+
+func (wp WritePolicy) String() string {
+	switch wp {
+	case RetryWrites:
+		return "retry"
+	case ReadOnlyOnWriteFailure:
+		return "readonly"
+	case ShutdownOnWriteFailure:
+		return "shutdown"
+	default:
+		return fmt.Sprintf("WritePolicy(%d)", uint8(wp))
+	}
+}
+
+// WriteFailures applies a WritePolicy to the failures of writes to a
+// Store, and keeps count of them. Failures are reported from the
+// go-routines which await the futures of the writes of vars,
+// proposers and acceptors, hence the lock. Var managers created by
+// tests have none: a nil *WriteFailures retries with backoff and
+// logs, but counts nothing and never makes the node read-only.
+type WriteFailures struct {
+	policy     WritePolicy
+	shutdown   func(error)
+	lock       sync.Mutex
+	failing    map[string]server.EmptyStruct
+	failures   uint64
+	recoveries uint64
+	superseded uint64
+	abandoned  uint64
+	lastErr    error
+	lastAt     time.Time
+	readOnly   bool
+	shutDown   bool
+}
+
+// WriteFailureStats is a snapshot of a WriteFailures, suitable for
+// reporting as JSON.
+type WriteFailureStats struct {
+	Policy       string
+	Failures     uint64
+	Recoveries   uint64
+	Superseded   uint64
+	Abandoned    uint64
+	Failing      int
+	ReadOnly     bool
+	ShutDown     bool
+	LastError    string
+	LastFailedAt time.Time
+}
+
+// NewWriteFailures creates a WriteFailures applying policy. shutdown
+// is invoked, at most once and from a new go-routine, if the policy is
+// ShutdownOnWriteFailure and a write fails, or if any write is given
+// up on.
+func NewWriteFailures(policy WritePolicy, shutdown func(error)) *WriteFailures {
+	return &WriteFailures{
+		policy:   policy,
+		shutdown: shutdown,
+		failing:  make(map[string]server.EmptyStruct),
+	}
+}
+
+// Failed records that the write identified by key, which is on its
+// attempt'th retry (starting at 0), has failed with err. It returns
+// how long to wait before retrying, and false if the write should not
+// be retried, either because the node is shutting down, or because
+// the write has now failed server.DiskWriteMaxAttempts times and is
+// given up on. key is used in logs, and must be passed to Succeeded
+// once the write eventually works.
+func (wf *WriteFailures) Failed(key string, err error, attempt uint) (time.Duration, bool) {
+	delay := server.DiskWriteRetryMin
+	for idx := uint(0); idx < attempt && delay < server.DiskWriteRetryMax; idx++ {
+		delay *= 2
+	}
+	if delay > server.DiskWriteRetryMax {
+		delay = server.DiskWriteRetryMax
+	}
+	giveUp := attempt+1 >= server.DiskWriteMaxAttempts
+	if wf == nil {
+		if giveUp {
+			log.Printf("%v Error when writing to disk (attempt %v; giving up): %v\n", key, attempt+1, err)
+			return 0, false
+		}
+		log.Printf("%v Error when writing to disk (attempt %v; retrying in %v): %v\n", key, attempt+1, delay, err)
+		return delay, true
+	}
+
+	wf.lock.Lock()
+	defer wf.lock.Unlock()
+	wf.failures++
+	wf.failing[key] = server.EmptyStruct{}
+	wf.lastErr = err
+	wf.lastAt = time.Now()
+
+	switch {
+	case giveUp:
+		wf.abandoned++
+		log.Printf("%v Error when writing to disk (attempt %v; giving up): %v\n", key, attempt+1, err)
+		wf.shutDownLocked(fmt.Errorf("Disk write abandoned after %v attempts: %v", attempt+1, err))
+		return 0, false
+	case wf.policy == ShutdownOnWriteFailure:
+		if !wf.shutDown {
+			log.Printf("%v Error when writing to disk: %v. Shutting down.\n", key, err)
+		}
+		wf.shutDownLocked(fmt.Errorf("Disk write failure: %v", err))
+		return 0, false
+	case wf.policy == ReadOnlyOnWriteFailure:
+		if !wf.readOnly {
+			wf.readOnly = true
+			log.Println("Disk write failing: node is now read-only.")
+		}
+	}
+	log.Printf("%v Error when writing to disk (attempt %v; retrying in %v): %v\n", key, attempt+1, delay, err)
+	return delay, true
+}
+
+func (wf *WriteFailures) shutDownLocked(err error) {
+	if wf.shutDown {
+		return
+	}
+	wf.shutDown = true
+	if wf.shutdown != nil {
+		go wf.shutdown(err)
+	}
+}
+
+// Succeeded records that the write identified by key has succeeded,
+// after having previously failed. There's no need to call it for
+// writes which have never failed. Once no write is failing, the node
+// stops being read-only.
+func (wf *WriteFailures) Succeeded(key string) {
+	if wf != nil {
+		wf.stopFailing(key, &wf.recoveries, "recovered")
+	}
+}
+
+// Superseded records that the write identified by key, having
+// previously failed, is no longer needed because a later write of the
+// same thing has been made instead. It is not a recovery: the failed
+// write never succeeded. Once no write is failing, the node stops
+// being read-only.
+func (wf *WriteFailures) Superseded(key string) {
+	if wf != nil {
+		wf.stopFailing(key, &wf.superseded, "superseded")
+	}
+}
+
+func (wf *WriteFailures) stopFailing(key string, count *uint64, how string) {
+	wf.lock.Lock()
+	defer wf.lock.Unlock()
+	if _, found := wf.failing[key]; !found {
+		return
+	}
+	delete(wf.failing, key)
+	*count++
+	if len(wf.failing) == 0 && wf.readOnly {
+		wf.readOnly = false
+		log.Printf("Disk writes %v: node is no longer read-only.\n", how)
+	}
+}
+
+// ReadOnly returns a non-empty reason if writes should currently be
+// refused.
+func (wf *WriteFailures) ReadOnly() string {
+	if wf == nil {
+		return ""
+	}
+	wf.lock.Lock()
+	defer wf.lock.Unlock()
+	switch {
+	case wf.shutDown:
+		return "Node is shutting down due to disk write failure"
+	case wf.readOnly:
+		return fmt.Sprintf("Node is read-only due to disk write failure: %v", wf.lastErr)
+	default:
+		return ""
+	}
+}
+
+func (wf *WriteFailures) Stats() *WriteFailureStats {
+	if wf == nil {
+		return &WriteFailureStats{Policy: RetryWrites.String()}
+	}
+	wf.lock.Lock()
+	defer wf.lock.Unlock()
+	stats := &WriteFailureStats{
+		Policy:       wf.policy.String(),
+		Failures:     wf.failures,
+		Recoveries:   wf.recoveries,
+		Superseded:   wf.superseded,
+		Abandoned:    wf.abandoned,
+		Failing:      len(wf.failing),
+		ReadOnly:     wf.readOnly,
+		ShutDown:     wf.shutDown,
+		LastFailedAt: wf.lastAt,
+	}
+	if wf.lastErr != nil {
+		stats.LastError = wf.lastErr.Error()
+	}
+	return stats
+}
+
+func (wf *WriteFailures) Status(sc *server.StatusConsumer) {
+	stats := wf.Stats()
+	sc.Emit(fmt.Sprintf("Disk Write Failure Policy: %v", stats.Policy))
+	sc.Emit(fmt.Sprintf("- Failures: %v; Recoveries: %v; Superseded: %v; Abandoned: %v; Currently Failing: %v", stats.Failures, stats.Recoveries, stats.Superseded, stats.Abandoned, stats.Failing))
+	sc.Emit(fmt.Sprintf("- Read Only? %v; Shut Down? %v", stats.ReadOnly, stats.ShutDown))
+	if stats.LastError != "" {
+		sc.Emit(fmt.Sprintf("- Last Error: %v (at %v)", stats.LastError, stats.LastFailedAt))
+	}
+	sc.Join()
+}
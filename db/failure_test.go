@@ -0,0 +1,150 @@
+package db
+
+import (
+	"goshawkdb.io/server"
+	"testing"
+	"time"
+)
+
+func TestWriteFailuresRetry(t *testing.T) {
+	wf := NewWriteFailures(RetryWrites, func(err error) { t.Errorf("Unexpected shutdown: %v", err) })
+	var last time.Duration
+	for attempt := uint(0); attempt < 20; attempt++ {
+		delay, retry := wf.Failed("a", errInjected, attempt)
+		if !retry {
+			t.Fatalf("Expected retry on attempt %v", attempt)
+		}
+		if delay < last {
+			t.Fatalf("Delay decreased from %v to %v on attempt %v", last, delay, attempt)
+		}
+		last = delay
+	}
+	if wf.ReadOnly() != "" {
+		t.Fatal("RetryWrites should never go read-only")
+	}
+	stats := wf.Stats()
+	if stats.Failures != 20 || stats.Failing != 1 {
+		t.Fatalf("Expected 20 failures of 1 write; got %+v", stats)
+	}
+	wf.Succeeded("a")
+	if stats = wf.Stats(); stats.Failing != 0 || stats.Recoveries != 1 {
+		t.Fatalf("Expected 1 recovery and nothing failing; got %+v", stats)
+	}
+}
+
+func TestWriteFailuresReadOnly(t *testing.T) {
+	wf := NewWriteFailures(ReadOnlyOnWriteFailure, func(err error) { t.Errorf("Unexpected shutdown: %v", err) })
+	if wf.ReadOnly() != "" {
+		t.Fatal("Read-only before any failure")
+	}
+	if _, retry := wf.Failed("a", errInjected, 0); !retry {
+		t.Fatal("Expected retry")
+	}
+	if _, retry := wf.Failed("b", errInjected, 0); !retry {
+		t.Fatal("Expected retry")
+	}
+	if wf.ReadOnly() == "" {
+		t.Fatal("Expected read-only after failure")
+	}
+	wf.Succeeded("a")
+	if wf.ReadOnly() == "" {
+		t.Fatal("Expected read-only whilst a write is still failing")
+	}
+	wf.Succeeded("b")
+	if reason := wf.ReadOnly(); reason != "" {
+		t.Fatalf("Expected writable once all writes recovered; got '%v'", reason)
+	}
+}
+
+func TestWriteFailuresSuperseded(t *testing.T) {
+	wf := NewWriteFailures(ReadOnlyOnWriteFailure, func(err error) { t.Errorf("Unexpected shutdown: %v", err) })
+	if _, retry := wf.Failed("a", errInjected, 0); !retry {
+		t.Fatal("Expected retry")
+	}
+	wf.Superseded("a")
+	if reason := wf.ReadOnly(); reason != "" {
+		t.Fatalf("Expected writable once the failing write was superseded; got '%v'", reason)
+	}
+	if stats := wf.Stats(); stats.Superseded != 1 || stats.Recoveries != 0 || stats.Failing != 0 {
+		t.Fatalf("Expected 1 superseded write and no recoveries; got %+v", stats)
+	}
+	// Superseding a write which never failed counts nothing.
+	wf.Superseded("b")
+	if stats := wf.Stats(); stats.Superseded != 1 {
+		t.Fatalf("Expected 1 superseded write; got %+v", stats)
+	}
+}
+
+func TestWriteFailuresShutdown(t *testing.T) {
+	shutdown := make(chan error, 2)
+	wf := NewWriteFailures(ShutdownOnWriteFailure, func(err error) { shutdown <- err })
+	for idx := 0; idx < 2; idx++ {
+		if _, retry := wf.Failed("a", errInjected, 0); retry {
+			t.Fatal("Expected no retry")
+		}
+	}
+	select {
+	case err := <-shutdown:
+		if err == nil {
+			t.Fatal("Expected shutdown error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown not invoked")
+	}
+	select {
+	case <-shutdown:
+		t.Fatal("Shutdown invoked twice")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if stats := wf.Stats(); !stats.ShutDown || wf.ReadOnly() == "" {
+		t.Fatalf("Expected shut down and refusing writes; got %+v", stats)
+	}
+}
+
+func TestWriteFailuresGiveUp(t *testing.T) {
+	shutdown := make(chan error, 1)
+	wf := NewWriteFailures(RetryWrites, func(err error) { shutdown <- err })
+	last := uint(server.DiskWriteMaxAttempts - 1)
+	if _, retry := wf.Failed("a", errInjected, last-1); !retry {
+		t.Fatal("Expected retry before the last attempt")
+	}
+	if _, retry := wf.Failed("a", errInjected, last); retry {
+		t.Fatal("Expected the last attempt not to be retried")
+	}
+	select {
+	case err := <-shutdown:
+		if err == nil {
+			t.Fatal("Expected shutdown error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown not invoked when giving up")
+	}
+	if stats := wf.Stats(); stats.Abandoned != 1 || !stats.ShutDown || wf.ReadOnly() == "" {
+		t.Fatalf("Expected 1 abandoned write and shut down; got %+v", stats)
+	}
+}
+
+func TestWriteFailuresNil(t *testing.T) {
+	var wf *WriteFailures
+	if _, retry := wf.Failed("a", errInjected, 0); !retry {
+		t.Fatal("Expected retry")
+	}
+	if _, retry := wf.Failed("a", errInjected, server.DiskWriteMaxAttempts-1); retry {
+		t.Fatal("Expected the last attempt not to be retried")
+	}
+	wf.Succeeded("a")
+	if wf.ReadOnly() != "" {
+		t.Fatal("Nil WriteFailures should never be read-only")
+	}
+}
+
+func TestParseWritePolicy(t *testing.T) {
+	for _, policy := range []WritePolicy{RetryWrites, ReadOnlyOnWriteFailure, ShutdownOnWriteFailure} {
+		if parsed, err := ParseWritePolicy(policy.String()); err != nil || parsed != policy {
+			t.Fatalf("Round trip of %v gave %v (err: %v)", policy, parsed, err)
+		}
+	}
+	if _, err := ParseWritePolicy("bogus"); err == nil {
+		t.Fatal("Expected error parsing bogus policy")
+	}
+}
@@ -0,0 +1,245 @@
+package db
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Crashed is returned by every txn submitted to a FaultyStore after
+// it has crashed.
+var Crashed = errors.New("Store has crashed")
+
+// FaultyStore wraps a Store and injects faults into it, for testing
+// how the rest of the server copes with a misbehaving disk. It can:
+//
+// 1. fail read-write txns, without applying them;
+//
+// 2. delay, or hold indefinitely, the futures of read-write txns;
+//
+// 3. crash. When AsyncFlush is on, committed read-write txns are not
+// durable until Flush is called. Crash discards every such txn from
+// the wrapped Store, and fails every txn thereafter. The wrapped Store
+// is then left as a restarted node would find its disk.
+type FaultyStore struct {
+	Store
+	lock       sync.Mutex
+	failCount  int
+	failErr    error
+	delay      time.Duration
+	gate       chan struct{}
+	asyncFlush bool
+	unflushed  [][]faultyUndo
+	crashed    bool
+}
+
+type faultyUndo struct {
+	table Table
+	key   []byte
+	value []byte
+	found bool
+}
+
+func NewFaultyStore(store Store) *FaultyStore {
+	return &FaultyStore{Store: store}
+}
+
+// FailWrites causes the next count read-write txns to fail with err,
+// which must not be nil. If count is negative, every read-write txn
+// fails until FailWrites is called again.
+func (fs *FaultyStore) FailWrites(count int, err error) {
+	if err == nil {
+		panic("FailWrites requires an error")
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.failCount = count
+	fs.failErr = err
+}
+
+// DelayWrites causes the future of each subsequent read-write txn to
+// complete no sooner than delay after the txn was submitted.
+func (fs *FaultyStore) DelayWrites(delay time.Duration) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.delay = delay
+}
+
+// HoldWrites stops the futures of subsequent read-write txns from
+// completing until ReleaseWrites is called. The txns themselves are
+// still applied.
+func (fs *FaultyStore) HoldWrites() {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.gate == nil {
+		fs.gate = make(chan struct{})
+	}
+}
+
+func (fs *FaultyStore) ReleaseWrites() {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.gate != nil {
+		close(fs.gate)
+		fs.gate = nil
+	}
+}
+
+// Flush makes every committed read-write txn durable.
+func (fs *FaultyStore) Flush() {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.unflushed = nil
+}
+
+// Unflushed returns the number of committed read-write txns which
+// would be lost by a crash.
+func (fs *FaultyStore) Unflushed() int {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return len(fs.unflushed)
+}
+
+// Crash discards every read-write txn which has not been flushed, in
+// reverse order, and fails every txn from then on.
+func (fs *FaultyStore) Crash() error {
+	fs.lock.Lock()
+	fs.crashed = true
+	unflushed := fs.unflushed
+	fs.unflushed = nil
+	fs.lock.Unlock()
+
+	_, err := fs.Store.ReadWriteTransaction(true, func(rwtxn RWTxn) (interface{}, error) {
+		for idx := len(unflushed) - 1; idx >= 0; idx-- {
+			undos := unflushed[idx]
+			for idy := len(undos) - 1; idy >= 0; idy-- {
+				undo := undos[idy]
+				if undo.found {
+					if err := rwtxn.Put(undo.table, undo.key, undo.value); err != nil {
+						return nil, err
+					}
+				} else if err := rwtxn.Del(undo.table, undo.key); err != nil && err != NotFound {
+					return nil, err
+				}
+			}
+		}
+		return nil, nil
+	}).ResultError()
+	return err
+}
+
+func (fs *FaultyStore) SetAsyncFlush(async bool) error {
+	fs.lock.Lock()
+	fs.asyncFlush = async
+	if !async {
+		fs.unflushed = nil
+	}
+	fs.lock.Unlock()
+	return fs.Store.SetAsyncFlush(async)
+}
+
+func (fs *FaultyStore) ReadonlyTransaction(fun func(rtxn RTxn) (interface{}, error)) Future {
+	fs.lock.Lock()
+	crashed := fs.crashed
+	fs.lock.Unlock()
+	if crashed {
+		return &faultyFuture{err: Crashed}
+	}
+	return fs.Store.ReadonlyTransaction(fun)
+}
+
+func (fs *FaultyStore) ReadWriteTransaction(forceCommit bool, fun func(rwtxn RWTxn) (interface{}, error)) Future {
+	fs.lock.Lock()
+	ff := &faultyFuture{gate: fs.gate}
+	if fs.delay > 0 {
+		ff.ready = time.Now().Add(fs.delay)
+	}
+	switch {
+	case fs.crashed:
+		ff.err = Crashed
+	case fs.failCount != 0:
+		if fs.failCount > 0 {
+			fs.failCount--
+		}
+		ff.err = fs.failErr
+	}
+	fs.lock.Unlock()
+	if ff.err != nil {
+		return ff
+	}
+
+	// The wrapped Store may run fun synchronously, so we must not hold
+	// the lock here.
+	ff.Future = fs.Store.ReadWriteTransaction(forceCommit, func(rwtxn RWTxn) (interface{}, error) {
+		recorder := &recordingRWTxn{RWTxn: rwtxn}
+		result, err := fun(recorder)
+		if err != nil {
+			return result, err
+		}
+		fs.lock.Lock()
+		defer fs.lock.Unlock()
+		if fs.crashed {
+			return nil, Crashed
+		}
+		if fs.asyncFlush && len(recorder.undo) != 0 {
+			fs.unflushed = append(fs.unflushed, recorder.undo)
+		}
+		return result, nil
+	})
+	return ff
+}
+
+type faultyFuture struct {
+	Future
+	err   error
+	ready time.Time
+	gate  chan struct{}
+}
+
+func (ff *faultyFuture) ResultError() (interface{}, error) {
+	if ff.gate != nil {
+		<-ff.gate
+	}
+	if delay := ff.ready.Sub(time.Now()); delay > 0 {
+		time.Sleep(delay)
+	}
+	if ff.Future == nil {
+		return nil, ff.err
+	}
+	return ff.Future.ResultError()
+}
+
+// recordingRWTxn records the value of a key before each modification,
+// so that the txn can be undone.
+type recordingRWTxn struct {
+	RWTxn
+	undo []faultyUndo
+}
+
+func (t *recordingRWTxn) Put(table Table, key, value []byte) error {
+	if err := t.record(table, key); err != nil {
+		return err
+	}
+	return t.RWTxn.Put(table, key, value)
+}
+
+func (t *recordingRWTxn) Del(table Table, key []byte) error {
+	if err := t.record(table, key); err != nil {
+		return err
+	}
+	return t.RWTxn.Del(table, key)
+}
+
+func (t *recordingRWTxn) record(table Table, key []byte) error {
+	value, err := t.RWTxn.Get(table, key)
+	if err != nil && err != NotFound {
+		return err
+	}
+	t.undo = append(t.undo, faultyUndo{
+		table: table,
+		key:   append([]byte(nil), key...),
+		value: value,
+		found: err == nil,
+	})
+	return nil
+}
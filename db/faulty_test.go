@@ -0,0 +1,229 @@
+package db
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+var errInjected = errors.New("Injected failure")
+
+func put(s Store, table Table, key, value string) error {
+	_, err := s.ReadWriteTransaction(false, func(rwtxn RWTxn) (interface{}, error) {
+		return nil, rwtxn.Put(table, []byte(key), []byte(value))
+	}).ResultError()
+	return err
+}
+
+func del(s Store, table Table, key string) error {
+	_, err := s.ReadWriteTransaction(false, func(rwtxn RWTxn) (interface{}, error) {
+		return nil, rwtxn.Del(table, []byte(key))
+	}).ResultError()
+	return err
+}
+
+func get(s Store, table Table, key string) (string, error) {
+	result, err := s.ReadonlyTransaction(func(rtxn RTxn) (interface{}, error) {
+		return rtxn.Get(table, []byte(key))
+	}).ResultError()
+	if err != nil {
+		return "", err
+	}
+	return string(result.([]byte)), nil
+}
+
+func checkValue(t *testing.T, s Store, table Table, key, expected string) {
+	if value, err := get(s, table, key); err != nil {
+		t.Errorf("Unable to read %v from %v: %v", key, table, err)
+	} else if value != expected {
+		t.Errorf("Expected %v to be '%v' in %v; found '%v'", key, expected, table, value)
+	}
+}
+
+func checkMissing(t *testing.T, s Store, table Table, key string) {
+	if value, err := get(s, table, key); err != NotFound {
+		t.Errorf("Expected %v to be missing from %v; found '%v' (err: %v)", key, table, value, err)
+	}
+}
+
+func TestFaultyStoreFailWrites(t *testing.T) {
+	inner := NewMemoryStore()
+	fs := NewFaultyStore(inner)
+	fs.FailWrites(2, errInjected)
+
+	for idx := 0; idx < 2; idx++ {
+		if err := put(fs, Vars, "a", "1"); err != errInjected {
+			t.Fatalf("Expected write %v to fail with injected error; got %v", idx, err)
+		}
+	}
+	checkMissing(t, fs, Vars, "a")
+
+	if err := put(fs, Vars, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	checkValue(t, fs, Vars, "a", "1")
+
+	fs.FailWrites(-1, errInjected)
+	for idx := 0; idx < 5; idx++ {
+		if err := put(fs, Vars, "a", "2"); err != errInjected {
+			t.Fatalf("Expected write %v to fail with injected error; got %v", idx, err)
+		}
+	}
+	checkValue(t, fs, Vars, "a", "1")
+}
+
+func TestFaultyStoreHoldWrites(t *testing.T) {
+	fs := NewFaultyStore(NewMemoryStore())
+	fs.HoldWrites()
+
+	done := make(chan error, 1)
+	future := fs.ReadWriteTransaction(false, func(rwtxn RWTxn) (interface{}, error) {
+		return nil, rwtxn.Put(Proposers, []byte("a"), []byte("1"))
+	})
+	go func() {
+		_, err := future.ResultError()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("Future completed whilst writes held (err: %v)", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	// The txn itself is not held up.
+	checkValue(t, fs, Proposers, "a", "1")
+
+	fs.ReleaseWrites()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Future did not complete after writes released")
+	}
+}
+
+func TestFaultyStoreDelayWrites(t *testing.T) {
+	fs := NewFaultyStore(NewMemoryStore())
+	delay := 30 * time.Millisecond
+	fs.DelayWrites(delay)
+
+	start := time.Now()
+	if err := put(fs, BallotOutcomes, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Now().Sub(start); elapsed < delay {
+		t.Fatalf("Expected write to take at least %v; took %v", delay, elapsed)
+	}
+
+	fs.DelayWrites(0)
+	fs.FailWrites(1, errInjected)
+	fs.DelayWrites(delay)
+	start = time.Now()
+	if err := put(fs, BallotOutcomes, "a", "2"); err != errInjected {
+		t.Fatalf("Expected write to fail with injected error; got %v", err)
+	}
+	if elapsed := time.Now().Sub(start); elapsed < delay {
+		t.Fatalf("Expected failure to take at least %v; took %v", delay, elapsed)
+	}
+}
+
+func TestFaultyStoreCrashAsyncFlush(t *testing.T) {
+	inner := NewMemoryStore()
+	fs := NewFaultyStore(inner)
+	if err := put(fs, Vars, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetAsyncFlush(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := put(fs, Vars, "b", "1"); err != nil {
+		t.Fatal(err)
+	}
+	fs.Flush()
+
+	// None of these are flushed.
+	if err := put(fs, Vars, "a", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := put(fs, Vars, "a", "3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := del(fs, Vars, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := put(fs, Transactions, "c", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if n := fs.Unflushed(); n != 4 {
+		t.Fatalf("Expected 4 unflushed txns; found %v", n)
+	}
+	checkValue(t, fs, Vars, "a", "3")
+	checkMissing(t, fs, Vars, "b")
+
+	if err := fs.Crash(); err != nil {
+		t.Fatal(err)
+	}
+	if err := put(fs, Vars, "a", "4"); err != Crashed {
+		t.Fatalf("Expected write after crash to fail; got %v", err)
+	}
+	if _, err := get(fs, Vars, "a"); err != Crashed {
+		t.Fatalf("Expected read after crash to fail; got %v", err)
+	}
+
+	// Restart over what's left.
+	checkValue(t, inner, Vars, "a", "1")
+	checkValue(t, inner, Vars, "b", "1")
+	checkMissing(t, inner, Transactions, "c")
+}
+
+func TestFaultyStoreCrashSyncFlush(t *testing.T) {
+	inner := NewMemoryStore()
+	fs := NewFaultyStore(inner)
+	if err := put(fs, Vars, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetAsyncFlush(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := put(fs, Vars, "a", "2"); err != nil {
+		t.Fatal(err)
+	}
+	// Turning AsyncFlush off flushes everything.
+	if err := fs.SetAsyncFlush(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := put(fs, Vars, "b", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if n := fs.Unflushed(); n != 0 {
+		t.Fatalf("Expected no unflushed txns; found %v", n)
+	}
+	if err := fs.Crash(); err != nil {
+		t.Fatal(err)
+	}
+	checkValue(t, inner, Vars, "a", "2")
+	checkValue(t, inner, Vars, "b", "1")
+}
+
+func TestFaultyStoreAbortedTxnNotRecorded(t *testing.T) {
+	inner := NewMemoryStore()
+	fs := NewFaultyStore(inner)
+	if err := fs.SetAsyncFlush(true); err != nil {
+		t.Fatal(err)
+	}
+	_, err := fs.ReadWriteTransaction(false, func(rwtxn RWTxn) (interface{}, error) {
+		if err := rwtxn.Put(Vars, []byte("a"), []byte("1")); err != nil {
+			return nil, err
+		}
+		return nil, errInjected
+	}).ResultError()
+	if err != errInjected {
+		t.Fatalf("Expected txn to fail with injected error; got %v", err)
+	}
+	if n := fs.Unflushed(); n != 0 {
+		t.Fatalf("Expected no unflushed txns; found %v", n)
+	}
+	checkMissing(t, fs, Vars, "a")
+}
@@ -0,0 +1,133 @@
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+const (
+	RMIdFile      = "rmid"
+	BootCountFile = "bootcount"
+	LockFile      = "lock"
+)
+
+// An identity file (rmid or bootcount) holds a big-endian uint32
+// followed by the big-endian CRC32 (IEEE) of those 4 bytes. Files
+// written before the checksum was added hold just the 4 bytes, and are
+// still accepted.
+const (
+	legacyIdentityLen = 4
+	identityLen       = 8
+)
+
+// ReadIdentityFile reads the value held in the identity file at
+// path. If the file does not exist, the error satisfies
+// os.IsNotExist. Any other failure, including a bad checksum, is
+// reported as corruption: the file must not be silently regenerated.
+func ReadIdentityFile(path string) (uint32, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	switch len(b) {
+	case legacyIdentityLen:
+		return binary.BigEndian.Uint32(b), nil
+	case identityLen:
+		value, sum := b[:4], binary.BigEndian.Uint32(b[4:])
+		if crc32.ChecksumIEEE(value) != sum {
+			return 0, fmt.Errorf("Identity file %v is corrupt: checksum mismatch. Restore it from a backup, or remove the data directory to start afresh as a new node", path)
+		}
+		return binary.BigEndian.Uint32(value), nil
+	default:
+		return 0, fmt.Errorf("Identity file %v is corrupt: expected %v bytes but found %v. Restore it from a backup, or remove the data directory to start afresh as a new node", path, identityLen, len(b))
+	}
+}
+
+// WriteIdentityFile atomically replaces the identity file at path
+// with one holding value: the new contents are written and synced to
+// a temporary file which is then renamed over path, and the directory
+// is synced so that the rename is durable.
+func WriteIdentityFile(path string, value uint32, perm os.FileMode) error {
+	b := make([]byte, identityLen)
+	binary.BigEndian.PutUint32(b, value)
+	binary.BigEndian.PutUint32(b[4:], crc32.ChecksumIEEE(b[:4]))
+
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if errClose := tmp.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// DirLock is an exclusive lock on a data directory, held by this
+// process until Unlock is called or the process exits.
+type DirLock struct {
+	file *os.File
+}
+
+// LockDir takes an exclusive lock on dir, failing immediately if
+// another process already holds it. The pid of the holder is written
+// into the lock file to help identify it.
+func LockDir(dir string) (*DirLock, error) {
+	path := filepath.Join(dir, LockFile)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		holder, _ := ioutil.ReadAll(file)
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("Data directory %v is in use by another process (pid %s)", dir, holder)
+		}
+		return nil, fmt.Errorf("Unable to lock data directory %v: %v", dir, err)
+	}
+	if err = file.Truncate(0); err == nil {
+		_, err = file.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &DirLock{file: file}, nil
+}
+
+func (dl *DirLock) Unlock() {
+	// Closing the file releases the lock. The lock file itself is left
+	// in place: removing it would race with another process locking it.
+	dl.file.Close()
+}
@@ -0,0 +1,97 @@
+package db
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "identity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestIdentityFileRoundTrip(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, BootCountFile)
+
+	if _, err := ReadIdentityFile(path); !os.IsNotExist(err) {
+		t.Fatalf("Expected not exist error; got %v", err)
+	}
+	for _, value := range []uint32{1, 2, 0xdeadbeef} {
+		if err := WriteIdentityFile(path, value, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if read, err := ReadIdentityFile(path); err != nil || read != value {
+			t.Fatalf("Expected %v; got %v (err: %v)", value, read, err)
+		}
+	}
+	if entries, err := ioutil.ReadDir(dir); err != nil || len(entries) != 1 {
+		t.Fatalf("Expected only the identity file in %v; found %v (err: %v)", dir, len(entries), err)
+	}
+}
+
+func TestIdentityFileLegacy(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, RMIdFile)
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, 42)
+	if err := ioutil.WriteFile(path, b, 0400); err != nil {
+		t.Fatal(err)
+	}
+	if read, err := ReadIdentityFile(path); err != nil || read != 42 {
+		t.Fatalf("Expected 42; got %v (err: %v)", read, err)
+	}
+}
+
+func TestIdentityFileCorrupt(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, RMIdFile)
+	if err := WriteIdentityFile(path, 42, 0600); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if err = ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ReadIdentityFile(path); err == nil || !strings.Contains(err.Error(), "corrupt") {
+		t.Fatalf("Expected corruption error; got %v", err)
+	}
+	if err = ioutil.WriteFile(path, b[:6], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ReadIdentityFile(path); err == nil || !strings.Contains(err.Error(), "corrupt") {
+		t.Fatalf("Expected corruption error; got %v", err)
+	}
+}
+
+func TestLockDir(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	lock, err := LockDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LockDir(dir); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("Expected second lock to fail; got %v", err)
+	}
+	lock.Unlock()
+	lock, err = LockDir(dir)
+	if err != nil {
+		t.Fatalf("Expected lock to succeed once released; got %v", err)
+	}
+	lock.Unlock()
+}
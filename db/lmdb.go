@@ -0,0 +1,372 @@
+package db
+
+import (
+	"flag"
+	"fmt"
+	mdb "github.com/msackman/gomdb"
+	mdbs "github.com/msackman/gomdb/server"
+	"goshawkdb.io/server"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	DB.Vars = &mdbs.DBISettings{Flags: mdb.CREATE}
+	DB.Proposers = &mdbs.DBISettings{Flags: mdb.CREATE}
+	DB.BallotOutcomes = &mdbs.DBISettings{Flags: mdb.CREATE}
+	DB.Transactions = &mdbs.DBISettings{Flags: mdb.CREATE}
+	DB.TransactionRefs = &mdbs.DBISettings{Flags: mdb.CREATE}
+}
+
+// LMDBConfig holds the settings with which an LMDB environment is
+// opened.
+type LMDBConfig struct {
+	// MapSize is the initial size of the map in bytes. LMDB never
+	// shrinks a map, so an existing environment may open larger.
+	MapSize uint64
+	// MaxMapSize is the size up to which the map is grown, online,
+	// once more than GrowAt of it is in use. If it's no bigger than
+	// MapSize, the map is never grown.
+	MaxMapSize uint64
+	GrowAt     float64
+	Flags      uint
+	Mode       os.FileMode
+	Readers    int
+	// BatchInterval is how long read-write txns are batched up for
+	// before being committed together.
+	BatchInterval time.Duration
+}
+
+// DefaultLMDBConfig returns the settings for opening an environment
+// for occasional use by a tool rather than by a running server.
+func DefaultLMDBConfig() *LMDBConfig {
+	return &LMDBConfig{
+		MapSize:       server.OneTB,
+		GrowAt:        server.DefaultMapGrowAt,
+		Mode:          0600,
+		Readers:       1,
+		BatchInterval: time.Millisecond,
+	}
+}
+
+// RegisterFlags adds flags to fs for each of the settings, with the
+// current settings as defaults.
+func (c *LMDBConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.Uint64Var(&c.MapSize, "mapsize", c.MapSize, "Initial size of the database map in `bytes`")
+	fs.Uint64Var(&c.MaxMapSize, "maxmapsize", c.MaxMapSize, "Size in `bytes` up to which the database map is grown online (0 to never grow)")
+	fs.Float64Var(&c.GrowAt, "mapgrowat", c.GrowAt, "`Fraction` of the database map in use at which the map is grown")
+	fs.Var((*lmdbFlags)(&c.Flags), "lmdbflags", "Comma separated LMDB environment `flags`: any of "+strings.Join(lmdbFlagNames(), ", "))
+	fs.Var((*fileMode)(&c.Mode), "lmdbmode", "Octal `mode` of the database files")
+	fs.IntVar(&c.Readers, "lmdbreaders", c.Readers, "Number of concurrent database readers")
+	fs.DurationVar(&c.BatchInterval, "lmdbbatch", c.BatchInterval, "Interval over which database writes are batched")
+}
+
+func (c *LMDBConfig) Validate() error {
+	switch {
+	case c.MapSize == 0:
+		return fmt.Errorf("Supplied map size is illegal (%v). Must be > 0", c.MapSize)
+	case c.MaxMapSize != 0 && c.MaxMapSize < c.MapSize:
+		return fmt.Errorf("Supplied maximum map size (%v) is illegal. Must be 0 or >= map size (%v)", c.MaxMapSize, c.MapSize)
+	case !(0 < c.GrowAt && c.GrowAt <= 1):
+		return fmt.Errorf("Supplied map growth threshold is illegal (%v). Must be > 0 and <= 1", c.GrowAt)
+	case c.Mode&0600 != 0600 || c.Mode&^os.ModePerm != 0:
+		return fmt.Errorf("Supplied database file mode is illegal (%v). Must be a permission which is at least readable and writable by the owner", c.Mode)
+	case c.Readers < 1:
+		return fmt.Errorf("Supplied number of database readers is illegal (%v). Must be > 0", c.Readers)
+	case c.BatchInterval <= 0:
+		return fmt.Errorf("Supplied database batch interval is illegal (%v). Must be > 0", c.BatchInterval)
+	default:
+		return nil
+	}
+}
+
+var lmdbFlagValues = map[string]uint{
+	"writemap":   mdb.WRITEMAP,
+	"mapasync":   mdb.MAPASYNC,
+	"nosync":     mdb.NOSYNC,
+	"nometasync": mdb.NOMETASYNC,
+	"notls":      mdb.NOTLS,
+}
+
+func lmdbFlagNames() []string {
+	names := make([]string, 0, len(lmdbFlagValues))
+	for name := range lmdbFlagValues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type lmdbFlags uint
+
+func (f *lmdbFlags) String() string {
+	names := []string{}
+	for _, name := range lmdbFlagNames() {
+		if uint(*f)&lmdbFlagValues[name] != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+func (f *lmdbFlags) Set(str string) error {
+	flags := uint(0)
+	for _, name := range strings.Split(str, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		} else if value, found := lmdbFlagValues[strings.ToLower(name)]; found {
+			flags |= value
+		} else {
+			return fmt.Errorf("Unknown LMDB flag: '%v'", name)
+		}
+	}
+	*f = lmdbFlags(flags)
+	return nil
+}
+
+type fileMode os.FileMode
+
+func (m *fileMode) String() string {
+	return fmt.Sprintf("%#o", uint32(*m))
+}
+
+func (m *fileMode) Set(str string) error {
+	mode, err := strconv.ParseUint(str, 8, 32)
+	if err != nil {
+		return err
+	}
+	*m = fileMode(mode)
+	return nil
+}
+
+// LMDBStore is a Store held in an LMDB environment in a directory.
+//
+// LMDB only allows the map to be resized whilst this process has no
+// txn open, so every txn holds txns for reading from when it's
+// submitted until its future completes, and MaybeGrowMap holds it for
+// writing. A txn function must therefore not wait on another txn of
+// the same store: were a resize to be waiting, neither could proceed.
+// A long running txn, such as a backup's, holds growth off instead
+// (see HoldGrowth), as otherwise a resize waiting for it would hold
+// up every new txn until it finished.
+type LMDBStore struct {
+	*mdbs.MDBServer
+	dbs        *Databases
+	config     LMDBConfig
+	txns       sync.RWMutex
+	growth     sync.Mutex
+	growthHeld int
+}
+
+// NewLMDBStore opens the LMDB environment in dir, using DB for the
+// DBIs. Only one LMDBStore using DB may be open at a time.
+func NewLMDBStore(dir string, config *LMDBConfig) (*LMDBStore, error) {
+	return newLMDBStore(dir, config, DB)
+}
+
+func newLMDBStore(dir string, config *LMDBConfig, dbs *Databases) (*LMDBStore, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	disk, err := mdbs.NewMDBServer(dir, config.Flags, config.Mode, config.MapSize, config.Readers, config.BatchInterval, dbs)
+	if err != nil {
+		return nil, err
+	}
+	return &LMDBStore{MDBServer: disk, dbs: dbs, config: *config}, nil
+}
+
+func (dbs *Databases) dbi(table Table) *mdbs.DBISettings {
+	switch table {
+	case Vars:
+		return dbs.Vars
+	case Proposers:
+		return dbs.Proposers
+	case BallotOutcomes:
+		return dbs.BallotOutcomes
+	case Transactions:
+		return dbs.Transactions
+	case TransactionRefs:
+		return dbs.TransactionRefs
+	default:
+		panic("Unknown table: " + table.String())
+	}
+}
+
+func (s *LMDBStore) ReadonlyTransaction(fun func(rtxn RTxn) (interface{}, error)) Future {
+	s.txns.RLock()
+	return s.released(s.MDBServer.ReadonlyTransaction(func(rtxn *mdbs.RTxn) (interface{}, error) {
+		return fun(&lmdbRTxn{rtxn: rtxn, dbs: s.dbs})
+	}))
+}
+
+func (s *LMDBStore) ReadWriteTransaction(forceCommit bool, fun func(rwtxn RWTxn) (interface{}, error)) Future {
+	s.txns.RLock()
+	return s.released(s.MDBServer.ReadWriteTransaction(forceCommit, func(rwtxn *mdbs.RWTxn) (interface{}, error) {
+		return fun(&lmdbRWTxn{lmdbRTxn: lmdbRTxn{rtxn: rwtxn, dbs: s.dbs}, rwtxn: rwtxn})
+	}))
+}
+
+// released returns a future which completes once inner has, and the
+// txn's hold on txns has been released. The hold is released whether
+// or not anyone waits for the result.
+func (s *LMDBStore) released(inner Future) Future {
+	lf := &lmdbFuture{done: make(chan struct{})}
+	go func() {
+		lf.result, lf.err = inner.ResultError()
+		s.txns.RUnlock()
+		close(lf.done)
+	}()
+	return lf
+}
+
+type lmdbFuture struct {
+	done   chan struct{}
+	result interface{}
+	err    error
+}
+
+func (lf *lmdbFuture) ResultError() (interface{}, error) {
+	<-lf.done
+	return lf.result, lf.err
+}
+
+func (s *LMDBStore) SetAsyncFlush(async bool) error {
+	_, err := s.MDBServer.WithEnv(func(env *mdb.Env) (interface{}, error) {
+		return nil, env.SetFlags(mdb.MAPASYNC, async)
+	}).ResultError()
+	return err
+}
+
+// MapUsage returns the number of bytes of the map in use, and the
+// size of the map.
+func (s *LMDBStore) MapUsage() (uint64, uint64, error) {
+	result, err := s.MDBServer.WithEnv(func(env *mdb.Env) (interface{}, error) {
+		info, err := env.Info()
+		if err != nil {
+			return nil, err
+		}
+		stat, err := env.Stat()
+		if err != nil {
+			return nil, err
+		}
+		return [2]uint64{uint64(info.LastPNO+1) * uint64(stat.PSize), uint64(info.MapSize)}, nil
+	}).ResultError()
+	if err != nil {
+		return 0, 0, err
+	}
+	usage := result.([2]uint64)
+	return usage[0], usage[1], nil
+}
+
+// HoldGrowth stops the map being grown until the func returned is
+// called. If the map is being grown, it waits for that to finish. A
+// map which fills meanwhile is not grown, but the SpaceMonitor will
+// refuse client writes long before it is full.
+func (s *LMDBStore) HoldGrowth() func() {
+	s.growth.Lock()
+	s.growthHeld++
+	s.growth.Unlock()
+	return func() {
+		s.growth.Lock()
+		s.growthHeld--
+		s.growth.Unlock()
+	}
+}
+
+// MaybeGrowMap doubles the size of the map, up to MaxMapSize, if more
+// than GrowAt of it is in use, and growth is not held off. The map is
+// resized only once every txn in flight has finished, and new txns
+// wait until it has been.
+func (s *LMDBStore) MaybeGrowMap() error {
+	s.growth.Lock()
+	defer s.growth.Unlock()
+	if s.growthHeld != 0 {
+		return nil
+	}
+	used, size, err := s.MapUsage()
+	if err != nil || size >= s.config.MaxMapSize || float64(used) < s.config.GrowAt*float64(size) {
+		return err
+	}
+	s.txns.Lock()
+	defer s.txns.Unlock()
+	newSize := 2 * size
+	if newSize > s.config.MaxMapSize {
+		newSize = s.config.MaxMapSize
+	}
+	_, err = s.MDBServer.WithEnv(func(env *mdb.Env) (interface{}, error) {
+		return nil, env.SetMapSize(newSize)
+	}).ResultError()
+	if err == nil {
+		log.Printf("Grew database map from %v to %v bytes (%v bytes in use).\n", size, newSize, used)
+	}
+	return err
+}
+
+// mdbsReader is satisfied by both *mdbs.RTxn and *mdbs.RWTxn.
+type mdbsReader interface {
+	Get(dbi *mdbs.DBISettings, key []byte) ([]byte, error)
+	WithCursor(dbi *mdbs.DBISettings, fun func(cursor *mdb.Cursor) (interface{}, error)) (interface{}, error)
+}
+
+type lmdbRTxn struct {
+	rtxn mdbsReader
+	dbs  *Databases
+}
+
+func (t *lmdbRTxn) Get(table Table, key []byte) ([]byte, error) {
+	bites, err := t.rtxn.Get(t.dbs.dbi(table), key)
+	return bites, translateError(err)
+}
+
+func (t *lmdbRTxn) ForEach(table Table, fun func(key, value []byte) error) error {
+	return t.ForEachFrom(table, nil, fun)
+}
+
+func (t *lmdbRTxn) ForEachFrom(table Table, from []byte, fun func(key, value []byte) error) error {
+	_, err := t.rtxn.WithCursor(t.dbs.dbi(table), func(cursor *mdb.Cursor) (interface{}, error) {
+		// cursor.Get returns a copy of the data.
+		var key, value []byte
+		var err error
+		if len(from) == 0 {
+			key, value, err = cursor.Get(nil, nil, mdb.FIRST)
+		} else {
+			key, value, err = cursor.Get(from, nil, mdb.SET_RANGE)
+		}
+		for ; err == nil; key, value, err = cursor.Get(nil, nil, mdb.NEXT) {
+			if err = fun(key, value); err != nil {
+				return nil, err
+			}
+		}
+		if err == mdb.NotFound {
+			// fine, we just fell off the end as expected.
+			return nil, nil
+		}
+		return nil, err
+	})
+	return err
+}
+
+type lmdbRWTxn struct {
+	lmdbRTxn
+	rwtxn *mdbs.RWTxn
+}
+
+func (t *lmdbRWTxn) Put(table Table, key, value []byte) error {
+	return t.rwtxn.Put(t.dbs.dbi(table), key, value, 0)
+}
+
+func (t *lmdbRWTxn) Del(table Table, key []byte) error {
+	return translateError(t.rwtxn.Del(t.dbs.dbi(table), key, nil))
+}
+
+func translateError(err error) error {
+	if err == mdb.NotFound {
+		return NotFound
+	}
+	return err
+}
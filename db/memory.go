@@ -0,0 +1,164 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// MemoryStore is a Store held entirely in memory. Nothing survives
+// Shutdown. It is intended for tests and simulations which should not
+// touch disk.
+//
+// Txns are run synchronously by the go-routine which submits them, so
+// the returned Future is always complete. As with LMDB, read-only txns
+// work against a snapshot and do not block writers, and read-write
+// txns are run one at a time. A read-write txn copies each table the
+// first time it modifies it, and the copies are only published if the
+// txn function returns a nil error.
+type MemoryStore struct {
+	writeLock sync.Mutex
+	lock      sync.RWMutex
+	tables    *memoryTables
+}
+
+type memoryTables [tableCount]map[string][]byte
+
+func NewMemoryStore() *MemoryStore {
+	tables := new(memoryTables)
+	for idx := range tables {
+		tables[idx] = make(map[string][]byte)
+	}
+	return &MemoryStore{tables: tables}
+}
+
+func (ms *MemoryStore) snapshot() *memoryTables {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	return ms.tables
+}
+
+func (ms *MemoryStore) ReadonlyTransaction(fun func(rtxn RTxn) (interface{}, error)) Future {
+	tables := ms.snapshot()
+	if tables == nil {
+		return &memoryFuture{err: fmt.Errorf("Store is shut down")}
+	}
+	result, err := fun(&memoryRTxn{tables: tables})
+	return &memoryFuture{result: result, err: err}
+}
+
+func (ms *MemoryStore) ReadWriteTransaction(forceCommit bool, fun func(rwtxn RWTxn) (interface{}, error)) Future {
+	ms.writeLock.Lock()
+	defer ms.writeLock.Unlock()
+	tables := ms.snapshot()
+	if tables == nil {
+		return &memoryFuture{err: fmt.Errorf("Store is shut down")}
+	}
+	tablesCopy := *tables
+	rwtxn := &memoryRWTxn{memoryRTxn: memoryRTxn{tables: &tablesCopy}}
+	result, err := fun(rwtxn)
+	if err != nil {
+		return &memoryFuture{err: err}
+	}
+	ms.lock.Lock()
+	if ms.tables != nil {
+		ms.tables = rwtxn.tables
+	}
+	ms.lock.Unlock()
+	return &memoryFuture{result: result}
+}
+
+// SetAsyncFlush has no effect: there is nothing to flush.
+func (ms *MemoryStore) SetAsyncFlush(async bool) error {
+	return nil
+}
+
+func (ms *MemoryStore) Shutdown() {
+	ms.lock.Lock()
+	ms.tables = nil
+	ms.lock.Unlock()
+}
+
+// Len returns the number of keys in table.
+func (ms *MemoryStore) Len(table Table) int {
+	if tables := ms.snapshot(); tables != nil {
+		return len(tables[table])
+	}
+	return 0
+}
+
+type memoryFuture struct {
+	result interface{}
+	err    error
+}
+
+func (mf *memoryFuture) ResultError() (interface{}, error) {
+	return mf.result, mf.err
+}
+
+type memoryRTxn struct {
+	tables *memoryTables
+}
+
+func (t *memoryRTxn) Get(table Table, key []byte) ([]byte, error) {
+	if value, found := t.tables[table][string(key)]; found {
+		return append([]byte(nil), value...), nil
+	}
+	return nil, NotFound
+}
+
+func (t *memoryRTxn) ForEach(table Table, fun func(key, value []byte) error) error {
+	return t.ForEachFrom(table, nil, fun)
+}
+
+func (t *memoryRTxn) ForEachFrom(table Table, from []byte, fun func(key, value []byte) error) error {
+	contents := t.tables[table]
+	keys := make([]string, 0, len(contents))
+	for key := range contents {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	keys = keys[sort.SearchStrings(keys, string(from)):]
+	for _, key := range keys {
+		// fun may have deleted key if we're within a read-write txn.
+		value, found := contents[key]
+		if !found {
+			continue
+		}
+		if err := fun([]byte(key), append([]byte(nil), value...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type memoryRWTxn struct {
+	memoryRTxn
+	copied [tableCount]bool
+}
+
+func (t *memoryRWTxn) Put(table Table, key, value []byte) error {
+	t.copyTable(table)[string(key)] = append([]byte(nil), value...)
+	return nil
+}
+
+func (t *memoryRWTxn) Del(table Table, key []byte) error {
+	if _, found := t.tables[table][string(key)]; !found {
+		return NotFound
+	}
+	delete(t.copyTable(table), string(key))
+	return nil
+}
+
+func (t *memoryRWTxn) copyTable(table Table) map[string][]byte {
+	if !t.copied[table] {
+		orig := t.tables[table]
+		contents := make(map[string][]byte, len(orig))
+		for key, value := range orig {
+			contents[key] = value
+		}
+		t.tables[table] = contents
+		t.copied[table] = true
+	}
+	return t.tables[table]
+}
@@ -0,0 +1,171 @@
+package db
+
+import (
+	"fmt"
+	"goshawkdb.io/server"
+	"log"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// mapUser is implemented by Stores which have a fixed size map, such
+// as LMDB's, which can fill up independently of the disk.
+type mapUser interface {
+	MapUsage() (used, size uint64, err error)
+	MaybeGrowMap() error
+}
+
+// SpaceUsage is a snapshot of the space available to a Store,
+// suitable for reporting as JSON.
+type SpaceUsage struct {
+	DiskFree   uint64
+	DiskTotal  uint64
+	MinFree    uint64
+	MapUsed    uint64
+	MapSize    uint64
+	MaxMapUsed float64
+	CheckedAt  time.Time
+	Refusal    string
+}
+
+// SpaceMonitor periodically checks the free space on the filesystem
+// holding a Store's directory, and how full the Store's map is (if it
+// has one), growing the map if the Store allows. Once either crosses
+// its threshold, Refusal returns a reason: txns which would grow the
+// Store should be refused, and the node should report itself unready. The checks run in the monitor's own
+// go-routine, whilst Refusal is asked of every client txn by the
+// connection manager, so the latest usage is kept under a lock. A
+// connection manager may be created without a monitor, as by tests:
+// a nil *SpaceMonitor never refuses and reports no usage.
+type SpaceMonitor struct {
+	dir        string
+	disk       Store
+	minFree    uint64
+	maxMapUsed float64
+	terminate  chan struct{}
+	lock       sync.Mutex
+	usage      SpaceUsage
+}
+
+// NewSpaceMonitor starts monitoring the space available to disk,
+// which is held in dir. Writes are refused once fewer than minFree
+// bytes are free on the filesystem, or more than maxMapUsed (a
+// fraction between 0 and 1) of the Store's map is in use.
+func NewSpaceMonitor(dir string, disk Store, minFree uint64, maxMapUsed float64, interval time.Duration) *SpaceMonitor {
+	sm := &SpaceMonitor{
+		dir:        dir,
+		disk:       disk,
+		minFree:    minFree,
+		maxMapUsed: maxMapUsed,
+		terminate:  make(chan struct{}),
+	}
+	sm.usage.MinFree = minFree
+	sm.usage.MaxMapUsed = maxMapUsed
+	if err := sm.Check(); err != nil {
+		log.Println("Unable to check disk space:", err)
+	}
+	go sm.checkPeriodically(interval)
+	return sm
+}
+
+func (sm *SpaceMonitor) checkPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sm.terminate:
+			return
+		case <-ticker.C:
+			if err := sm.Check(); err != nil {
+				log.Println("Unable to check disk space:", err)
+			}
+		}
+	}
+}
+
+func (sm *SpaceMonitor) Shutdown() {
+	if sm != nil {
+		close(sm.terminate)
+	}
+}
+
+// Check measures the space available now, and updates Refusal
+// accordingly. If the space can't be measured, the previous
+// measurement stands.
+func (sm *SpaceMonitor) Check() error {
+	usage := SpaceUsage{
+		MinFree:    sm.minFree,
+		MaxMapUsed: sm.maxMapUsed,
+		CheckedAt:  time.Now(),
+	}
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(sm.dir, &stat); err != nil {
+		return err
+	}
+	usage.DiskFree = uint64(stat.Bavail) * uint64(stat.Bsize)
+	usage.DiskTotal = uint64(stat.Blocks) * uint64(stat.Bsize)
+	if mu, ok := sm.disk.(mapUser); ok {
+		if err := mu.MaybeGrowMap(); err != nil {
+			log.Println("Unable to grow database map:", err)
+		}
+		used, size, err := mu.MapUsage()
+		if err != nil {
+			return err
+		}
+		usage.MapUsed, usage.MapSize = used, size
+	}
+
+	switch {
+	case usage.DiskFree < sm.minFree:
+		usage.Refusal = fmt.Sprintf("Insufficient disk space: %v bytes free in %v; at least %v required", usage.DiskFree, sm.dir, sm.minFree)
+	case usage.MapSize != 0 && float64(usage.MapUsed) > sm.maxMapUsed*float64(usage.MapSize):
+		usage.Refusal = fmt.Sprintf("Insufficient database space: %v of %v bytes of the map in use; at most %.0f%% permitted", usage.MapUsed, usage.MapSize, sm.maxMapUsed*100)
+	}
+
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	if usage.Refusal != sm.usage.Refusal {
+		if usage.Refusal == "" {
+			log.Println("Sufficient space available again: accepting client writes.")
+		} else {
+			log.Printf("%v: refusing client writes.\n", usage.Refusal)
+		}
+	}
+	sm.usage = usage
+	return nil
+}
+
+// Refusal returns a non-empty reason if txns which would grow the
+// Store should currently be refused.
+func (sm *SpaceMonitor) Refusal() string {
+	if sm == nil {
+		return ""
+	}
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	return sm.usage.Refusal
+}
+
+func (sm *SpaceMonitor) Usage() *SpaceUsage {
+	if sm == nil {
+		return nil
+	}
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	usage := sm.usage
+	return &usage
+}
+
+func (sm *SpaceMonitor) Status(sc *server.StatusConsumer) {
+	if usage := sm.Usage(); usage != nil {
+		sc.Emit(fmt.Sprintf("Disk Space: %v of %v bytes free (minimum %v)", usage.DiskFree, usage.DiskTotal, usage.MinFree))
+		if usage.MapSize != 0 {
+			sc.Emit(fmt.Sprintf("- Map: %v of %v bytes used (maximum %.0f%%)", usage.MapUsed, usage.MapSize, usage.MaxMapUsed*100))
+		}
+		if usage.Refusal != "" {
+			sc.Emit(fmt.Sprintf("- Refusing Writes: %v", usage.Refusal))
+		}
+	}
+	sc.Join()
+}
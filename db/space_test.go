@@ -0,0 +1,74 @@
+package db
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fixedMapStore struct {
+	*MemoryStore
+	used, size uint64
+}
+
+func (s *fixedMapStore) MapUsage() (uint64, uint64, error) {
+	return s.used, s.size, nil
+}
+
+func (s *fixedMapStore) MaybeGrowMap() error {
+	return nil
+}
+
+func TestSpaceMonitorDiskFree(t *testing.T) {
+	sm := NewSpaceMonitor(os.TempDir(), NewMemoryStore(), 0, 1, time.Hour)
+	defer sm.Shutdown()
+	if reason := sm.Refusal(); reason != "" {
+		t.Fatalf("Expected no refusal; got '%v'", reason)
+	}
+	usage := sm.Usage()
+	if usage.DiskTotal == 0 || usage.DiskFree > usage.DiskTotal {
+		t.Fatalf("Implausible usage: %+v", usage)
+	}
+
+	sm.minFree = usage.DiskTotal + 1
+	if err := sm.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if reason := sm.Refusal(); !strings.Contains(reason, "disk space") {
+		t.Fatalf("Expected refusal for disk space; got '%v'", reason)
+	}
+}
+
+func TestSpaceMonitorMapUsage(t *testing.T) {
+	disk := &fixedMapStore{MemoryStore: NewMemoryStore(), used: 50, size: 100}
+	sm := NewSpaceMonitor(os.TempDir(), disk, 0, 0.9, time.Hour)
+	defer sm.Shutdown()
+	if reason := sm.Refusal(); reason != "" {
+		t.Fatalf("Expected no refusal; got '%v'", reason)
+	}
+
+	disk.used = 95
+	if err := sm.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if reason := sm.Refusal(); !strings.Contains(reason, "database space") {
+		t.Fatalf("Expected refusal for map usage; got '%v'", reason)
+	}
+
+	disk.used = 10
+	if err := sm.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if reason := sm.Refusal(); reason != "" {
+		t.Fatalf("Expected refusal to clear; got '%v'", reason)
+	}
+}
+
+func TestSpaceMonitorNil(t *testing.T) {
+	var sm *SpaceMonitor
+	if sm.Refusal() != "" || sm.Usage() != nil {
+		t.Fatal("Nil SpaceMonitor should never refuse")
+	}
+	sm.Shutdown()
+}
@@ -0,0 +1,104 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Table identifies one of the collections held by a Store. Keys and
+// values are opaque to the Store.
+type Table uint8
+
+const (
+	// Vars maps a VarUUId to its serialized msgs.Var, checksummed. See
+	// WriteVarToDisk and ReadVarFromDisk.
+	Vars Table = iota
+	// Proposers maps a TxnId to the serialized state of its proposer.
+	Proposers
+	// BallotOutcomes maps a TxnId to the serialized state of its
+	// acceptor, checksummed.
+	BallotOutcomes
+	// Transactions maps a TxnId to its serialized msgs.Txn,
+	// checksummed.
+	Transactions
+	// TransactionRefs maps a TxnId to the number of references to
+	// it. See WriteTxnToDisk and DeleteTxnFromDisk.
+	TransactionRefs
+	tableCount
+)
+
+var Tables = []Table{Vars, Proposers, BallotOutcomes, Transactions, TransactionRefs}
+
+func (t Table) String() string {
+	switch t {
+	case Vars:
+		return "Vars"
+	case Proposers:
+		return "Proposers"
+	case BallotOutcomes:
+		return "BallotOutcomes"
+	case Transactions:
+		return "Transactions"
+	case TransactionRefs:
+		return "TransactionRefs"
+	default:
+		return fmt.Sprintf("Table(%d)", uint8(t))
+	}
+}
+
+func ParseTable(str string) (Table, error) {
+	for _, table := range Tables {
+		if table.String() == str {
+			return table, nil
+		}
+	}
+	return tableCount, fmt.Errorf("Unknown table: '%v'", str)
+}
+
+// NotFound is returned by RTxn.Get when the key is not present.
+var NotFound = errors.New("Not found")
+
+// Store is the storage used by the txn engine, the acceptors and the
+// proposers. Every Store must provide:
+//
+// 1. Isolation: the function passed to a txn sees a consistent view,
+// and the writes of a read-write txn are applied atomically, and only
+// if the function returns a nil error.
+//
+// 2. Ordering: read-write txns are applied in the order in which they
+// are submitted from any one go-routine.
+//
+// Txns may be run asynchronously: the result is only available
+// through the returned Future.
+type Store interface {
+	ReadonlyTransaction(fun func(rtxn RTxn) (interface{}, error)) Future
+	ReadWriteTransaction(forceCommit bool, fun func(rwtxn RWTxn) (interface{}, error)) Future
+	// SetAsyncFlush controls whether committed txns must be flushed to
+	// stable storage before their futures complete.
+	SetAsyncFlush(async bool) error
+	Shutdown()
+}
+
+type Future interface {
+	ResultError() (interface{}, error)
+}
+
+type RTxn interface {
+	// Get returns a copy of the value of key, or NotFound.
+	Get(table Table, key []byte) ([]byte, error)
+	// ForEach calls fun with every key and value in table, in key
+	// order. The key and value are copies so they may be retained. If
+	// fun returns an error, iteration stops and that error is
+	// returned.
+	ForEach(table Table, fun func(key, value []byte) error) error
+	// ForEachFrom is as ForEach, but starts at the first key which is
+	// not less than from, without visiting the keys before it.
+	ForEachFrom(table Table, from []byte, fun func(key, value []byte) error) error
+}
+
+type RWTxn interface {
+	RTxn
+	Put(table Table, key, value []byte) error
+	// Del removes key. It is an error if key is not present.
+	Del(table Table, key []byte) error
+}
@@ -0,0 +1,429 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	mdb "github.com/msackman/gomdb"
+	"os"
+	"testing"
+	"time"
+)
+
+// The behaviour every Store must provide. Each test is run against
+// each implementation by the Test*Store functions below.
+var storeTests = []struct {
+	name string
+	fun  func(t *testing.T, s Store)
+}{
+	{"PutGetDel", testStorePutGetDel},
+	{"TablesAreDistinct", testStoreTablesAreDistinct},
+	{"FailedTxnDiscarded", testStoreFailedTxnDiscarded},
+	{"ReadsOwnWrites", testStoreReadsOwnWrites},
+	{"ForEach", testStoreForEach},
+	{"ForEachFrom", testStoreForEachFrom},
+	{"ValuesAreCopies", testStoreValuesAreCopies},
+}
+
+func runStoreTests(t *testing.T, newStore func(t *testing.T) (Store, func())) {
+	for _, test := range storeTests {
+		s, cleanup := newStore(t)
+		t.Run(test.name, func(t *testing.T) { test.fun(t, s) })
+		cleanup()
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	runStoreTests(t, func(t *testing.T) (Store, func()) {
+		s := NewMemoryStore()
+		return s, s.Shutdown
+	})
+}
+
+func TestFaultyStore(t *testing.T) {
+	// With no faults injected, a FaultyStore must behave exactly as
+	// the Store it wraps, whether or not it is recording for a crash.
+	for _, async := range []bool{false, true} {
+		runStoreTests(t, func(t *testing.T) (Store, func()) {
+			s := NewFaultyStore(NewMemoryStore())
+			if err := s.SetAsyncFlush(async); err != nil {
+				t.Fatal(err)
+			}
+			return s, s.Shutdown
+		})
+	}
+}
+
+func TestLMDBStore(t *testing.T) {
+	runStoreTests(t, func(t *testing.T) (Store, func()) {
+		dir := tempDir(t)
+		s, err := newLMDBStore(dir, DefaultLMDBConfig(), newBackupDatabases(mdb.CREATE))
+		if err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+		return s, func() {
+			s.Shutdown()
+			os.RemoveAll(dir)
+		}
+	})
+}
+
+func testStorePutGetDel(t *testing.T, s Store) {
+	checkMissing(t, s, Vars, "a")
+	if err := put(s, Vars, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	checkValue(t, s, Vars, "a", "1")
+	if err := put(s, Vars, "a", "2"); err != nil {
+		t.Fatal(err)
+	}
+	checkValue(t, s, Vars, "a", "2")
+	if err := del(s, Vars, "a"); err != nil {
+		t.Fatal(err)
+	}
+	checkMissing(t, s, Vars, "a")
+	if err := del(s, Vars, "a"); err != NotFound {
+		t.Fatalf("Expected delete of missing key to give NotFound; got %v", err)
+	}
+}
+
+func testStoreTablesAreDistinct(t *testing.T, s Store) {
+	for idx, table := range Tables {
+		if err := put(s, table, "a", fmt.Sprint(idx)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := del(s, Vars, "a"); err != nil {
+		t.Fatal(err)
+	}
+	checkMissing(t, s, Vars, "a")
+	for idx, table := range Tables[1:] {
+		checkValue(t, s, table, "a", fmt.Sprint(idx+1))
+	}
+}
+
+func testStoreFailedTxnDiscarded(t *testing.T, s Store) {
+	if err := put(s, Vars, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	failure := errors.New("Txn failed")
+	_, err := s.ReadWriteTransaction(false, func(rwtxn RWTxn) (interface{}, error) {
+		if err := rwtxn.Put(Vars, []byte("a"), []byte("2")); err != nil {
+			return nil, err
+		}
+		if err := rwtxn.Put(Transactions, []byte("b"), []byte("1")); err != nil {
+			return nil, err
+		}
+		if err := rwtxn.Del(Vars, []byte("a")); err != nil {
+			return nil, err
+		}
+		return nil, failure
+	}).ResultError()
+	if err != failure {
+		t.Fatalf("Expected txn to fail with its own error; got %v", err)
+	}
+	checkValue(t, s, Vars, "a", "1")
+	checkMissing(t, s, Transactions, "b")
+}
+
+func testStoreReadsOwnWrites(t *testing.T, s Store) {
+	if err := put(s, Vars, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	result, err := s.ReadWriteTransaction(false, func(rwtxn RWTxn) (interface{}, error) {
+		if err := rwtxn.Put(Vars, []byte("b"), []byte("2")); err != nil {
+			return nil, err
+		}
+		if err := rwtxn.Del(Vars, []byte("a")); err != nil {
+			return nil, err
+		}
+		if _, err := rwtxn.Get(Vars, []byte("a")); err != NotFound {
+			return nil, fmt.Errorf("Expected deleted key to be missing; got %v", err)
+		}
+		keys := []string{}
+		err := rwtxn.ForEach(Vars, func(key, value []byte) error {
+			keys = append(keys, string(key)+"="+string(value))
+			return nil
+		})
+		return keys, err
+	}).ResultError()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := result.([]string); len(keys) != 1 || keys[0] != "b=2" {
+		t.Fatalf("Expected txn to see only its own write; saw %v", keys)
+	}
+}
+
+func testStoreForEach(t *testing.T, s Store) {
+	for _, key := range []string{"c", "a", "d", "b"} {
+		if err := put(s, Proposers, key, key+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stop := errors.New("Stop")
+	for _, test := range []struct {
+		stopAt   string
+		expected string
+		err      error
+	}{
+		{"", "a=aa b=bb c=cc d=dd ", nil},
+		{"b", "a=aa b=bb ", stop},
+	} {
+		result, err := s.ReadonlyTransaction(func(rtxn RTxn) (interface{}, error) {
+			seen := ""
+			err := rtxn.ForEach(Proposers, func(key, value []byte) error {
+				seen += fmt.Sprintf("%s=%s ", key, value)
+				if string(key) == test.stopAt {
+					return stop
+				}
+				return nil
+			})
+			return seen, err
+		}).ResultError()
+		if err != test.err {
+			t.Fatalf("Expected ForEach to return %v; got %v", test.err, err)
+		}
+		if test.err == nil && result.(string) != test.expected {
+			t.Fatalf("Expected ForEach to see '%v'; saw '%v'", test.expected, result)
+		}
+	}
+
+	// An empty table is fine.
+	if _, err := s.ReadonlyTransaction(func(rtxn RTxn) (interface{}, error) {
+		return nil, rtxn.ForEach(BallotOutcomes, func(key, value []byte) error {
+			return fmt.Errorf("Found %s in empty table", key)
+		})
+	}).ResultError(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testStoreForEachFrom(t *testing.T, s Store) {
+	for _, key := range []string{"b", "d", "f"} {
+		if err := put(s, Proposers, key, key+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, test := range []struct {
+		from     string
+		expected string
+	}{
+		{"", "b d f "},
+		{"a", "b d f "},
+		{"b", "b d f "},
+		{"c", "d f "},
+		{"f", "f "},
+		{"g", ""},
+	} {
+		result, err := s.ReadonlyTransaction(func(rtxn RTxn) (interface{}, error) {
+			seen := ""
+			err := rtxn.ForEachFrom(Proposers, []byte(test.from), func(key, value []byte) error {
+				seen += fmt.Sprintf("%s ", key)
+				return nil
+			})
+			return seen, err
+		}).ResultError()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.(string) != test.expected {
+			t.Fatalf("Expected ForEachFrom '%v' to see '%v'; saw '%v'", test.from, test.expected, result)
+		}
+	}
+}
+
+func testStoreValuesAreCopies(t *testing.T, s Store) {
+	if err := put(s, Vars, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	var retainedKey, retainedValue []byte
+	_, err := s.ReadonlyTransaction(func(rtxn RTxn) (interface{}, error) {
+		value, err := rtxn.Get(Vars, []byte("a"))
+		if err != nil {
+			return nil, err
+		}
+		value[0] = 'x'
+		return nil, rtxn.ForEach(Vars, func(key, value []byte) error {
+			retainedKey, retainedValue = key, value
+			return nil
+		})
+	}).ResultError()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := put(s, Vars, "a", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if string(retainedKey) != "a" || string(retainedValue) != "1" {
+		t.Fatalf("Expected retained key and value to be unchanged; found %s=%s", retainedKey, retainedValue)
+	}
+	checkValue(t, s, Vars, "a", "2")
+}
+
+// A read-only txn of a MemoryStore works against a snapshot, and is
+// not blocked by, nor sees, writes which commit whilst it runs.
+func TestMemoryStoreSnapshotIsolation(t *testing.T) {
+	s := NewMemoryStore()
+	if err := put(s, Vars, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	result, err := s.ReadonlyTransaction(func(rtxn RTxn) (interface{}, error) {
+		done := make(chan error, 1)
+		go func() { done <- put(s, Vars, "a", "2") }()
+		if err := <-done; err != nil {
+			return nil, err
+		}
+		return rtxn.Get(Vars, []byte("a"))
+	}).ResultError()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := string(result.([]byte)); value != "1" {
+		t.Fatalf("Expected read-only txn to see its snapshot; saw '%v'", value)
+	}
+	checkValue(t, s, Vars, "a", "2")
+	if n := s.Len(Vars); n != 1 {
+		t.Fatalf("Expected 1 var; found %v", n)
+	}
+}
+
+func TestMemoryStoreShutdown(t *testing.T) {
+	s := NewMemoryStore()
+	if err := put(s, Vars, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	s.Shutdown()
+	if err := put(s, Vars, "a", "2"); err == nil {
+		t.Fatal("Expected write after shutdown to fail")
+	}
+	if _, err := get(s, Vars, "a"); err == nil {
+		t.Fatal("Expected read after shutdown to fail")
+	}
+	if n := s.Len(Vars); n != 0 {
+		t.Fatalf("Expected nothing after shutdown; found %v", n)
+	}
+}
+
+// The map is only resized once every txn in flight has finished.
+func TestLMDBStoreGrowMapWaitsForTxns(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	config := DefaultLMDBConfig()
+	config.MapSize, config.MaxMapSize, config.GrowAt = 1<<20, 1<<22, 0.0001
+	config.Readers = 2
+	s, err := newLMDBStore(dir, config, newBackupDatabases(mdb.CREATE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+	if err := put(s, Vars, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	_, size, err := s.MapUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release := make(chan struct{})
+	reading := make(chan struct{})
+	reader := s.ReadonlyTransaction(func(rtxn RTxn) (interface{}, error) {
+		close(reading)
+		<-release
+		return rtxn.Get(Vars, []byte("a"))
+	})
+	<-reading
+	grown := make(chan error, 1)
+	go func() { grown <- s.MaybeGrowMap() }()
+	select {
+	case err := <-grown:
+		t.Fatalf("Map grown whilst a txn was open (err: %v)", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if _, err := reader.ResultError(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-grown:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Map not grown once the txn finished")
+	}
+	if _, newSize, err := s.MapUsage(); err != nil {
+		t.Fatal(err)
+	} else if newSize != 2*size {
+		t.Fatalf("Expected map to grow from %v to %v; found %v", size, 2*size, newSize)
+	}
+	checkValue(t, s, Vars, "a", "1")
+}
+
+// Whilst growth is held off, as by a backup, a resize neither waits
+// for the txns in flight nor holds up new ones.
+func TestLMDBStoreGrowthHeld(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	config := DefaultLMDBConfig()
+	config.MapSize, config.MaxMapSize, config.GrowAt = 1<<20, 1<<22, 0.0001
+	config.Readers = 2
+	s, err := newLMDBStore(dir, config, newBackupDatabases(mdb.CREATE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+	if err := put(s, Vars, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	_, size, err := s.MapUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release := s.HoldGrowth()
+	finish := make(chan struct{})
+	reading := make(chan struct{})
+	reader := s.ReadonlyTransaction(func(rtxn RTxn) (interface{}, error) {
+		close(reading)
+		<-finish
+		return rtxn.Get(Vars, []byte("a"))
+	})
+	<-reading
+	done := make(chan error, 1)
+	go func() {
+		if err := s.MaybeGrowMap(); err != nil {
+			done <- err
+			return
+		}
+		done <- put(s, Vars, "b", "2")
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Held growth blocked a txn behind the open txn")
+	}
+	if _, heldSize, err := s.MapUsage(); err != nil {
+		t.Fatal(err)
+	} else if heldSize != size {
+		t.Fatalf("Expected map not to grow whilst held; grew from %v to %v", size, heldSize)
+	}
+
+	close(finish)
+	if _, err := reader.ResultError(); err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if err := s.MaybeGrowMap(); err != nil {
+		t.Fatal(err)
+	}
+	if _, newSize, err := s.MapUsage(); err != nil {
+		t.Fatal(err)
+	} else if newSize != 2*size {
+		t.Fatalf("Expected map to grow from %v to %v once released; found %v", size, 2*size, newSize)
+	}
+}
@@ -7,16 +7,14 @@ import (
 	"goshawkdb.io/server"
 	// "fmt"
 	capn "github.com/glycerine/go-capnproto"
-	mdb "github.com/msackman/gomdb"
-	mdbs "github.com/msackman/gomdb/server"
 )
 
-func init() {
-	DB.Transactions = &mdbs.DBISettings{Flags: mdb.CREATE}
-	DB.TransactionRefs = &mdbs.DBISettings{Flags: mdb.CREATE}
+func TxnToRootBytes(txn *msgs.Txn) []byte {
+	seg, _ := copyTxnToRoot(txn)
+	return server.SegToBytes(seg)
 }
 
-func TxnToRootBytes(txn *msgs.Txn) []byte {
+func copyTxnToRoot(txn *msgs.Txn) (*capn.Segment, msgs.Txn) {
 	seg := capn.NewBuffer(nil)
 	txnCap := msgs.NewRootTxn(seg)
 	txnCap.SetId(txn.Id())
@@ -27,47 +25,43 @@ func TxnToRootBytes(txn *msgs.Txn) []byte {
 	txnCap.SetAllocations(txn.Allocations())
 	txnCap.SetFInc(txn.FInc())
 	txnCap.SetTopologyVersion(txn.TopologyVersion())
-
-	return server.SegToBytes(seg)
+	return seg, txnCap
 }
 
-func WriteTxnToDisk(rwtxn *mdbs.RWTxn, txnId *common.TxnId, txnBites []byte) error {
-	bites, err := rwtxn.Get(DB.TransactionRefs, txnId[:])
+func WriteTxnToDisk(rwtxn RWTxn, txnId *common.TxnId, txnBites []byte) error {
+	bites, err := rwtxn.Get(TransactionRefs, txnId[:])
 
 	switch err {
 	case nil:
 		count := binary.BigEndian.Uint32(bites) + 1
 		// fmt.Printf("%v +Refcount now %v\n", txnId, count)
 		binary.BigEndian.PutUint32(bites, count)
-		return rwtxn.Put(DB.TransactionRefs, txnId[:], bites, 0)
+		return rwtxn.Put(TransactionRefs, txnId[:], bites)
 
-	case mdb.NotFound:
-		if err = rwtxn.Put(DB.Transactions, txnId[:], txnBites, 0); err != nil {
+	case NotFound:
+		if err = rwtxn.Put(Transactions, txnId[:], AddChecksum(Transactions, txnId[:], txnBites)); err != nil {
 			return err
 		}
 
 		bites = []byte{0, 0, 0, 0}
 		binary.BigEndian.PutUint32(bites, 1)
 		// fmt.Printf("%v +Refcount now 1\n", txnId)
-		return rwtxn.Put(DB.TransactionRefs, txnId[:], bites, 0)
+		return rwtxn.Put(TransactionRefs, txnId[:], bites)
 
 	default:
 		return err
 	}
 }
 
-func ReadTxnFromDisk(rtxn *mdbs.RTxn, txnId *common.TxnId) (*msgs.Txn, error) {
-	bites, err := rtxn.Get(DB.Transactions, txnId[:])
+// ReadTxnFromDisk returns nil if the txn is not on disk, and a
+// *CorruptionError if it is damaged.
+func ReadTxnFromDisk(rtxn RTxn, txnId *common.TxnId) (*msgs.Txn, error) {
+	bites, err := rtxn.Get(Transactions, txnId[:])
 	switch err {
 	case nil:
-		if seg, _, err := capn.ReadFromMemoryZeroCopy(bites); err == nil {
-			txn := msgs.ReadRootTxn(seg)
-			return &txn, nil
-		} else {
-			return nil, err
-		}
+		return DecodeTxn(txnId, bites)
 
-	case mdb.NotFound:
+	case NotFound:
 		return nil, nil
 
 	default:
@@ -75,24 +69,46 @@ func ReadTxnFromDisk(rtxn *mdbs.RTxn, txnId *common.TxnId) (*msgs.Txn, error) {
 	}
 }
 
-func DeleteTxnFromDisk(rwtxn *mdbs.RWTxn, txnId *common.TxnId) error {
-	bites, err := rwtxn.Get(DB.TransactionRefs, txnId[:])
+// DecodeTxn verifies and decodes the record held under txnId in
+// Transactions.
+func DecodeTxn(txnId *common.TxnId, record []byte) (*msgs.Txn, error) {
+	bites, err := VerifyChecksum(Transactions, txnId[:], record)
+	if err != nil {
+		return nil, err
+	}
+	seg, _, err := capn.ReadFromMemoryZeroCopy(bites)
+	if err != nil {
+		return nil, &CorruptionError{Table: Transactions, Key: txnId[:], Reason: err.Error()}
+	}
+	txn := msgs.ReadRootTxn(seg)
+	return &txn, nil
+}
+
+// ReplaceTxnOnDisk overwrites the record of a txn, which must already
+// be referenced, with txnBites. Its reference count is unchanged. This
+// is used when repairing a damaged record.
+func ReplaceTxnOnDisk(rwtxn RWTxn, txnId *common.TxnId, txnBites []byte) error {
+	return rwtxn.Put(Transactions, txnId[:], AddChecksum(Transactions, txnId[:], txnBites))
+}
+
+func DeleteTxnFromDisk(rwtxn RWTxn, txnId *common.TxnId) error {
+	bites, err := rwtxn.Get(TransactionRefs, txnId[:])
 
 	switch err {
 	case nil:
 		if count := binary.BigEndian.Uint32(bites) - 1; count == 0 {
 			// fmt.Printf("%v -Refcount now 0\n", txnId)
-			if err = rwtxn.Del(DB.TransactionRefs, txnId[:], nil); err != nil {
+			if err = rwtxn.Del(TransactionRefs, txnId[:]); err != nil {
 				return err
 			}
-			return rwtxn.Del(DB.Transactions, txnId[:], nil)
+			return rwtxn.Del(Transactions, txnId[:])
 
 		} else {
 			// fmt.Printf("%v -Refcount now %v\n", txnId, count)
 			binary.BigEndian.PutUint32(bites, count)
-			return rwtxn.Put(DB.TransactionRefs, txnId[:], bites, 0)
+			return rwtxn.Put(TransactionRefs, txnId[:], bites)
 		}
-	case mdb.NotFound:
+	case NotFound:
 		return nil
 	default:
 		return err
@@ -0,0 +1,36 @@
+package db
+
+import (
+	capn "github.com/glycerine/go-capnproto"
+	msgs "goshawkdb.io/common/capnp"
+)
+
+// WriteVarToDisk stores varBites, a serialized msgs.Var, under
+// vUUId.
+func WriteVarToDisk(rwtxn RWTxn, vUUId, varBites []byte) error {
+	return rwtxn.Put(Vars, vUUId, AddChecksum(Vars, vUUId, varBites))
+}
+
+// ReadVarFromDisk returns NotFound if the var is not on disk, and a
+// *CorruptionError if it is damaged.
+func ReadVarFromDisk(rtxn RTxn, vUUId []byte) (*msgs.Var, error) {
+	record, err := rtxn.Get(Vars, vUUId)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeVar(vUUId, record)
+}
+
+// DecodeVar verifies and decodes the record held under vUUId in Vars.
+func DecodeVar(vUUId, record []byte) (*msgs.Var, error) {
+	bites, err := VerifyChecksum(Vars, vUUId, record)
+	if err != nil {
+		return nil, err
+	}
+	seg, _, err := capn.ReadFromMemoryZeroCopy(bites)
+	if err != nil {
+		return nil, &CorruptionError{Table: Vars, Key: vUUId, Reason: err.Error()}
+	}
+	varCap := msgs.ReadRootVar(seg)
+	return &varCap, nil
+}
@@ -0,0 +1,83 @@
+package export
+
+// The export format is a stream of JSON values: a single Header
+// followed by a Var for every var reachable from the root. Values are
+// base64 encoded as per encoding/json. Positions are informational
+// only: on import, new positions are chosen by the target cluster.
+
+import (
+	"encoding/hex"
+	"fmt"
+	"goshawkdb.io/common"
+	"time"
+)
+
+const (
+	FormatName    = common.ProductName + "-export"
+	FormatVersion = 1
+)
+
+type Header struct {
+	Format    string
+	Version   int
+	ClusterId string
+	Root      string
+	Created   time.Time
+}
+
+func NewHeader(clusterId string, root *common.VarUUId) *Header {
+	return &Header{
+		Format:    FormatName,
+		Version:   FormatVersion,
+		ClusterId: clusterId,
+		Root:      VarUUIdToStr(root),
+		Created:   time.Now(),
+	}
+}
+
+func (h *Header) Validate() error {
+	if h.Format != FormatName {
+		return fmt.Errorf("Not an export: format is '%s'", h.Format)
+	}
+	if h.Version != FormatVersion {
+		return fmt.Errorf("Unsupported export version %v (expected %v)", h.Version, FormatVersion)
+	}
+	if VarUUIdFromStr(h.Root) == nil {
+		return fmt.Errorf("Unable to parse export root '%s'", h.Root)
+	}
+	return nil
+}
+
+type Var struct {
+	VarUUId    string
+	WriteTxnId string
+	Positions  []int
+	Value      []byte
+	References []string
+}
+
+// Ids parses the var's own id and those of its references.
+func (v *Var) Ids() (*common.VarUUId, []*common.VarUUId, error) {
+	vUUId := VarUUIdFromStr(v.VarUUId)
+	if vUUId == nil {
+		return nil, nil, fmt.Errorf("Unable to parse var id '%s'", v.VarUUId)
+	}
+	refs := make([]*common.VarUUId, len(v.References))
+	for idx, ref := range v.References {
+		if refs[idx] = VarUUIdFromStr(ref); refs[idx] == nil {
+			return nil, nil, fmt.Errorf("Unable to parse reference '%s' of var %v", ref, vUUId)
+		}
+	}
+	return vUUId, refs, nil
+}
+
+func VarUUIdToStr(vUUId *common.VarUUId) string {
+	return hex.EncodeToString(vUUId[:])
+}
+
+func VarUUIdFromStr(str string) *common.VarUUId {
+	if b, err := hex.DecodeString(str); err == nil && len(b) == common.KeyLen {
+		return common.MakeVarUUId(b)
+	}
+	return nil
+}
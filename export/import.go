@@ -0,0 +1,145 @@
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"goshawkdb.io/common"
+	"io"
+)
+
+// Target is what an export is imported into.
+type Target interface {
+	// RootIsEmpty reports whether the root var has never been written.
+	RootIsEmpty() (bool, error)
+	// Create creates each of the vars with an empty value and no
+	// references.
+	Create(vUUIds []*common.VarUUId) error
+	// Write writes the value and references of each of the vars. Every
+	// var, and every var referenced, will have been created (or be the
+	// root).
+	Write(vars []*ImportVar) error
+}
+
+type ImportVar struct {
+	VarUUId    *common.VarUUId
+	Value      []byte
+	References []*common.VarUUId
+}
+
+const (
+	importCreated = iota + 1
+	importWritten
+)
+
+// Import streams the export read from r into target. The root of the
+// export becomes root, which must not have been written to. Every
+// other var keeps its id. The export is read batchSize vars at a time:
+// first every var of the batch, and every var they reference, which
+// has not yet been created is created empty, and then the batch is
+// written. So references to vars later in the export, including
+// cycles, are resolved without holding more than a batch of values.
+// Only the ids of vars seen so far are held, so that, once the export
+// is exhausted, vars which were referenced but never written can be
+// reported. Returns the number of vars written.
+func Import(r io.Reader, root *common.VarUUId, target Target, batchSize int) (int, error) {
+	if batchSize <= 0 {
+		return 0, fmt.Errorf("Illegal batch size: %v", batchSize)
+	}
+	decoder := json.NewDecoder(r)
+	header := &Header{}
+	if err := decoder.Decode(header); err != nil {
+		return 0, fmt.Errorf("Unable to read export header: %v", err)
+	}
+	if err := header.Validate(); err != nil {
+		return 0, err
+	}
+	oldRoot := VarUUIdFromStr(header.Root)
+
+	if empty, err := target.RootIsEmpty(); err != nil {
+		return 0, err
+	} else if !empty {
+		return 0, fmt.Errorf("Refusing to import: root var has already been written to")
+	}
+
+	state := map[common.VarUUId]int{*root: importCreated}
+	written := 0
+	for {
+		batch, err := readBatch(decoder, oldRoot, root, batchSize, written)
+		if err != nil {
+			return written, err
+		} else if len(batch) == 0 {
+			break
+		}
+
+		creates := []*common.VarUUId{}
+		for _, v := range batch {
+			for _, vUUId := range append([]*common.VarUUId{v.VarUUId}, v.References...) {
+				if _, found := state[*vUUId]; !found {
+					state[*vUUId] = importCreated
+					creates = append(creates, vUUId)
+				}
+			}
+			if state[*v.VarUUId] == importWritten {
+				return written, fmt.Errorf("Var %v appears more than once in the export", v.VarUUId)
+			}
+			state[*v.VarUUId] = importWritten
+		}
+		for len(creates) != 0 {
+			chunk := creates
+			if len(chunk) > batchSize {
+				chunk = chunk[:batchSize]
+			}
+			creates = creates[len(chunk):]
+			if err := target.Create(chunk); err != nil {
+				return written, err
+			}
+		}
+
+		if err := target.Write(batch); err != nil {
+			return written, err
+		}
+		written += len(batch)
+	}
+
+	missing := 0
+	var example common.VarUUId
+	for vUUId, s := range state {
+		if s != importWritten {
+			missing++
+			example = vUUId
+		}
+	}
+	if missing != 0 {
+		return written, fmt.Errorf("Export references %v vars which it does not contain, including %v", missing, &example)
+	}
+	return written, nil
+}
+
+// readBatch reads up to batchSize vars from decoder, replacing
+// oldRoot with root. Returns an empty batch once the export is
+// exhausted.
+func readBatch(decoder *json.Decoder, oldRoot, root *common.VarUUId, batchSize, read int) ([]*ImportVar, error) {
+	batch := make([]*ImportVar, 0, batchSize)
+	for len(batch) < batchSize {
+		v := &Var{}
+		if err := decoder.Decode(v); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Unable to read var %v of export: %v", read+len(batch), err)
+		}
+		vUUId, references, err := v.Ids()
+		if err != nil {
+			return nil, err
+		}
+		if *vUUId == *oldRoot {
+			vUUId = root
+		}
+		for idx, ref := range references {
+			if *ref == *oldRoot {
+				references[idx] = root
+			}
+		}
+		batch = append(batch, &ImportVar{VarUUId: vUUId, Value: v.Value, References: references})
+	}
+	return batch, nil
+}
@@ -0,0 +1,175 @@
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"goshawkdb.io/common"
+	"strings"
+	"testing"
+)
+
+type memoryVar struct {
+	value      []byte
+	references []*common.VarUUId
+	written    bool
+}
+
+// memoryTarget checks that Import only writes vars, and references,
+// which have been created.
+type memoryTarget struct {
+	root    *common.VarUUId
+	vars    map[common.VarUUId]*memoryVar
+	creates int
+	writes  int
+}
+
+func newMemoryTarget(root *common.VarUUId) *memoryTarget {
+	return &memoryTarget{
+		root: root,
+		vars: map[common.VarUUId]*memoryVar{*root: {}},
+	}
+}
+
+func (mt *memoryTarget) RootIsEmpty() (bool, error) {
+	return !mt.vars[*mt.root].written, nil
+}
+
+func (mt *memoryTarget) Create(vUUIds []*common.VarUUId) error {
+	mt.creates++
+	for _, vUUId := range vUUIds {
+		if _, found := mt.vars[*vUUId]; found {
+			return fmt.Errorf("Var %v created twice", vUUId)
+		}
+		mt.vars[*vUUId] = &memoryVar{}
+	}
+	return nil
+}
+
+func (mt *memoryTarget) Write(vars []*ImportVar) error {
+	mt.writes++
+	for _, v := range vars {
+		for _, vUUId := range append([]*common.VarUUId{v.VarUUId}, v.References...) {
+			if _, found := mt.vars[*vUUId]; !found {
+				return fmt.Errorf("Var %v written before it was created", vUUId)
+			}
+		}
+		mt.vars[*v.VarUUId] = &memoryVar{value: v.Value, references: v.References, written: true}
+	}
+	return nil
+}
+
+func varUUId(n byte) *common.VarUUId {
+	b := make([]byte, common.KeyLen)
+	b[0] = n
+	return common.MakeVarUUId(b)
+}
+
+func makeExport(t *testing.T, root *common.VarUUId, vars ...*Var) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	encoder := json.NewEncoder(buf)
+	if err := encoder.Encode(NewHeader("cluster", root)); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range vars {
+		if err := encoder.Encode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf
+}
+
+func exportVar(vUUId *common.VarUUId, value string, refs ...*common.VarUUId) *Var {
+	v := &Var{VarUUId: VarUUIdToStr(vUUId), Value: []byte(value)}
+	for _, ref := range refs {
+		v.References = append(v.References, VarUUIdToStr(ref))
+	}
+	return v
+}
+
+func TestImportRoundTrip(t *testing.T) {
+	oldRoot, newRoot := varUUId(1), varUUId(100)
+	a, b, c := varUUId(2), varUUId(3), varUUId(4)
+	// a and b form a cycle, and both they and c are referenced before
+	// they appear, in a different batch.
+	buf := makeExport(t, oldRoot,
+		exportVar(oldRoot, "root", a, c),
+		exportVar(c, "c", oldRoot),
+		exportVar(a, "a", b),
+		exportVar(b, "b", a, a),
+	)
+
+	target := newMemoryTarget(newRoot)
+	written, err := Import(buf, newRoot, target, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != 4 || target.writes != 2 {
+		t.Fatalf("Expected 4 vars written in 2 batches; got %v vars in %v batches", written, target.writes)
+	}
+	if _, found := target.vars[*oldRoot]; found {
+		t.Fatal("Expected old root to be replaced by the new root")
+	}
+	for vUUId, expected := range map[common.VarUUId]struct {
+		value string
+		refs  []*common.VarUUId
+	}{
+		*newRoot: {"root", []*common.VarUUId{a, c}},
+		*a:       {"a", []*common.VarUUId{b}},
+		*b:       {"b", []*common.VarUUId{a, a}},
+		*c:       {"c", []*common.VarUUId{newRoot}},
+	} {
+		v, found := target.vars[vUUId]
+		if !found || !v.written {
+			t.Fatalf("Expected %v to be written", &vUUId)
+		}
+		if string(v.value) != expected.value || len(v.references) != len(expected.refs) {
+			t.Fatalf("Var %v: expected '%s' %v; got '%s' %v", &vUUId, expected.value, expected.refs, v.value, v.references)
+		}
+		for idx, ref := range v.references {
+			if *ref != *expected.refs[idx] {
+				t.Fatalf("Var %v: expected reference %v to be %v; got %v", &vUUId, idx, expected.refs[idx], ref)
+			}
+		}
+	}
+}
+
+func TestImportRefusesWrittenRoot(t *testing.T) {
+	root := varUUId(1)
+	target := newMemoryTarget(root)
+	target.vars[*root].written = true
+	buf := makeExport(t, root, exportVar(root, "root", varUUId(2)), exportVar(varUUId(2), "a"))
+	if _, err := Import(buf, root, target, 2); err == nil || !strings.Contains(err.Error(), "already been written") {
+		t.Fatalf("Expected import into written root to fail; got %v", err)
+	}
+	if target.creates != 0 || target.writes != 0 {
+		t.Fatal("Expected nothing to be created or written")
+	}
+}
+
+func TestImportReportsMissingVars(t *testing.T) {
+	root := varUUId(1)
+	buf := makeExport(t, root, exportVar(root, "root", varUUId(2)))
+	if _, err := Import(buf, root, newMemoryTarget(root), 2); err == nil || !strings.Contains(err.Error(), "does not contain") {
+		t.Fatalf("Expected dangling reference to be reported; got %v", err)
+	}
+}
+
+func TestImportRejectsDuplicateVars(t *testing.T) {
+	root, a := varUUId(1), varUUId(2)
+	buf := makeExport(t, root, exportVar(root, "root", a), exportVar(a, "a"), exportVar(a, "a again"))
+	if _, err := Import(buf, root, newMemoryTarget(root), 2); err == nil || !strings.Contains(err.Error(), "more than once") {
+		t.Fatalf("Expected duplicate var to be rejected; got %v", err)
+	}
+}
+
+func TestImportRejectsBadHeader(t *testing.T) {
+	root := varUUId(1)
+	buf := new(bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(&Header{Format: "something else", Version: FormatVersion, Root: VarUUIdToStr(root)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Import(buf, root, newMemoryTarget(root), 2); err == nil {
+		t.Fatal("Expected import of non-export to fail")
+	}
+}
@@ -0,0 +1,561 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"goshawkdb.io/common"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type command struct {
+	help string
+	run  func(ac *adminClient, args []string) error
+}
+
+var commands = map[string]*command{
+	"topology": {
+		help: "Show the cluster topology as known by the node",
+		run:  simpleCommand("GET", "/admin/topology"),
+	},
+	"connections": {
+		help: "Show the node's connections to other nodes",
+		run:  simpleCommand("GET", "/admin/connections"),
+	},
+	"counts": {
+		help: "Show counts of active vars, proposers and acceptors",
+		run:  simpleCommand("GET", "/admin/counts"),
+	},
+	"status": {
+		help: "Show the node's full status tree",
+		run:  simpleCommand("GET", "/admin/status"),
+	},
+	"reload": {
+		help: "Reload the node's configuration file",
+		run:  simpleCommand("POST", "/admin/reload"),
+	},
+	"drain": {
+		help: "Show whether the node is draining, or with 'start', drain it and shut it down, or with 'cancel', cancel the drain",
+		run:  drain,
+	},
+	"backup": {
+		help: "Take a consistent copy of the node's store into the given directory on the node",
+		run:  backup,
+	},
+	"snapshot": {
+		help: "Pause client txns on every host in -host, back them all up into the given directory on each node, and resume",
+		run:  snapshot,
+	},
+	"gc": {
+		help: "Show the last collection of unreachable vars, or with 'run', run a collection",
+		run:  gc,
+	},
+	"antientropy": {
+		help: "Show the last comparison of vars with the other replicas, or with 'run', run a comparison",
+		run:  antiEntropy,
+	},
+	"import": {
+		help: "Load an export file, as written by goshawkdb-export, into the cluster. The node must be in maintenance mode, and the other nodes quiesced",
+		run:  importExport,
+	},
+	"maintenance": {
+		help: "Show maintenance mode, or set it with 'on' or 'off'",
+		run:  maintenance,
+	},
+	"encryption": {
+		help: "Show encryption at rest, or with 'rotate', reload the keys and re-encrypt with the newest",
+		run:  encryption,
+	},
+}
+
+func main() {
+	log.SetPrefix(common.ProductName + "-admin ")
+	log.SetFlags(0)
+
+	var host, username, password, passwordFile, caFile string
+	var timeout time.Duration
+
+	flag.StringVar(&host, "host", "", "host:port of the HTTP interface of the node to connect to (comma separated list for snapshot)")
+	flag.StringVar(&username, "user", "", "Admin account username")
+	flag.StringVar(&password, "password", "", "Admin account password")
+	flag.StringVar(&passwordFile, "passwordfile", "", "`Path` to file containing admin account password")
+	flag.StringVar(&caFile, "cacert", "", "`Path` to CA certificate with which to verify the node's TLS certificate")
+	flag.DurationVar(&timeout, "timeout", 30*time.Second, "Time after which a pause of client txns lapses, unless renewed, during a snapshot")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, found := commands[args[0]]
+	if !found {
+		log.Printf("Unknown command '%s'\n", args[0])
+		usage()
+		os.Exit(2)
+	}
+
+	if args[0] != "snapshot" && strings.Contains(host, ",") {
+		log.Fatalf("Command '%s' only accepts a single host", args[0])
+	}
+	ac, err := newAdminClient(host, username, password, passwordFile, caFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ac.timeout = timeout
+	if err = cmd.run(ac, args[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] command [args]\n\nCommands:\n", os.Args[0])
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", name, commands[name].help)
+	}
+	fmt.Fprintln(os.Stderr, "\nOptions:")
+	flag.PrintDefaults()
+}
+
+func simpleCommand(method, path string) func(*adminClient, []string) error {
+	return func(ac *adminClient, args []string) error {
+		if len(args) != 0 {
+			return fmt.Errorf("Unexpected arguments: %v", args)
+		}
+		body, err := ac.do(method, path, nil)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(os.Stdout, bytes.NewReader(body))
+		return err
+	}
+}
+
+func drain(ac *adminClient, args []string) error {
+	var body []byte
+	var err error
+	switch {
+	case len(args) == 0:
+		body, err = ac.do("GET", "/admin/drain", nil)
+	case len(args) == 1 && args[0] == "start":
+		body, err = ac.do("POST", "/admin/drain", nil)
+	case len(args) == 1 && args[0] == "cancel":
+		body, err = ac.do("POST", "/admin/drain", url.Values{"cancel": {"true"}})
+	default:
+		return fmt.Errorf("Expected 'start' or 'cancel', got: %v", args)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(body)
+	return err
+}
+
+func maintenance(ac *adminClient, args []string) error {
+	var body []byte
+	var err error
+	switch {
+	case len(args) == 0:
+		body, err = ac.do("GET", "/admin/maintenance", nil)
+	case len(args) == 1 && (args[0] == "on" || args[0] == "off"):
+		body, err = ac.do("POST", "/admin/maintenance", url.Values{"enabled": {fmt.Sprint(args[0] == "on")}})
+	default:
+		return fmt.Errorf("Expected 'on' or 'off', got: %v", args)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(body)
+	return err
+}
+
+func backup(ac *adminClient, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Expected a single directory argument, got: %v", args)
+	}
+	body, err := ac.do("POST", "/admin/backup", url.Values{"dir": {args[0]}})
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(body)
+	return err
+}
+
+// snapshot takes a backup of every node at the same point in the
+// history of the cluster: client txns are paused everywhere, and we
+// wait for every node's proposers and acceptors to finish before
+// taking any backups. The pauses are renewed for as long as the
+// snapshot takes, and the snapshot fails if any of them lapsed. Client
+// txns are always resumed, even on failure.
+func snapshot(ac *adminClient, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Expected a single directory argument, got: %v", args)
+	}
+	if ac.timeout <= 0 {
+		return fmt.Errorf("Illegal timeout: %v", ac.timeout)
+	}
+	hosts := strings.Split(ac.host, ",")
+	clients := make([]*adminClient, len(hosts))
+	for idx, host := range hosts {
+		clients[idx] = ac.withHost(host)
+	}
+
+	p := newPauses(ac.timeout)
+	infos, err := backupPaused(p, clients, args[0])
+	if errResume := p.resume(); err == nil {
+		err = errResume
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos[1:] {
+		if info.ClusterId != infos[0].ClusterId || info.TopologyDBVersion != infos[0].TopologyDBVersion {
+			return fmt.Errorf("Snapshot is inconsistent: %v has cluster %v topology %v, but %v has cluster %v topology %v",
+				infos[0].Host, infos[0].ClusterId, infos[0].TopologyDBVersion, info.Host, info.ClusterId, info.TopologyDBVersion)
+		}
+	}
+	body, err := json.MarshalIndent(infos, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Println(string(body))
+	return err
+}
+
+func backupPaused(p *pauses, clients []*adminClient, dir string) ([]*backupInfo, error) {
+	for _, c := range clients {
+		if err := p.pause(c); err != nil {
+			return nil, err
+		}
+	}
+	timeout := url.Values{"timeout": {p.timeout.String()}}
+	for _, c := range clients {
+		if _, err := c.do("POST", "/admin/quiesce", timeout); err != nil {
+			return nil, err
+		}
+	}
+
+	infos := make([]*backupInfo, len(clients))
+	for idx, c := range clients {
+		dir := path.Join(dir, strings.Replace(c.host, ":", "_", -1))
+		body, err := c.do("POST", "/admin/backup", url.Values{"dir": {dir}})
+		if err != nil {
+			return nil, err
+		}
+		info := &backupInfo{Host: c.host, Dir: dir}
+		if err = json.Unmarshal(body, info); err != nil {
+			return nil, err
+		}
+		infos[idx] = info
+	}
+	return infos, nil
+}
+
+// pauses holds client txns paused on a set of nodes. Each pause is
+// renewed at a third of its timeout, so it only lapses if we lose
+// contact with the node for most of a timeout.
+type pauses struct {
+	sync.Mutex
+	timeout time.Duration
+	clients []*adminClient
+	ids     []uint64
+	lapsed  []string
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+type pauseInfo struct {
+	Pause uint64
+}
+
+func newPauses(timeout time.Duration) *pauses {
+	return &pauses{
+		timeout: timeout,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+func (p *pauses) pause(c *adminClient) error {
+	body, err := c.do("POST", "/admin/pause", url.Values{"paused": {"true"}, "timeout": {p.timeout.String()}})
+	if err != nil {
+		return err
+	}
+	info := &pauseInfo{}
+	if err = json.Unmarshal(body, info); err != nil {
+		return err
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.clients = append(p.clients, c)
+	p.ids = append(p.ids, info.Pause)
+	if len(p.clients) == 1 {
+		go p.renew()
+	}
+	return nil
+}
+
+func (p *pauses) renew() {
+	defer close(p.stopped)
+	ticker := time.NewTicker(p.timeout / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.Lock()
+			for idx, c := range p.clients {
+				if p.ids[idx] == 0 {
+					continue
+				}
+				query := url.Values{"paused": {"true"}, "timeout": {p.timeout.String()}, "pause": {fmt.Sprint(p.ids[idx])}}
+				if _, err := c.do("POST", "/admin/pause", query); err != nil {
+					log.Printf("Unable to renew pause of client txns on %v: %v\n", c.host, err)
+					p.lapsed = append(p.lapsed, c.host)
+					p.ids[idx] = 0
+				}
+			}
+			p.Unlock()
+		}
+	}
+}
+
+// resume stops renewing the pauses and ends them. It returns an error
+// if any pause lapsed, or can't be ended, as then client txns may
+// have run during the snapshot.
+func (p *pauses) resume() error {
+	p.Lock()
+	started := len(p.clients) != 0
+	p.Unlock()
+	if started {
+		close(p.stop)
+		<-p.stopped
+	}
+	for idx, c := range p.clients {
+		if p.ids[idx] == 0 {
+			continue
+		}
+		query := url.Values{"paused": {"false"}, "pause": {fmt.Sprint(p.ids[idx])}}
+		if _, err := c.do("POST", "/admin/pause", query); err != nil {
+			log.Printf("Unable to resume client txns on %v: %v\n", c.host, err)
+			p.lapsed = append(p.lapsed, c.host)
+		}
+	}
+	if len(p.lapsed) != 0 {
+		return fmt.Errorf("Snapshot is inconsistent: client txns were not paused throughout on %v", strings.Join(p.lapsed, ", "))
+	}
+	return nil
+}
+
+func gc(ac *adminClient, args []string) error {
+	var body []byte
+	var err error
+	switch {
+	case len(args) == 0:
+		body, err = ac.do("GET", "/admin/gc", nil)
+	case len(args) == 1 && args[0] == "run":
+		body, err = ac.do("POST", "/admin/gc", nil)
+	default:
+		return fmt.Errorf("Expected nothing or 'run', got: %v", args)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(body)
+	return err
+}
+
+func antiEntropy(ac *adminClient, args []string) error {
+	var body []byte
+	var err error
+	switch {
+	case len(args) == 0:
+		body, err = ac.do("GET", "/admin/antientropy", nil)
+	case len(args) == 1 && args[0] == "run":
+		body, err = ac.do("POST", "/admin/antientropy", nil)
+	default:
+		return fmt.Errorf("Expected nothing or 'run', got: %v", args)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(body)
+	return err
+}
+
+func encryption(ac *adminClient, args []string) error {
+	var body []byte
+	var err error
+	switch {
+	case len(args) == 0:
+		body, err = ac.do("GET", "/admin/encryption", nil)
+	case len(args) == 1 && args[0] == "rotate":
+		body, err = ac.do("POST", "/admin/encryption", nil)
+	default:
+		return fmt.Errorf("Expected nothing or 'rotate', got: %v", args)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(body)
+	return err
+}
+
+func importExport(ac *adminClient, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Expected a single export file argument, got: %v", args)
+	}
+	file, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	body, err := ac.doWithBody("POST", "/admin/import", nil, file)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(body)
+	return err
+}
+
+type backupInfo struct {
+	Host              string
+	Dir               string
+	ClusterId         string
+	TopologyVersion   uint32
+	TopologyDBVersion string
+	RMId              uint32
+	BootCount         uint32
+	Created           time.Time
+	Counts            map[string]int
+}
+
+type adminClient struct {
+	client   *http.Client
+	host     string
+	username string
+	password string
+	timeout  time.Duration
+}
+
+func (ac *adminClient) withHost(host string) *adminClient {
+	c := *ac
+	c.host = host
+	return &c
+}
+
+// newAdminClient returns a client which always uses TLS: every request
+// carries the admin account's credentials, which must never be sent in
+// the clear (and the node refuses admin requests without TLS anyway).
+func newAdminClient(host, username, password, passwordFile, caFile string) (*adminClient, error) {
+	if host == "" {
+		return nil, fmt.Errorf("No host supplied (missing -host parameter)")
+	}
+	if username == "" {
+		return nil, fmt.Errorf("No admin account supplied (missing -user parameter)")
+	}
+	switch {
+	case password == "" && passwordFile == "":
+		return nil, fmt.Errorf("Password must be supplied with either -password or -passwordfile")
+	case password != "" && passwordFile != "":
+		return nil, fmt.Errorf("Both -password and -passwordfile supplied. Only one can be supplied.")
+	case passwordFile != "":
+		passwordFileBytes, err := ioutil.ReadFile(passwordFile)
+		if err != nil {
+			return nil, err
+		}
+		password = strings.TrimRight(string(passwordFileBytes), "\r\n")
+	}
+
+	tlsConfig := &tls.Config{}
+	if caFile != "" {
+		caBytes, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBytes) {
+			return nil, fmt.Errorf("Unable to parse any certificates from %v", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return &adminClient{
+		client: &http.Client{
+			Transport:     &http.Transport{TLSClientConfig: tlsConfig},
+			CheckRedirect: refuseInsecureRedirect,
+		},
+		host:     host,
+		username: username,
+		password: password,
+	}, nil
+}
+
+// do issues the request and returns the body of the response. JSON
+// responses are indented for display.
+func (ac *adminClient) do(method, path string, query url.Values) ([]byte, error) {
+	return ac.doWithBody(method, path, query, nil)
+}
+
+// refuseInsecureRedirect stops the credentials from following a
+// redirect off TLS.
+func refuseInsecureRedirect(req *http.Request, via []*http.Request) error {
+	if req.URL.Scheme != "https" {
+		return fmt.Errorf("Refusing to follow redirect to %v: admin credentials are only sent over TLS", req.URL)
+	}
+	if len(via) >= 10 {
+		return fmt.Errorf("Stopped after %v redirects", len(via))
+	}
+	return nil
+}
+
+func (ac *adminClient) doWithBody(method, path string, query url.Values, reqBody io.Reader) ([]byte, error) {
+	u := url.URL{Scheme: "https", Host: ac.host, Path: path}
+	if query != nil {
+		u.RawQuery = query.Encode()
+	}
+	req, err := http.NewRequest(method, u.String(), reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(ac.username, ac.password)
+	resp, err := ac.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%v: %s: %s", ac.host, resp.Status, bytes.TrimSpace(body))
+	}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		buf := new(bytes.Buffer)
+		if err := json.Indent(buf, body, "", "  "); err == nil {
+			body = buf.Bytes()
+		}
+	}
+	return body, nil
+}
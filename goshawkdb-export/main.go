@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"goshawkdb.io/common"
+	msgs "goshawkdb.io/common/capnp"
+	"goshawkdb.io/server"
+	"goshawkdb.io/server/db"
+	"goshawkdb.io/server/export"
+	eng "goshawkdb.io/server/txnengine"
+	"io"
+	"log"
+	"os"
+)
+
+// Export every var reachable from the root. Each node only holds the
+// vars whose positions map to it, so the data dirs of enough nodes to
+// cover every var must be supplied. Where replicas disagree, the copy
+// with the highest version of the var wins.
+func main() {
+	log.SetPrefix(common.ProductName + "-export ")
+	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
+	log.Println(server.RedactArgs(os.Args))
+
+	var outFile string
+	flag.StringVar(&outFile, "out", "", "`Path` to write the export to (default stdout)")
+	lmdbConfig := db.DefaultLMDBConfig()
+	lmdbConfig.RegisterFlags(flag.CommandLine)
+	encryption := &db.EncryptionConfig{}
+	encryption.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+	if err := lmdbConfig.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	if err := encryption.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	dirs := flag.Args()
+	if len(dirs) == 0 {
+		log.Fatal("No dirs supplied")
+	}
+
+	vars := make(map[common.VarUUId]*varValue)
+	for _, d := range dirs {
+		dir := d
+		log.Printf("...loading from %v\n", dir)
+		lmdb, err := db.NewLMDBStore(dir, lmdbConfig)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		disk, err := encryption.Wrap(lmdb)
+		if err != nil {
+			log.Println(err)
+			lmdb.Shutdown()
+			continue
+		}
+		loadVars(disk, vars)
+		lmdb.Shutdown()
+	}
+	log.Printf("Found %v unique vars", len(vars))
+
+	topologyVar, found := vars[*server.TopologyVarUUId]
+	if !found {
+		log.Fatal("Unable to find topology in supplied dirs")
+	}
+	topology, err := server.TopologyDeserialize(topologyVar.writeTxnId, nil, topologyVar.value)
+	if err != nil {
+		log.Fatal("Unable to deserialize topology: ", err)
+	}
+	if len(topologyVar.references) != 1 {
+		log.Fatal("Topology has no root")
+	}
+	root := topologyVar.references[0]
+
+	var out io.Writer = os.Stdout
+	if outFile != "" {
+		file, err := os.Create(outFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer file.Close()
+		out = file
+	}
+	buffered := bufio.NewWriter(out)
+	if err = write(buffered, topology.ClusterId, root, vars); err == nil {
+		err = buffered.Flush()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func write(out io.Writer, clusterId string, root *common.VarUUId, vars map[common.VarUUId]*varValue) error {
+	encoder := json.NewEncoder(out)
+	if err := encoder.Encode(export.NewHeader(clusterId, root)); err != nil {
+		return err
+	}
+
+	visited := map[common.VarUUId]server.EmptyStruct{*root: server.EmptyStructVal}
+	queue := []*common.VarUUId{root}
+	dangling := 0
+	for len(queue) != 0 {
+		vUUId := queue[0]
+		queue = queue[1:]
+		v, found := vars[*vUUId]
+		if !found {
+			log.Printf("Unable to find %v in supplied dirs; omitting it\n", vUUId)
+			dangling++
+			continue
+		}
+		positions := make([]int, len(*v.positions))
+		for idx, pos := range *v.positions {
+			positions[idx] = int(pos)
+		}
+		references := make([]string, len(v.references))
+		for idx, ref := range v.references {
+			references[idx] = export.VarUUIdToStr(ref)
+			if _, found := visited[*ref]; !found {
+				visited[*ref] = server.EmptyStructVal
+				queue = append(queue, ref)
+			}
+		}
+		err := encoder.Encode(&export.Var{
+			VarUUId:    export.VarUUIdToStr(vUUId),
+			WriteTxnId: hex.EncodeToString(v.writeTxnId[:]),
+			Positions:  positions,
+			Value:      v.value,
+			References: references,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("Exported %v vars (%v missing)\n", len(visited)-dangling, dangling)
+	return nil
+}
+
+type varValue struct {
+	version    uint64
+	writeTxnId *common.TxnId
+	positions  *common.Positions
+	value      []byte
+	references []*common.VarUUId
+}
+
+func loadVars(disk db.Store, vars map[common.VarUUId]*varValue) {
+	_, err := disk.ReadonlyTransaction(func(rtxn db.RTxn) (interface{}, error) {
+		return nil, rtxn.ForEach(db.Vars, func(key, data []byte) error {
+			vUUId := common.MakeVarUUId(key)
+			varCap, err := db.DecodeVar(key, data)
+			if err != nil {
+				log.Println(err)
+				return nil
+			}
+			writeTxnId := common.MakeTxnId(varCap.WriteTxnId())
+			version := eng.VectorClockFromCap(varCap.WriteTxnClock()).Clock[*vUUId]
+			if existing, found := vars[*vUUId]; found {
+				if !existing.writeTxnId.Equal(writeTxnId) && existing.version == version {
+					log.Printf("%v has divergent replicas: %v vs %v\n", vUUId, existing.writeTxnId, writeTxnId)
+				}
+				if existing.version >= version {
+					return nil
+				}
+			}
+			v, err := readValue(rtxn, vUUId, writeTxnId)
+			if err != nil {
+				log.Println(err)
+				return nil
+			}
+			pos := varCap.Positions()
+			v.version = version
+			v.positions = (*common.Positions)(&pos)
+			vars[*vUUId] = v
+			return nil
+		})
+	}).ResultError()
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func readValue(rtxn db.RTxn, vUUId *common.VarUUId, writeTxnId *common.TxnId) (*varValue, error) {
+	txn, err := db.ReadTxnFromDisk(rtxn, writeTxnId)
+	if err != nil {
+		return nil, err
+	} else if txn == nil {
+		return nil, fmt.Errorf("%v Unable to find txn %v", vUUId, writeTxnId)
+	}
+	actions := txn.Actions()
+	for idx, l := 0, actions.Len(); idx < l; idx++ {
+		action := actions.At(idx)
+		if !bytes.Equal(action.VarId(), vUUId[:]) {
+			continue
+		}
+		var (
+			value      []byte
+			references msgs.VarIdPos_List
+		)
+		switch action.Which() {
+		case msgs.ACTION_WRITE:
+			write := action.Write()
+			value, references = write.Value(), write.References()
+		case msgs.ACTION_READWRITE:
+			rw := action.Readwrite()
+			value, references = rw.Value(), rw.References()
+		case msgs.ACTION_CREATE:
+			create := action.Create()
+			value, references = create.Value(), create.References()
+		case msgs.ACTION_ROLL:
+			roll := action.Roll()
+			value, references = roll.Value(), roll.References()
+		default:
+			return nil, fmt.Errorf("%v Txn %v has unexpected action type: %v", vUUId, writeTxnId, action.Which())
+		}
+		v := &varValue{
+			writeTxnId: writeTxnId,
+			value:      append([]byte(nil), value...),
+			references: make([]*common.VarUUId, references.Len()),
+		}
+		for idx := range v.references {
+			v.references[idx] = common.MakeVarUUId(references.At(idx).Id())
+		}
+		return v, nil
+	}
+	return nil, fmt.Errorf("%v Txn %v has no action for var", vUUId, writeTxnId)
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"goshawkdb.io/common"
+	goshawk "goshawkdb.io/server"
+	"goshawkdb.io/server/db"
+	"goshawkdb.io/server/export"
+	eng "goshawkdb.io/server/txnengine"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type httpServer struct {
+	*server
+	listener   net.Listener
+	mux        *http.ServeMux
+	pauseLock  sync.Mutex
+	pauseTimer *time.Timer
+	pauseId    uint64
+	probeLock  sync.Mutex
+	probe      chan struct{}
+}
+
+func newHTTPServer(s *server) (*httpServer, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%v", s.httpPort))
+	if err != nil {
+		return nil, err
+	}
+	hs := &httpServer{
+		server:   s,
+		listener: listener,
+		mux:      http.NewServeMux(),
+	}
+	hs.mux.HandleFunc("/healthz", hs.healthz)
+	hs.mux.HandleFunc("/readyz", hs.readyz)
+	hs.mux.Handle("/debug/pprof/", hs.admin(http.HandlerFunc(pprof.Index)))
+	hs.mux.Handle("/debug/pprof/profile", hs.admin(http.HandlerFunc(pprof.Profile)))
+	hs.mux.Handle("/debug/pprof/trace", hs.admin(http.HandlerFunc(pprof.Trace)))
+	hs.mux.Handle("/debug/pprof/heap", hs.admin(pprof.Handler("heap")))
+	hs.mux.Handle("/debug/pprof/goroutine", hs.admin(pprof.Handler("goroutine")))
+	hs.mux.Handle("/admin/topology", hs.admin(http.HandlerFunc(hs.adminTopology)))
+	hs.mux.Handle("/admin/connections", hs.admin(http.HandlerFunc(hs.adminConnections)))
+	hs.mux.Handle("/admin/counts", hs.admin(http.HandlerFunc(hs.adminCounts)))
+	hs.mux.Handle("/admin/status", hs.admin(http.HandlerFunc(hs.adminStatus)))
+	hs.mux.Handle("/admin/reload", hs.admin(http.HandlerFunc(hs.adminReload)))
+	hs.mux.Handle("/admin/drain", hs.admin(http.HandlerFunc(hs.adminDrain)))
+	hs.mux.Handle("/admin/maintenance", hs.admin(http.HandlerFunc(hs.adminMaintenance)))
+	hs.mux.Handle("/admin/backup", hs.admin(http.HandlerFunc(hs.adminBackup)))
+	hs.mux.Handle("/admin/pause", hs.admin(http.HandlerFunc(hs.adminPause)))
+	hs.mux.Handle("/admin/quiesce", hs.admin(http.HandlerFunc(hs.adminQuiesce)))
+	hs.mux.Handle("/admin/import", hs.admin(http.HandlerFunc(hs.adminImport)))
+	hs.mux.Handle("/admin/gc", hs.admin(http.HandlerFunc(hs.adminGC)))
+	hs.mux.Handle("/admin/vars", hs.admin(http.HandlerFunc(hs.adminVars)))
+	hs.mux.Handle("/admin/antientropy", hs.admin(http.HandlerFunc(hs.adminAntiEntropy)))
+	hs.mux.Handle("/admin/encryption", hs.admin(http.HandlerFunc(hs.adminEncryption)))
+	hs.mux.Handle("/peer/record", hs.peer(hs.peerRecord))
+	hs.mux.Handle("/peer/digests", hs.peer(hs.peerDigests))
+	hs.mux.Handle("/peer/barrier", hs.peer(hs.peerBarrier))
+	go func() {
+		var err error
+		if s.httpCertFile == "" {
+			err = http.Serve(listener, hs.mux)
+		} else {
+			err = http.ServeTLS(listener, hs.mux, s.httpCertFile, s.httpKeyFile)
+		}
+		if err != nil {
+			log.Println("HTTP server stopped:", err)
+		}
+	}()
+	log.Printf("HTTP server listening on port %v\n", s.httpPort)
+	return hs, nil
+}
+
+func (hs *httpServer) Shutdown() {
+	if err := hs.listener.Close(); err != nil {
+		log.Println("Error when closing HTTP listener:", err)
+	}
+}
+
+// The node is live if the connection manager is still answering
+// queries. If its actor loop is wedged, so are we.
+func (hs *httpServer) healthz(w http.ResponseWriter, r *http.Request) {
+	timer := time.NewTimer(goshawk.HTTPHealthCheckTimeout)
+	defer timer.Stop()
+	select {
+	case <-hs.healthProbe():
+		fmt.Fprintln(w, "ok")
+	case <-timer.C:
+		http.Error(w, "ConnectionManager not responding", http.StatusServiceUnavailable)
+	}
+}
+
+// healthProbe returns a channel which is closed once the connection
+// manager has answered a query. Only one probe is outstanding at a
+// time: whilst the connection manager is wedged, every request waits
+// on the same probe rather than each leaving behind another blocked
+// go-routine.
+func (hs *httpServer) healthProbe() <-chan struct{} {
+	hs.probeLock.Lock()
+	defer hs.probeLock.Unlock()
+	if hs.probe == nil {
+		probe := make(chan struct{})
+		hs.probe = probe
+		go func() {
+			hs.connectionManager.Topology()
+			hs.probeLock.Lock()
+			hs.probe = nil
+			hs.probeLock.Unlock()
+			close(probe)
+		}()
+	}
+	return hs.probe
+}
+
+func (hs *httpServer) readyz(w http.ResponseWriter, r *http.Request) {
+	if ready, reason := hs.connectionManager.Readiness(); ready {
+		fmt.Fprintln(w, "ready")
+	} else {
+		http.Error(w, reason, http.StatusServiceUnavailable)
+	}
+}
+
+// admin wraps handlers that must only be available to the admin
+// account. Credentials are supplied with HTTP basic auth and checked
+// against the accounts in the current topology. They are only
+// accepted over TLS.
+func (hs *httpServer) admin(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hs.adminAccount == "" {
+			http.Error(w, "Admin interface disabled (missing -adminaccount parameter)", http.StatusForbidden)
+			return
+		}
+		if r.TLS == nil {
+			http.Error(w, "Admin interface requires TLS", http.StatusForbidden)
+			return
+		}
+		un, pw, ok := r.BasicAuth()
+		if !ok || un != hs.adminAccount {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+goshawk.AdminRealm+`"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		topology := hs.connectionManager.Topology()
+		if topology == nil {
+			http.Error(w, "No topology established", http.StatusServiceUnavailable)
+			return
+		}
+		if hash, found := topology.Accounts[un]; !found || bcrypt.CompareHashAndPassword([]byte(hash), []byte(pw)) != nil {
+			log.Printf("Admin authentication failed for '%s' from %v", un, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+goshawk.AdminRealm+`"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func (hs *httpServer) adminTopology(w http.ResponseWriter, r *http.Request) {
+	topology := hs.connectionManager.Topology()
+	if topology == nil {
+		http.Error(w, "No topology established", http.StatusServiceUnavailable)
+		return
+	}
+	allRMs := make([]string, len(topology.AllRMs))
+	for idx, rmId := range topology.AllRMs {
+		allRMs[idx] = rmId.String()
+	}
+	root := ""
+	if topology.RootVarUUId != nil {
+		root = topology.RootVarUUId.String()
+	}
+	writeJSON(w, &struct {
+		ClusterId  string
+		Version    uint32
+		Hosts      []string
+		F          uint8
+		MaxRMCount uint8
+		AsyncFlush bool
+		AllRMs     []string
+		DBVersion  string
+		Root       string
+	}{
+		ClusterId:  topology.ClusterId,
+		Version:    topology.Version,
+		Hosts:      topology.Hosts,
+		F:          topology.F,
+		MaxRMCount: topology.MaxRMCount,
+		AsyncFlush: topology.AsyncFlush,
+		AllRMs:     allRMs,
+		DBVersion:  topology.DBVersion.String(),
+		Root:       root,
+	})
+}
+
+func (hs *httpServer) adminConnections(w http.ResponseWriter, r *http.Request) {
+	if info := hs.connectionManager.ConnectionsInfo(); info == nil {
+		http.Error(w, "ConnectionManager is shut down", http.StatusServiceUnavailable)
+	} else {
+		writeJSON(w, info)
+	}
+}
+
+func (hs *httpServer) adminCounts(w http.ResponseWriter, r *http.Request) {
+	dispatchers := hs.connectionManager.Dispatchers
+	writeJSON(w, &struct {
+		ActiveVars    int
+		Proposers     int
+		Acceptors     int
+		WriteFailures *db.WriteFailureStats
+		Corruptions   *db.CorruptionStats
+		Space         *db.SpaceUsage
+	}{
+		ActiveVars:    dispatchers.VarDispatcher.ActiveVarCount(),
+		Proposers:     dispatchers.ProposerDispatcher.ProposerCount(),
+		Acceptors:     dispatchers.AcceptorDispatcher.AcceptorCount(),
+		WriteFailures: hs.writeFailures.Stats(),
+		Corruptions:   hs.corruptions.Stats(),
+		Space:         hs.spaceMonitor.Usage(),
+	})
+}
+
+func (hs *httpServer) adminStatus(w http.ResponseWriter, r *http.Request) {
+	result := make(chan string, 1)
+	hs.status(func(str string) { result <- str })
+	fmt.Fprintln(w, <-result)
+}
+
+func (hs *httpServer) adminReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Reload requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := hs.reloadConfig(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "Reloaded configuration.")
+}
+
+// GET reports whether the node is draining. POST drains the node and
+// then shuts it down, as SIGTERM does; with cancel=true it cancels a
+// drain in progress instead.
+func (hs *httpServer) adminDrain(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method != "POST":
+		fmt.Fprintf(w, "Draining: %v\n", hs.isDraining())
+	case r.FormValue("cancel") == "true":
+		if !hs.cancelDrain() {
+			http.Error(w, "Not draining", http.StatusConflict)
+			return
+		}
+		fmt.Fprintln(w, "Drain cancelled.")
+	default:
+		if !hs.startDrain() {
+			http.Error(w, "Already draining", http.StatusConflict)
+			return
+		}
+		fmt.Fprintln(w, "Draining.")
+	}
+}
+
+// GET reports whether the node is in maintenance mode. POST with
+// enabled=true|false toggles it.
+func (hs *httpServer) adminMaintenance(w http.ResponseWriter, r *http.Request) {
+	cm := hs.connectionManager
+	if r.Method == "POST" {
+		enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Unable to parse 'enabled' parameter: %v", err), http.StatusBadRequest)
+			return
+		}
+		cm.SetMaintenance(enabled)
+		fmt.Fprintf(w, "Maintenance mode set to %v.\n", enabled)
+		return
+	}
+	fmt.Fprintf(w, "Maintenance mode: %v\n", cm.InMaintenance())
+}
+
+// adminBackup takes a consistent copy of the local store into the
+// directory given by the dir parameter, which is a path on the node,
+// not on the client.
+func (hs *httpServer) adminBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Backup requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	dir := r.FormValue("dir")
+	if dir == "" {
+		http.Error(w, "Missing 'dir' parameter", http.StatusBadRequest)
+		return
+	}
+	if hs.connectionManager.Topology() == nil {
+		http.Error(w, "No topology established", http.StatusServiceUnavailable)
+		return
+	}
+	// The topology is recorded by Backup, from the txn it copies within.
+	info := &db.BackupInfo{
+		RMId:      hs.rmId,
+		BootCount: hs.bootCount,
+	}
+	log.Printf("Backing up to %v\n", dir)
+	if err := db.Backup(hs.disk, dir, info); err != nil {
+		log.Printf("Backup to %v failed: %v\n", dir, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Backup to %v complete: %v\n", dir, info.Counts)
+	writeJSON(w, info)
+}
+
+// pauseInfo identifies a pause of client txns.
+type pauseInfo struct {
+	Pause   uint64
+	Timeout string
+}
+
+// adminPause pauses (paused=true) or resumes (paused=false) client
+// txn submission. A pause lasts at most timeout (default
+// DefaultClientTxnsPauseTimeout) so that a lost admin client cannot
+// leave the node paused indefinitely. Each new pause is given an id,
+// which is returned. Passing that id as the pause parameter renews
+// the pause for another timeout (paused=true) or ends it
+// (paused=false). Either fails with 409 if the pause has lapsed or
+// been superseded by another, so the caller can tell that client txns
+// were not paused throughout.
+func (hs *httpServer) adminPause(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Pause requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	paused, err := strconv.ParseBool(r.FormValue("paused"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to parse 'paused' parameter: %v", err), http.StatusBadRequest)
+		return
+	}
+	timeout := goshawk.DefaultClientTxnsPauseTimeout
+	if str := r.FormValue("timeout"); str != "" {
+		if timeout, err = time.ParseDuration(str); err != nil || timeout <= 0 {
+			http.Error(w, fmt.Sprintf("Illegal 'timeout' parameter: %v", str), http.StatusBadRequest)
+			return
+		}
+	}
+	var pauseId uint64
+	if str := r.FormValue("pause"); str != "" {
+		if pauseId, err = strconv.ParseUint(str, 10, 64); err != nil || pauseId == 0 {
+			http.Error(w, fmt.Sprintf("Illegal 'pause' parameter: %v", str), http.StatusBadRequest)
+			return
+		}
+	}
+
+	cm := hs.connectionManager
+	hs.pauseLock.Lock()
+	defer hs.pauseLock.Unlock()
+	if pauseId != 0 && (pauseId != hs.pauseId || hs.pauseTimer == nil) {
+		http.Error(w, fmt.Sprintf("Pause %v has lapsed", pauseId), http.StatusConflict)
+		return
+	}
+	if hs.pauseTimer != nil {
+		hs.pauseTimer.Stop()
+		hs.pauseTimer = nil
+	}
+	cm.SetClientTxnsPaused(paused)
+	if paused {
+		if pauseId == 0 {
+			hs.pauseId++
+			pauseId = hs.pauseId
+		}
+		var timer *time.Timer
+		timer = time.AfterFunc(timeout, func() {
+			hs.pauseLock.Lock()
+			defer hs.pauseLock.Unlock()
+			if hs.pauseTimer == timer {
+				log.Printf("Client txns paused for longer than %v: resuming.\n", timeout)
+				hs.pauseTimer = nil
+				cm.SetClientTxnsPaused(false)
+			}
+		})
+		hs.pauseTimer = timer
+		writeJSON(w, &pauseInfo{Pause: pauseId, Timeout: timeout.String()})
+	} else {
+		fmt.Fprintln(w, "Client txns resumed.")
+	}
+}
+
+// adminQuiesce waits, up to timeout, for all proposers and acceptors
+// on this node to finish. Acceptors only finish once their 2Bs have
+// been received by every learner, and the submitter has confirmed
+// completion, so once both counts reach zero no txn is in flight
+// through this node. Used with adminPause to reach a point where no
+// txns are in flight anywhere.
+func (hs *httpServer) adminQuiesce(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Quiesce requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	timeout := goshawk.DefaultClientTxnsPauseTimeout
+	if str := r.FormValue("timeout"); str != "" {
+		var err error
+		if timeout, err = time.ParseDuration(str); err != nil || timeout <= 0 {
+			http.Error(w, fmt.Sprintf("Illegal 'timeout' parameter: %v", str), http.StatusBadRequest)
+			return
+		}
+	}
+	dispatchers := hs.connectionManager.Dispatchers
+	deadline := time.Now().Add(timeout)
+	for {
+		proposers := dispatchers.ProposerDispatcher.ProposerCount()
+		acceptors := dispatchers.AcceptorDispatcher.AcceptorCount()
+		if proposers == 0 && acceptors == 0 {
+			fmt.Fprintln(w, "Quiesced.")
+			return
+		}
+		if time.Now().After(deadline) {
+			http.Error(w, fmt.Sprintf("Timed out with %v proposers and %v acceptors outstanding", proposers, acceptors), http.StatusServiceUnavailable)
+			return
+		}
+		time.Sleep(goshawk.DrainPollInterval)
+	}
+}
+
+// adminImport streams the export in the request body into the
+// cluster. The node must be in maintenance mode throughout.
+func (hs *httpServer) adminImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Import requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	cm := hs.connectionManager
+	if !cm.InMaintenance() {
+		http.Error(w, "Import requires maintenance mode", http.StatusConflict)
+		return
+	}
+	count, err := importExport(hs.localConnection, cm.Topology(), cm.InMaintenance, r.Body)
+	if err != nil {
+		log.Printf("Import failed after %v vars: %v\n", count, err)
+		http.Error(w, fmt.Sprintf("Import failed after %v vars: %v", count, err), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "Imported %v vars.\n", count)
+}
+
+// GET returns the result of the last collection of unreachable vars.
+// POST runs a collection and returns its result.
+func (hs *httpServer) adminGC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		if result := hs.collector.LastResult(); result == nil {
+			fmt.Fprintln(w, "No collection has completed.")
+		} else {
+			writeJSON(w, result)
+		}
+		return
+	}
+	result, err := hs.collector.Collect()
+	if result == nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+	writeJSON(w, result)
+}
+
+// adminVars returns the metadata of the vars we hold, without their
+// values: of the var 'var' if given, otherwise a page of up to 'limit'
+// vars after the var 'after'.
+func (hs *httpServer) adminVars(w http.ResponseWriter, r *http.Request) {
+	page := &eng.VarMetadataPage{RMId: hs.rmId}
+	if str := r.FormValue("var"); str != "" {
+		vUUId := export.VarUUIdFromStr(str)
+		if vUUId == nil {
+			http.Error(w, fmt.Sprintf("Unable to parse 'var' parameter: %v", str), http.StatusBadRequest)
+			return
+		}
+		md, err := eng.ReadVarMetadata(hs.disk, vUUId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if md != nil {
+			page.Vars = []*eng.VarMetadata{md}
+		}
+		writeJSON(w, page)
+		return
+	}
+
+	var after *common.VarUUId
+	if str := r.FormValue("after"); str != "" {
+		if after = export.VarUUIdFromStr(str); after == nil {
+			http.Error(w, fmt.Sprintf("Unable to parse 'after' parameter: %v", str), http.StatusBadRequest)
+			return
+		}
+	}
+	limit := goshawk.VarMetadataPageSize
+	if str := r.FormValue("limit"); str != "" {
+		l, err := strconv.Atoi(str)
+		if err != nil || l <= 0 {
+			http.Error(w, fmt.Sprintf("Unable to parse 'limit' parameter: %v", str), http.StatusBadRequest)
+			return
+		} else if l < limit {
+			limit = l
+		}
+	}
+	vars, more, err := eng.ReadVarMetadataPage(hs.disk, after, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page.Vars = vars
+	if more {
+		page.Next = vars[len(vars)-1].VarUUId
+	}
+	writeJSON(w, page)
+}
+
+// GET returns the result of the last comparison of our vars with the
+// other replicas'. POST runs a comparison and returns its result.
+func (hs *httpServer) adminAntiEntropy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		if result := hs.antiEntropy.LastResult(); result == nil {
+			fmt.Fprintln(w, "No anti-entropy run has completed.")
+		} else {
+			writeJSON(w, result)
+		}
+		return
+	}
+	result, err := hs.antiEntropy.Run()
+	if result == nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+	writeJSON(w, result)
+}
+
+// GET reports on encryption at rest. POST reloads the keys and starts
+// re-encrypting everything with the newest.
+func (hs *httpServer) adminEncryption(w http.ResponseWriter, r *http.Request) {
+	es, ok := hs.disk.(*db.EncryptedStore)
+	if !ok {
+		http.Error(w, "Encryption at rest is not enabled", http.StatusNotFound)
+		return
+	}
+	if r.Method == "POST" {
+		if err := es.Rotate(); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	}
+	writeJSON(w, es.Stats())
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Println("Error when encoding HTTP response:", err)
+	}
+}
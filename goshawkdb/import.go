@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	capn "github.com/glycerine/go-capnproto"
+	"goshawkdb.io/common"
+	msgs "goshawkdb.io/common/capnp"
+	goshawk "goshawkdb.io/server"
+	"goshawkdb.io/server/client"
+	"goshawkdb.io/server/export"
+	"io"
+	"log"
+)
+
+// importTarget imports through client txns submitted from the local
+// connection. It keeps the positions of every var it creates, as they
+// are needed to write the vars, and to write references to them.
+type importTarget struct {
+	lc            *client.LocalConnection
+	topology      *goshawk.Topology
+	positions     map[common.VarUUId]*common.Positions
+	inMaintenance func() bool
+	created       int
+}
+
+// importExport loads an export into the cluster. The root of the
+// export becomes the root of the cluster, which must not have been
+// written to. Every other var keeps its id, but gets new positions.
+// The export is streamed from r: see export.Import.
+//
+// Import is not atomic, and other clients must not see, nor write to,
+// the vars until it is complete. So the node must be in maintenance
+// mode, with no client connections, throughout; the import fails as
+// soon as it is not. The other nodes of the cluster must be quiesced
+// likewise, which the caller must ensure.
+func importExport(lc *client.LocalConnection, topology *goshawk.Topology, inMaintenance func() bool, r io.Reader) (int, error) {
+	if topology == nil || topology.RootVarUUId == nil {
+		return 0, fmt.Errorf("No root established")
+	}
+	if !inMaintenance() {
+		return 0, fmt.Errorf("Refusing to import: node is not in maintenance mode")
+	}
+	target := &importTarget{
+		lc:            lc,
+		topology:      topology,
+		positions:     map[common.VarUUId]*common.Positions{*topology.RootVarUUId: topology.RootPositions},
+		inMaintenance: inMaintenance,
+	}
+	written, err := export.Import(r, topology.RootVarUUId, target, goshawk.ImportBatchSize)
+	log.Printf("Import: created %v vars and wrote %v vars.\n", target.created, written)
+	return written, err
+}
+
+func (it *importTarget) RootIsEmpty() (bool, error) {
+	return rootIsEmpty(it.lc, it.topology)
+}
+
+func (it *importTarget) Create(vUUIds []*common.VarUUId) error {
+	if !it.inMaintenance() {
+		return fmt.Errorf("Maintenance mode ended during import")
+	}
+	vars := make([]*export.ImportVar, len(vUUIds))
+	for idx, vUUId := range vUUIds {
+		vars[idx] = &export.ImportVar{VarUUId: vUUId}
+	}
+	outcome, err := runImportTxn(it.lc, vars, true, nil)
+	if err != nil {
+		return err
+	}
+	actions := outcome.Txn().Actions()
+	for idx, l := 0, actions.Len(); idx < l; idx++ {
+		if action := actions.At(idx); action.Which() == msgs.ACTION_CREATE {
+			pos := common.Positions(action.Create().Positions())
+			it.positions[*common.MakeVarUUId(action.VarId())] = &pos
+		}
+	}
+	it.created += len(vUUIds)
+	return nil
+}
+
+func (it *importTarget) Write(vars []*export.ImportVar) error {
+	if !it.inMaintenance() {
+		return fmt.Errorf("Maintenance mode ended during import")
+	}
+	varPosMap := make(map[common.VarUUId]*common.Positions)
+	for _, v := range vars {
+		for _, vUUId := range append([]*common.VarUUId{v.VarUUId}, v.References...) {
+			pos, found := it.positions[*vUUId]
+			if !found {
+				return fmt.Errorf("Var %v references %v which was not created", v.VarUUId, vUUId)
+			}
+			varPosMap[*vUUId] = pos
+		}
+	}
+	_, err := runImportTxn(it.lc, vars, false, varPosMap)
+	return err
+}
+
+func runImportTxn(lc *client.LocalConnection, vars []*export.ImportVar, create bool, varPosMap map[common.VarUUId]*common.Positions) (*msgs.Outcome, error) {
+	for {
+		seg := capn.NewBuffer(nil)
+		ctxn := msgs.NewClientTxn(seg)
+		ctxn.SetRetry(false)
+		actions := msgs.NewClientActionList(seg, len(vars))
+		ctxn.SetActions(actions)
+		for idx, v := range vars {
+			action := actions.At(idx)
+			action.SetVarId(v.VarUUId[:])
+			if create {
+				action.SetCreate()
+				c := action.Create()
+				c.SetValue([]byte{})
+				c.SetReferences(seg.NewDataList(0))
+			} else {
+				action.SetWrite()
+				w := action.Write()
+				w.SetValue(v.Value)
+				refs := seg.NewDataList(len(v.References))
+				w.SetReferences(refs)
+				for idy, ref := range v.References {
+					refs.Set(idy, ref[:])
+				}
+			}
+		}
+		outcome, err := lc.RunClientTransaction(&ctxn, varPosMap, true)
+		switch {
+		case err != nil:
+			return nil, err
+		case outcome == nil:
+			return nil, fmt.Errorf("Shutting down")
+		case outcome.Which() == msgs.OUTCOME_COMMIT:
+			return outcome, nil
+		case outcome.Abort().Which() == msgs.OUTCOMEABORT_RESUBMIT:
+			continue
+		default:
+			return nil, fmt.Errorf("Import txn unexpectedly aborted")
+		}
+	}
+}
+
+// rootIsEmpty reads the root var, as GetTopologyFromLocalDatabase
+// reads the topology: a read at VersionZero always aborts and the
+// rerun tells us the current value.
+func rootIsEmpty(lc *client.LocalConnection, topology *goshawk.Topology) (bool, error) {
+	root := topology.RootVarUUId
+	for {
+		seg := capn.NewBuffer(nil)
+		ctxn := msgs.NewClientTxn(seg)
+		ctxn.SetRetry(false)
+		actions := msgs.NewClientActionList(seg, 1)
+		ctxn.SetActions(actions)
+		action := actions.At(0)
+		action.SetVarId(root[:])
+		action.SetRead()
+		action.Read().SetVersion(common.VersionZero[:])
+
+		varPosMap := map[common.VarUUId]*common.Positions{*root: topology.RootPositions}
+		outcome, err := lc.RunClientTransaction(&ctxn, varPosMap, true)
+		switch {
+		case err != nil:
+			return false, err
+		case outcome == nil:
+			return false, fmt.Errorf("Shutting down")
+		case outcome.Which() == msgs.OUTCOME_COMMIT:
+			return true, nil
+		}
+		abort := outcome.Abort()
+		if abort.Which() == msgs.OUTCOMEABORT_RESUBMIT {
+			continue
+		}
+		updates := abort.Rerun()
+		for idx, l := 0, updates.Len(); idx < l; idx++ {
+			updateActions := updates.At(idx).Actions()
+			for idy, m := 0, updateActions.Len(); idy < m; idy++ {
+				updateAction := updateActions.At(idy)
+				if !bytes.Equal(updateAction.VarId(), root[:]) {
+					continue
+				}
+				switch updateAction.Which() {
+				case msgs.ACTION_WRITE:
+					write := updateAction.Write()
+					return len(write.Value()) == 0 && write.References().Len() == 0, nil
+				default:
+					return false, fmt.Errorf("Unexpected action type when reading root: %v", updateAction.Which())
+				}
+			}
+		}
+		return false, fmt.Errorf("Read of root gave no value")
+	}
+}
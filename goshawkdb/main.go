@@ -2,27 +2,27 @@ package main
 
 import (
 	"crypto/sha256"
-	"encoding/binary"
 	"flag"
 	"fmt"
 	mdb "github.com/msackman/gomdb"
-	mdbs "github.com/msackman/gomdb/server"
 	"goshawkdb.io/common"
 	msgs "goshawkdb.io/common/capnp"
 	goshawk "goshawkdb.io/server"
+	"goshawkdb.io/server/client"
 	"goshawkdb.io/server/configuration"
 	"goshawkdb.io/server/db"
 	"goshawkdb.io/server/network"
 	"goshawkdb.io/server/paxos"
 	eng "goshawkdb.io/server/txnengine"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
 	"runtime/pprof"
-	"runtime/trace"
 	"sync"
 	"syscall"
 	"time"
@@ -31,7 +31,7 @@ import (
 func main() {
 	log.SetPrefix(common.ProductName + " ")
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
-	log.Println(os.Args)
+	log.Println(goshawk.RedactArgs(os.Args))
 
 	s, err := newServer()
 	goshawk.CheckFatal(err)
@@ -39,15 +39,42 @@ func main() {
 }
 
 func newServer() (*server, error) {
-	var configFile, dataDir, password, passwordFile string
-	var port int
-	var version bool
+	var configFile, dataDir, password, passwordFile, adminAccount, httpCertFile, httpKeyFile, restoreDir, restoreClusterId, diskFailurePolicy string
+	var port, httpPort, peerHTTPPort int
+	var drainTimeout, gcInterval, gcGracePeriod, antiEntropyInterval time.Duration
+	var minDiskFree uint64
+	var maxMapUsage float64
+	var antiEntropyRepair, restoreForce, version bool
 
 	flag.StringVar(&configFile, "config", "", "`Path` to configuration file")
 	flag.StringVar(&dataDir, "dir", "", "`Path` to data directory")
 	flag.StringVar(&password, "password", "", "Cluster password")
 	flag.StringVar(&passwordFile, "passwordfile", "", "`Path` to file containing cluster password")
 	flag.IntVar(&port, "port", common.DefaultPort, "Port to listen on")
+	flag.IntVar(&httpPort, "httpport", 0, "Port to listen on for HTTP health, readiness and admin requests (0 to disable)")
+	flag.IntVar(&peerHTTPPort, "peerhttpport", 0, "Port the other nodes listen on for HTTP requests, used to fetch replacements for corrupt records, for anti-entropy and for the write barriers of collections; requires -httpcert (default: same as -httpport)")
+	flag.StringVar(&adminAccount, "adminaccount", "", "Account permitted to use the HTTP admin interface (requires -httpcert)")
+	flag.StringVar(&httpCertFile, "httpcert", "", "`Path` to TLS certificate for the HTTP interface")
+	flag.StringVar(&httpKeyFile, "httpkey", "", "`Path` to TLS key for the HTTP interface")
+	flag.DurationVar(&drainTimeout, "draintimeout", goshawk.DefaultDrainTimeout, "Maximum time to wait for in-flight txns to complete on shutdown")
+	flag.DurationVar(&gcInterval, "gcinterval", 0, "Interval between collections of unreachable vars (0 to only collect on admin request)")
+	flag.DurationVar(&gcGracePeriod, "gcgrace", goshawk.DefaultGCGracePeriod, "Minimum time a var must be unreachable for before it is collected")
+	flag.DurationVar(&antiEntropyInterval, "antientropyinterval", goshawk.DefaultAntiEntropyInterval, "Interval between comparisons of our vars with the other replicas' (0 to only compare on admin request)")
+	flag.BoolVar(&antiEntropyRepair, "antientropyrepair", false, "Replace vars which differ from the other replicas with the version held by a majority of replicas")
+	flag.StringVar(&diskFailurePolicy, "diskfailurepolicy", db.RetryWrites.String(), "What to do when a write to disk fails: retry (with backoff), readonly (retry, whilst refusing client writes and reporting unready) or shutdown. Whatever the policy, a write which keeps failing is eventually given up on, and the node shuts down")
+	flag.Uint64Var(&minDiskFree, "mindiskfree", goshawk.DefaultMinDiskFree, "Minimum free `bytes` on the data directory's filesystem, below which client txns which create or write vars are refused")
+	flag.Float64Var(&maxMapUsage, "maxmapusage", goshawk.DefaultMaxMapUsage, "Maximum `fraction` of the database map in use, above which client txns which create or write vars are refused")
+	lmdbConfig := db.DefaultLMDBConfig()
+	lmdbConfig.Flags = mdb.WRITEMAP
+	if procs := runtime.NumCPU(); procs > 2 {
+		lmdbConfig.Readers = procs / 2
+	}
+	lmdbConfig.RegisterFlags(flag.CommandLine)
+	encryption := &db.EncryptionConfig{}
+	encryption.RegisterFlags(flag.CommandLine)
+	flag.StringVar(&restoreDir, "restore", "", "`Path` to a backup to validate and restore into the data directory before starting")
+	flag.StringVar(&restoreClusterId, "restoreclusterid", "", "New cluster id to give the data restored with -restore (default: keep the original)")
+	flag.BoolVar(&restoreForce, "restoreforce", false, "Restore with -restore even if the data directory already has a different RMId")
 	flag.BoolVar(&version, "version", false, "Display version and exit")
 	flag.Parse()
 
@@ -68,6 +95,11 @@ func newServer() (*server, error) {
 	if err != nil {
 		return nil, err
 	}
+	// Held until we exit, so no other server can use the same data dir.
+	dirLock, err := db.LockDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
 
 	if configFile != "" {
 		_, err := ioutil.ReadFile(configFile)
@@ -79,6 +111,53 @@ func newServer() (*server, error) {
 	if !(0 < port && port < 65536) {
 		return nil, fmt.Errorf("Supplied port is illegal (%v). Port must be > 0 and < 65536", port)
 	}
+	if !(0 <= httpPort && httpPort < 65536) || httpPort == port {
+		return nil, fmt.Errorf("Supplied HTTP port is illegal (%v). HTTP port must be >= 0, < 65536 and different from port", httpPort)
+	}
+
+	if drainTimeout < 0 {
+		return nil, fmt.Errorf("Supplied drain timeout is illegal (%v). Must be >= 0", drainTimeout)
+	}
+
+	if gcInterval < 0 || gcGracePeriod < 0 {
+		return nil, fmt.Errorf("Supplied GC interval (%v) or grace period (%v) is illegal. Must be >= 0", gcInterval, gcGracePeriod)
+	}
+
+	if antiEntropyInterval < 0 {
+		return nil, fmt.Errorf("Supplied anti-entropy interval is illegal (%v). Must be >= 0", antiEntropyInterval)
+	}
+
+	writePolicy, err := db.ParseWritePolicy(diskFailurePolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	if !(0 < maxMapUsage && maxMapUsage <= 1) {
+		return nil, fmt.Errorf("Supplied maximum map usage is illegal (%v). Must be > 0 and <= 1", maxMapUsage)
+	}
+
+	if err = lmdbConfig.Validate(); err != nil {
+		return nil, err
+	}
+	if err = encryption.Validate(); err != nil {
+		return nil, err
+	}
+	if lmdbConfig.MaxMapSize > lmdbConfig.MapSize && lmdbConfig.GrowAt >= maxMapUsage {
+		return nil, fmt.Errorf("Supplied map growth threshold (%v) must be below the maximum map usage (%v), or client writes will be refused before the map is grown", lmdbConfig.GrowAt, maxMapUsage)
+	}
+
+	if peerHTTPPort == 0 {
+		peerHTTPPort = httpPort
+	} else if !(0 < peerHTTPPort && peerHTTPPort < 65536) {
+		return nil, fmt.Errorf("Supplied peer HTTP port is illegal (%v). Peer HTTP port must be > 0 and < 65536", peerHTTPPort)
+	}
+
+	if (httpCertFile == "") != (httpKeyFile == "") {
+		return nil, fmt.Errorf("Both -httpcert and -httpkey must be supplied to enable TLS on the HTTP interface")
+	}
+	if adminAccount != "" && httpCertFile == "" {
+		return nil, fmt.Errorf("The HTTP admin interface requires TLS: -adminaccount must be supplied with -httpcert and -httpkey")
+	}
 
 	var passwordHash [sha256.Size]byte
 	switch {
@@ -99,13 +178,40 @@ func newServer() (*server, error) {
 	}
 
 	s := &server{
-		configFile:   configFile,
-		dataDir:      dataDir,
-		port:         port,
-		passwordHash: passwordHash,
-		onShutdown:   []func(){},
+		configFile:          configFile,
+		dataDir:             dataDir,
+		port:                port,
+		httpPort:            httpPort,
+		peerHTTPPort:        peerHTTPPort,
+		adminAccount:        adminAccount,
+		httpCertFile:        httpCertFile,
+		httpKeyFile:         httpKeyFile,
+		drainTimeout:        drainTimeout,
+		gcInterval:          gcInterval,
+		gcGracePeriod:       gcGracePeriod,
+		antiEntropyInterval: antiEntropyInterval,
+		antiEntropyRepair:   antiEntropyRepair,
+		minDiskFree:         minDiskFree,
+		maxMapUsage:         maxMapUsage,
+		lmdbConfig:          lmdbConfig,
+		encryption:          encryption,
+		passwordHash:        passwordHash,
+		onShutdown:          []func(){dirLock.Unlock},
 	}
+	s.writeFailures = db.NewWriteFailures(writePolicy, s.failFast)
+	s.corruptions = db.NewCorruptions(s.failFast)
 
+	if restoreClusterId != "" && restoreDir == "" {
+		return nil, fmt.Errorf("-restoreclusterid requires -restore")
+	}
+	if restoreForce && restoreDir == "" {
+		return nil, fmt.Errorf("-restoreforce requires -restore")
+	}
+	if restoreDir != "" {
+		if err = s.restore(restoreDir, restoreClusterId, restoreForce); err != nil {
+			return nil, err
+		}
+	}
 	if err = s.ensureRMId(); err != nil {
 		return nil, err
 	}
@@ -118,17 +224,41 @@ func newServer() (*server, error) {
 
 type server struct {
 	sync.WaitGroup
-	configFile        string
-	dataDir           string
-	port              int
-	passwordHash      [sha256.Size]byte
-	rmId              common.RMId
-	bootCount         uint32
-	connectionManager *network.ConnectionManager
-	dispatchers       *paxos.Dispatchers
-	profileFile       *os.File
-	traceFile         *os.File
-	onShutdown        []func()
+	configFile          string
+	dataDir             string
+	port                int
+	httpPort            int
+	peerHTTPPort        int
+	adminAccount        string
+	httpCertFile        string
+	httpKeyFile         string
+	drainTimeout        time.Duration
+	gcInterval          time.Duration
+	gcGracePeriod       time.Duration
+	antiEntropyInterval time.Duration
+	antiEntropyRepair   bool
+	minDiskFree         uint64
+	maxMapUsage         float64
+	lmdbConfig          *db.LMDBConfig
+	encryption          *db.EncryptionConfig
+	drainLock           sync.Mutex
+	drainCancel         chan struct{}
+	doneOnce            sync.Once
+	passwordHash        [sha256.Size]byte
+	rmId                common.RMId
+	bootCount           uint32
+	disk                db.Store
+	writeFailures       *db.WriteFailures
+	corruptions         *db.Corruptions
+	spaceMonitor        *db.SpaceMonitor
+	shutdownErr         error
+	connectionManager   *network.ConnectionManager
+	localConnection     *client.LocalConnection
+	collector           *eng.Collector
+	antiEntropy         *eng.AntiEntropy
+	dispatchers         *paxos.Dispatchers
+	profileFile         *os.File
+	onShutdown          []func()
 }
 
 func (s *server) start() {
@@ -138,15 +268,41 @@ func (s *server) start() {
 	}
 	runtime.GOMAXPROCS(procs)
 
-	disk, err := mdbs.NewMDBServer(s.dataDir, mdb.WRITEMAP, 0600, goshawk.OneTB, procs/2, time.Millisecond, db.DB)
+	lmdb, err := db.NewLMDBStore(s.dataDir, s.lmdbConfig)
+	s.maybeShutdown(err)
+	s.addOnShutdown(lmdb.Shutdown)
+	disk, err := s.encryption.Wrap(lmdb)
 	s.maybeShutdown(err)
-	s.addOnShutdown(disk.Shutdown)
+	s.disk = disk
 
-	cm, lc := network.NewConnectionManager(s.rmId, s.bootCount, procs, disk, s.passwordHash)
+	s.spaceMonitor = db.NewSpaceMonitor(s.dataDir, lmdb, s.minDiskFree, s.maxMapUsage, goshawk.SpaceCheckInterval)
+	s.addOnShutdown(s.spaceMonitor.Shutdown)
+
+	s.maybeShutdown(paxos.CheckAcceptorStates(disk))
+	cm, lc := network.NewConnectionManager(s.rmId, s.bootCount, procs, disk, s.writeFailures, s.corruptions, s.spaceMonitor, s.passwordHash)
 	s.connectionManager = cm
+	s.localConnection = lc
+	var replicas eng.Replicas
+	var barriers eng.Barriers
+	if s.peerHTTPPort != 0 && s.httpCertFile == "" {
+		log.Println("Requests to and from other nodes over HTTP are disabled: they require TLS (-httpcert and -httpkey).")
+	} else if s.peerHTTPPort != 0 {
+		pc := newPeerClient(s)
+		s.corruptions.SetFetcher(pc.FetchRecord)
+		replicas = pc
+		barriers = pc
+	}
+	s.collector = eng.NewCollector(cm.Dispatchers.VarDispatcher, disk, lc, s.rmId, cm.Topology, barriers, s.gcGracePeriod)
+	s.antiEntropy = eng.NewAntiEntropy(cm.Dispatchers.VarDispatcher, disk, s.rmId, cm.Topology, replicas, s.antiEntropyRepair)
 	s.addOnShutdown(cm.Shutdown)
 	s.addOnShutdown(lc.Shutdown)
 
+	if s.httpPort != 0 {
+		hs, err := newHTTPServer(s)
+		s.maybeShutdown(err)
+		s.addOnShutdown(hs.Shutdown)
+	}
+
 	s.Add(1)
 	go s.signalHandler()
 
@@ -182,9 +338,9 @@ func (s *server) start() {
 					log.Println("Unable to deserialize new topology:", err)
 				}
 				cm.SetTopology(topology)
-				disk.WithEnv(func(env *mdb.Env) (interface{}, error) {
-					return nil, env.SetFlags(mdb.MAPASYNC, topology.AsyncFlush)
-				})
+				if err := disk.SetAsyncFlush(topology.AsyncFlush); err != nil {
+					log.Println("Unable to set AsyncFlush:", err)
+				}
 			})
 	}, false, goshawk.TopologyVarUUId)
 
@@ -201,8 +357,50 @@ func (s *server) start() {
 
 	cm.SetDesiredServers(localHost, remoteHosts)
 
-	defer s.shutdown(nil)
+	if s.gcInterval != 0 {
+		terminate := make(chan struct{})
+		s.addOnShutdown(func() { close(terminate) })
+		go s.collectPeriodically(terminate)
+	}
+
+	if s.antiEntropyInterval != 0 && replicas != nil {
+		terminate := make(chan struct{})
+		s.addOnShutdown(func() { close(terminate) })
+		go s.antiEntropyPeriodically(terminate)
+	}
+
 	s.Wait()
+	s.shutdown(s.shutdownErr)
+}
+
+func (s *server) collectPeriodically(terminate chan struct{}) {
+	ticker := time.NewTicker(s.gcInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-terminate:
+			return
+		case <-ticker.C:
+			if _, err := s.collector.Collect(); err != nil {
+				log.Println("GC error:", err)
+			}
+		}
+	}
+}
+
+func (s *server) antiEntropyPeriodically(terminate chan struct{}) {
+	ticker := time.NewTicker(s.antiEntropyInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-terminate:
+			return
+		case <-ticker.C:
+			if _, err := s.antiEntropy.Run(); err != nil {
+				log.Println("Anti-entropy error:", err)
+			}
+		}
+	}
 }
 
 func (s *server) addOnShutdown(f func()) {
@@ -227,11 +425,14 @@ func (s *server) maybeShutdown(err error) {
 }
 
 func (s *server) ensureRMId() error {
-	path := s.dataDir + "/rmid"
-	if b, err := ioutil.ReadFile(path); err == nil {
-		s.rmId = common.RMId(binary.BigEndian.Uint32(b))
+	path := filepath.Join(s.dataDir, db.RMIdFile)
+	if rmId, err := db.ReadIdentityFile(path); err == nil {
+		s.rmId = common.RMId(rmId)
 		return nil
 
+	} else if !os.IsNotExist(err) {
+		return err
+
 	} else {
 		rng := rand.New(rand.NewSource(time.Now().UnixNano()))
 		for {
@@ -240,22 +441,109 @@ func (s *server) ensureRMId() error {
 				break
 			}
 		}
-		b := make([]byte, 4)
-		binary.BigEndian.PutUint32(b, uint32(s.rmId))
-		return ioutil.WriteFile(path, b, 0400)
+		return db.WriteIdentityFile(path, uint32(s.rmId), 0400)
 	}
 }
 
 func (s *server) ensureBootCount() error {
-	path := s.dataDir + "/bootcount"
-	if b, err := ioutil.ReadFile(path); err == nil {
-		s.bootCount = binary.BigEndian.Uint32(b) + 1
-	} else {
+	path := filepath.Join(s.dataDir, db.BootCountFile)
+	if bootCount, err := db.ReadIdentityFile(path); err == nil {
+		s.bootCount = bootCount + 1
+	} else if os.IsNotExist(err) {
 		s.bootCount = 1
+	} else {
+		return err
 	}
-	b := make([]byte, 4)
-	binary.BigEndian.PutUint32(b, s.bootCount)
-	return ioutil.WriteFile(path, b, 0600)
+	return db.WriteIdentityFile(path, s.bootCount, 0600)
+}
+
+// restore validates the backup in dir and copies it into the data
+// dir, which must not already contain a store. The boot count is never
+// allowed to go backwards, otherwise other nodes could mistake us for
+// an old instance of ourself. Nor, unless force is set, is the RMId
+// allowed to change: a data dir which already has a different RMId
+// belongs to a different node. If clusterId is not empty, the restored
+// topology is given that cluster id.
+func (s *server) restore(dir, clusterId string, force bool) error {
+	info, err := db.ValidateBackup(dir, s.encryption.KeySource())
+	if err != nil {
+		return fmt.Errorf("Unable to restore from %v: %v", dir, err)
+	}
+	dataFile := filepath.Join(s.dataDir, "data.mdb")
+	if _, err := os.Stat(dataFile); err == nil {
+		return fmt.Errorf("Refusing to restore from %v: %v already exists", dir, dataFile)
+	}
+
+	rmIdPath := filepath.Join(s.dataDir, db.RMIdFile)
+	if existing, err := db.ReadIdentityFile(rmIdPath); err == nil {
+		if rmId := common.RMId(existing); rmId != info.RMId {
+			if !force {
+				return fmt.Errorf("Refusing to restore from %v: data dir has RMId %v but backup has RMId %v (use -restoreforce to override)", dir, rmId, info.RMId)
+			}
+			log.Printf("Replacing RMId %v with RMId %v from backup.\n", rmId, info.RMId)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	bootCountPath := filepath.Join(s.dataDir, db.BootCountFile)
+	bootCount := info.BootCount
+	if existing, err := db.ReadIdentityFile(bootCountPath); err == nil {
+		if existing > bootCount {
+			bootCount = existing
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err = copyFile(filepath.Join(dir, "data.mdb"), dataFile, 0600); err != nil {
+		return err
+	}
+	if err = db.WriteIdentityFile(rmIdPath, uint32(info.RMId), 0400); err != nil {
+		return err
+	}
+	if err = db.WriteIdentityFile(bootCountPath, bootCount, 0600); err != nil {
+		return err
+	}
+	if clusterId != "" {
+		lmdb, err := db.NewLMDBStore(s.dataDir, s.lmdbConfig)
+		if err != nil {
+			return err
+		}
+		disk, err := s.encryption.Wrap(lmdb)
+		if err == nil {
+			err = db.RewriteClusterId(disk, clusterId)
+		}
+		lmdb.Shutdown()
+		if err != nil {
+			return err
+		}
+		log.Printf("Restored data now belongs to cluster '%v' (was '%v').\n", clusterId, info.ClusterId)
+	}
+	log.Printf("Restored backup of RMId %v taken at %v (topology version %v, DBVersion %v).\n",
+		info.RMId, info.Created, info.TopologyVersion, info.TopologyDBVersion)
+	return nil
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
 }
 
 func (s *server) chooseTopology(topology *goshawk.Topology) (*goshawk.Topology, error) {
@@ -285,38 +573,154 @@ func (s *server) chooseTopology(topology *goshawk.Topology) (*goshawk.Topology,
 }
 
 func (s *server) signalShutdown() {
-	log.Println("Shutting down.")
-	s.Done()
+	switch {
+	case s.connectionManager == nil || s.drainTimeout == 0:
+		log.Println("Shutting down.")
+		s.doneOnce.Do(s.Done)
+	case !s.startDrain():
+		log.Println("Shutting down without waiting for drain to complete.")
+		s.doneOnce.Do(s.Done)
+	}
+}
+
+// startDrain drains in the background and then shuts down, unless the
+// drain is cancelled first. It returns false if we're already
+// draining.
+func (s *server) startDrain() bool {
+	s.drainLock.Lock()
+	defer s.drainLock.Unlock()
+	if s.drainCancel != nil {
+		return false
+	}
+	cancel := make(chan struct{})
+	s.drainCancel = cancel
+	go func() {
+		s.drain(cancel)
+		s.drainLock.Lock()
+		cancelled := s.drainCancel != cancel
+		s.drainLock.Unlock()
+		if !cancelled {
+			log.Println("Shutting down.")
+			s.doneOnce.Do(s.Done)
+		}
+	}()
+	return true
+}
+
+// cancelDrain stops a drain in progress, and starts accepting client
+// connections again. It returns false if we're not draining.
+func (s *server) cancelDrain() bool {
+	s.drainLock.Lock()
+	defer s.drainLock.Unlock()
+	if s.drainCancel == nil {
+		return false
+	}
+	close(s.drainCancel)
+	s.drainCancel = nil
+	s.connectionManager.CancelDrain()
+	return true
+}
+
+func (s *server) isDraining() bool {
+	s.drainLock.Lock()
+	defer s.drainLock.Unlock()
+	return s.drainCancel != nil
+}
+
+// failFast shuts down immediately, without draining, and exits with
+// err.
+func (s *server) failFast(err error) {
+	s.doneOnce.Do(func() {
+		s.shutdownErr = err
+		s.Done()
+	})
+}
+
+// drain stops new client connections and txns, and then waits, up to
+// drainTimeout or until cancel is closed, for our client connections
+// to close, for the txns submitted through us to complete, and for our
+// acceptors to hand over the outcomes they have already decided.
+//
+// Learners only go locally complete once every acceptor has sent them
+// the same outcome, and a 2B counts for the acceptor which sent it, so
+// no other RM can send ours. Handing over an outcome therefore means
+// sending its 2Bs until every learner, and the submitter, has
+// acknowledged it. Only the acceptors which were sending 2Bs when the
+// drain started are waited for: the others are working for txns
+// submitted elsewhere, and on a busy cluster there's always another.
+// Anything still outstanding at the timeout is on disk, and resumes
+// when we next start.
+func (s *server) drain(cancel chan struct{}) {
+	log.Printf("Draining (timeout %v).\n", s.drainTimeout)
+	cm := s.connectionManager
+	cm.Drain()
+	deadline := time.Now().Add(s.drainTimeout)
+	ticker := time.NewTicker(goshawk.DrainPollInterval)
+	defer ticker.Stop()
+	acceptors := cm.Dispatchers.AcceptorDispatcher.SendingTwoBs(nil)
+	for {
+		clients, proposers := 0, cm.Dispatchers.ProposerDispatcher.LocalProposerCount()
+		if info := cm.ConnectionsInfo(); info != nil {
+			clients = info.ClientCount - 1 // don't count the local connection
+		}
+		acceptors = cm.Dispatchers.AcceptorDispatcher.SendingTwoBs(acceptors)
+		if clients == 0 && proposers == 0 && len(acceptors) == 0 {
+			log.Println("Drain complete.")
+			return
+		}
+		if time.Now().After(deadline) {
+			log.Printf("Drain timed out with %v client connections, %v proposers of our txns and %v acceptors sending 2Bs outstanding.\n", clients, proposers, len(acceptors))
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-cancel:
+			log.Println("Drain cancelled.")
+			return
+		}
+	}
 }
 
 func (s *server) signalStatus() {
-	sc := goshawk.NewStatusConsumer()
-	go sc.Consume(func(str string) {
+	s.status(func(str string) {
 		log.Printf("System Status for %v\n%v\nStatus End\n", s.rmId, str)
 	})
+}
+
+func (s *server) status(fun func(string)) {
+	sc := goshawk.NewStatusConsumer()
+	go sc.Consume(fun)
 	sc.Emit(fmt.Sprintf("Configuration File: %v", s.configFile))
 	sc.Emit(fmt.Sprintf("Data Directory: %v", s.dataDir))
 	sc.Emit(fmt.Sprintf("Port: %v", s.port))
+	sc.Emit(fmt.Sprintf("HTTP Port: %v", s.httpPort))
+	if es, ok := s.disk.(*db.EncryptedStore); ok {
+		es.Status(sc.Fork())
+	}
 	s.connectionManager.Status(sc)
 }
 
 func (s *server) signalReloadConfig() {
+	if err := s.reloadConfig(); err != nil {
+		log.Println(err)
+	}
+}
+
+func (s *server) reloadConfig() error {
 	if s.configFile == "" {
-		log.Println("Attempt to reload config failed as no path to configuration provided on command line.")
-		return
+		return fmt.Errorf("Attempt to reload config failed as no path to configuration provided on command line.")
 	}
 	config, err := configuration.LoadConfigurationFromPath(s.configFile)
 	if err != nil {
-		log.Println("Cannot reload config due to error:", err)
-		return
+		return fmt.Errorf("Cannot reload config due to error: %v", err)
 	}
 	localHost, remoteHosts, err := config.LocalRemoteHosts(s.port)
 	if err != nil {
-		log.Println("Cannot reload config due to error:", err)
-		return
+		return fmt.Errorf("Cannot reload config due to error: %v", err)
 	}
 	s.connectionManager.SetDesiredServers(localHost, remoteHosts)
 	log.Println("Reloaded configuration.")
+	return nil
 }
 
 func (s *server) signalDumpStacks() {
@@ -364,27 +768,6 @@ func (s *server) signalToggleCpuProfile() {
 	}
 }
 
-func (s *server) signalToggleTrace() {
-	if s.traceFile == nil {
-		traceFile, err := ioutil.TempFile("", common.ProductName+"_Trace_")
-		if goshawk.CheckWarn(err) {
-			return
-		}
-		if goshawk.CheckWarn(trace.Start(traceFile)) {
-			return
-		}
-		s.traceFile = traceFile
-		log.Println("Tracing started in", traceFile.Name())
-
-	} else {
-		trace.Stop()
-		if !goshawk.CheckWarn(s.traceFile.Close()) {
-			log.Println("Tracing stopped in", s.traceFile.Name())
-		}
-		s.traceFile = nil
-	}
-}
-
 func (s *server) signalHandler() {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2, os.Interrupt)
@@ -401,7 +784,6 @@ func (s *server) signalHandler() {
 			s.signalStatus()
 		case syscall.SIGUSR2:
 			s.signalToggleCpuProfile()
-			//s.signalToggleTrace()
 		}
 	}
 }
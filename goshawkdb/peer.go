@@ -0,0 +1,425 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"goshawkdb.io/common"
+	goshawk "goshawkdb.io/server"
+	"goshawkdb.io/server/db"
+	"goshawkdb.io/server/network"
+	eng "goshawkdb.io/server/txnengine"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Nodes ask each other for copies of records, and for anti-entropy
+// digests, over their HTTP
+// interfaces. These requests don't use the admin account: instead,
+// requests and responses carry an HMAC keyed by the cluster password,
+// which every node has. The request's HMAC covers a timestamp, so it
+// can't be replayed for long, and the RMId of the node making it,
+// which must be in the current topology; the response's HMAC covers
+// the request's, so it can't be swapped for another. As with the admin
+// interface, these requests are only accepted over TLS, and a record
+// is only handed to a node which should hold a copy of it itself.
+
+const peerAuthHeader = "X-Goshawk-Peer-Auth"
+
+func peerMAC(key []byte, parts ...string) string {
+	mac := hmac.New(sha256.New, key)
+	for _, part := range parts {
+		fmt.Fprintf(mac, "%d:%s", len(part), part)
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func peerRequestMAC(key []byte, r *http.Request, timestamp, rmId string) string {
+	return peerMAC(key, "request", r.Method, r.URL.Path, r.URL.RawQuery, timestamp, rmId)
+}
+
+func peerResponseMAC(key []byte, requestMAC string, body []byte) string {
+	return peerMAC(key, "response", requestMAC, string(body))
+}
+
+// peer wraps handlers that are only available to other nodes in the
+// cluster. The handler is told which node the request is from, and
+// must reply with writePeer.
+func (hs *httpServer) peer(handler func(w http.ResponseWriter, r *http.Request, sender common.RMId, topology *goshawk.Topology)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil {
+			http.Error(w, "Peer interface requires TLS", http.StatusForbidden)
+			return
+		}
+		fields := strings.SplitN(r.Header.Get(peerAuthHeader), " ", 3)
+		if len(fields) != 3 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		timestamp, rmIdStr, requestMAC := fields[0], fields[1], fields[2]
+		secs, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil || !hmac.Equal([]byte(requestMAC), []byte(peerRequestMAC(hs.passwordHash[:], r, timestamp, rmIdStr))) {
+			log.Printf("Peer authentication failed from %v", r.RemoteAddr)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if age := time.Since(time.Unix(secs, 0)); age > goshawk.PeerAuthWindow || age < -goshawk.PeerAuthWindow {
+			http.Error(w, "Request expired", http.StatusUnauthorized)
+			return
+		}
+		rmId, err := strconv.ParseUint(rmIdStr, 10, 32)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		sender := common.RMId(rmId)
+		topology := hs.connectionManager.Topology()
+		if topology == nil {
+			http.Error(w, "No topology established", http.StatusServiceUnavailable)
+			return
+		}
+		if sender == hs.rmId || !containsRMId(topology.AllRMs, sender) {
+			log.Printf("Peer request from %v, which is not another node of the cluster", sender)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		handler(w, r, sender, topology)
+	})
+}
+
+func containsRMId(rmIds []common.RMId, rmId common.RMId) bool {
+	for _, r := range rmIds {
+		if r == rmId {
+			return true
+		}
+	}
+	return false
+}
+
+func (hs *httpServer) writePeer(w http.ResponseWriter, r *http.Request, body []byte) {
+	fields := strings.SplitN(r.Header.Get(peerAuthHeader), " ", 3)
+	w.Header().Set(peerAuthHeader, peerResponseMAC(hs.passwordHash[:], fields[2], body))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(body)
+}
+
+// peerRecord replies with the payload of one var or txn record, if
+// both we and the sender should hold it: a var must resolve to both of
+// us, and a txn must have been allocated to both of us. Damaged
+// records, and records we shouldn't hold, are treated as missing.
+func (hs *httpServer) peerRecord(w http.ResponseWriter, r *http.Request, sender common.RMId, topology *goshawk.Topology) {
+	table, err := db.ParseTable(r.FormValue("table"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, err := hex.DecodeString(r.FormValue("key"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to parse 'key' parameter: %v", err), http.StatusBadRequest)
+		return
+	}
+	if table != db.Vars && table != db.Transactions {
+		http.Error(w, fmt.Sprintf("%v records are not replicated", table), http.StatusBadRequest)
+		return
+	} else if len(key) != common.KeyLen {
+		http.Error(w, fmt.Sprintf("Illegal 'key' parameter: must be %v bytes", common.KeyLen), http.StatusBadRequest)
+		return
+	}
+	var holders []common.RMId
+	result, err := hs.disk.ReadonlyTransaction(func(rtxn db.RTxn) (interface{}, error) {
+		record, err := rtxn.Get(table, key)
+		if err != nil {
+			return nil, err
+		}
+		payload, err := db.VerifyChecksum(table, key, record)
+		if err != nil {
+			return nil, err
+		}
+		if table == db.Vars {
+			varCap, err := db.DecodeVar(key, record)
+			if err != nil {
+				return nil, err
+			}
+			positions := common.Positions(varCap.Positions())
+			// The topology var has no positions: every node holds it.
+			if holders, err = eng.VarReplicas(topology, &positions); err == nil && holders == nil {
+				holders = topology.AllRMs
+			}
+			return payload, err
+		}
+		txnCap, err := db.DecodeTxn(common.MakeTxnId(key), record)
+		if err != nil {
+			return nil, err
+		}
+		allocations := txnCap.Allocations()
+		for idx, l := 0, allocations.Len(); idx < l; idx++ {
+			holders = append(holders, common.RMId(allocations.At(idx).RmId()))
+		}
+		return payload, nil
+	}).ResultError()
+	if err == nil && !(containsRMId(holders, hs.rmId) && containsRMId(holders, sender)) {
+		err = db.NotFound
+	}
+	if err == db.NotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if _, corrupt := db.IsCorruption(err); corrupt {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	hs.writePeer(w, r, result.([]byte))
+}
+
+// peerDigests replies with our anti-entropy digests over the vars we
+// share with the sender: of each bucket, or if bucket is given, of
+// each var in that bucket.
+func (hs *httpServer) peerDigests(w http.ResponseWriter, r *http.Request, sender common.RMId, topology *goshawk.Topology) {
+	if hs.antiEntropy == nil {
+		http.Error(w, "Anti-entropy is not available", http.StatusNotFound)
+		return
+	}
+	var result interface{}
+	var err error
+	if str := r.FormValue("bucket"); str == "" {
+		result, err = hs.antiEntropy.BucketDigests(sender)
+	} else if bucket, errParse := strconv.Atoi(str); errParse != nil || bucket < 0 || bucket >= goshawk.AntiEntropyBuckets {
+		http.Error(w, fmt.Sprintf("Illegal 'bucket' parameter: %v", str), http.StatusBadRequest)
+		return
+	} else {
+		result, err = hs.antiEntropy.BucketEntries(sender, bucket)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	body, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	hs.writePeer(w, r, body)
+}
+
+// peerBarrier starts (POST with no id), drains (POST with id), or
+// drains and stops (POST with id and stop=true) a write barrier for a
+// collection being run by another node. Replies with the barrier's id
+// or what it has recorded.
+func (hs *httpServer) peerBarrier(w http.ResponseWriter, r *http.Request, sender common.RMId, topology *goshawk.Topology) {
+	if r.Method != "POST" {
+		http.Error(w, "Barrier requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	barrier := hs.connectionManager.Dispatchers.VarDispatcher.Barrier
+	var result interface{}
+	if str := r.FormValue("id"); str == "" {
+		result = barrier.Start()
+	} else if id, err := strconv.ParseUint(str, 10, 64); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to parse 'id' parameter: %v", err), http.StatusBadRequest)
+		return
+	} else if refs, found := barrier.Drain(id, r.FormValue("stop") == "true"); !found {
+		http.Error(w, fmt.Sprintf("No write barrier %v", id), http.StatusNotFound)
+		return
+	} else {
+		result = refs
+	}
+	body, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	hs.writePeer(w, r, body)
+}
+
+// peerClient makes requests of the other nodes we're connected to. It
+// is the eng.Replicas used for anti-entropy, and the eng.Barriers used
+// for collection.
+type peerClient struct {
+	connectionManager *network.ConnectionManager
+	rmId              common.RMId
+	key               []byte
+	scheme            string
+	port              int
+	client            *http.Client
+}
+
+func newPeerClient(s *server) *peerClient {
+	return &peerClient{
+		connectionManager: s.connectionManager,
+		rmId:              s.rmId,
+		key:               s.passwordHash[:],
+		scheme:            "https",
+		port:              s.peerHTTPPort,
+		client:            &http.Client{Timeout: goshawk.PeerRequestTimeout},
+	}
+}
+
+// peers returns the HTTP addresses of the other nodes to which we
+// currently have connections.
+func (pc *peerClient) peers() map[common.RMId]string {
+	info := pc.connectionManager.ConnectionsInfo()
+	if info == nil {
+		return nil
+	}
+	peers := make(map[common.RMId]string, len(info.Servers))
+	for _, conn := range info.Servers {
+		if !conn.Established || conn.RMId == info.RMId {
+			continue
+		}
+		host, _, err := net.SplitHostPort(conn.Host)
+		if err != nil {
+			continue
+		}
+		peers[conn.RMId] = net.JoinHostPort(host, strconv.Itoa(pc.port))
+	}
+	return peers
+}
+
+func (pc *peerClient) Peers() []common.RMId {
+	peers := pc.peers()
+	rmIds := make([]common.RMId, 0, len(peers))
+	for rmId := range peers {
+		rmIds = append(rmIds, rmId)
+	}
+	sort.Slice(rmIds, func(i, j int) bool { return rmIds[i] < rmIds[j] })
+	return rmIds
+}
+
+func (pc *peerClient) BucketDigests(rmId common.RMId) ([][]byte, error) {
+	var digests [][]byte
+	err := pc.getDigests(rmId, url.Values{}, &digests)
+	return digests, err
+}
+
+func (pc *peerClient) BucketEntries(rmId common.RMId, bucket int) ([]*eng.DigestEntry, error) {
+	var entries []*eng.DigestEntry
+	err := pc.getDigests(rmId, url.Values{"bucket": {strconv.Itoa(bucket)}}, &entries)
+	return entries, err
+}
+
+func (pc *peerClient) getDigests(rmId common.RMId, query url.Values, result interface{}) error {
+	peer, found := pc.peers()[rmId]
+	if !found {
+		return fmt.Errorf("Not connected to %v", rmId)
+	}
+	body, err := pc.get(peer, "/peer/digests", query)
+	if err != nil {
+		return err
+	} else if body == nil {
+		return fmt.Errorf("%v: anti-entropy is not available", peer)
+	}
+	return json.Unmarshal(body, result)
+}
+
+func (pc *peerClient) StartBarrier(rmId common.RMId) (uint64, error) {
+	var id uint64
+	err := pc.barrier(rmId, url.Values{}, &id)
+	return id, err
+}
+
+func (pc *peerClient) DrainBarrier(rmId common.RMId, id uint64, stop bool) ([]*eng.BarrierRef, error) {
+	var refs []*eng.BarrierRef
+	query := url.Values{"id": {strconv.FormatUint(id, 10)}, "stop": {strconv.FormatBool(stop)}}
+	err := pc.barrier(rmId, query, &refs)
+	return refs, err
+}
+
+func (pc *peerClient) barrier(rmId common.RMId, query url.Values, result interface{}) error {
+	peer, found := pc.peers()[rmId]
+	if !found {
+		return fmt.Errorf("Not connected to %v", rmId)
+	}
+	body, err := pc.request("POST", peer, "/peer/barrier", query)
+	if err != nil {
+		return err
+	} else if body == nil {
+		return fmt.Errorf("%v: write barrier has lapsed", peer)
+	}
+	return json.Unmarshal(body, result)
+}
+
+// get returns nil if the peer doesn't have what was asked for.
+func (pc *peerClient) get(peer, path string, query url.Values) ([]byte, error) {
+	return pc.request("GET", peer, path, query)
+}
+
+func (pc *peerClient) request(method, peer, path string, query url.Values) ([]byte, error) {
+	u := url.URL{Scheme: pc.scheme, Host: peer, Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	timestamp, rmId := strconv.FormatInt(time.Now().Unix(), 10), strconv.FormatUint(uint64(pc.rmId), 10)
+	requestMAC := peerRequestMAC(pc.key, req, timestamp, rmId)
+	req.Header.Set(peerAuthHeader, timestamp+" "+rmId+" "+requestMAC)
+	resp, err := pc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	switch {
+	case err != nil:
+		return nil, err
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("%v: %v %s", peer, resp.Status, strings.TrimSpace(string(body)))
+	case !hmac.Equal([]byte(resp.Header.Get(peerAuthHeader)), []byte(peerResponseMAC(pc.key, requestMAC, body))):
+		return nil, fmt.Errorf("%v: response failed authentication", peer)
+	default:
+		return body, nil
+	}
+}
+
+// FetchRecord is a db.RecordFetcher which asks every peer at once:
+// only those which should hold the record reply with it. It only fails
+// if every peer does.
+func (pc *peerClient) FetchRecord(table db.Table, key []byte) (map[common.RMId][]byte, int, error) {
+	topology := pc.connectionManager.Topology()
+	if topology == nil {
+		return nil, 0, fmt.Errorf("Unable to fetch %v record %x: no topology established", table, key)
+	} else if topology.F == 0 {
+		return nil, 0, db.NoReplicas
+	}
+	peers := pc.peers()
+	if len(peers) == 0 {
+		return nil, 0, fmt.Errorf("Unable to fetch %v record %x: not connected to any other nodes", table, key)
+	}
+	query := url.Values{"table": {table.String()}, "key": {hex.EncodeToString(key)}}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	copies := make(map[common.RMId][]byte)
+	var errs []string
+	for rmId, peer := range peers {
+		wg.Add(1)
+		go func(rmId common.RMId, peer string) {
+			defer wg.Done()
+			body, err := pc.get(peer, "/peer/record", query)
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				errs = append(errs, err.Error())
+			} else if body != nil {
+				copies[rmId] = body
+			}
+		}(rmId, peer)
+	}
+	wg.Wait()
+	if len(errs) == len(peers) {
+		return nil, 0, fmt.Errorf("Unable to fetch %v record %x: %v", table, key, strings.Join(errs, "; "))
+	}
+	return copies, int(topology.FInc), nil
+}
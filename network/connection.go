@@ -80,12 +80,30 @@ type connectionMsgDisableHashCodes map[common.RMId]paxos.Connection
 
 func (cmdhc connectionMsgDisableHashCodes) connectionMsgWitness() {}
 
+type connectionMsgDrain struct{}
+
+func (cmd *connectionMsgDrain) connectionMsgWitness() {}
+
+var connectionMsgDrainInst = &connectionMsgDrain{}
+
+type connectionMsgSetClientTxnsPaused bool
+
+func (cmsctp connectionMsgSetClientTxnsPaused) connectionMsgWitness() {}
+
 func (conn *Connection) Shutdown(sync bool) {
 	if conn.enqueueQuery(connectionMsgShutdownInst) && sync {
 		conn.cellTail.Wait()
 	}
 }
 
+func (conn *Connection) Drain() {
+	conn.enqueueQuery(connectionMsgDrainInst)
+}
+
+func (conn *Connection) SetClientTxnsPaused(paused bool) {
+	conn.enqueueQuery(connectionMsgSetClientTxnsPaused(paused))
+}
+
 func (conn *Connection) Send(msg []byte) {
 	conn.enqueueQuery(connectionMsgSend(msg))
 }
@@ -248,6 +266,10 @@ func (conn *Connection) handleMsg(msg connectionMsg) (terminate bool, err error)
 		conn.topologyChange(msgT)
 	case connectionMsgDisableHashCodes:
 		conn.disableHashCodes(msgT)
+	case *connectionMsgDrain:
+		terminate = conn.drain()
+	case connectionMsgSetClientTxnsPaused:
+		conn.setClientTxnsPaused(bool(msgT))
 	case *connectionMsgStatus:
 		conn.status((*server.StatusConsumer)(msgT))
 	default:
@@ -310,6 +332,8 @@ func (conn *Connection) status(sc *server.StatusConsumer) {
 	sc.Emit(fmt.Sprintf("- Established? %v", conn.established))
 	sc.Emit(fmt.Sprintf("- IsServer? %v", conn.isServer))
 	sc.Emit(fmt.Sprintf("- IsClient? %v", conn.isClient))
+	sc.Emit(fmt.Sprintf("- Draining? %v", conn.draining))
+	sc.Emit(fmt.Sprintf("- Paused Txns: %v", len(conn.pausedTxns)))
 	if conn.submitter != nil {
 		conn.submitter.Status(sc.Fork())
 	}
@@ -660,6 +684,15 @@ func (cach *connectionAwaitClientHandshake) start() (bool, error) {
 			log.Printf("User '%s' authenticated", un)
 		}
 
+		if reason, redirect := cach.connectionManager.ClientRefusal(cach.ConnectionNumber); reason != "" {
+			if redirect != "" {
+				if err := cach.send(server.SegToBytes(MakeRedirect(redirect))); err != nil {
+					log.Printf("Unable to redirect client connection from %v to %s: %v", cach.socket.RemoteAddr(), redirect, err)
+				}
+			}
+			return false, fmt.Errorf("Refusing client connection from %v: %s (redirect: '%s')", cach.socket.RemoteAddr(), reason, redirect)
+		}
+
 		helloFromServer := cach.makeHelloFromServer(topology)
 		if err := cach.send(server.SegToBytes(helloFromServer)); err != nil {
 			return cach.connectionAwaitHandshake.maybeRestartConnection(err)
@@ -685,6 +718,9 @@ type connectionRun struct {
 	mustSendBeat bool
 	missingBeats int
 	beatBytes    []byte
+	draining     bool
+	paused       bool
+	pausedTxns   []func()
 }
 
 func (cr *connectionRun) connectionStateMachineComponentWitness() {}
@@ -717,6 +753,10 @@ func (cr *connectionRun) start() (bool, error) {
 		cr.connectionManager.AddSender(cr.Connection)
 		cr.submitter = client.NewClientTxnSubmitter(cr.connectionManager.RMId, cr.connectionManager.BootCount, topology, cr.connectionManager)
 		cr.submitter.TopologyChange(nil, servers)
+		if reason, _ := cr.connectionManager.ClientRefusal(cr.ConnectionNumber); reason != "" {
+			return false, fmt.Errorf("Closing client connection from %v: %s", cr.remoteHost, reason)
+		}
+		cr.paused = cr.connectionManager.ClientTxnsPaused()
 	}
 	cr.mustSendBeat = true
 	cr.missingBeats = 0
@@ -730,6 +770,31 @@ func (cr *connectionRun) start() (bool, error) {
 	return false, nil
 }
 
+// Returns true if the connection should be terminated immediately.
+func (cr *connectionRun) drain() bool {
+	if cr.currentState != cr || !cr.isClient {
+		return false
+	}
+	cr.draining = true
+	return !cr.submitter.TxnLive() && len(cr.pausedTxns) == 0
+}
+
+// Whilst paused, client txns are held rather than submitted. They are
+// submitted in order once we are unpaused.
+func (cr *connectionRun) setClientTxnsPaused(paused bool) {
+	if cr.currentState != cr || !cr.isClient {
+		return
+	}
+	cr.paused = paused
+	if !paused {
+		pausedTxns := cr.pausedTxns
+		cr.pausedTxns = nil
+		for _, submit := range pausedTxns {
+			submit()
+		}
+	}
+}
+
 func (cr *connectionRun) topologyChange(tChange *connectionMsgTopologyChange) {
 	if cr.currentState != cr || !cr.isClient {
 		return
@@ -756,19 +821,35 @@ func (cr *connectionRun) handleMsgFromPeer(msg *msgs.Message) error {
 	case msgs.MESSAGE_CLIENTTXNSUBMISSION:
 		ctxn := msg.ClientTxnSubmission()
 		origTxnId := common.MakeTxnId(ctxn.Id())
-		cr.submitter.SubmitClientTransaction(&ctxn, func(clientOutcome *msgs.ClientTxnOutcome, err error) {
-			switch {
-			case err != nil:
-				cr.clientTxnError(&ctxn, err, origTxnId)
-			case clientOutcome == nil: // shutdown
-				return
-			default:
-				seg := capn.NewBuffer(nil)
-				msg := msgs.NewRootMessage(seg)
-				msg.SetClientTxnOutcome(*clientOutcome)
-				cr.sendMessage(server.SegToBytes(msg.Segment))
-			}
-		})
+		if cr.draining {
+			return cr.clientTxnError(&ctxn, fmt.Errorf("Node is not accepting client txns"), origTxnId)
+		}
+		if err := cr.connectionManager.AdmitClientTxn(&ctxn); err != nil {
+			return cr.clientTxnError(&ctxn, err, origTxnId)
+		}
+		submit := func() {
+			cr.submitter.SubmitClientTransaction(&ctxn, func(clientOutcome *msgs.ClientTxnOutcome, err error) {
+				switch {
+				case err != nil:
+					cr.clientTxnError(&ctxn, err, origTxnId)
+				case clientOutcome == nil: // shutdown
+					return
+				default:
+					seg := capn.NewBuffer(nil)
+					msg := msgs.NewRootMessage(seg)
+					msg.SetClientTxnOutcome(*clientOutcome)
+					cr.sendMessage(server.SegToBytes(msg.Segment))
+				}
+				if cr.draining && !cr.submitter.TxnLive() && len(cr.pausedTxns) == 0 {
+					cr.Shutdown(false)
+				}
+			})
+		}
+		if cr.paused {
+			cr.pausedTxns = append(cr.pausedTxns, submit)
+		} else {
+			submit()
+		}
 	default:
 		cr.connectionManager.Dispatchers.DispatchMessage(cr.remoteRMId, which, msg)
 	}
@@ -5,11 +5,11 @@ import (
 	"fmt"
 	capn "github.com/glycerine/go-capnproto"
 	cc "github.com/msackman/chancell"
-	mdbs "github.com/msackman/gomdb/server"
 	"goshawkdb.io/common"
 	msgs "goshawkdb.io/common/capnp"
 	"goshawkdb.io/server"
 	"goshawkdb.io/server/client"
+	"goshawkdb.io/server/db"
 	"goshawkdb.io/server/paxos"
 	"log"
 	"sync"
@@ -31,6 +31,13 @@ type ConnectionManager struct {
 	connCountToClient map[uint32]paxos.ClientConnection
 	desired           []string
 	senders           map[paxos.Sender]server.EmptyStruct
+	draining          bool
+	maintenance       bool
+	redirectHosts     []string
+	clientTxnsPaused  bool
+	writeFailures     *db.WriteFailures
+	corruptions       *db.Corruptions
+	spaceMonitor      *db.SpaceMonitor
 	Dispatchers       *paxos.Dispatchers
 }
 
@@ -85,6 +92,33 @@ type connectionManagerMsgGetTopology struct {
 
 func (cmmgt *connectionManagerMsgGetTopology) connectionManagerMsgWitness() {}
 
+type connectionManagerMsgGetReadiness struct {
+	resultChan chan struct{}
+	ready      bool
+	reason     string
+}
+
+func (cmmgr *connectionManagerMsgGetReadiness) connectionManagerMsgWitness() {}
+
+type connectionManagerMsgGetConnectionsInfo struct {
+	resultChan chan struct{}
+	info       *ConnectionsInfo
+}
+
+func (cmmgci *connectionManagerMsgGetConnectionsInfo) connectionManagerMsgWitness() {}
+
+type connectionManagerMsgDrain bool
+
+func (cmmd connectionManagerMsgDrain) connectionManagerMsgWitness() {}
+
+type connectionManagerMsgSetMaintenance bool
+
+func (cmmsm connectionManagerMsgSetMaintenance) connectionManagerMsgWitness() {}
+
+type connectionManagerMsgSetClientTxnsPaused bool
+
+func (cmmsctp connectionManagerMsgSetClientTxnsPaused) connectionManagerMsgWitness() {}
+
 type connectionManagerMsgSetTopology server.Topology
 
 func (cmmst *connectionManagerMsgSetTopology) connectionManagerMsgWitness() {}
@@ -99,6 +133,111 @@ func (cm *ConnectionManager) Shutdown() {
 	<-c
 }
 
+// Drain stops the node from accepting any further client connections
+// or client txns. Existing client connections are closed as soon as
+// they have no txn in flight. Connections to other servers are
+// unaffected so that in-flight txns can complete.
+func (cm *ConnectionManager) Drain() {
+	cm.enqueueQuery(connectionManagerMsgDrain(true))
+}
+
+// CancelDrain starts accepting client connections and txns again.
+// Client connections which have already been closed stay closed.
+func (cm *ConnectionManager) CancelDrain() {
+	cm.enqueueQuery(connectionManagerMsgDrain(false))
+}
+
+func (cm *ConnectionManager) IsDraining() bool {
+	cm.RLock()
+	defer cm.RUnlock()
+	return cm.draining
+}
+
+// SetMaintenance puts the node into, or takes it out of, maintenance
+// mode. Whilst in maintenance mode, existing client connections are
+// closed as soon as they have no txn in flight and new client
+// connections are redirected to other hosts. The node continues to
+// take part in txns as an acceptor and var holder.
+func (cm *ConnectionManager) SetMaintenance(enabled bool) {
+	cm.enqueueQuery(connectionManagerMsgSetMaintenance(enabled))
+}
+
+func (cm *ConnectionManager) InMaintenance() bool {
+	cm.RLock()
+	defer cm.RUnlock()
+	return cm.maintenance
+}
+
+// SetClientTxnsPaused pauses or resumes the submission of txns from
+// client connections. Whilst paused, client txns are held by their
+// connections rather than rejected, so clients just see extra
+// latency. Txns from the local connection (e.g. topology changes) are
+// unaffected.
+func (cm *ConnectionManager) SetClientTxnsPaused(paused bool) {
+	cm.enqueueQuery(connectionManagerMsgSetClientTxnsPaused(paused))
+}
+
+func (cm *ConnectionManager) ClientTxnsPaused() bool {
+	cm.RLock()
+	defer cm.RUnlock()
+	return cm.clientTxnsPaused
+}
+
+// ClientRefusal returns a non-empty reason if the client connection
+// should be refused, along with the host to redirect the client to,
+// if any.
+func (cm *ConnectionManager) ClientRefusal(connNumber uint32) (reason string, redirect string) {
+	cm.RLock()
+	defer cm.RUnlock()
+	switch {
+	case cm.draining:
+		reason = "node is draining"
+	case cm.maintenance:
+		reason = "node is in maintenance mode"
+	default:
+		return "", ""
+	}
+	if len(cm.redirectHosts) != 0 {
+		redirect = cm.redirectHosts[int(connNumber)%len(cm.redirectHosts)]
+	}
+	return reason, redirect
+}
+
+// AdmitClientTxn returns an error if the client txn should be
+// refused: either because the node is read-only following disk write
+// failures and the txn would modify vars, or because the node is short
+// of space and the txn would create, write or roll vars. Reads (and
+// deletes, when short of space) are always admitted.
+func (cm *ConnectionManager) AdmitClientTxn(ctxn *msgs.ClientTxn) error {
+	modifies, grows := clientTxnEffects(ctxn)
+	if reason := cm.writeFailures.ReadOnly(); reason != "" && modifies {
+		return fmt.Errorf("%v", reason)
+	}
+	if reason := cm.spaceMonitor.Refusal(); reason != "" && grows {
+		return fmt.Errorf("%v", reason)
+	}
+	return nil
+}
+
+// clientTxnEffects returns whether any action of the client txn would
+// modify a var, and whether any would take more space on disk. A roll
+// leaves the value alone, but still writes a new txn record for the
+// var, so it grows the store just as a write does. Only a delete
+// modifies without growing.
+func clientTxnEffects(ctxn *msgs.ClientTxn) (modifies, grows bool) {
+	actions := ctxn.Actions()
+	for idx, l := 0, actions.Len(); idx < l; idx++ {
+		switch actions.At(idx).Which() {
+		case msgs.CLIENTACTION_READ:
+		case msgs.CLIENTACTION_DELETE:
+			modifies = true
+		default:
+			modifies, grows = true, true
+		}
+	}
+	return
+}
+
 func (cm *ConnectionManager) SetDesiredServers(localhost string, remotehosts []string) {
 	cm.enqueueQuery(&connectionManagerMsgSetDesired{
 		local:  localhost,
@@ -158,6 +297,30 @@ func (cm *ConnectionManager) Topology() *server.Topology {
 	return nil
 }
 
+// Readiness reports whether this node can currently expect to get
+// client txns through: we must have a topology, the root var must
+// exist, and we must be connected to at least F+1 of the RMs in the
+// topology (including ourself). If not ready, the reason says why.
+func (cm *ConnectionManager) Readiness() (bool, string) {
+	query := &connectionManagerMsgGetReadiness{
+		resultChan: make(chan struct{}),
+	}
+	if cm.enqueueSyncQuery(query, query.resultChan) {
+		return query.ready, query.reason
+	}
+	return false, "ConnectionManager is shut down"
+}
+
+func (cm *ConnectionManager) ConnectionsInfo() *ConnectionsInfo {
+	query := &connectionManagerMsgGetConnectionsInfo{
+		resultChan: make(chan struct{}),
+	}
+	if cm.enqueueSyncQuery(query, query.resultChan) {
+		return query.info
+	}
+	return nil
+}
+
 func (cm *ConnectionManager) SetTopology(topology *server.Topology) {
 	cm.enqueueQuery((*connectionManagerMsgSetTopology)(topology))
 }
@@ -200,7 +363,7 @@ func (cm *ConnectionManager) enqueueSyncQuery(msg connectionManagerMsg, resultCh
 	}
 }
 
-func NewConnectionManager(rmId common.RMId, bootCount uint32, procs int, disk *mdbs.MDBServer, passwordHash [sha256.Size]byte) (*ConnectionManager, *client.LocalConnection) {
+func NewConnectionManager(rmId common.RMId, bootCount uint32, procs int, disk db.Store, failures *db.WriteFailures, corruptions *db.Corruptions, spaceMonitor *db.SpaceMonitor, passwordHash [sha256.Size]byte) (*ConnectionManager, *client.LocalConnection) {
 	cm := &ConnectionManager{
 		RMId:              rmId,
 		BootCount:         bootCount,
@@ -210,6 +373,9 @@ func NewConnectionManager(rmId common.RMId, bootCount uint32, procs int, disk *m
 		connCountToClient: make(map[uint32]paxos.ClientConnection),
 		desired:           nil,
 		senders:           make(map[paxos.Sender]server.EmptyStruct),
+		writeFailures:     failures,
+		corruptions:       corruptions,
+		spaceMonitor:      spaceMonitor,
 	}
 	var head *cc.ChanCellHead
 	head, cm.cellTail = cc.NewChanCellTail(
@@ -231,7 +397,7 @@ func NewConnectionManager(rmId common.RMId, bootCount uint32, procs int, disk *m
 			}
 		})
 	lc := client.NewLocalConnection(rmId, bootCount, server.BlankTopology, cm)
-	cm.Dispatchers = paxos.NewDispatchers(cm, rmId, uint8(procs), disk, lc)
+	cm.Dispatchers = paxos.NewDispatchers(cm, rmId, uint8(procs), disk, failures, corruptions, lc)
 	cm.rmToServer[rmId] = &connectionWithBootCount{connectionSend: cm, bootCount: bootCount}
 	go cm.actorLoop(head)
 	cm.ClientEstablished(0, lc)
@@ -268,6 +434,16 @@ func (cm *ConnectionManager) actorLoop(head *cc.ChanCellHead) {
 				cm.updateTopology((*server.Topology)(msgT))
 			case *connectionManagerMsgGetTopology:
 				cm.getTopology(msgT)
+			case *connectionManagerMsgGetReadiness:
+				cm.getReadiness(msgT)
+			case *connectionManagerMsgGetConnectionsInfo:
+				cm.getConnectionsInfo(msgT)
+			case connectionManagerMsgDrain:
+				cm.drain(bool(msgT))
+			case connectionManagerMsgSetMaintenance:
+				cm.setMaintenance(bool(msgT))
+			case connectionManagerMsgSetClientTxnsPaused:
+				cm.setClientTxnsPaused(bool(msgT))
 			case *connectionManagerMsgClientEstablished:
 				cm.clientEstablished(msgT)
 			case *connectionManagerMsgStatus:
@@ -293,6 +469,7 @@ func (cm *ConnectionManager) actorLoop(head *cc.ChanCellHead) {
 func (cm *ConnectionManager) setDesiredServers(hosts *connectionManagerMsgSetDesired) {
 	cm.Lock()
 	cm.localHost = hosts.local
+	cm.redirectHosts = hosts.remote
 	cm.Unlock()
 	cm.desired = hosts.remote
 	oldServers := cm.servers
@@ -391,6 +568,76 @@ func (cm *ConnectionManager) clientEstablished(msg *connectionManagerMsgClientEs
 	close(msg.resultChan)
 }
 
+func (cm *ConnectionManager) drain(draining bool) {
+	cm.Lock()
+	if cm.draining == draining {
+		cm.Unlock()
+		return
+	}
+	cm.draining = draining
+	if !draining {
+		cm.Unlock()
+		log.Println("Drain cancelled: accepting client connections.")
+		return
+	}
+	clients := cm.clientConnections()
+	cm.Unlock()
+	log.Printf("Draining: closing %v client connections once their txns complete.\n", len(clients))
+	for _, conn := range clients {
+		conn.Drain()
+	}
+}
+
+func (cm *ConnectionManager) setMaintenance(enabled bool) {
+	cm.Lock()
+	if cm.maintenance == enabled {
+		cm.Unlock()
+		return
+	}
+	cm.maintenance = enabled
+	if !enabled {
+		cm.Unlock()
+		log.Println("Leaving maintenance mode: accepting client connections.")
+		return
+	}
+	clients := cm.clientConnections()
+	cm.Unlock()
+	log.Printf("Entering maintenance mode: closing %v client connections once their txns complete.\n", len(clients))
+	for _, conn := range clients {
+		conn.Drain()
+	}
+}
+
+func (cm *ConnectionManager) setClientTxnsPaused(paused bool) {
+	cm.Lock()
+	if cm.clientTxnsPaused == paused {
+		cm.Unlock()
+		return
+	}
+	cm.clientTxnsPaused = paused
+	clients := cm.clientConnections()
+	cm.Unlock()
+	if paused {
+		log.Println("Pausing client txns.")
+	} else {
+		log.Println("Resuming client txns.")
+	}
+	for _, conn := range clients {
+		conn.SetClientTxnsPaused(paused)
+	}
+}
+
+// Requires the lock to be held.
+func (cm *ConnectionManager) clientConnections() []*Connection {
+	clients := make([]*Connection, 0, len(cm.connCountToClient))
+	for _, cconn := range cm.connCountToClient {
+		if conn, ok := cconn.(*Connection); ok {
+			clients = append(clients, conn)
+		}
+	}
+	return clients
+}
+
 func (cm *ConnectionManager) startSender(sender paxos.Sender) {
 	if _, found := cm.senders[sender]; found {
 		server.Log(sender, "CM found duplicate add sender")
@@ -446,6 +693,69 @@ func (cm *ConnectionManager) getTopology(msg *connectionManagerMsgGetTopology) {
 	close(msg.resultChan)
 }
 
+func (cm *ConnectionManager) getReadiness(msg *connectionManagerMsgGetReadiness) {
+	topology := cm.topology
+	readOnly := cm.writeFailures.ReadOnly()
+	spaceRefusal := cm.spaceMonitor.Refusal()
+	switch {
+	case cm.draining:
+		msg.reason = "Node is draining"
+	case cm.maintenance:
+		msg.reason = "Node is in maintenance mode"
+	case readOnly != "":
+		msg.reason = readOnly
+	case spaceRefusal != "":
+		msg.reason = spaceRefusal
+	case topology == nil || topology.Equal(server.BlankTopology):
+		msg.reason = "No topology established"
+	case topology.RootVarUUId == nil:
+		msg.reason = "Root var does not exist"
+	default:
+		connected := 0
+		for _, rmId := range topology.AllRMs {
+			if _, found := cm.rmToServer[rmId]; found && rmId != common.RMIdEmpty {
+				connected++
+			}
+		}
+		if connected < int(topology.FInc) {
+			msg.reason = fmt.Sprintf("Connected to %v of %v RMs, but F+1 is %v", connected, topology.AllRMs.NonEmptyLen(), topology.FInc)
+		} else {
+			msg.ready = true
+		}
+	}
+	close(msg.resultChan)
+}
+
+func (cm *ConnectionManager) getConnectionsInfo(msg *connectionManagerMsgGetConnectionsInfo) {
+	// Clients are added and removed under the lock from other
+	// go-routines.
+	cm.RLock()
+	clientCount := len(cm.connCountToClient)
+	cm.RUnlock()
+	info := &ConnectionsInfo{
+		LocalHost:   cm.localHost,
+		RMId:        cm.RMId,
+		BootCount:   cm.BootCount,
+		Desired:     cm.desired,
+		Servers:     make([]ServerConnectionInfo, 0, len(cm.servers)),
+		ClientCount: clientCount,
+		SenderCount: len(cm.senders),
+	}
+	for host, conn := range cm.servers {
+		established, _, rmId, bootCount, _, _ := conn.RemoteDetails()
+		c, found := cm.rmToServer[rmId]
+		info.Servers = append(info.Servers, ServerConnectionInfo{
+			Host:        host,
+			RMId:        rmId,
+			BootCount:   bootCount,
+			Established: established,
+			Active:      found && c.connectionSend == conn,
+		})
+	}
+	msg.info = info
+	close(msg.resultChan)
+}
+
 func (cm *ConnectionManager) cloneRMToServer() map[common.RMId]paxos.Connection {
 	rmToServerCopy := make(map[common.RMId]paxos.Connection, len(cm.rmToServer))
 	for rmId, server := range cm.rmToServer {
@@ -457,6 +767,12 @@ func (cm *ConnectionManager) cloneRMToServer() map[common.RMId]paxos.Connection
 func (cm *ConnectionManager) status(sc *server.StatusConsumer) {
 	sc.Emit(fmt.Sprintf("Address: %v", cm.localHost))
 	sc.Emit(fmt.Sprintf("Boot Count: %v", cm.BootCount))
+	sc.Emit(fmt.Sprintf("Draining? %v", cm.draining))
+	sc.Emit(fmt.Sprintf("Maintenance? %v", cm.maintenance))
+	sc.Emit(fmt.Sprintf("Client Txns Paused? %v", cm.clientTxnsPaused))
+	cm.writeFailures.Status(sc.Fork())
+	cm.spaceMonitor.Status(sc.Fork())
+	cm.corruptions.Status(sc.Fork())
 	sc.Emit(fmt.Sprintf("Current Topology: %v", cm.topology))
 	serverConnections := make([]string, 0, len(cm.servers))
 	for server := range cm.servers {
@@ -494,6 +810,26 @@ func (cm *ConnectionManager) Send(b []byte) {
 	cm.Dispatchers.DispatchMessage(cm.RMId, msg.Which(), &msg)
 }
 
+type ConnectionsInfo struct {
+	LocalHost   string
+	RMId        common.RMId
+	BootCount   uint32
+	Desired     []string
+	Servers     []ServerConnectionInfo
+	ClientCount int
+	SenderCount int
+}
+
+// Active is true iff this connection is the one currently used to
+// talk to its RMId.
+type ServerConnectionInfo struct {
+	Host        string
+	RMId        common.RMId
+	BootCount   uint32
+	Established bool
+	Active      bool
+}
+
 type connectionWithBootCount struct {
 	connectionSend
 	bootCount uint32
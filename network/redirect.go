@@ -0,0 +1,35 @@
+package network
+
+import (
+	capn "github.com/glycerine/go-capnproto"
+	msgs "goshawkdb.io/common/capnp"
+)
+
+// A client which is refused because the node is draining or in
+// maintenance mode may be sent a redirect in place of the normal
+// HelloFromServer. A redirect is a HelloFromServer with an empty
+// namespace and with LocalHost set to the host the client should
+// connect to instead. Every normal HelloFromServer carries a
+// namespace (the client needs it to create var ids), so the two can
+// never be confused: a client which finds no namespace must not use
+// the connection, and should reconnect to the redirect host.
+//
+// After sending a redirect, the server closes the connection.
+
+// MakeRedirect returns a redirect to host.
+func MakeRedirect(host string) *capn.Segment {
+	seg := capn.NewBuffer(nil)
+	hello := msgs.NewRootHelloFromServer(seg)
+	hello.SetLocalHost(host)
+	return seg
+}
+
+// RedirectHost returns the host that hello redirects the client to. If
+// hello is not a redirect, ok is false.
+func RedirectHost(hello *msgs.HelloFromServer) (host string, ok bool) {
+	if len(hello.Namespace()) != 0 {
+		return "", false
+	}
+	host = hello.LocalHost()
+	return host, host != ""
+}
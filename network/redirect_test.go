@@ -0,0 +1,38 @@
+package network
+
+import (
+	capn "github.com/glycerine/go-capnproto"
+	"goshawkdb.io/common"
+	msgs "goshawkdb.io/common/capnp"
+	"goshawkdb.io/server"
+	"testing"
+)
+
+func TestRedirectRoundTrip(t *testing.T) {
+	seg, _, err := capn.ReadFromMemoryZeroCopy(server.SegToBytes(MakeRedirect("other:7894")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello := msgs.ReadRootHelloFromServer(seg)
+	if host, ok := RedirectHost(&hello); !ok || host != "other:7894" {
+		t.Fatalf("Expected redirect to other:7894; got '%s' (%v)", host, ok)
+	}
+}
+
+func TestHelloIsNotRedirect(t *testing.T) {
+	seg := capn.NewBuffer(nil)
+	hello := msgs.NewRootHelloFromServer(seg)
+	hello.SetLocalHost("self:7894")
+	hello.SetNamespace(make([]byte, common.KeyLen-8))
+	if host, ok := RedirectHost(&hello); ok {
+		t.Fatalf("Expected hello with namespace not to be a redirect; got redirect to '%s'", host)
+	}
+}
+
+func TestEmptyRedirectIsNotRedirect(t *testing.T) {
+	seg := capn.NewBuffer(nil)
+	hello := msgs.NewRootHelloFromServer(seg)
+	if _, ok := RedirectHost(&hello); ok {
+		t.Fatal("Expected hello with no namespace and no host not to be a redirect")
+	}
+}
@@ -3,12 +3,12 @@ package paxos
 import (
 	"fmt"
 	capn "github.com/glycerine/go-capnproto"
-	mdbs "github.com/msackman/gomdb/server"
 	"goshawkdb.io/common"
 	msgs "goshawkdb.io/common/capnp"
 	"goshawkdb.io/server"
 	"goshawkdb.io/server/db"
 	"log"
+	"time"
 )
 
 type Acceptor struct {
@@ -21,18 +21,19 @@ type Acceptor struct {
 	acceptorDeleteFromDisk
 }
 
-func NewAcceptor(txnId *common.TxnId, txn *msgs.Txn, am *AcceptorManager) *Acceptor {
+func NewAcceptor(txnId *common.TxnId, txn *msgs.Txn, txnDeflated bool, am *AcceptorManager) *Acceptor {
 	a := &Acceptor{
 		txnId:           txnId,
 		acceptorManager: am,
 	}
+	a.ballotAccumulator = NewBallotAccumulator(txnId, txn, txnDeflated)
 	a.init(txn)
 	return a
 }
 
 func AcceptorFromData(txnId *common.TxnId, txn *msgs.Txn, outcome *msgs.Outcome, sendToAll bool, instances *msgs.InstancesForVar_List, am *AcceptorManager) *Acceptor {
 	outcomeEqualId := (*outcomeEqualId)(outcome)
-	a := NewAcceptor(txnId, txn, am)
+	a := NewAcceptor(txnId, txn, false, am)
 	a.ballotAccumulator = BallotAccumulatorFromData(txnId, txn, outcomeEqualId, instances)
 	a.outcome = outcomeEqualId
 	a.sendToAll = sendToAll
@@ -106,7 +107,6 @@ type acceptorReceiveBallots struct {
 
 func (arb *acceptorReceiveBallots) init(a *Acceptor, txn *msgs.Txn) {
 	arb.Acceptor = a
-	arb.ballotAccumulator = NewBallotAccumulator(arb.txnId, txn)
 }
 
 func (arb *acceptorReceiveBallots) start()                                {}
@@ -115,14 +115,14 @@ func (arb *acceptorReceiveBallots) String() string {
 	return "acceptorReceiveBallots"
 }
 
-func (arb *acceptorReceiveBallots) BallotAccepted(instanceRMId common.RMId, inst *instance, vUUId *common.VarUUId, txn *msgs.Txn) {
+func (arb *acceptorReceiveBallots) BallotAccepted(instanceRMId common.RMId, inst *instance, vUUId *common.VarUUId, txn *msgs.Txn, txnDeflated bool) {
 	// We can accept a ballot from instanceRMId at any point up until
 	// we've received a TLC from instanceRMId (see notes in ALC re
 	// retry). Note an acceptor can change it's mind!
 	if arb.currentState == &arb.acceptorDeleteFromDisk {
 		log.Printf("Error: %v received ballot for instance %v after all TLCs received.", arb.txnId, instanceRMId)
 	}
-	outcome := arb.ballotAccumulator.BallotReceived(instanceRMId, inst, vUUId, txn)
+	outcome := arb.ballotAccumulator.BallotReceived(instanceRMId, inst, vUUId, txn, txnDeflated)
 	if outcome != nil && !outcome.Equal(arb.outcome) {
 		arb.outcome = outcome
 		arb.nextState(&arb.acceptorWriteToDisk)
@@ -155,24 +155,48 @@ func (awtd *acceptorWriteToDisk) start() {
 	state.SetInstances(awtd.ballotAccumulator.AddInstancesToSeg(stateSeg))
 
 	data := server.SegToBytes(stateSeg)
+	awtd.write(outcome, sendToAll, data, 0)
+}
 
+func (awtd *acceptorWriteToDisk) write(outcome *outcomeEqualId, sendToAll bool, data []byte, attempt uint) {
 	// to ensure correct order of writes, schedule the write from
 	// the current go-routine...
 	server.Log(awtd.txnId, "Writing 2B to disk...")
-	future := awtd.acceptorManager.Disk.ReadWriteTransaction(false, func(rwtxn *mdbs.RWTxn) (interface{}, error) {
-		return nil, rwtxn.Put(db.DB.BallotOutcomes, awtd.txnId[:], data, 0)
+	future := awtd.acceptorManager.Disk.ReadWriteTransaction(false, func(rwtxn db.RWTxn) (interface{}, error) {
+		return nil, rwtxn.Put(db.BallotOutcomes, awtd.txnId[:], db.AddChecksum(db.BallotOutcomes, awtd.txnId[:], data))
 	})
 	go func() {
 		// ... but process the result in a new go-routine to avoid blocking the executor.
 		if _, err := future.ResultError(); err != nil {
-			log.Printf("Error: %v Acceptor Write error: %v", awtd.txnId, err)
+			delay, retry := awtd.acceptorManager.WriteFailures.Failed(awtd.writeKey(), err, attempt)
+			if retry {
+				time.AfterFunc(delay, func() {
+					awtd.acceptorManager.Exe.Enqueue(func() { awtd.retryWrite(outcome, sendToAll, data, attempt+1) })
+				})
+			}
 			return
+		} else if attempt > 0 {
+			awtd.acceptorManager.WriteFailures.Succeeded(awtd.writeKey())
 		}
 		server.Log(awtd.txnId, "Writing 2B to disk...done.")
 		awtd.acceptorManager.Exe.Enqueue(func() { awtd.writeDone(outcome, sendToAll) })
 	}()
 }
 
+func (awtd *acceptorWriteToDisk) retryWrite(outcome *outcomeEqualId, sendToAll bool, data []byte, attempt uint) {
+	if awtd.outcome == outcome && awtd.currentState == awtd {
+		awtd.write(outcome, sendToAll, data, attempt)
+	} else {
+		// A later outcome has been written (or is being written) since,
+		// so this write is no longer needed.
+		awtd.acceptorManager.WriteFailures.Superseded(awtd.writeKey())
+	}
+}
+
+func (a *Acceptor) writeKey() string {
+	return fmt.Sprintf("%v Acceptor", a.txnId)
+}
+
 func (awtd *acceptorWriteToDisk) acceptorStateMachineComponentWitness() {}
 func (awtd *acceptorWriteToDisk) String() string {
 	return "acceptorWriteToDisk"
@@ -299,13 +323,28 @@ func (adfd *acceptorDeleteFromDisk) start() {
 		adfd.acceptorManager.ConnectionManager.RemoveSenderSync(adfd.twoBSender)
 		adfd.twoBSender = nil
 	}
-	future := adfd.acceptorManager.Disk.ReadWriteTransaction(false, func(rwtxn *mdbs.RWTxn) (interface{}, error) {
-		return nil, rwtxn.Del(db.DB.BallotOutcomes, adfd.txnId[:], nil)
+	adfd.deleteFromDisk(0)
+}
+
+func (adfd *acceptorDeleteFromDisk) deleteFromDisk(attempt uint) {
+	future := adfd.acceptorManager.Disk.ReadWriteTransaction(false, func(rwtxn db.RWTxn) (interface{}, error) {
+		return nil, rwtxn.Del(db.BallotOutcomes, adfd.txnId[:])
 	})
 	go func() {
 		if _, err := future.ResultError(); err != nil {
-			log.Printf("Error: %v Acceptor Deletion error: %v", adfd.txnId, err)
+			delay, retry := adfd.acceptorManager.WriteFailures.Failed(adfd.writeKey(), err, attempt)
+			if retry {
+				time.AfterFunc(delay, func() {
+					adfd.acceptorManager.Exe.Enqueue(func() {
+						if adfd.currentState == adfd {
+							adfd.deleteFromDisk(attempt + 1)
+						}
+					})
+				})
+			}
 			return
+		} else if attempt > 0 {
+			adfd.acceptorManager.WriteFailures.Succeeded(adfd.writeKey())
 		}
 		server.Log(adfd.txnId, "Deleted 2B from disk...done.")
 		adfd.acceptorManager.Exe.Enqueue(adfd.deletionDone)
@@ -2,14 +2,13 @@ package paxos
 
 import (
 	"fmt"
-	mdb "github.com/msackman/gomdb"
-	mdbs "github.com/msackman/gomdb/server"
 	"goshawkdb.io/common"
 	msgs "goshawkdb.io/common/capnp"
 	"goshawkdb.io/server"
 	"goshawkdb.io/server/db"
 	"goshawkdb.io/server/dispatcher"
 	"log"
+	"strings"
 )
 
 type AcceptorDispatcher struct {
@@ -18,13 +17,13 @@ type AcceptorDispatcher struct {
 	acceptormanagers  []*AcceptorManager
 }
 
-func NewAcceptorDispatcher(cm ConnectionManager, count uint8, server *mdbs.MDBServer) *AcceptorDispatcher {
+func NewAcceptorDispatcher(cm ConnectionManager, count uint8, server db.Store, failures *db.WriteFailures) *AcceptorDispatcher {
 	ad := &AcceptorDispatcher{
 		acceptormanagers: make([]*AcceptorManager, count),
 	}
 	ad.Dispatcher.Init(count)
 	for idx, exe := range ad.Executors {
-		ad.acceptormanagers[idx] = NewAcceptorManager(exe, cm, server)
+		ad.acceptormanagers[idx] = NewAcceptorManager(exe, cm, server, failures)
 	}
 	ad.loadFromDisk(server)
 	return ad
@@ -61,29 +60,96 @@ func (ad *AcceptorDispatcher) Status(sc *server.StatusConsumer) {
 	sc.Join()
 }
 
-func (ad *AcceptorDispatcher) loadFromDisk(server *mdbs.MDBServer) {
-	res, err := server.ReadonlyTransaction(func(rtxn *mdbs.RTxn) (interface{}, error) {
-		return rtxn.WithCursor(db.DB.BallotOutcomes, func(cursor *mdb.Cursor) (interface{}, error) {
-			// cursor.Get returns a copy of the data. So it's fine for us
-			// to store and process this later - it's not about to be
-			// overwritten on disk.
-			count := 0
-			txnIdData, acceptorState, err := cursor.Get(nil, nil, mdb.FIRST)
-			for ; err == nil; txnIdData, acceptorState, err = cursor.Get(nil, nil, mdb.NEXT) {
-				count++
-				txnId := common.MakeTxnId(txnIdData)
-				acceptorStateCopy := acceptorState
-				ad.withAcceptorManager(txnId, func(am *AcceptorManager) {
-					am.loadFromData(txnId, acceptorStateCopy)
-				})
+func (ad *AcceptorDispatcher) AcceptorCount() int {
+	results := make(chan int, len(ad.Executors))
+	for idx, executor := range ad.Executors {
+		manager := ad.acceptormanagers[idx]
+		if !executor.Enqueue(func() { results <- len(manager.acceptors) }) {
+			results <- 0
+		}
+	}
+	count := 0
+	for range ad.Executors {
+		count += <-results
+	}
+	return count
+}
+
+// SendingTwoBs returns the txns whose outcome our acceptor has
+// decided and written to disk, but which are still sending 2Bs as not
+// every learner has said it's locally complete, or the submitter has
+// not said its submission is complete. If among is not nil, only txns
+// in among are considered.
+func (ad *AcceptorDispatcher) SendingTwoBs(among map[common.TxnId]server.EmptyStruct) map[common.TxnId]server.EmptyStruct {
+	results := make(chan map[common.TxnId]server.EmptyStruct, len(ad.Executors))
+	for idx, executor := range ad.Executors {
+		manager := ad.acceptormanagers[idx]
+		result := make(map[common.TxnId]server.EmptyStruct)
+		if !executor.Enqueue(func() {
+			manager.sendingTwoBs(among, result)
+			results <- result
+		}) {
+			results <- result
+		}
+	}
+	txns := make(map[common.TxnId]server.EmptyStruct)
+	for range ad.Executors {
+		for txnId := range <-results {
+			txns[txnId] = server.EmptyStructVal
+		}
+	}
+	return txns
+}
+
+// CheckAcceptorStates verifies every acceptor state on disk. A damaged
+// acceptor state can't be fetched from elsewhere, as no other node
+// holds our acceptor's state, and nor can it be skipped: the votes it
+// has accepted may be all that stands between its txn and a different
+// outcome. So a node with a damaged acceptor state must not start.
+func CheckAcceptorStates(disk db.Store) error {
+	result, err := disk.ReadonlyTransaction(func(rtxn db.RTxn) (interface{}, error) {
+		damaged := []string{}
+		err := rtxn.ForEach(db.BallotOutcomes, func(txnIdData, acceptorState []byte) error {
+			_, err := db.VerifyChecksum(db.BallotOutcomes, txnIdData, acceptorState)
+			if ce, corrupt := db.IsCorruption(err); corrupt {
+				damaged = append(damaged, ce.Error())
+				return nil
 			}
-			if err == mdb.NotFound {
-				// fine, we just fell off the end as expected.
-				return count, nil
-			} else {
-				return count, err
+			return err
+		})
+		return damaged, err
+	}).ResultError()
+	if err != nil {
+		return err
+	}
+	if damaged := result.([]string); len(damaged) != 0 {
+		return fmt.Errorf("Refusing to start: %v damaged acceptor states, which can't be repaired: %v",
+			len(damaged), strings.Join(damaged, "; "))
+	}
+	return nil
+}
+
+// loadFromDisk restarts the acceptors found on disk. These must have
+// been checked with CheckAcceptorStates first.
+func (ad *AcceptorDispatcher) loadFromDisk(server db.Store) {
+	res, err := server.ReadonlyTransaction(func(rtxn db.RTxn) (interface{}, error) {
+		// ForEach passes us copies of the data. So it's fine for us
+		// to store and process this later - it's not about to be
+		// overwritten on disk.
+		count := 0
+		err := rtxn.ForEach(db.BallotOutcomes, func(txnIdData, acceptorState []byte) error {
+			acceptorState, err := db.VerifyChecksum(db.BallotOutcomes, txnIdData, acceptorState)
+			if err != nil {
+				panic(fmt.Sprintf("Acceptor state damaged since it was checked: %v", err))
 			}
+			count++
+			txnId := common.MakeTxnId(txnIdData)
+			ad.withAcceptorManager(txnId, func(am *AcceptorManager) {
+				am.loadFromData(txnId, acceptorState)
+			})
+			return nil
 		})
+		return count, err
 	}).ResultError()
 	if err == nil {
 		log.Printf("Loaded %v acceptors from disk\n", res.(int))
@@ -5,8 +5,6 @@ import (
 	"encoding/binary"
 	"fmt"
 	capn "github.com/glycerine/go-capnproto"
-	mdb "github.com/msackman/gomdb"
-	mdbs "github.com/msackman/gomdb/server"
 	"goshawkdb.io/common"
 	msgs "goshawkdb.io/common/capnp"
 	"goshawkdb.io/server"
@@ -15,21 +13,19 @@ import (
 	"log"
 )
 
-func init() {
-	db.DB.BallotOutcomes = &mdbs.DBISettings{Flags: mdb.CREATE}
-}
-
 type AcceptorManager struct {
-	Disk              *mdbs.MDBServer
+	Disk              db.Store
+	WriteFailures     *db.WriteFailures
 	ConnectionManager ConnectionManager
 	Exe               *dispatcher.Executor
 	instances         map[instanceId]*instance
 	acceptors         map[common.TxnId]*acceptorInstances
 }
 
-func NewAcceptorManager(exe *dispatcher.Executor, cm ConnectionManager, server *mdbs.MDBServer) *AcceptorManager {
+func NewAcceptorManager(exe *dispatcher.Executor, cm ConnectionManager, server db.Store, failures *db.WriteFailures) *AcceptorManager {
 	return &AcceptorManager{
 		Disk:              server,
+		WriteFailures:     failures,
 		ConnectionManager: cm,
 		Exe:               exe,
 		instances:         make(map[instanceId]*instance),
@@ -56,18 +52,18 @@ func (am *AcceptorManager) ensureInstance(txnId *common.TxnId, instId *instanceI
 	}
 }
 
-func (am *AcceptorManager) ensureAcceptor(txnId *common.TxnId, txnCap *msgs.Txn) *Acceptor {
+func (am *AcceptorManager) ensureAcceptor(txnId *common.TxnId, txnCap *msgs.Txn, txnDeflated bool) *Acceptor {
 	aInst, found := am.acceptors[*txnId]
 	switch {
 	case found && aInst.acceptor != nil:
 		return aInst.acceptor
 	case found:
-		a := NewAcceptor(txnId, txnCap, am)
+		a := NewAcceptor(txnId, txnCap, txnDeflated, am)
 		aInst.acceptor = a
 		a.Start()
 		return a
 	default:
-		a := NewAcceptor(txnId, txnCap, am)
+		a := NewAcceptor(txnId, txnCap, txnDeflated, am)
 		aInst = &acceptorInstances{acceptor: a}
 		am.acceptors[*txnId] = aInst
 		a.Start()
@@ -170,8 +166,9 @@ func (am *AcceptorManager) TwoATxnVotesReceived(sender common.RMId, txnId *commo
 	binary.BigEndian.PutUint32(instIdSlice[common.KeyLen:], uint32(instanceRMId))
 
 	txnCap := twoATxnVotes.Txn()
-	a := am.ensureAcceptor(txnId, &txnCap)
 	requests := twoATxnVotes.AcceptRequests()
+	txnDeflated := twoADeflated(&requests)
+	a := am.ensureAcceptor(txnId, &txnCap, txnDeflated)
 	failureInstances := make([]*instance, 0, requests.Len())
 	failureRequests := make([]*msgs.TxnVoteAcceptRequest, 0, requests.Len())
 
@@ -182,7 +179,7 @@ func (am *AcceptorManager) TwoATxnVotesReceived(sender common.RMId, txnId *commo
 		inst := am.ensureInstance(txnId, &instId, vUUId)
 		accepted, rejected := inst.TwoATxnVotesReceived(&request)
 		if accepted {
-			a.BallotAccepted(instanceRMId, inst, vUUId, &txnCap)
+			a.BallotAccepted(instanceRMId, inst, vUUId, &txnCap, txnDeflated)
 		} else if rejected {
 			failureInstances = append(failureInstances, inst)
 			failureRequests = append(failureRequests, &request)
@@ -249,6 +246,22 @@ func (am *AcceptorManager) AcceptorFinished(txnId *common.TxnId) {
 	}
 }
 
+// sendingTwoBs adds to result the txns of among, or of every acceptor
+// if among is nil, whose outcome is decided and on disk, but which are
+// still sending 2Bs.
+func (am *AcceptorManager) sendingTwoBs(among, result map[common.TxnId]server.EmptyStruct) {
+	for txnId, aInst := range am.acceptors {
+		if among != nil {
+			if _, found := among[txnId]; !found {
+				continue
+			}
+		}
+		if acc := aInst.acceptor; acc != nil && acc.currentState == &acc.acceptorAwaitLocallyComplete {
+			result[txnId] = server.EmptyStructVal
+		}
+	}
+}
+
 func (am *AcceptorManager) Status(sc *server.StatusConsumer) {
 	s := sc.Fork()
 	s.Emit(fmt.Sprintf("- Live Instances: %v", len(am.instances)))
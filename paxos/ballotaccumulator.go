@@ -13,6 +13,7 @@ import (
 
 type BallotAccumulator struct {
 	Txn            *msgs.Txn
+	txnDeflated    bool
 	txnId          *common.TxnId
 	vUUIdToBallots map[common.VarUUId]*varBallot
 	outcome        *outcomeEqualId
@@ -24,10 +25,16 @@ type BallotAccumulator struct {
 // paxos instance namespace is {rmId,varId}. So for each var, we
 // expect to see ballots from fInc distinct rms.
 
-func NewBallotAccumulator(txnId *common.TxnId, txn *msgs.Txn) *BallotAccumulator {
+// txnDeflated says whether txn is the deflation of the txn, which
+// only carries the ids of the vars. A txn which only deletes vars has
+// nothing but ACTION_MISSING actions, just as a deflated txn does, so
+// that can't be told from the txn itself: it has to be known from how
+// the txn arrived.
+func NewBallotAccumulator(txnId *common.TxnId, txn *msgs.Txn, txnDeflated bool) *BallotAccumulator {
 	actions := txn.Actions()
 	ba := &BallotAccumulator{
 		Txn:            txn,
+		txnDeflated:    txnDeflated,
 		txnId:          txnId,
 		vUUIdToBallots: make(map[common.VarUUId]*varBallot),
 		outcome:        nil,
@@ -85,7 +92,8 @@ type rmBallot struct {
 }
 
 func BallotAccumulatorFromData(txnId *common.TxnId, txn *msgs.Txn, outcome *outcomeEqualId, instances *msgs.InstancesForVar_List) *BallotAccumulator {
-	ba := NewBallotAccumulator(txnId, txn)
+	// Only the txn of a commit is certain to be whole.
+	ba := NewBallotAccumulator(txnId, txn, (*msgs.Outcome)(outcome).Which() != msgs.OUTCOME_COMMIT)
 	ba.outcome = outcome
 
 	for idx, l := 0, instances.Len(); idx < l; idx++ {
@@ -119,9 +127,10 @@ func BallotAccumulatorFromData(txnId *common.TxnId, txn *msgs.Txn, outcome *outc
 // For every vUUId involved in this txn, we should see fInc * ballots:
 // one from each RM voting for each vUUId. rmId is the paxos
 // instanceRMId.
-func (ba *BallotAccumulator) BallotReceived(instanceRMId common.RMId, inst *instance, vUUId *common.VarUUId, txn *msgs.Txn) *outcomeEqualId {
-	if isDeflated(ba.Txn) && !isDeflated(txn) {
+func (ba *BallotAccumulator) BallotReceived(instanceRMId common.RMId, inst *instance, vUUId *common.VarUUId, txn *msgs.Txn, txnDeflated bool) *outcomeEqualId {
+	if ba.txnDeflated && !txnDeflated {
 		ba.Txn = txn
+		ba.txnDeflated = false
 	}
 
 	vBallot := ba.vUUIdToBallots[*vUUId]
@@ -207,8 +216,11 @@ func (ba *BallotAccumulator) determineOutcome() *outcomeEqualId {
 	}
 
 	if aborted {
-		deflatedTxn := deflateTxn(ba.Txn, seg)
-		outcome.SetTxn(*deflatedTxn)
+		if ba.txnDeflated {
+			outcome.SetTxn(*ba.Txn)
+		} else {
+			outcome.SetTxn(*deflateTxn(ba.Txn, seg))
+		}
 		outcome.SetAbort()
 		abort := outcome.Abort()
 		if deadlock {
@@ -327,9 +339,6 @@ func (vb *varBallot) combineVote(rmBal *rmBallot, br badReads) {
 }
 
 func deflateTxn(txn *msgs.Txn, seg *capn.Segment) *msgs.Txn {
-	if isDeflated(txn) {
-		return txn
-	}
 	deflatedTxn := msgs.NewTxn(seg)
 	deflatedTxn.SetId(txn.Id())
 	deflatedTxn.SetRetry(txn.Retry())
@@ -352,9 +361,16 @@ func deflateTxn(txn *msgs.Txn, seg *capn.Segment) *msgs.Txn {
 	return &deflatedTxn
 }
 
-func isDeflated(txn *msgs.Txn) bool {
-	actions := txn.Actions()
-	return actions.Len() != 0 && actions.At(0).Which() == msgs.ACTION_MISSING
+// twoADeflated says whether the txn of a 2A was deflated by its
+// proposer, which it is if any of the ballots is not to commit (see
+// proposal.maybeSendTwoA).
+func twoADeflated(requests *msgs.TxnVoteAcceptRequest_List) bool {
+	for idx, l := 0, requests.Len(); idx < l; idx++ {
+		if requests.At(idx).Ballot().Vote().Which() != msgs.VOTE_COMMIT {
+			return true
+		}
+	}
+	return false
 }
 
 type badReads map[common.VarUUId]*badReadAction
@@ -487,6 +503,12 @@ func (br badReads) AddToSeg(seg *capn.Segment) msgs.Update_List {
 				newAction.SetMissing()
 			case msgs.ACTION_WRITE:
 				actionList.Set(idy, *action)
+			case msgs.ACTION_MISSING:
+				// Readers needn't know what version a delete was
+				// guarded by.
+				newAction := actionList.At(idy)
+				newAction.SetVarId(action.VarId())
+				newAction.SetMissing()
 			case msgs.ACTION_READWRITE:
 				readWrite := action.Readwrite()
 				newAction := actionList.At(idy)
@@ -3,23 +3,22 @@ package paxos
 import (
 	"encoding/binary"
 	"fmt"
-	mdb "github.com/msackman/gomdb"
-	mdbs "github.com/msackman/gomdb/server"
 	"goshawkdb.io/common"
 	msgs "goshawkdb.io/common/capnp"
 	"goshawkdb.io/server"
+	"goshawkdb.io/server/db"
 	eng "goshawkdb.io/server/txnengine"
 )
 
 type Dispatchers struct {
-	disk               *mdbs.MDBServer
+	disk               db.Store
 	AcceptorDispatcher *AcceptorDispatcher
 	VarDispatcher      *eng.VarDispatcher
 	ProposerDispatcher *ProposerDispatcher
 	connectionManager  ConnectionManager
 }
 
-func NewDispatchers(cm ConnectionManager, rmId common.RMId, count uint8, disk *mdbs.MDBServer, lc eng.LocalConnection) *Dispatchers {
+func NewDispatchers(cm ConnectionManager, rmId common.RMId, count uint8, disk db.Store, failures *db.WriteFailures, corruptions *db.Corruptions, lc eng.LocalConnection) *Dispatchers {
 	// It actually doesn't matter at this point what order we start up
 	// the acceptors. This is because we are called from the
 	// ConnectionManager constructor, and its actor loop hasn't been
@@ -30,11 +29,11 @@ func NewDispatchers(cm ConnectionManager, rmId common.RMId, count uint8, disk *m
 
 	d := &Dispatchers{
 		disk:               disk,
-		AcceptorDispatcher: NewAcceptorDispatcher(cm, count, disk),
-		VarDispatcher:      eng.NewVarDispatcher(count, disk, lc),
+		AcceptorDispatcher: NewAcceptorDispatcher(cm, count, disk, failures),
+		VarDispatcher:      eng.NewVarDispatcher(count, disk, failures, corruptions, lc),
 		connectionManager:  cm,
 	}
-	d.ProposerDispatcher = NewProposerDispatcher(count, rmId, d.VarDispatcher, cm, disk)
+	d.ProposerDispatcher = NewProposerDispatcher(count, rmId, d.VarDispatcher, cm, disk, failures)
 
 	return d
 }
@@ -87,7 +86,7 @@ func (d *Dispatchers) DispatchMessage(sender common.RMId, msgType msgs.Message_W
 func IsDatabaseClean(varDispatcher *eng.VarDispatcher) bool {
 	resultChan := make(chan bool, 1)
 	varDispatcher.ApplyToVar(func(v *eng.Var, err error) {
-		resultChan <- err == mdb.NotFound
+		resultChan <- err == db.NotFound
 	}, false, server.TopologyVarUUId)
 	return <-resultChan
 }
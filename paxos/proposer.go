@@ -3,13 +3,13 @@ package paxos
 import (
 	"fmt"
 	capn "github.com/glycerine/go-capnproto"
-	mdbs "github.com/msackman/gomdb/server"
 	"goshawkdb.io/common"
 	msgs "goshawkdb.io/common/capnp"
 	"goshawkdb.io/server"
 	"goshawkdb.io/server/db"
 	eng "goshawkdb.io/server/txnengine"
 	"log"
+	"time"
 )
 
 type ProposerMode uint8
@@ -364,19 +364,37 @@ func (palc *proposerAwaitLocallyComplete) maybeWriteToDisk() {
 	}
 
 	data := server.SegToBytes(stateSeg)
+	palc.writeToDisk(data, 0)
+}
 
-	future := palc.proposerManager.Disk.ReadWriteTransaction(false, func(rwtxn *mdbs.RWTxn) (interface{}, error) {
-		return nil, rwtxn.Put(db.DB.Proposers, palc.txnId[:], data, 0)
+func (palc *proposerAwaitLocallyComplete) writeToDisk(data []byte, attempt uint) {
+	future := palc.proposerManager.Disk.ReadWriteTransaction(false, func(rwtxn db.RWTxn) (interface{}, error) {
+		return nil, rwtxn.Put(db.Proposers, palc.txnId[:], data)
 	})
 	go func() {
 		if _, err := future.ResultError(); err != nil {
-			log.Printf("Error: %v when writing proposer to disk: %v\n", palc.txnId, err)
+			delay, retry := palc.proposerManager.WriteFailures.Failed(palc.writeKey(), err, attempt)
+			if retry {
+				time.AfterFunc(delay, func() {
+					palc.proposerManager.Exe.Enqueue(func() {
+						if palc.currentState == palc {
+							palc.writeToDisk(data, attempt+1)
+						}
+					})
+				})
+			}
 			return
+		} else if attempt > 0 {
+			palc.proposerManager.WriteFailures.Succeeded(palc.writeKey())
 		}
 		palc.proposerManager.Exe.Enqueue(palc.writeDone)
 	}()
 }
 
+func (p *Proposer) writeKey() string {
+	return fmt.Sprintf("%v Proposer", p.txnId)
+}
+
 func (palc *proposerAwaitLocallyComplete) writeDone() {
 	if palc.currentState == palc {
 		palc.nextState()
@@ -453,22 +471,33 @@ func (paf *proposerAwaitFinished) TxnFinished() {
 	server.Log(paf.txnId, "Txn Finished Callback")
 	if paf.currentState == paf {
 		paf.nextState()
-		future := paf.proposerManager.Disk.ReadWriteTransaction(false, func(rwtxn *mdbs.RWTxn) (interface{}, error) {
-			return nil, rwtxn.Del(db.DB.Proposers, paf.txnId[:], nil)
-		})
-		go func() {
-			if _, err := future.ResultError(); err != nil {
-				log.Printf("Error: %v when deleting proposer from disk: %v\n", paf.txnId, err)
-				return
-			}
-			paf.proposerManager.Exe.Enqueue(func() {
-				paf.proposerManager.ConnectionManager.RemoveSenderAsync(paf.tlcSender)
-				paf.tlcSender = nil
-				paf.proposerManager.TxnFinished(paf.txnId)
-			})
-		}()
+		paf.deleteFromDisk(0)
 	} else {
 		log.Printf("Error: %v TxnFinished callback invoked with proposer in wrong state: %v",
 			paf.txnId, paf.currentState)
 	}
 }
+
+func (paf *proposerAwaitFinished) deleteFromDisk(attempt uint) {
+	future := paf.proposerManager.Disk.ReadWriteTransaction(false, func(rwtxn db.RWTxn) (interface{}, error) {
+		return nil, rwtxn.Del(db.Proposers, paf.txnId[:])
+	})
+	go func() {
+		if _, err := future.ResultError(); err != nil {
+			delay, retry := paf.proposerManager.WriteFailures.Failed(paf.writeKey(), err, attempt)
+			if retry {
+				time.AfterFunc(delay, func() {
+					paf.proposerManager.Exe.Enqueue(func() { paf.deleteFromDisk(attempt + 1) })
+				})
+			}
+			return
+		} else if attempt > 0 {
+			paf.proposerManager.WriteFailures.Succeeded(paf.writeKey())
+		}
+		paf.proposerManager.Exe.Enqueue(func() {
+			paf.proposerManager.ConnectionManager.RemoveSenderAsync(paf.tlcSender)
+			paf.tlcSender = nil
+			paf.proposerManager.TxnFinished(paf.txnId)
+		})
+	}()
+}
@@ -2,8 +2,6 @@ package paxos
 
 import (
 	"fmt"
-	mdb "github.com/msackman/gomdb"
-	mdbs "github.com/msackman/gomdb/server"
 	"goshawkdb.io/common"
 	msgs "goshawkdb.io/common/capnp"
 	"goshawkdb.io/server"
@@ -18,13 +16,13 @@ type ProposerDispatcher struct {
 	proposermanagers []*ProposerManager
 }
 
-func NewProposerDispatcher(count uint8, rmId common.RMId, varDispatcher *eng.VarDispatcher, cm ConnectionManager, server *mdbs.MDBServer) *ProposerDispatcher {
+func NewProposerDispatcher(count uint8, rmId common.RMId, varDispatcher *eng.VarDispatcher, cm ConnectionManager, server db.Store, failures *db.WriteFailures) *ProposerDispatcher {
 	pd := &ProposerDispatcher{
 		proposermanagers: make([]*ProposerManager, count),
 	}
 	pd.Dispatcher.Init(count)
 	for idx, exe := range pd.Executors {
-		pd.proposermanagers[idx] = NewProposerManager(rmId, exe, varDispatcher, cm, server)
+		pd.proposermanagers[idx] = NewProposerManager(rmId, exe, varDispatcher, cm, server, failures)
 	}
 	pd.loadFromDisk(server)
 	return pd
@@ -74,29 +72,46 @@ func (pd *ProposerDispatcher) Status(sc *server.StatusConsumer) {
 	sc.Join()
 }
 
-func (pd *ProposerDispatcher) loadFromDisk(server *mdbs.MDBServer) {
-	res, err := server.ReadonlyTransaction(func(rtxn *mdbs.RTxn) (interface{}, error) {
-		return rtxn.WithCursor(db.DB.Proposers, func(cursor *mdb.Cursor) (interface{}, error) {
-			// cursor.Get returns a copy of the data. So it's fine for us
-			// to store and process this later - it's not about to be
-			// overwritten on disk.
-			count := 0
-			txnIdData, proposerState, err := cursor.Get(nil, nil, mdb.FIRST)
-			for ; err == nil; txnIdData, proposerState, err = cursor.Get(nil, nil, mdb.NEXT) {
-				count++
-				txnId := common.MakeTxnId(txnIdData)
-				proposerStateCopy := proposerState
-				pd.withProposerManager(txnId, func(pm *ProposerManager) {
-					pm.loadFromData(txnId, proposerStateCopy)
-				})
-			}
-			if err == mdb.NotFound {
-				// fine, we just fell off the end as expected.
-				return count, nil
-			} else {
-				return count, err
-			}
+func (pd *ProposerDispatcher) ProposerCount() int {
+	return pd.count(func(pm *ProposerManager) int { return len(pm.proposers) })
+}
+
+// LocalProposerCount returns the number of proposers for txns which
+// were submitted through this RM.
+func (pd *ProposerDispatcher) LocalProposerCount() int {
+	return pd.count((*ProposerManager).localProposerCount)
+}
+
+func (pd *ProposerDispatcher) count(fun func(*ProposerManager) int) int {
+	results := make(chan int, len(pd.Executors))
+	for idx, executor := range pd.Executors {
+		manager := pd.proposermanagers[idx]
+		if !executor.Enqueue(func() { results <- fun(manager) }) {
+			results <- 0
+		}
+	}
+	count := 0
+	for range pd.Executors {
+		count += <-results
+	}
+	return count
+}
+
+func (pd *ProposerDispatcher) loadFromDisk(server db.Store) {
+	res, err := server.ReadonlyTransaction(func(rtxn db.RTxn) (interface{}, error) {
+		// ForEach passes us copies of the data. So it's fine for us
+		// to store and process this later - it's not about to be
+		// overwritten on disk.
+		count := 0
+		err := rtxn.ForEach(db.Proposers, func(txnIdData, proposerState []byte) error {
+			count++
+			txnId := common.MakeTxnId(txnIdData)
+			pd.withProposerManager(txnId, func(pm *ProposerManager) {
+				pm.loadFromData(txnId, proposerState)
+			})
+			return nil
 		})
+		return count, err
 	}).ResultError()
 	if err == nil {
 		log.Printf("Loaded %v proposers from disk\n", res.(int))
@@ -4,8 +4,6 @@ import (
 	"encoding/binary"
 	"fmt"
 	capn "github.com/glycerine/go-capnproto"
-	mdb "github.com/msackman/gomdb"
-	mdbs "github.com/msackman/gomdb/server"
 	"goshawkdb.io/common"
 	msgs "goshawkdb.io/common/capnp"
 	"goshawkdb.io/server"
@@ -15,10 +13,6 @@ import (
 	"log"
 )
 
-func init() {
-	db.DB.Proposers = &mdbs.DBISettings{Flags: mdb.CREATE}
-}
-
 const ( //                  txnId  rmId
 	instanceIdPrefixLen = common.KeyLen + 4
 )
@@ -30,12 +24,13 @@ type ProposerManager struct {
 	VarDispatcher     *eng.VarDispatcher
 	Exe               *dispatcher.Executor
 	ConnectionManager ConnectionManager
-	Disk              *mdbs.MDBServer
+	Disk              db.Store
+	WriteFailures     *db.WriteFailures
 	proposals         map[instanceIdPrefix]*proposal
 	proposers         map[common.TxnId]*Proposer
 }
 
-func NewProposerManager(rmId common.RMId, exe *dispatcher.Executor, varDispatcher *eng.VarDispatcher, cm ConnectionManager, server *mdbs.MDBServer) *ProposerManager {
+func NewProposerManager(rmId common.RMId, exe *dispatcher.Executor, varDispatcher *eng.VarDispatcher, cm ConnectionManager, server db.Store, failures *db.WriteFailures) *ProposerManager {
 	pm := &ProposerManager{
 		RMId:              rmId,
 		proposals:         make(map[instanceIdPrefix]*proposal),
@@ -44,6 +39,7 @@ func NewProposerManager(rmId common.RMId, exe *dispatcher.Executor, varDispatche
 		Exe:               exe,
 		ConnectionManager: cm,
 		Disk:              server,
+		WriteFailures:     failures,
 	}
 	return pm
 }
@@ -213,6 +209,20 @@ func (pm *ProposerManager) TxnSubmissionAbortReceived(sender common.RMId, txnId
 	}
 }
 
+// Only proposers which are voting hold the txn, so only they can tell
+// who submitted it. A txn submitted through us on which we don't vote
+// is left to the client connection which submitted it: that
+// connection doesn't close whilst it's waiting for the outcome.
+func (pm *ProposerManager) localProposerCount() int {
+	count := 0
+	for _, prop := range pm.proposers {
+		if prop.txn != nil && common.RMId(prop.txn.TxnCap.Submitter()) == pm.RMId {
+			count++
+		}
+	}
+	return count
+}
+
 // from proposer
 func (pm *ProposerManager) TxnFinished(txnId *common.TxnId) {
 	delete(pm.proposers, *txnId)
@@ -0,0 +1,588 @@
+package txnengine
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	capn "github.com/glycerine/go-capnproto"
+	"goshawkdb.io/common"
+	msgs "goshawkdb.io/common/capnp"
+	"goshawkdb.io/server"
+	ch "goshawkdb.io/server/consistenthash"
+	"goshawkdb.io/server/db"
+	"hash/crc32"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AntiEntropy checks that this node agrees with the other replicas of
+// the vars it holds. Each var is held by the first 2F+1 RMs its
+// positions resolve to; for every other node, we compare digests of
+// (vUUId, writeTxnId, writesClock) for the vars the two of us share.
+//
+// Vars are hashed into server.AntiEntropyBuckets buckets, and the
+// digest of a bucket is the XOR of the digests of its vars, so only
+// the buckets which differ need their vars listing. Replicas can
+// legitimately differ for a short time whilst a txn is applied, so a
+// var is only reported as divergent if it still differs after
+// server.AntiEntropyRecheckDelay.
+//
+// Our vars are indexed, by bucket, with a single scan, which is shared
+// for a short time by our own round and by our peers' requests of us.
+//
+// If repair is enabled, a divergent var is replaced with the version
+// held by at least F+1 of its replicas, provided it's not active and
+// our copy hasn't changed in the meantime. Each node only ever repairs
+// its own copies.
+type AntiEntropy struct {
+	sync.Mutex
+	varDispatcher *VarDispatcher
+	disk          db.Store
+	rmId          common.RMId
+	topology      func() *server.Topology
+	replicas      Replicas
+	repair        bool
+	running       bool
+	last          *AntiEntropyResult
+	indexLock     sync.Mutex
+	index         *digestIndex
+}
+
+// Replicas gives access to the other nodes' copies of the vars we
+// share with them.
+type Replicas interface {
+	// Peers returns the other nodes we can currently reach.
+	Peers() []common.RMId
+	// BucketDigests returns the peer's digest of each bucket, over
+	// the vars it shares with us.
+	BucketDigests(rmId common.RMId) ([][]byte, error)
+	// BucketEntries returns the peer's digest of each var in the
+	// bucket which it shares with us.
+	BucketEntries(rmId common.RMId, bucket int) ([]*DigestEntry, error)
+	// FetchRecord fetches the other replicas' copies of a record. It
+	// is a db.RecordFetcher.
+	FetchRecord(table db.Table, key []byte) (map[common.RMId][]byte, int, error)
+}
+
+type DigestEntry struct {
+	VarUUId *common.VarUUId
+	Digest  []byte
+}
+
+type AntiEntropyResult struct {
+	Started        time.Time
+	Finished       time.Time
+	Peers          int
+	Compared       int
+	DivergentCount int
+	Divergent      []string
+	Repaired       int
+	PeerErrors     []string
+	Error          string
+}
+
+func NewAntiEntropy(vd *VarDispatcher, disk db.Store, rmId common.RMId, topology func() *server.Topology, replicas Replicas, repair bool) *AntiEntropy {
+	return &AntiEntropy{
+		varDispatcher: vd,
+		disk:          disk,
+		rmId:          rmId,
+		topology:      topology,
+		replicas:      replicas,
+		repair:        repair,
+	}
+}
+
+// VarDigest returns the digest of the var's vUUId, writeTxnId and
+// writesClock.
+func VarDigest(vUUId *common.VarUUId, varCap *msgs.Var) []byte {
+	hash := sha256.New()
+	hash.Write(vUUId[:])
+	hash.Write(varCap.WriteTxnId())
+	writesClock := VectorClockFromCap(varCap.WritesClock()).Clock
+	keys := make([]common.VarUUId, 0, len(writesClock))
+	for key := range writesClock {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i][:], keys[j][:]) < 0 })
+	value := make([]byte, 8)
+	for _, key := range keys {
+		binary.BigEndian.PutUint64(value, writesClock[key])
+		hash.Write(key[:])
+		hash.Write(value)
+	}
+	return hash.Sum(nil)
+}
+
+// DigestBucket returns the bucket the var is hashed into.
+func DigestBucket(vUUId *common.VarUUId) int {
+	return int(crc32.ChecksumIEEE(vUUId[:]) % server.AntiEntropyBuckets)
+}
+
+// LastResult returns the result of the most recently completed run,
+// or nil if there has not been one.
+func (ae *AntiEntropy) LastResult() *AntiEntropyResult {
+	ae.Lock()
+	defer ae.Unlock()
+	return ae.last
+}
+
+// Run compares our vars with every peer we can reach, and repairs
+// divergent vars if enabled. Only one run may happen at a time.
+func (ae *AntiEntropy) Run() (*AntiEntropyResult, error) {
+	ae.Lock()
+	if ae.running {
+		ae.Unlock()
+		return nil, fmt.Errorf("Anti-entropy already running")
+	}
+	ae.running = true
+	ae.Unlock()
+
+	result := &AntiEntropyResult{Started: time.Now()}
+	err := ae.run(result)
+	result.Finished = time.Now()
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	ae.Lock()
+	ae.running = false
+	ae.last = result
+	ae.Unlock()
+	return result, err
+}
+
+func (ae *AntiEntropy) run(result *AntiEntropyResult) error {
+	if ae.replicas == nil {
+		return fmt.Errorf("No means of reaching other replicas")
+	}
+	topology := ae.topology()
+	if topology == nil {
+		return fmt.Errorf("No topology established")
+	}
+	peers := ae.replicas.Peers()
+	result.Peers = len(peers)
+
+	divergent, err := ae.compare(topology, peers, result, nil)
+	if err != nil {
+		return err
+	}
+	if len(divergent) == 0 {
+		log.Printf("Anti-entropy: %v vars compared with %v peers; no divergence.\n", result.Compared, len(peers))
+		return nil
+	}
+
+	time.Sleep(server.AntiEntropyRecheckDelay)
+	if divergent, err = ae.compare(topology, peers, nil, divergent); err != nil {
+		return err
+	}
+	result.DivergentCount = len(divergent)
+	vUUIds := make([]common.VarUUId, 0, len(divergent))
+	for vUUId := range divergent {
+		vUUIds = append(vUUIds, vUUId)
+	}
+	sort.Slice(vUUIds, func(i, j int) bool { return bytes.Compare(vUUIds[i][:], vUUIds[j][:]) < 0 })
+	for _, vUUId := range vUUIds {
+		if len(result.Divergent) == server.AntiEntropyMaxReported {
+			break
+		}
+		rmIds := make([]common.RMId, 0, len(divergent[vUUId]))
+		for rmId := range divergent[vUUId] {
+			rmIds = append(rmIds, rmId)
+		}
+		sort.Slice(rmIds, func(i, j int) bool { return rmIds[i] < rmIds[j] })
+		vUUIdCopy := vUUId
+		result.Divergent = append(result.Divergent, fmt.Sprintf("%v differs from %v", &vUUIdCopy, rmIds))
+	}
+	log.Printf("Anti-entropy: %v vars compared with %v peers; %v divergent.\n", result.Compared, len(peers), len(divergent))
+
+	if !ae.repair {
+		return nil
+	}
+	for _, vUUId := range vUUIds {
+		vUUIdCopy := vUUId
+		replaced, err := ae.repairVar(topology, &vUUIdCopy)
+		if err != nil {
+			log.Printf("Anti-entropy: unable to repair %v: %v\n", &vUUIdCopy, err)
+		} else if replaced {
+			result.Repaired++
+		}
+	}
+	log.Printf("Anti-entropy: repaired %v vars.\n", result.Repaired)
+	return nil
+}
+
+// compare finds the vars on which we differ from each peer. If only is
+// not nil, only those vars are compared. Errors from individual peers
+// are recorded in result if it's not nil. Our vars are scanned once,
+// whatever the number of peers and buckets.
+func (ae *AntiEntropy) compare(topology *server.Topology, peers []common.RMId, result *AntiEntropyResult, only map[common.VarUUId]map[common.RMId]server.EmptyStruct) (map[common.VarUUId]map[common.RMId]server.EmptyStruct, error) {
+	index, err := ae.digestIndex(topology)
+	if err != nil {
+		return nil, err
+	}
+	divergent := make(map[common.VarUUId]map[common.RMId]server.EmptyStruct)
+	for _, rmId := range peers {
+		var buckets map[int]server.EmptyStruct
+		if only == nil {
+			remote, err := ae.replicas.BucketDigests(rmId)
+			if err != nil {
+				if result != nil {
+					result.PeerErrors = append(result.PeerErrors, fmt.Sprintf("%v: %v", rmId, err))
+				}
+				continue
+			}
+			local := index.bucketDigests(rmId)
+			buckets = make(map[int]server.EmptyStruct)
+			for bucket, digest := range local {
+				if bucket >= len(remote) || !bytes.Equal(digest, remote[bucket]) {
+					buckets[bucket] = server.EmptyStructVal
+				}
+			}
+		} else {
+			buckets = make(map[int]server.EmptyStruct)
+			for vUUId, rmIds := range only {
+				if _, found := rmIds[rmId]; found {
+					buckets[DigestBucket(&vUUId)] = server.EmptyStructVal
+				}
+			}
+		}
+
+		for bucket := range buckets {
+			entries, err := ae.replicas.BucketEntries(rmId, bucket)
+			if err != nil {
+				if result != nil {
+					result.PeerErrors = append(result.PeerErrors, fmt.Sprintf("%v: %v", rmId, err))
+				}
+				break
+			}
+			remote := make(map[common.VarUUId][]byte, len(entries))
+			for _, entry := range entries {
+				remote[*entry.VarUUId] = entry.Digest
+			}
+			local := index.bucketEntries(rmId, bucket)
+			for vUUId, digest := range local {
+				if result != nil {
+					result.Compared++
+				}
+				if !bytes.Equal(digest, remote[vUUId]) {
+					divergent = addDivergence(divergent, only, vUUId, rmId)
+				}
+			}
+			for vUUId := range remote {
+				if _, found := local[vUUId]; !found {
+					divergent = addDivergence(divergent, only, vUUId, rmId)
+				}
+			}
+		}
+	}
+	return divergent, nil
+}
+
+func addDivergence(divergent, only map[common.VarUUId]map[common.RMId]server.EmptyStruct, vUUId common.VarUUId, rmId common.RMId) map[common.VarUUId]map[common.RMId]server.EmptyStruct {
+	if only != nil {
+		if _, found := only[vUUId][rmId]; !found {
+			return divergent
+		}
+	}
+	rmIds, found := divergent[vUUId]
+	if !found {
+		rmIds = make(map[common.RMId]server.EmptyStruct)
+		divergent[vUUId] = rmIds
+	}
+	rmIds[rmId] = server.EmptyStructVal
+	return divergent
+}
+
+// repairVar replaces our copy of the var with the version held by at
+// least F+1 of its replicas, counting ourself, if that differs from
+// ours. Only the copies of the var's replicas are counted. If we have
+// no copy at all, that's only taken to mean we've fallen behind if the
+// F+1 version is a tombstone: otherwise we may well have collected the
+// var already, and replacing it would resurrect it.
+func (ae *AntiEntropy) repairVar(topology *server.Topology, vUUId *common.VarUUId) (bool, error) {
+	type local struct {
+		digest   []byte
+		replicas []common.RMId
+	}
+	result, err := ae.disk.ReadonlyTransaction(func(rtxn db.RTxn) (interface{}, error) {
+		varCap, err := db.ReadVarFromDisk(rtxn, vUUId[:])
+		if err == db.NotFound {
+			return &local{}, nil
+		} else if err != nil {
+			return nil, err
+		}
+		replicas, err := varHolders(topology, varCap)
+		if err != nil {
+			return nil, err
+		}
+		return &local{digest: VarDigest(vUUId, varCap), replicas: replicas}, nil
+	}).ResultError()
+	if err != nil {
+		return false, err
+	}
+	ours := result.(*local)
+
+	copies, _, err := ae.replicas.FetchRecord(db.Vars, vUUId[:])
+	if err != nil {
+		return false, err
+	}
+	type version struct {
+		votes      int
+		varBites   []byte
+		writeTxnId *common.TxnId
+	}
+	versions := make(map[string]*version)
+	if ours.digest != nil {
+		versions[string(ours.digest)] = &version{votes: 1}
+	}
+	replicas := ours.replicas
+	for rmId, bites := range copies {
+		varCap, err := db.DecodeVar(vUUId[:], bites)
+		if err != nil {
+			continue
+		}
+		if replicas == nil {
+			if replicas, err = varHolders(topology, varCap); err != nil {
+				return false, err
+			}
+		}
+		if !containsRMId(replicas, rmId) {
+			continue
+		}
+		digest := string(VarDigest(vUUId, varCap))
+		if v, found := versions[digest]; found {
+			v.votes++
+			if v.varBites == nil {
+				v.varBites, v.writeTxnId = bites, common.MakeTxnId(varCap.WriteTxnId())
+			}
+		} else {
+			versions[digest] = &version{votes: 1, varBites: bites, writeTxnId: common.MakeTxnId(varCap.WriteTxnId())}
+		}
+	}
+	for digest, v := range versions {
+		if v.votes < int(topology.FInc) {
+			continue
+		} else if digest == string(ours.digest) {
+			// We agree with the majority: it's up to the others to
+			// repair themselves.
+			return false, nil
+		}
+		txnBites, err := fetchTxnRecord(ae.replicas.FetchRecord, vUUId, v.writeTxnId)
+		if err != nil {
+			return false, err
+		}
+		if ours.digest == nil {
+			txnCap, err := db.DecodeTxn(v.writeTxnId, txnBites)
+			if err != nil {
+				return false, err
+			}
+			if actions := txnCap.Actions(); !Deletes(&actions, vUUId) {
+				return false, fmt.Errorf("Not held here, and may have been collected: the F+1 version is not a tombstone")
+			}
+		}
+		return ae.varDispatcher.ReplaceVarIfUnchanged(vUUId, ours.digest, v.varBites, v.writeTxnId, txnBites)
+	}
+	return false, fmt.Errorf("No version held by F+1 (%v) replicas", topology.FInc)
+}
+
+// fetchTxnRecord fetches a copy of the txn which last wrote the var
+// from the other replicas. A txn's id is unique to it, so every intact
+// copy is of the same txn, but at least quorum of them must be intact.
+func fetchTxnRecord(fetch db.RecordFetcher, vUUId *common.VarUUId, txnId *common.TxnId) ([]byte, error) {
+	copies, quorum, err := fetch(db.Transactions, txnId[:])
+	if err != nil {
+		return nil, err
+	}
+	var txnBites []byte
+	intact := 0
+	for _, bites := range copies {
+		if _, err := db.DecodeTxn(txnId, bites); err == nil {
+			txnBites = bites
+			intact++
+		}
+	}
+	if intact < quorum {
+		return nil, fmt.Errorf("Only %v other replicas have an intact copy of txn %v, which last wrote var %v; F+1 (%v) needed", intact, txnId, vUUId, quorum)
+	}
+	return txnBites, nil
+}
+
+// VarReplicas returns the RMIds of the nodes which should hold a var
+// with positions, or nil if it has no positions (i.e. it's the
+// topology var).
+func VarReplicas(topology *server.Topology, positions *common.Positions) ([]common.RMId, error) {
+	resolver := ch.NewResolver(rand.New(rand.NewSource(time.Now().UnixNano())), topology.AllRMs)
+	return varReplicas(resolver, topology, positions)
+}
+
+// varHolders returns the RMIds of the nodes which should hold varCap:
+// every node, for the topology var.
+func varHolders(topology *server.Topology, varCap *msgs.Var) ([]common.RMId, error) {
+	positions := common.Positions(varCap.Positions())
+	if replicas, err := VarReplicas(topology, &positions); err != nil || replicas != nil {
+		return replicas, err
+	}
+	return topology.AllRMs, nil
+}
+
+func varReplicas(resolver *ch.Resolver, topology *server.Topology, positions *common.Positions) ([]common.RMId, error) {
+	positionsCap := (*capn.UInt8List)(positions)
+	if positionsCap.Len() == 0 {
+		return nil, nil
+	}
+	hashCodes, err := resolver.ResolveHashCodes(positionsCap.ToArray(), topology.AllRMs.NonEmptyLen())
+	if err != nil {
+		return nil, err
+	}
+	if len(hashCodes) > int(topology.TwoFInc) {
+		hashCodes = hashCodes[:topology.TwoFInc]
+	}
+	return hashCodes, nil
+}
+
+// BucketDigests returns the digest of each bucket over the vars we
+// share with rmId. An empty bucket has a digest of all zeros.
+func (ae *AntiEntropy) BucketDigests(rmId common.RMId) ([][]byte, error) {
+	topology := ae.topology()
+	if topology == nil {
+		return nil, fmt.Errorf("No topology established")
+	}
+	index, err := ae.digestIndex(topology)
+	if err != nil {
+		return nil, err
+	}
+	return index.bucketDigests(rmId), nil
+}
+
+// BucketEntries returns the digest of each var in the bucket which we
+// share with rmId.
+func (ae *AntiEntropy) BucketEntries(rmId common.RMId, bucket int) ([]*DigestEntry, error) {
+	topology := ae.topology()
+	if topology == nil {
+		return nil, fmt.Errorf("No topology established")
+	}
+	index, err := ae.digestIndex(topology)
+	if err != nil {
+		return nil, err
+	}
+	entries := index.bucketEntries(rmId, bucket)
+	result := make([]*DigestEntry, 0, len(entries))
+	for vUUId, digest := range entries {
+		vUUIdCopy := vUUId
+		result = append(result, &DigestEntry{VarUUId: &vUUIdCopy, Digest: digest})
+	}
+	return result, nil
+}
+
+// digestIndex holds the digest, and replicas, of every var on disk,
+// by bucket, so that the digests shared with every peer, of every
+// bucket, can be found from a single scan of the vars.
+type digestIndex struct {
+	topology *server.Topology
+	built    time.Time
+	buckets  []map[common.VarUUId]*indexedVar
+}
+
+type indexedVar struct {
+	digest   []byte
+	replicas []common.RMId
+}
+
+// digestIndex returns an index of the vars on disk. A scan of every
+// var is expensive, and a round makes many requests of each peer, as
+// do the peers of us, so an index is reused for up to
+// server.AntiEntropyIndexMaxAge: no more than one scan happens in that
+// time, however many requests there are.
+func (ae *AntiEntropy) digestIndex(topology *server.Topology) (*digestIndex, error) {
+	ae.indexLock.Lock()
+	defer ae.indexLock.Unlock()
+	if index := ae.index; index != nil && index.topology == topology && time.Since(index.built) < server.AntiEntropyIndexMaxAge {
+		return index, nil
+	}
+	index, err := ae.buildIndex(topology)
+	if err != nil {
+		return nil, err
+	}
+	ae.index = index
+	return index, nil
+}
+
+// buildIndex indexes every var on disk which we should hold. Vars
+// without positions (i.e. the topology var) and damaged vars are
+// skipped: the latter are repaired when they're next used.
+func (ae *AntiEntropy) buildIndex(topology *server.Topology) (*digestIndex, error) {
+	index := &digestIndex{
+		topology: topology,
+		built:    time.Now(),
+		buckets:  make([]map[common.VarUUId]*indexedVar, server.AntiEntropyBuckets),
+	}
+	for idx := range index.buckets {
+		index.buckets[idx] = make(map[common.VarUUId]*indexedVar)
+	}
+	resolver := ch.NewResolver(rand.New(rand.NewSource(time.Now().UnixNano())), topology.AllRMs)
+	_, err := ae.disk.ReadonlyTransaction(func(rtxn db.RTxn) (interface{}, error) {
+		return nil, rtxn.ForEach(db.Vars, func(key, data []byte) error {
+			varCap, err := db.DecodeVar(key, data)
+			if _, corrupt := db.IsCorruption(err); corrupt {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			positions := common.Positions(varCap.Positions())
+			replicas, err := varReplicas(resolver, topology, &positions)
+			if err != nil || !containsRMId(replicas, ae.rmId) {
+				return nil
+			}
+			vUUId := common.MakeVarUUId(key)
+			index.buckets[DigestBucket(vUUId)][*vUUId] = &indexedVar{digest: VarDigest(vUUId, varCap), replicas: replicas}
+			return nil
+		})
+	}).ResultError()
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// bucketDigests returns the digest of each bucket over the vars we
+// share with rmId.
+func (index *digestIndex) bucketDigests(rmId common.RMId) [][]byte {
+	digests := make([][]byte, len(index.buckets))
+	for bucket, vars := range index.buckets {
+		digest := make([]byte, sha256.Size)
+		for _, iv := range vars {
+			if containsRMId(iv.replicas, rmId) {
+				for idx, b := range iv.digest {
+					digest[idx] ^= b
+				}
+			}
+		}
+		digests[bucket] = digest
+	}
+	return digests
+}
+
+// bucketEntries returns the digest of each var in the bucket which we
+// share with rmId.
+func (index *digestIndex) bucketEntries(rmId common.RMId, bucket int) map[common.VarUUId][]byte {
+	entries := make(map[common.VarUUId][]byte)
+	for vUUId, iv := range index.buckets[bucket] {
+		if containsRMId(iv.replicas, rmId) {
+			entries[vUUId] = iv.digest
+		}
+	}
+	return entries
+}
+
+func containsRMId(rmIds []common.RMId, rmId common.RMId) bool {
+	for _, r := range rmIds {
+		if r == rmId {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+package txnengine
+
+import (
+	capn "github.com/glycerine/go-capnproto"
+	"goshawkdb.io/common"
+	msgs "goshawkdb.io/common/capnp"
+	"goshawkdb.io/server"
+	"sync"
+	"time"
+)
+
+// WriteBarrier records the references in every value written to a var
+// held by this node, whilst any collection is marking. A collection
+// starts a barrier on every node before it marks, and follows every
+// reference recorded, so that a reference which is moved into a var
+// the mark has already read is not missed. See Collector.
+type WriteBarrier struct {
+	sync.Mutex
+	nextId   uint64
+	barriers map[uint64]*barrier
+}
+
+type barrier struct {
+	refs    map[common.VarUUId]*common.Positions
+	drained time.Time
+}
+
+// BarrierRef is a reference recorded by a write barrier.
+type BarrierRef struct {
+	VarUUId   *common.VarUUId
+	Positions []uint8
+}
+
+func NewWriteBarrier() *WriteBarrier {
+	return &WriteBarrier{barriers: make(map[uint64]*barrier)}
+}
+
+// Start starts a barrier, and returns its id. A barrier which is not
+// drained for server.GCBarrierTimeout lapses, so a collection which
+// goes away can't leave us recording forever.
+func (wb *WriteBarrier) Start() uint64 {
+	wb.Lock()
+	defer wb.Unlock()
+	wb.expire()
+	wb.nextId++
+	wb.barriers[wb.nextId] = &barrier{
+		refs:    make(map[common.VarUUId]*common.Positions),
+		drained: time.Now(),
+	}
+	return wb.nextId
+}
+
+// Drain returns, and forgets, the references recorded by the barrier
+// since it was started or last drained. If stop is true, the barrier
+// is removed. found is false if there is no such barrier: either it
+// lapsed, or we've restarted since it was started. Either way, writes
+// may have gone unrecorded.
+func (wb *WriteBarrier) Drain(id uint64, stop bool) (refs []*BarrierRef, found bool) {
+	wb.Lock()
+	defer wb.Unlock()
+	wb.expire()
+	b, found := wb.barriers[id]
+	if !found {
+		return nil, false
+	}
+	refs = make([]*BarrierRef, 0, len(b.refs))
+	for vUUId, positions := range b.refs {
+		vUUIdCopy := vUUId
+		refs = append(refs, &BarrierRef{VarUUId: &vUUIdCopy, Positions: (*capn.UInt8List)(positions).ToArray()})
+	}
+	if stop {
+		delete(wb.barriers, id)
+	} else {
+		b.refs = make(map[common.VarUUId]*common.Positions)
+		b.drained = time.Now()
+	}
+	return refs, true
+}
+
+func (wb *WriteBarrier) expire() {
+	for id, b := range wb.barriers {
+		if time.Since(b.drained) > server.GCBarrierTimeout {
+			delete(wb.barriers, id)
+		}
+	}
+}
+
+// record is called by every var as it applies a committed value. A
+// var manager which was not created by a VarDispatcher has no barrier,
+// so wb may be nil.
+func (wb *WriteBarrier) record(references *msgs.VarIdPos_List) {
+	if wb == nil || references.Len() == 0 {
+		return
+	}
+	wb.Lock()
+	defer wb.Unlock()
+	if len(wb.barriers) == 0 {
+		return
+	}
+	for idx, l := 0, references.Len(); idx < l; idx++ {
+		ref := references.At(idx)
+		positions := common.Positions(ref.Positions())
+		wb.recordRef(common.MakeVarUUId(ref.Id()), &positions)
+	}
+}
+
+func (wb *WriteBarrier) recordRef(vUUId *common.VarUUId, positions *common.Positions) {
+	for _, b := range wb.barriers {
+		b.refs[*vUUId] = positions
+	}
+}
+
+func (br *BarrierRef) positions() *common.Positions {
+	positionsCap := capn.NewBuffer(nil).NewUInt8List(len(br.Positions))
+	for idx, position := range br.Positions {
+		positionsCap.Set(idx, position)
+	}
+	positions := common.Positions(positionsCap)
+	return &positions
+}
@@ -0,0 +1,530 @@
+package txnengine
+
+import (
+	"bytes"
+	"fmt"
+	capn "github.com/glycerine/go-capnproto"
+	"goshawkdb.io/common"
+	msgs "goshawkdb.io/common/capnp"
+	"goshawkdb.io/server"
+	"goshawkdb.io/server/db"
+	"log"
+	"sync"
+	"time"
+)
+
+// Collector removes vars held by this node which can no longer be
+// reached from the root. Every node runs its own collector over the
+// vars it holds.
+//
+// The mark phase reads the graph from the root through client txns,
+// so it sees the same committed state as any client, and works
+// alongside live txns. Each batch of reads is a separate txn, so the
+// mark is not a snapshot: a txn could move a reference from a var we
+// have yet to read into one we have already read. So before marking,
+// we start a WriteBarrier on every node in the topology, which records
+// the references of every value written to a var from then on. After
+// the graph from the root is exhausted, the mark drains every barrier
+// and follows everything they recorded, repeatedly, until the drains
+// turn up nothing new. Every var which is reachable when a mark ends
+// is then marked: it was either reached from the root, or a reference
+// to it was written during the mark, and recorded. The barriers
+// record from the start of the first mark to the end of the second,
+// including the grace period between the two, during which they are
+// drained periodically. If any barrier can't be started or drained
+// (say a node is unreachable, or has restarted), the collection fails.
+//
+// A var is only swept if:
+//
+//  1. it was on disk before the first mark started;
+//  2. neither of two marks, separated by gracePeriod, reached it, and
+//     no reference to it was written in the meantime;
+//  3. our copy has not been written since before the first mark; and
+//  4. our copy is not active (i.e. no txns or rolls are in flight for
+//     it).
+//
+// Vars are swept by client txns which delete them, so every replica
+// of a var deletes it, or none does. Each delete is guarded by the
+// version we found in our copy, so a var written after we checked it
+// is not deleted. A var which is swept after being
+// written back into the graph by a client which held on to a
+// reference to it for longer than gracePeriod after the var became
+// unreachable will be lost. The grace period must therefore exceed
+// the time clients hold unreachable references.
+type Collector struct {
+	sync.Mutex
+	varDispatcher *VarDispatcher
+	disk          db.Store
+	lc            LocalConnection
+	rmId          common.RMId
+	topology      func() *server.Topology
+	barriers      Barriers
+	gracePeriod   time.Duration
+	read          func(map[common.VarUUId]*common.Positions) (map[common.VarUUId]*common.Positions, error)
+	running       bool
+	last          *CollectionResult
+}
+
+// Barriers gives access to the write barriers of the other nodes.
+type Barriers interface {
+	// StartBarrier starts a write barrier on the node.
+	StartBarrier(rmId common.RMId) (uint64, error)
+	// DrainBarrier returns what the node's write barrier has recorded
+	// since it started or was last drained, and removes it if stop is
+	// true. It fails if the barrier has lapsed.
+	DrainBarrier(rmId common.RMId, id uint64, stop bool) ([]*BarrierRef, error)
+}
+
+type CollectionResult struct {
+	Started    time.Time
+	Finished   time.Time
+	Candidates int
+	Reachable  int
+	Barriered  int
+	Deleted    int
+	Skipped    int
+	Error      string
+}
+
+type candidate struct {
+	writeTxnId *common.TxnId
+	positions  *common.Positions
+}
+
+// NewCollector returns a collector of the vars held by rmId. barriers
+// may be nil, in which case only a cluster of one node can be
+// collected.
+func NewCollector(vd *VarDispatcher, disk db.Store, lc LocalConnection, rmId common.RMId, topology func() *server.Topology, barriers Barriers, gracePeriod time.Duration) *Collector {
+	c := &Collector{
+		varDispatcher: vd,
+		disk:          disk,
+		lc:            lc,
+		rmId:          rmId,
+		topology:      topology,
+		barriers:      barriers,
+		gracePeriod:   gracePeriod,
+	}
+	c.read = c.readReferences
+	return c
+}
+
+// LastResult returns the result of the most recently completed
+// collection, or nil if there has not been one.
+func (c *Collector) LastResult() *CollectionResult {
+	c.Lock()
+	defer c.Unlock()
+	return c.last
+}
+
+// Collect runs a complete collection. Only one collection may run at a
+// time.
+func (c *Collector) Collect() (*CollectionResult, error) {
+	c.Lock()
+	if c.running {
+		c.Unlock()
+		return nil, fmt.Errorf("Collection already running")
+	}
+	c.running = true
+	c.Unlock()
+
+	result := &CollectionResult{Started: time.Now()}
+	err := c.collect(result)
+	result.Finished = time.Now()
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	c.Lock()
+	c.running = false
+	c.last = result
+	c.Unlock()
+	return result, err
+}
+
+func (c *Collector) collect(result *CollectionResult) error {
+	topology := c.topology()
+	if topology == nil || topology.RootVarUUId == nil {
+		return fmt.Errorf("No root established")
+	}
+	root := map[common.VarUUId]*common.Positions{*topology.RootVarUUId: topology.RootPositions}
+	candidates, err := c.localVars()
+	if err != nil {
+		return err
+	}
+	delete(candidates, *topology.RootVarUUId)
+	delete(candidates, *server.TopologyVarUUId)
+	result.Candidates = len(candidates)
+	log.Printf("GC: %v candidate vars.\n", len(candidates))
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	barriers, err := c.startBarriers(topology)
+	if err != nil {
+		return err
+	}
+	defer c.stopBarriers(barriers)
+
+	reachable := make(map[common.VarUUId]server.EmptyStruct)
+	if err = c.mark(barriers, reachable, root, result); err != nil {
+		return err
+	}
+	for vUUId := range reachable {
+		delete(candidates, vUUId)
+	}
+	if len(candidates) == 0 {
+		result.Reachable = len(reachable)
+		return nil
+	}
+
+	// Drain the barriers throughout the grace period, so they don't
+	// lapse, and so that anything written into the graph in the
+	// meantime is kept.
+	for waited := time.Duration(0); waited < c.gracePeriod; waited += server.GCBarrierDrainInterval {
+		pause := c.gracePeriod - waited
+		if pause > server.GCBarrierDrainInterval {
+			pause = server.GCBarrierDrainInterval
+		}
+		time.Sleep(pause)
+		if err = c.mark(barriers, reachable, nil, result); err != nil {
+			return err
+		}
+	}
+	for vUUId := range reachable {
+		delete(candidates, vUUId)
+	}
+
+	reachable = make(map[common.VarUUId]server.EmptyStruct)
+	if err = c.mark(barriers, reachable, root, result); err != nil {
+		return err
+	}
+	result.Reachable = len(reachable)
+	for vUUId := range reachable {
+		delete(candidates, vUUId)
+	}
+
+	// A node which joined since we started has no barrier.
+	if now := c.topology(); now == nil || !now.DBVersion.Equal(topology.DBVersion) {
+		return fmt.Errorf("Topology changed during collection")
+	}
+
+	if err = c.sweep(candidates, result); err != nil {
+		return err
+	}
+	log.Printf("GC: deleted %v vars; skipped %v changed or active vars.\n", result.Deleted, result.Skipped)
+	return nil
+}
+
+// startBarriers starts a write barrier on every node in the topology.
+func (c *Collector) startBarriers(topology *server.Topology) (map[common.RMId]uint64, error) {
+	barriers := make(map[common.RMId]uint64, len(topology.AllRMs))
+	for _, rmId := range topology.AllRMs {
+		var id uint64
+		var err error
+		switch {
+		case rmId == c.rmId:
+			id = c.varDispatcher.Barrier.Start()
+		case c.barriers == nil:
+			err = fmt.Errorf("Unable to start write barrier on %v: no access to other nodes", rmId)
+		default:
+			id, err = c.barriers.StartBarrier(rmId)
+		}
+		if err != nil {
+			c.stopBarriers(barriers)
+			return nil, err
+		}
+		barriers[rmId] = id
+	}
+	return barriers, nil
+}
+
+func (c *Collector) stopBarriers(barriers map[common.RMId]uint64) {
+	if _, err := c.drainBarriers(barriers, true); err != nil {
+		log.Println("GC: error when stopping write barriers:", err)
+	}
+}
+
+// drainBarriers returns everything the barriers have recorded since
+// they were last drained.
+func (c *Collector) drainBarriers(barriers map[common.RMId]uint64, stop bool) (map[common.VarUUId]*common.Positions, error) {
+	refs := make(map[common.VarUUId]*common.Positions)
+	var firstErr error
+	for rmId, id := range barriers {
+		var recorded []*BarrierRef
+		var err error
+		if rmId == c.rmId {
+			var found bool
+			if recorded, found = c.varDispatcher.Barrier.Drain(id, stop); !found {
+				err = fmt.Errorf("Write barrier on %v has lapsed", rmId)
+			}
+		} else {
+			recorded, err = c.barriers.DrainBarrier(rmId, id, stop)
+		}
+		if err != nil {
+			// When stopping, carry on so we stop the rest.
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		for _, ref := range recorded {
+			if *ref.VarUUId != *server.TopologyVarUUId {
+				refs[*ref.VarUUId] = ref.positions()
+			}
+		}
+	}
+	return refs, firstErr
+}
+
+// mark adds to reachable everything reachable from roots, and from
+// the references recorded by the barriers, until draining the
+// barriers turns up nothing new.
+func (c *Collector) mark(barriers map[common.RMId]uint64, reachable map[common.VarUUId]server.EmptyStruct, roots map[common.VarUUId]*common.Positions, result *CollectionResult) error {
+	pending := make(map[common.VarUUId]*common.Positions, len(roots))
+	for vUUId, positions := range roots {
+		if _, found := reachable[vUUId]; !found {
+			reachable[vUUId] = server.EmptyStructVal
+			pending[vUUId] = positions
+		}
+	}
+	for {
+		for len(pending) != 0 {
+			batch := make(map[common.VarUUId]*common.Positions, server.GCMarkBatchSize)
+			for vUUId, positions := range pending {
+				batch[vUUId] = positions
+				delete(pending, vUUId)
+				if len(batch) == server.GCMarkBatchSize {
+					break
+				}
+			}
+			refs, err := c.read(batch)
+			if err != nil {
+				return err
+			}
+			for vUUId, positions := range refs {
+				if _, found := reachable[vUUId]; !found {
+					reachable[vUUId] = server.EmptyStructVal
+					pending[vUUId] = positions
+				}
+			}
+		}
+
+		refs, err := c.drainBarriers(barriers, false)
+		if err != nil {
+			return err
+		}
+		for vUUId, positions := range refs {
+			if _, found := reachable[vUUId]; !found {
+				reachable[vUUId] = server.EmptyStructVal
+				pending[vUUId] = positions
+				result.Barriered++
+			}
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+	}
+}
+
+// sweep deletes the candidates which are unchanged, in batches.
+func (c *Collector) sweep(candidates map[common.VarUUId]*candidate, result *CollectionResult) error {
+	batch := make(map[common.VarUUId]*candidate, server.GCSweepBatchSize)
+	flush := func() error {
+		size := len(batch)
+		deleted, err := c.deleteVars(batch)
+		result.Deleted += deleted
+		result.Skipped += size - deleted
+		batch = make(map[common.VarUUId]*candidate, server.GCSweepBatchSize)
+		return err
+	}
+	for vUUId, cand := range candidates {
+		vUUIdCopy := vUUId
+		unchanged, err := c.varDispatcher.VarIsUnchanged(&vUUIdCopy, cand.writeTxnId)
+		if err != nil {
+			return err
+		} else if !unchanged {
+			result.Skipped++
+			continue
+		}
+		batch[vUUId] = cand
+		if len(batch) == server.GCSweepBatchSize {
+			if err = flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if len(batch) != 0 {
+		return flush()
+	}
+	return nil
+}
+
+// deleteVars deletes the vars in batch through a client txn, so every
+// replica of each var deletes it. Each delete is guarded by the
+// version of the var we found unchanged: if any var has been written
+// since, the txn aborts, and we try again without the vars the abort
+// tells us have changed. It returns how many vars were deleted, and
+// removes from batch those which were not.
+func (c *Collector) deleteVars(batch map[common.VarUUId]*candidate) (int, error) {
+	for len(batch) != 0 {
+		seg := capn.NewBuffer(nil)
+		ctxn := msgs.NewClientTxn(seg)
+		ctxn.SetRetry(false)
+		actions := msgs.NewClientActionList(seg, len(batch))
+		ctxn.SetActions(actions)
+		varPosMap := make(map[common.VarUUId]*common.Positions, len(batch))
+		idx := 0
+		for vUUId, cand := range batch {
+			action := actions.At(idx)
+			idx++
+			action.SetVarId(vUUId[:])
+			action.SetDelete()
+			action.Delete().SetVersion(cand.writeTxnId[:])
+			varPosMap[vUUId] = cand.positions
+		}
+
+		outcome, err := c.lc.RunClientTransaction(&ctxn, varPosMap, true)
+		switch {
+		case err != nil:
+			return 0, err
+		case outcome == nil:
+			return 0, fmt.Errorf("Shutting down")
+		case outcome.Which() == msgs.OUTCOME_COMMIT:
+			return len(batch), nil
+		}
+		abort := outcome.Abort()
+		if abort.Which() == msgs.OUTCOMEABORT_RESUBMIT {
+			continue
+		}
+
+		changed := 0
+		updates := abort.Rerun()
+		for idx, l := 0, updates.Len(); idx < l; idx++ {
+			updateActions := updates.At(idx).Actions()
+			for idy, m := 0, updateActions.Len(); idy < m; idy++ {
+				vUUId := common.MakeVarUUId(updateActions.At(idy).VarId())
+				if _, found := batch[*vUUId]; found {
+					delete(batch, *vUUId)
+					changed++
+				}
+			}
+		}
+		if changed == 0 {
+			return 0, fmt.Errorf("GC delete txn unexpectedly aborted")
+		}
+	}
+	return 0, nil
+}
+
+// localVars returns every var on disk, with the txn which last wrote
+// it and its positions.
+func (c *Collector) localVars() (map[common.VarUUId]*candidate, error) {
+	vars := make(map[common.VarUUId]*candidate)
+	_, err := c.disk.ReadonlyTransaction(func(rtxn db.RTxn) (interface{}, error) {
+		return nil, rtxn.ForEach(db.Vars, func(key, data []byte) error {
+			varCap, err := db.DecodeVar(key, data)
+			if _, corrupt := db.IsCorruption(err); corrupt {
+				// Never collect what we can't read: it'll be
+				// repaired when it's next used.
+				log.Println("GC: skipping", err)
+				return nil
+			} else if err != nil {
+				return err
+			}
+			vUUId := common.MakeVarUUId(key)
+			writeTxnId := common.MakeTxnId(varCap.WriteTxnId())
+			// A deleted var is already as collected as it can be until
+			// its tombstone expires (see VarManager.TombstoneComplete).
+			if txn, err := db.ReadTxnFromDisk(rtxn, writeTxnId); err != nil {
+				if _, corrupt := db.IsCorruption(err); corrupt {
+					log.Println("GC: skipping", err)
+					return nil
+				}
+				return err
+			} else if txn != nil {
+				if actions := txn.Actions(); Deletes(&actions, vUUId) {
+					return nil
+				}
+			}
+			positions := common.Positions(varCap.Positions())
+			vars[*vUUId] = &candidate{
+				writeTxnId: writeTxnId,
+				positions:  &positions,
+			}
+			return nil
+		})
+	}).ResultError()
+	return vars, err
+}
+
+// readReferences reads the vars in batch and returns everything they
+// reference. As in GetTopologyFromLocalDatabase, we read at
+// VersionZero so that the txn aborts and the rerun tells us the
+// current value of each var.
+func (c *Collector) readReferences(batch map[common.VarUUId]*common.Positions) (map[common.VarUUId]*common.Positions, error) {
+	for {
+		seg := capn.NewBuffer(nil)
+		ctxn := msgs.NewClientTxn(seg)
+		ctxn.SetRetry(false)
+		actions := msgs.NewClientActionList(seg, len(batch))
+		ctxn.SetActions(actions)
+		idx := 0
+		for vUUId := range batch {
+			action := actions.At(idx)
+			idx++
+			action.SetVarId(vUUId[:])
+			action.SetRead()
+			action.Read().SetVersion(common.VersionZero[:])
+		}
+
+		outcome, err := c.lc.RunClientTransaction(&ctxn, batch, true)
+		switch {
+		case err != nil:
+			return nil, err
+		case outcome == nil:
+			return nil, fmt.Errorf("Shutting down")
+		case outcome.Which() == msgs.OUTCOME_COMMIT:
+			// everything in batch is still at VersionZero, so nothing
+			// is referenced.
+			return nil, nil
+		}
+		abort := outcome.Abort()
+		if abort.Which() == msgs.OUTCOMEABORT_RESUBMIT {
+			continue
+		}
+
+		refs := make(map[common.VarUUId]*common.Positions)
+		updates := abort.Rerun()
+		for idx, l := 0, updates.Len(); idx < l; idx++ {
+			updateActions := updates.At(idx).Actions()
+			for idy, m := 0, updateActions.Len(); idy < m; idy++ {
+				updateAction := updateActions.At(idy)
+				if _, found := batch[*common.MakeVarUUId(updateAction.VarId())]; !found {
+					continue
+				}
+				var references msgs.VarIdPos_List
+				switch updateAction.Which() {
+				case msgs.ACTION_WRITE:
+					references = updateAction.Write().References()
+				case msgs.ACTION_READWRITE:
+					references = updateAction.Readwrite().References()
+				case msgs.ACTION_CREATE:
+					references = updateAction.Create().References()
+				case msgs.ACTION_ROLL:
+					references = updateAction.Roll().References()
+				default:
+					continue
+				}
+				for idz, n := 0, references.Len(); idz < n; idz++ {
+					ref := references.At(idz)
+					if bytes.Equal(ref.Id(), server.TopologyVarUUId[:]) {
+						continue
+					}
+					positions := common.Positions(ref.Positions())
+					refs[*common.MakeVarUUId(ref.Id())] = &positions
+				}
+			}
+		}
+		return refs, nil
+	}
+}
@@ -0,0 +1,342 @@
+package txnengine
+
+import (
+	"bytes"
+	"fmt"
+	capn "github.com/glycerine/go-capnproto"
+	"goshawkdb.io/common"
+	msgs "goshawkdb.io/common/capnp"
+	"goshawkdb.io/server"
+	"sort"
+	"testing"
+	"time"
+)
+
+func testVarUUId(n byte) common.VarUUId {
+	b := make([]byte, common.KeyLen)
+	b[0] = n
+	return *common.MakeVarUUId(b)
+}
+
+func testPositions() *common.Positions {
+	positions := common.Positions(capn.NewBuffer(nil).NewUInt8List(1))
+	return &positions
+}
+
+// testGraph stands in for the cluster's vars, as read by a mark.
+type testGraph struct {
+	edges map[common.VarUUId][]common.VarUUId
+	// beforeRead, if set, is called just before each var is read, so
+	// tests can change the graph part way through a batch.
+	beforeRead func(vUUId common.VarUUId)
+}
+
+func (g *testGraph) read(batch map[common.VarUUId]*common.Positions) (map[common.VarUUId]*common.Positions, error) {
+	ids := make([]common.VarUUId, 0, len(batch))
+	for vUUId := range batch {
+		ids = append(ids, vUUId)
+	}
+	sort.Slice(ids, func(i, j int) bool { return bytes.Compare(ids[i][:], ids[j][:]) < 0 })
+	refs := make(map[common.VarUUId]*common.Positions)
+	for _, vUUId := range ids {
+		if g.beforeRead != nil {
+			g.beforeRead(vUUId)
+		}
+		for _, ref := range g.edges[vUUId] {
+			refs[ref] = testPositions()
+		}
+	}
+	return refs, nil
+}
+
+// testBarriers are the barriers of the other nodes.
+type testBarriers struct {
+	barriers map[common.RMId]*WriteBarrier
+	lapsed   bool
+}
+
+func (tb *testBarriers) StartBarrier(rmId common.RMId) (uint64, error) {
+	wb, found := tb.barriers[rmId]
+	if !found {
+		return 0, fmt.Errorf("Not connected to %v", rmId)
+	}
+	return wb.Start(), nil
+}
+
+func (tb *testBarriers) DrainBarrier(rmId common.RMId, id uint64, stop bool) ([]*BarrierRef, error) {
+	wb, found := tb.barriers[rmId]
+	if !found {
+		return nil, fmt.Errorf("Not connected to %v", rmId)
+	}
+	refs, found := wb.Drain(id, stop)
+	if tb.lapsed || !found {
+		return nil, fmt.Errorf("Write barrier on %v has lapsed", rmId)
+	}
+	return refs, nil
+}
+
+// written simulates a var held by wb being written with a reference
+// to vUUId.
+func written(wb *WriteBarrier, vUUId common.VarUUId) {
+	wb.Lock()
+	defer wb.Unlock()
+	wb.recordRef(&vUUId, testPositions())
+}
+
+func newTestCollector(graph *testGraph, barriers Barriers, rmIds ...common.RMId) *Collector {
+	vd := &VarDispatcher{Barrier: NewWriteBarrier()}
+	topology := &server.Topology{AllRMs: rmIds, DBVersion: server.VersionOne}
+	c := NewCollector(vd, nil, nil, 1, func() *server.Topology { return topology }, barriers, 0)
+	if graph != nil {
+		c.read = graph.read
+	}
+	return c
+}
+
+func TestWriteBarrier(t *testing.T) {
+	wb := NewWriteBarrier()
+	a, b := testVarUUId(1), testVarUUId(2)
+	written(wb, a) // no barrier, so not recorded
+
+	id1, id2 := wb.Start(), wb.Start()
+	written(wb, b)
+	if refs, found := wb.Drain(id1, false); !found || len(refs) != 1 || *refs[0].VarUUId != b {
+		t.Fatalf("Expected barrier to have recorded only %v; got %v (found? %v)", b, refs, found)
+	}
+	if refs, found := wb.Drain(id1, false); !found || len(refs) != 0 {
+		t.Fatalf("Expected drained barrier to be empty; got %v (found? %v)", refs, found)
+	}
+	if refs, found := wb.Drain(id2, true); !found || len(refs) != 1 {
+		t.Fatalf("Expected second barrier to have recorded %v too; got %v (found? %v)", b, refs, found)
+	}
+	if _, found := wb.Drain(id2, false); found {
+		t.Fatal("Expected stopped barrier to be gone")
+	}
+
+	wb.barriers[id1].drained = time.Now().Add(-2 * server.GCBarrierTimeout)
+	if _, found := wb.Drain(id1, false); found {
+		t.Fatal("Expected barrier which has not been drained for too long to have lapsed")
+	}
+
+	// A var manager created without a VarDispatcher has no barrier.
+	seg := capn.NewBuffer(nil)
+	refs := msgs.NewVarIdPosList(seg, 1)
+	(*WriteBarrier)(nil).record(&refs)
+}
+
+// A txn moves the only reference to c from b, which the mark has yet
+// to read, into a, which it has already read. Without the barriers, c
+// and everything it references would be missed.
+func TestMarkFollowsReferencesMovedDuringMark(t *testing.T) {
+	root, a, b, c, d := testVarUUId(1), testVarUUId(2), testVarUUId(3), testVarUUId(4), testVarUUId(5)
+	newGraph := func(wb *WriteBarrier) *testGraph {
+		graph := &testGraph{edges: map[common.VarUUId][]common.VarUUId{
+			root: {a, b},
+			b:    {c},
+			c:    {d},
+		}}
+		graph.beforeRead = func(vUUId common.VarUUId) {
+			if vUUId == b && len(graph.edges[b]) != 0 {
+				graph.edges[a] = []common.VarUUId{c}
+				graph.edges[b] = nil
+				written(wb, c)
+			}
+		}
+		return graph
+	}
+	roots := map[common.VarUUId]*common.Positions{root: testPositions()}
+
+	// First show that the move really does hide c from the reads.
+	tb := &testBarriers{barriers: map[common.RMId]*WriteBarrier{2: NewWriteBarrier()}}
+	col := newTestCollector(newGraph(tb.barriers[2]), tb, 1, 2)
+	reachable := make(map[common.VarUUId]server.EmptyStruct)
+	if err := col.mark(map[common.RMId]uint64{}, reachable, roots, &CollectionResult{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := reachable[c]; found {
+		t.Fatal("Expected c to be missed without barriers")
+	}
+
+	// a is held by node 2, so it's node 2's barrier which records the
+	// write.
+	tb = &testBarriers{barriers: map[common.RMId]*WriteBarrier{2: NewWriteBarrier()}}
+	col = newTestCollector(newGraph(tb.barriers[2]), tb, 1, 2)
+	barriers, err := col.startBarriers(col.topology())
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := &CollectionResult{}
+	reachable = make(map[common.VarUUId]server.EmptyStruct)
+	if err = col.mark(barriers, reachable, roots, result); err != nil {
+		t.Fatal(err)
+	}
+	for _, vUUId := range []common.VarUUId{root, a, b, c, d} {
+		if _, found := reachable[vUUId]; !found {
+			t.Fatalf("Expected %v to be reachable", &vUUId)
+		}
+	}
+	if result.Barriered != 1 {
+		t.Fatalf("Expected 1 var to be found through the barriers; got %v", result.Barriered)
+	}
+
+	col.stopBarriers(barriers)
+	if _, found := col.varDispatcher.Barrier.Drain(barriers[1], false); found {
+		t.Fatal("Expected local barrier to be stopped")
+	}
+	if _, found := tb.barriers[2].Drain(barriers[2], false); found {
+		t.Fatal("Expected remote barrier to be stopped")
+	}
+}
+
+// A write to a var held locally is recorded by the local barrier.
+func TestMarkFollowsLocalWrites(t *testing.T) {
+	root, x, a := testVarUUId(1), testVarUUId(2), testVarUUId(3)
+	graph := &testGraph{edges: map[common.VarUUId][]common.VarUUId{root: {x}}}
+	col := newTestCollector(graph, nil, 1)
+	graph.beforeRead = func(vUUId common.VarUUId) {
+		if vUUId == x && len(graph.edges[root]) == 1 {
+			// root has been read, and is held by us.
+			graph.edges[root] = []common.VarUUId{x, a}
+			written(col.varDispatcher.Barrier, a)
+		}
+	}
+	barriers, err := col.startBarriers(col.topology())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer col.stopBarriers(barriers)
+	reachable := make(map[common.VarUUId]server.EmptyStruct)
+	roots := map[common.VarUUId]*common.Positions{root: testPositions()}
+	if err = col.mark(barriers, reachable, roots, &CollectionResult{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := reachable[a]; !found {
+		t.Fatal("Expected a to be reachable")
+	}
+}
+
+func TestMarkFailsWhenBarrierLapses(t *testing.T) {
+	root := testVarUUId(1)
+	tb := &testBarriers{barriers: map[common.RMId]*WriteBarrier{2: NewWriteBarrier()}}
+	col := newTestCollector(&testGraph{}, tb, 1, 2)
+	barriers, err := col.startBarriers(col.topology())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb.lapsed = true
+	reachable := make(map[common.VarUUId]server.EmptyStruct)
+	roots := map[common.VarUUId]*common.Positions{root: testPositions()}
+	if err = col.mark(barriers, reachable, roots, &CollectionResult{}); err == nil {
+		t.Fatal("Expected mark to fail when a barrier has lapsed")
+	}
+}
+
+func TestBarriersRequireEveryNode(t *testing.T) {
+	col := newTestCollector(nil, nil, 1, 2)
+	if _, err := col.startBarriers(col.topology()); err == nil {
+		t.Fatal("Expected barriers to fail without access to the other nodes")
+	}
+	// The local barrier must not be left running.
+	if len(col.varDispatcher.Barrier.barriers) != 0 {
+		t.Fatal("Expected local barrier to be stopped")
+	}
+
+	tb := &testBarriers{barriers: map[common.RMId]*WriteBarrier{2: NewWriteBarrier()}}
+	col = newTestCollector(nil, tb, 1, 2, 3)
+	if _, err := col.startBarriers(col.topology()); err == nil {
+		t.Fatal("Expected barriers to fail when a node is unreachable")
+	}
+	if len(col.varDispatcher.Barrier.barriers) != 0 || len(tb.barriers[2].barriers) != 0 {
+		t.Fatal("Expected started barriers to be stopped")
+	}
+}
+
+// testDeleter stands in for the cluster when the sweep deletes vars:
+// it holds the current version of each var, and votes on each delete
+// as a readwrite of the version it gives.
+type testDeleter struct {
+	versions map[common.VarUUId]*common.TxnId
+}
+
+func (td *testDeleter) RunClientTransaction(ctxn *msgs.ClientTxn, varPosMap map[common.VarUUId]*common.Positions, assignTxnId bool) (*msgs.Outcome, error) {
+	actions := ctxn.Actions()
+	changed := []common.VarUUId{}
+	for idx, l := 0, actions.Len(); idx < l; idx++ {
+		action := actions.At(idx)
+		if action.Which() != msgs.CLIENTACTION_DELETE {
+			return nil, fmt.Errorf("Unexpected action type: %v", action.Which())
+		}
+		vUUId := common.MakeVarUUId(action.VarId())
+		if _, found := varPosMap[*vUUId]; !found {
+			return nil, fmt.Errorf("No positions for %v", vUUId)
+		}
+		if version := action.Delete().Version(); !bytes.Equal(version, td.versions[*vUUId][:]) {
+			changed = append(changed, *vUUId)
+		}
+	}
+
+	seg := capn.NewBuffer(nil)
+	outcome := msgs.NewOutcome(seg)
+	if len(changed) == 0 {
+		for idx, l := 0, actions.Len(); idx < l; idx++ {
+			delete(td.versions, *common.MakeVarUUId(actions.At(idx).VarId()))
+		}
+		outcome.SetCommit((*VectorClock)(nil).AddToSeg(seg))
+		return &outcome, nil
+	}
+	outcome.SetAbort()
+	updates := msgs.NewUpdateList(seg, 1)
+	update := updates.At(0)
+	update.SetTxnId(testTxnId(0xff)[:])
+	updateActions := msgs.NewActionList(seg, len(changed))
+	update.SetActions(updateActions)
+	for idx, vUUId := range changed {
+		action := updateActions.At(idx)
+		action.SetVarId(vUUId[:])
+		action.SetWrite()
+	}
+	outcome.Abort().SetRerun(updates)
+	return &outcome, nil
+}
+
+func (td *testDeleter) Status(*server.StatusConsumer) {}
+
+func testTxnId(n byte) *common.TxnId {
+	b := make([]byte, common.KeyLen)
+	b[0] = n
+	return common.MakeTxnId(b)
+}
+
+// A var written after the sweep checked it must not be deleted: its
+// delete is guarded by the version the sweep saw.
+func TestDeleteVarsIsGuardedByVersion(t *testing.T) {
+	a, b, c := testVarUUId(1), testVarUUId(2), testVarUUId(3)
+	td := &testDeleter{versions: map[common.VarUUId]*common.TxnId{
+		a: testTxnId(1),
+		b: testTxnId(2),
+		c: testTxnId(3),
+	}}
+	col := newTestCollector(nil, nil, 1)
+	col.lc = td
+	batch := map[common.VarUUId]*candidate{
+		a: {writeTxnId: testTxnId(1), positions: testPositions()},
+		b: {writeTxnId: testTxnId(2), positions: testPositions()},
+		c: {writeTxnId: testTxnId(3), positions: testPositions()},
+	}
+	// b is written between the check and the delete.
+	td.versions[b] = testTxnId(4)
+
+	deleted, err := col.deleteVars(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 2 {
+		t.Fatalf("Expected 2 vars deleted; got %v", deleted)
+	}
+	if _, found := batch[b]; found || len(batch) != 2 {
+		t.Fatalf("Expected only b dropped from the batch; got %v", batch)
+	}
+	if len(td.versions) != 1 || td.versions[b] == nil {
+		t.Fatalf("Expected only b to survive; got %v", td.versions)
+	}
+}
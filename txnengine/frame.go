@@ -21,6 +21,7 @@ type frame struct {
 	frameWritesClock *VectorClock
 	readVoteClock    *VectorClock
 	positionsFound   bool
+	deleted          bool
 	mask             *VectorClock
 	frameOpen
 	frameClosed
@@ -38,6 +39,7 @@ func NewFrame(parent *frame, v *Var, txnId *common.TxnId, txnActions *msgs.Actio
 		frameWritesClock: writesClock,
 		positionsFound:   false,
 	}
+	f.deleted = f.isDelete()
 	if parent == nil {
 		f.mask = NewVectorClock()
 	} else {
@@ -50,6 +52,23 @@ func NewFrame(parent *frame, v *Var, txnId *common.TxnId, txnActions *msgs.Actio
 	return f
 }
 
+// isDelete returns true if the txn of this frame deleted the var.
+func (f *frame) isDelete() bool {
+	return f.frameTxnActions != nil && Deletes(f.frameTxnActions, f.v.UUId)
+}
+
+// Deletes returns true if actions delete vUUId: the var is then left
+// on disk as a tombstone, last written by the txn of actions.
+func Deletes(actions *msgs.Action_List, vUUId *common.VarUUId) bool {
+	for idx, l := 0, actions.Len(); idx < l; idx++ {
+		action := actions.At(idx)
+		if bytes.Equal(action.VarId(), vUUId[:]) {
+			return action.Which() == msgs.ACTION_MISSING
+		}
+	}
+	return false
+}
+
 func (f *frame) init() {
 	f.frameOpen.init(f)
 	f.frameClosed.init(f)
@@ -647,7 +666,9 @@ func (fo *frameOpen) maybeCreateChild() {
 }
 
 func (fo *frameOpen) maybeScheduleRoll() {
-	if !fo.rollScheduled && !fo.rollActive && fo.currentState == fo && fo.child == nil && fo.writes.Len() == 0 && fo.v.positions != nil &&
+	// There's nothing to roll for a deleted var: readers will be told
+	// it's missing.
+	if !fo.rollScheduled && !fo.rollActive && !fo.deleted && fo.currentState == fo && fo.child == nil && fo.writes.Len() == 0 && fo.v.positions != nil &&
 		(fo.reads.Len() > fo.uncommittedReads || (len(fo.frameTxnClock.Clock) > fo.frameTxnActions.Len() && fo.parent == nil && fo.reads.Len() == 0 && len(fo.learntFutureReads) == 0)) {
 		fo.rollScheduled = true
 		fo.v.vm.ScheduleCallback(func() {
@@ -660,7 +681,7 @@ func (fo *frameOpen) maybeScheduleRoll() {
 }
 
 func (fo *frameOpen) maybeStartRoll() {
-	if !fo.rollActive && fo.currentState == fo && fo.child == nil && fo.writes.Len() == 0 && fo.v.positions != nil &&
+	if !fo.rollActive && !fo.deleted && fo.currentState == fo && fo.child == nil && fo.writes.Len() == 0 && fo.v.positions != nil &&
 		(fo.reads.Len() > fo.uncommittedReads || (len(fo.frameTxnClock.Clock) > fo.frameTxnActions.Len() && fo.parent == nil && fo.reads.Len() == 0 && len(fo.learntFutureReads) == 0)) {
 		fo.rollActive = true
 		ctxn, varPosMap := fo.createRollClientTxn()
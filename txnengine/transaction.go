@@ -3,7 +3,6 @@ package txnengine
 import (
 	"fmt"
 	capn "github.com/glycerine/go-capnproto"
-	mdb "github.com/msackman/gomdb"
 	sl "github.com/msackman/skiplist"
 	"goshawkdb.io/common"
 	msgs "goshawkdb.io/common/capnp"
@@ -218,6 +217,18 @@ func (txn *Txn) populate(actionIndices capn.UInt16List, actions msgs.Action_List
 				txn.writes = append(txn.writes, common.MakeVarUUId(actionCap.VarId()))
 			}
 
+		case msgs.ACTION_MISSING:
+			if idx == actionIndex {
+				if version := actionCap.Missing().Version(); len(version) != 0 {
+					action.readVsn = common.MakeTxnId(version)
+				}
+				action.writeTxnActions = &actions
+				action.writeAction = &actionCap
+				txn.writes = append(txn.writes, action.vUUId)
+			} else {
+				txn.writes = append(txn.writes, common.MakeVarUUId(actionCap.VarId()))
+			}
+
 		case msgs.ACTION_ROLL:
 			if idx == actionIndex {
 				rollCap := actionCap.Roll()
@@ -394,7 +405,7 @@ func (talb *txnAwaitLocalBallots) preAbort() {
 		for idx := 0; idx < len(talb.localActions); idx++ {
 			action := &talb.localActions[idx]
 			f := func(v *Var, err error) {
-				if err == mdb.NotFound && action.ballot != nil && action.frame == nil {
+				if err == db.NotFound && action.ballot != nil && action.frame == nil {
 					// no problem - we've already voted to abort
 				} else if err == nil && action.ballot != nil && action.frame == nil {
 					v.maybeMakeInactive()
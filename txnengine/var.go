@@ -3,13 +3,11 @@ package txnengine
 import (
 	"fmt"
 	capn "github.com/glycerine/go-capnproto"
-	mdbs "github.com/msackman/gomdb/server"
 	"goshawkdb.io/common"
 	msgs "goshawkdb.io/common/capnp"
 	"goshawkdb.io/server"
 	"goshawkdb.io/server/db"
 	"goshawkdb.io/server/dispatcher"
-	"log"
 	"math/rand"
 	"time"
 )
@@ -22,22 +20,25 @@ type Var struct {
 	curFrame        *frame
 	curFrameOnDisk  *frame
 	writeInProgress func()
+	writeErr        error
 	subscribers     map[common.TxnId]VarWriteSubscriber
 	exe             *dispatcher.Executor
-	disk            *mdbs.MDBServer
+	disk            db.Store
 	vm              *VarManager
 	varCap          *msgs.Var
 	rng             *rand.Rand
 }
 
-func VarFromData(data []byte, exe *dispatcher.Executor, disk *mdbs.MDBServer, vm *VarManager) (*Var, error) {
-	seg, _, err := capn.ReadFromMemoryZeroCopy(data)
+// VarFromData restores the var held on disk as data. If either the
+// var or the txn which last wrote it is damaged or missing, the error
+// is a *db.CorruptionError.
+func VarFromData(uuid *common.VarUUId, data []byte, exe *dispatcher.Executor, disk db.Store, vm *VarManager) (*Var, error) {
+	varCap, err := db.DecodeVar(uuid[:], data)
 	if err != nil {
 		return nil, err
 	}
-	varCap := msgs.ReadRootVar(seg)
 
-	v := newVar(common.MakeVarUUId(varCap.Id()), exe, disk, vm)
+	v := newVar(uuid, exe, disk, vm)
 	positions := varCap.Positions()
 	if positions.Len() != 0 {
 		v.positions = (*common.Positions)(&positions)
@@ -48,11 +49,11 @@ func VarFromData(data []byte, exe *dispatcher.Executor, disk *mdbs.MDBServer, vm
 	writesClock := VectorClockFromCap(varCap.WritesClock())
 	server.Log(v.UUId, "Restored", writeTxnId)
 
-	if result, err := disk.ReadonlyTransaction(func(rtxn *mdbs.RTxn) (interface{}, error) {
+	if result, err := disk.ReadonlyTransaction(func(rtxn db.RTxn) (interface{}, error) {
 		return db.ReadTxnFromDisk(rtxn, writeTxnId)
 	}).ResultError(); err == nil {
 		if result == nil || result.(*msgs.Txn) == nil {
-			panic(fmt.Sprintf("%v Unable to find txn %v on disk (%v)", v.UUId, writeTxnId, result))
+			return nil, &db.CorruptionError{Table: db.Transactions, Key: writeTxnId[:], Reason: fmt.Sprintf("missing, but last wrote var %v", v.UUId)}
 		}
 		actions := result.(*msgs.Txn).Actions()
 		v.curFrame = NewFrame(nil, v, writeTxnId, &actions, writeTxnClock, writesClock)
@@ -61,12 +62,12 @@ func VarFromData(data []byte, exe *dispatcher.Executor, disk *mdbs.MDBServer, vm
 		return nil, err
 	}
 
-	v.varCap = &varCap
+	v.varCap = varCap
 
 	return v, nil
 }
 
-func NewVar(uuid *common.VarUUId, exe *dispatcher.Executor, disk *mdbs.MDBServer, vm *VarManager) *Var {
+func NewVar(uuid *common.VarUUId, exe *dispatcher.Executor, disk db.Store, vm *VarManager) *Var {
 	v := newVar(uuid, exe, disk, vm)
 
 	clock := NewVectorClock().Bump(*v.UUId, 0)
@@ -81,7 +82,7 @@ func NewVar(uuid *common.VarUUId, exe *dispatcher.Executor, disk *mdbs.MDBServer
 	return v
 }
 
-func newVar(uuid *common.VarUUId, exe *dispatcher.Executor, disk *mdbs.MDBServer, vm *VarManager) *Var {
+func newVar(uuid *common.VarUUId, exe *dispatcher.Executor, disk db.Store, vm *VarManager) *Var {
 	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
 	return &Var{
 		UUId:            uuid,
@@ -198,10 +199,11 @@ func (v *Var) SetCurFrame(f *frame, action *localAction, positions *common.Posit
 		create := actionCap.Create()
 		value = create.Value()
 		references = create.References()
-	case msgs.ACTION_ROLL: // deliberately do nothing
+	case msgs.ACTION_ROLL, msgs.ACTION_MISSING: // deliberately do nothing
 	default:
 		panic(fmt.Sprintf("Unexpected action type: %v", actionCap.Which()))
 	}
+	v.vm.barrier.record(&references)
 	for _, sub := range v.subscribers {
 		sub(v, value, &references, action.Txn)
 	}
@@ -245,25 +247,54 @@ func (v *Var) maybeWriteFrame(f *frame, action *localAction, positions *common.P
 
 	txnBytes := action.TxnRootBytes()
 
+	v.writeFrame(f, varData, txnBytes, 0)
+}
+
+// writeFrame writes f to disk. The txn of f has committed so the write
+// can't be abandoned lightly. If it fails, it is retried, with
+// exponential backoff, until it succeeds or the write failure policy
+// gives up on it, which shuts the node down. In the meantime
+// writeInProgress remains set, so the writes of later frames queue up
+// behind it, and the var stays active. If the write is given up on,
+// it stays set for good, and the var reports the failure in its
+// status until the node is gone.
+func (v *Var) writeFrame(f *frame, varData, txnBytes []byte, attempt uint) {
+	var oldTxnId *common.TxnId
+	if v.curFrameOnDisk != nil {
+		oldTxnId = v.curFrameOnDisk.frameTxnId
+	}
 	// to ensure correct order of writes, schedule the write from
 	// the current go-routine...
-	future := v.disk.ReadWriteTransaction(false, func(rwtxn *mdbs.RWTxn) (interface{}, error) {
+	future := v.disk.ReadWriteTransaction(false, func(rwtxn db.RWTxn) (interface{}, error) {
 		if err := db.WriteTxnToDisk(rwtxn, f.frameTxnId, txnBytes); err != nil {
 			return nil, err
 		}
-		if err := rwtxn.Put(db.DB.Vars, v.UUId[:], varData, 0); err != nil {
+		if err := db.WriteVarToDisk(rwtxn, v.UUId[:], varData); err != nil {
 			return nil, err
 		}
-		if v.curFrameOnDisk != nil {
-			return nil, db.DeleteTxnFromDisk(rwtxn, v.curFrameOnDisk.frameTxnId)
+		if oldTxnId != nil {
+			return nil, db.DeleteTxnFromDisk(rwtxn, oldTxnId)
 		}
 		return nil, nil
 	})
 	go func() {
 		// ... but process the result in a new go-routine to avoid blocking the executor.
 		if _, err := future.ResultError(); err != nil {
-			log.Println("Var error when writing to disk:", err)
+			delay, retry := v.vm.writeFailures.Failed(v.writeKey(), err, attempt)
+			if retry {
+				time.AfterFunc(delay, func() {
+					v.applyToVar(func() {
+						v.writeFrame(f, varData, txnBytes, attempt+1)
+					})
+				})
+			} else {
+				v.applyToVar(func() {
+					v.writeErr = fmt.Errorf("Unable to write %v to disk: %v", f.frameTxnId, err)
+				})
+			}
 			return
+		} else if attempt > 0 {
+			v.vm.writeFailures.Succeeded(v.writeKey())
 		}
 		// Switch back to the right go-routine
 		v.applyToVar(func() {
@@ -276,6 +307,10 @@ func (v *Var) maybeWriteFrame(f *frame, action *localAction, positions *common.P
 	}()
 }
 
+func (v *Var) writeKey() string {
+	return fmt.Sprintf("%v Var", v.UUId)
+}
+
 func (v *Var) TxnGloballyComplete(action *localAction) {
 	server.Log(v.UUId, "Txn globally complete", action)
 	if action.frame.v != v {
@@ -283,6 +318,9 @@ func (v *Var) TxnGloballyComplete(action *localAction) {
 	}
 	if action.IsWrite() {
 		action.frame.WriteGloballyComplete(action)
+		if Deletes(action.writeTxnActions, v.UUId) {
+			v.vm.TombstoneComplete(v.UUId, action.Id)
+		}
 	} else {
 		action.frame.ReadGloballyComplete(action)
 	}
@@ -323,6 +361,9 @@ func (v *Var) Status(sc *server.StatusConsumer) {
 	sc.Emit("- CurFrame:")
 	v.curFrame.Status(sc.Fork())
 	sc.Emit(fmt.Sprintf("- Subscribers: %v", len(v.subscribers)))
+	if v.writeErr != nil {
+		sc.Emit(fmt.Sprintf("- Write failed: %v", v.writeErr))
+	}
 	sc.Emit(fmt.Sprintf("- Idle? %v", v.isIdle()))
 	sc.Join()
 }
@@ -0,0 +1,639 @@
+package txnengine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	capn "github.com/glycerine/go-capnproto"
+	"goshawkdb.io/common"
+	msgs "goshawkdb.io/common/capnp"
+	"goshawkdb.io/server/db"
+	"goshawkdb.io/server/dispatcher"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errInjected = errors.New("Injected failure")
+
+type varTest struct {
+	t          *testing.T
+	dispatcher *dispatcher.Dispatcher
+	exe        *dispatcher.Executor
+	inner      *db.MemoryStore
+	disk       *db.FaultyStore
+	vm         *VarManager
+	vUUId      *common.VarUUId
+}
+
+func newVarTest(t *testing.T) *varTest {
+	vt := &varTest{
+		t:          t,
+		dispatcher: new(dispatcher.Dispatcher),
+		inner:      db.NewMemoryStore(),
+		vUUId:      common.MakeVarUUId([]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19}),
+	}
+	vt.dispatcher.Init(1)
+	vt.exe = vt.dispatcher.Executors[0]
+	vt.disk = db.NewFaultyStore(vt.inner)
+	vt.vm = NewVarManager(vt.exe, vt.disk, nil, nil, nil)
+	return vt
+}
+
+func (vt *varTest) shutdown() {
+	vt.dispatcher.Shutdown()
+}
+
+func makeTxnId(n uint32) *common.TxnId {
+	txnId := make([]byte, common.KeyLen)
+	binary.BigEndian.PutUint32(txnId[common.KeyLen-4:], n)
+	return common.MakeTxnId(txnId)
+}
+
+// write commits a write of value to the var at version n, as a
+// single-action txn, without involving any other part of the engine.
+func (vt *varTest) write(n uint32, value string) *common.TxnId {
+	return vt.commit(n, func(seg *capn.Segment, action *msgs.Action) {
+		action.SetWrite()
+		write := action.Write()
+		write.SetValue([]byte(value))
+		write.SetReferences(msgs.NewVarIdPosList(seg, 0))
+	})
+}
+
+// remove commits a delete of the var at version n.
+func (vt *varTest) remove(n uint32) *common.TxnId {
+	return vt.commit(n, func(seg *capn.Segment, action *msgs.Action) {
+		action.SetMissing()
+	})
+}
+
+func (vt *varTest) commit(n uint32, setAction func(*capn.Segment, *msgs.Action)) *common.TxnId {
+	txnId := makeTxnId(n)
+	seg := capn.NewBuffer(nil)
+	txnCap := msgs.NewRootTxn(seg)
+	txnCap.SetId(txnId[:])
+	actions := msgs.NewActionList(seg, 1)
+	txnCap.SetActions(actions)
+	action := actions.At(0)
+	action.SetVarId(vt.vUUId[:])
+	setAction(seg, &action)
+
+	done := make(chan struct{})
+	vt.exe.Enqueue(func() {
+		vt.vm.ApplyToVar(func(v *Var, err error) {
+			if err != nil {
+				vt.t.Error(err)
+				close(done)
+				return
+			}
+			clock := NewVectorClock().Bump(*v.UUId, uint64(n))
+			f := NewFrame(nil, v, txnId, &actions, clock, clock)
+			localAction := &localAction{
+				Txn:         &Txn{Id: txnId, TxnCap: &txnCap},
+				vUUId:       v.UUId,
+				writeAction: &action,
+			}
+			v.SetCurFrame(f, localAction, nil)
+			close(done)
+		}, true, vt.vUUId)
+	})
+	<-done
+	return txnId
+}
+
+type varState struct {
+	txnId   *common.TxnId
+	deleted bool
+	version uint64
+}
+
+// state applies to the var through vm as a txn would, creating it if
+// missing, and returns what its current frame is.
+func (vt *varTest) state(vm *VarManager) *varState {
+	result := make(chan *varState, 1)
+	vt.exe.Enqueue(func() {
+		vm.ApplyToVar(func(v *Var, err error) {
+			if err != nil {
+				vt.t.Error(err)
+				result <- nil
+				return
+			}
+			f := v.curFrame
+			result <- &varState{txnId: f.frameTxnId, deleted: f.deleted, version: f.frameTxnClock.Clock[*v.UUId]}
+			v.maybeMakeInactive()
+		}, true, vt.vUUId)
+	})
+	state := <-result
+	if state == nil {
+		vt.t.FailNow()
+	}
+	return state
+}
+
+func (vt *varTest) isActive() bool {
+	result := make(chan bool, 1)
+	vt.exe.Enqueue(func() {
+		_, found := vt.vm.active[*vt.vUUId]
+		result <- found
+	})
+	return <-result
+}
+
+// onDisk returns the id of the txn which last wrote the var to disk,
+// or nil.
+func (vt *varTest) onDisk() *common.TxnId {
+	result, err := vt.inner.ReadonlyTransaction(func(rtxn db.RTxn) (interface{}, error) {
+		return db.ReadVarFromDisk(rtxn, vt.vUUId[:])
+	}).ResultError()
+	if err == db.NotFound {
+		return nil
+	} else if err != nil {
+		vt.t.Fatal(err)
+	}
+	return common.MakeTxnId(result.(*msgs.Var).WriteTxnId())
+}
+
+// replica returns the payloads of every var and txn on disk, keyed by
+// table and key, as another replica would hold them.
+func (vt *varTest) replica() map[string][]byte {
+	replica := make(map[string][]byte)
+	_, err := vt.inner.ReadonlyTransaction(func(rtxn db.RTxn) (interface{}, error) {
+		for _, table := range []db.Table{db.Vars, db.Transactions} {
+			err := rtxn.ForEach(table, func(key, value []byte) error {
+				payload, err := db.VerifyChecksum(table, key, value)
+				replica[table.String()+string(key)] = append([]byte{}, payload...)
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	}).ResultError()
+	if err != nil {
+		vt.t.Fatal(err)
+	}
+	return replica
+}
+
+// damage damages our copy of the var on disk.
+func (vt *varTest) damage() {
+	_, err := vt.inner.ReadWriteTransaction(false, func(rwtxn db.RWTxn) (interface{}, error) {
+		record, err := rwtxn.Get(db.Vars, vt.vUUId[:])
+		if err != nil {
+			return nil, err
+		}
+		record[len(record)-1] ^= 0xff
+		return nil, rwtxn.Put(db.Vars, vt.vUUId[:], record)
+	}).ResultError()
+	if err != nil {
+		vt.t.Fatal(err)
+	}
+}
+
+// applyTo applies to the var through vm, and sends the id of the txn
+// which last wrote it once that happens.
+func (vt *varTest) applyTo(vm *VarManager) <-chan *common.TxnId {
+	result := make(chan *common.TxnId, 1)
+	vt.exe.Enqueue(func() {
+		vm.ApplyToVar(func(v *Var, err error) {
+			if err != nil {
+				vt.t.Error(err)
+				result <- nil
+				return
+			}
+			result <- v.curFrame.frameTxnId
+			v.maybeMakeInactive()
+		}, false, vt.vUUId)
+	})
+	return result
+}
+
+func (vt *varTest) awaitInactive(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for vt.isActive() {
+		if time.Now().After(deadline) {
+			vt.t.Fatalf("Var still active after %v", timeout)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestVarWriteRetriedAfterFailure(t *testing.T) {
+	vt := newVarTest(t)
+	defer vt.shutdown()
+
+	vt.disk.FailWrites(3, errInjected)
+	txnId := vt.write(1, "hello")
+	if !vt.isActive() {
+		t.Fatal("Var inactive whilst write outstanding")
+	}
+	vt.awaitInactive(5 * time.Second)
+
+	if onDisk := vt.onDisk(); onDisk == nil || !onDisk.Equal(txnId) {
+		t.Fatalf("Expected var to be written by %v; found %v", txnId, onDisk)
+	}
+	if n := vt.inner.Len(db.Transactions); n != 1 {
+		t.Fatalf("Expected 1 txn on disk; found %v", n)
+	}
+}
+
+func TestVarWritesQueueBehindFailedWrite(t *testing.T) {
+	vt := newVarTest(t)
+	defer vt.shutdown()
+
+	vt.disk.FailWrites(-1, errInjected)
+	vt.write(1, "hello")
+	txnId := vt.write(2, "world")
+	time.Sleep(50 * time.Millisecond)
+	if !vt.isActive() {
+		t.Fatal("Var inactive whilst writes failing")
+	}
+	if onDisk := vt.onDisk(); onDisk != nil {
+		t.Fatalf("Expected nothing on disk; found %v", onDisk)
+	}
+
+	vt.disk.FailWrites(0, errInjected)
+	vt.awaitInactive(10 * time.Second)
+
+	if onDisk := vt.onDisk(); onDisk == nil || !onDisk.Equal(txnId) {
+		t.Fatalf("Expected var to be written by %v; found %v", txnId, onDisk)
+	}
+	// The first txn is no longer referenced by the var, so only the
+	// second should remain.
+	if n := vt.inner.Len(db.Transactions); n != 1 {
+		t.Fatalf("Expected 1 txn on disk; found %v", n)
+	}
+}
+
+func TestVarStaysActiveWhilstWriteDelayed(t *testing.T) {
+	vt := newVarTest(t)
+	defer vt.shutdown()
+
+	vt.disk.HoldWrites()
+	txnId := vt.write(1, "hello")
+	time.Sleep(20 * time.Millisecond)
+	if !vt.isActive() {
+		t.Fatal("Var inactive whilst write held")
+	}
+	vt.disk.ReleaseWrites()
+	vt.awaitInactive(5 * time.Second)
+	if onDisk := vt.onDisk(); onDisk == nil || !onDisk.Equal(txnId) {
+		t.Fatalf("Expected var to be written by %v; found %v", txnId, onDisk)
+	}
+}
+
+func TestVarCrashDiscardsUnflushedWrite(t *testing.T) {
+	vt := newVarTest(t)
+	defer vt.shutdown()
+
+	if err := vt.disk.SetAsyncFlush(true); err != nil {
+		t.Fatal(err)
+	}
+	flushed := vt.write(1, "hello")
+	vt.awaitInactive(5 * time.Second)
+	vt.disk.Flush()
+
+	vt.write(2, "world")
+	vt.awaitInactive(5 * time.Second)
+	if err := vt.disk.Crash(); err != nil {
+		t.Fatal(err)
+	}
+
+	if onDisk := vt.onDisk(); onDisk == nil || !onDisk.Equal(flushed) {
+		t.Fatalf("Expected var to be written by %v after crash; found %v", flushed, onDisk)
+	}
+	if n := vt.inner.Len(db.Transactions); n != 1 {
+		t.Fatalf("Expected 1 txn on disk after crash; found %v", n)
+	}
+
+	// A new var manager, as after a restart, finds the flushed write.
+	vm := NewVarManager(vt.exe, vt.inner, nil, nil, nil)
+	result := make(chan *common.TxnId, 1)
+	vt.exe.Enqueue(func() {
+		vm.ApplyToVar(func(v *Var, err error) {
+			if err != nil {
+				t.Error(err)
+				result <- nil
+				return
+			}
+			result <- v.curFrame.frameTxnId
+			v.maybeMakeInactive()
+		}, false, vt.vUUId)
+	})
+	if txnId := <-result; txnId == nil || !txnId.Equal(flushed) {
+		t.Fatalf("Expected restored var to be at %v; found %v", flushed, txnId)
+	}
+}
+
+func TestVarRepairedFromReplica(t *testing.T) {
+	vt := newVarTest(t)
+	defer vt.shutdown()
+
+	txnId := vt.write(1, "hello")
+	vt.awaitInactive(5 * time.Second)
+
+	// Keep intact copies, as another replica would hold them, then
+	// damage ours.
+	replica := vt.replica()
+	vt.damage()
+
+	corruptions := db.NewCorruptions(nil)
+	vm := NewVarManager(vt.exe, vt.inner, nil, corruptions, nil)
+	result := vt.applyTo(vm)
+	// Nothing to fetch from yet, so the apply waits.
+	select {
+	case <-result:
+		t.Fatal("Expected apply to wait for repair")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if stats := corruptions.Stats(); stats.Found != 1 || len(stats.Outstanding) != 1 {
+		t.Fatalf("Expected 1 outstanding corruption; got %+v", stats)
+	}
+
+	corruptions.SetFetcher(func(table db.Table, key []byte) (map[common.RMId][]byte, int, error) {
+		if payload, found := replica[table.String()+string(key)]; found {
+			return map[common.RMId][]byte{2: payload}, 1, nil
+		}
+		return nil, 1, nil
+	})
+	select {
+	case repaired := <-result:
+		if repaired == nil || !repaired.Equal(txnId) {
+			t.Fatalf("Expected repaired var to be at %v; found %v", txnId, repaired)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Var was not repaired")
+	}
+	if stats := corruptions.Stats(); stats.Repaired != 1 || len(stats.Outstanding) != 0 {
+		t.Fatalf("Expected corruption to be repaired; got %+v", stats)
+	}
+	if onDisk := vt.onDisk(); onDisk == nil || !onDisk.Equal(txnId) {
+		t.Fatalf("Expected repaired var on disk to be written by %v; found %v", txnId, onDisk)
+	}
+}
+
+// A copy is only used to repair the var once F+1 replicas agree on it.
+func TestVarRepairNeedsQuorum(t *testing.T) {
+	vt := newVarTest(t)
+	defer vt.shutdown()
+
+	vt.write(1, "hello")
+	vt.awaitInactive(5 * time.Second)
+	stale := vt.replica()
+	txnId := vt.write(2, "world")
+	vt.awaitInactive(5 * time.Second)
+	current := vt.replica()
+	vt.damage()
+
+	var lock sync.Mutex
+	replicas := []map[string][]byte{current, stale}
+	corruptions := db.NewCorruptions(nil)
+	corruptions.SetFetcher(func(table db.Table, key []byte) (map[common.RMId][]byte, int, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		copies := make(map[common.RMId][]byte)
+		for idx, replica := range replicas {
+			if payload, found := replica[table.String()+string(key)]; found {
+				copies[common.RMId(idx+2)] = payload
+			}
+		}
+		return copies, 2, nil
+	})
+	vm := NewVarManager(vt.exe, vt.inner, nil, corruptions, nil)
+	result := vt.applyTo(vm)
+	select {
+	case <-result:
+		t.Fatal("Expected apply to wait until F+1 replicas agree")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	lock.Lock()
+	replicas = append(replicas, current)
+	lock.Unlock()
+	select {
+	case repaired := <-result:
+		if repaired == nil || !repaired.Equal(txnId) {
+			t.Fatalf("Expected repaired var to be at %v; found %v", txnId, repaired)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Var was not repaired")
+	}
+}
+
+// With no other replicas, the var can't be repaired, and the node is
+// shut down rather than leaving txns waiting for it forever.
+func TestVarUnrepairable(t *testing.T) {
+	vt := newVarTest(t)
+	defer vt.shutdown()
+
+	vt.write(1, "hello")
+	vt.awaitInactive(5 * time.Second)
+	vt.damage()
+
+	shutdowns := make(chan error, 1)
+	corruptions := db.NewCorruptions(func(err error) { shutdowns <- err })
+	corruptions.SetFetcher(func(table db.Table, key []byte) (map[common.RMId][]byte, int, error) {
+		return nil, 0, db.NoReplicas
+	})
+	vm := NewVarManager(vt.exe, vt.inner, nil, corruptions, nil)
+	result := vt.applyTo(vm)
+	select {
+	case <-shutdowns:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected node to be shut down")
+	}
+	if stats := corruptions.Stats(); len(stats.Unrepairable) != 1 {
+		t.Fatalf("Expected 1 unrepairable corruption; got %+v", stats)
+	}
+	unrepairable := make(chan bool, 1)
+	vt.exe.Enqueue(func() {
+		_, found := vm.unrepairable[*vt.vUUId]
+		unrepairable <- found
+	})
+	if !<-unrepairable {
+		t.Fatal("Expected var to be marked unrepairable")
+	}
+	select {
+	case <-result:
+		t.Fatal("Expected apply to remain queued")
+	default:
+	}
+}
+
+func TestVarReplacedIfUnchanged(t *testing.T) {
+	vt := newVarTest(t)
+	defer vt.shutdown()
+
+	oldTxnId := vt.write(1, "hello")
+	vt.awaitInactive(5 * time.Second)
+	replica := vt.replica()
+	varBites := replica[db.Vars.String()+string(vt.vUUId[:])]
+	txnBites := replica[db.Transactions.String()+string(oldTxnId[:])]
+
+	newTxnId := vt.write(2, "world")
+	vt.awaitInactive(5 * time.Second)
+	result, err := vt.inner.ReadonlyTransaction(func(rtxn db.RTxn) (interface{}, error) {
+		return db.ReadVarFromDisk(rtxn, vt.vUUId[:])
+	}).ResultError()
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := VarDigest(vt.vUUId, result.(*msgs.Var))
+	if oldCap, err := db.DecodeVar(vt.vUUId[:], varBites); err != nil {
+		t.Fatal(err)
+	} else if bytes.Equal(digest, VarDigest(vt.vUUId, oldCap)) {
+		t.Fatal("Expected different versions to have different digests")
+	}
+
+	replace := func(expected []byte) bool {
+		type replaced struct {
+			ok  bool
+			err error
+		}
+		resultChan := make(chan replaced, 1)
+		vt.exe.Enqueue(func() {
+			ok, err := vt.vm.replaceIfUnchanged(vt.vUUId, expected, varBites, oldTxnId, txnBites)
+			resultChan <- replaced{ok: ok, err: err}
+		})
+		r := <-resultChan
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		return r.ok
+	}
+
+	// Our copy has moved on from what was expected, or is not missing.
+	if replace(make([]byte, len(digest))) || replace(nil) {
+		t.Fatal("Expected var not to be replaced when changed")
+	}
+	if onDisk := vt.onDisk(); onDisk == nil || !onDisk.Equal(newTxnId) {
+		t.Fatalf("Expected var to still be written by %v; found %v", newTxnId, onDisk)
+	}
+
+	if !replace(digest) {
+		t.Fatal("Expected var to be replaced")
+	}
+	if onDisk := vt.onDisk(); onDisk == nil || !onDisk.Equal(oldTxnId) {
+		t.Fatalf("Expected var to be written by %v; found %v", oldTxnId, onDisk)
+	}
+	// The txn we replaced is no longer referenced, and the one we
+	// adopted is back.
+	if n := vt.inner.Len(db.Transactions); n != 1 {
+		t.Fatalf("Expected 1 txn on disk; found %v", n)
+	}
+}
+
+func TestVarDeleteLeavesTombstone(t *testing.T) {
+	vt := newVarTest(t)
+	defer vt.shutdown()
+
+	vt.write(1, "hello")
+	deleteTxnId := vt.remove(2)
+	vt.awaitInactive(5 * time.Second)
+
+	if onDisk := vt.onDisk(); onDisk == nil || !onDisk.Equal(deleteTxnId) {
+		t.Fatalf("Expected tombstone written by %v; found %v", deleteTxnId, onDisk)
+	}
+	// The write is no longer referenced; the delete is.
+	if n := vt.inner.Len(db.Transactions); n != 1 {
+		t.Fatalf("Expected 1 txn on disk; found %v", n)
+	}
+}
+
+func TestVarReadAfterDelete(t *testing.T) {
+	vt := newVarTest(t)
+	defer vt.shutdown()
+
+	vt.write(1, "hello")
+	deleteTxnId := vt.remove(2)
+	vt.awaitInactive(5 * time.Second)
+
+	// Both whilst running and after a restart, the next txn must find
+	// the delete, not a fresh var.
+	for _, vm := range []*VarManager{vt.vm, NewVarManager(vt.exe, vt.inner, nil, nil, nil)} {
+		state := vt.state(vm)
+		if state.txnId == nil || !state.txnId.Equal(deleteTxnId) || !state.deleted || state.version != 2 {
+			t.Fatalf("Expected var to be deleted by %v at version 2; found %+v", deleteTxnId, state)
+		}
+	}
+}
+
+func TestVarRecreatedAfterDelete(t *testing.T) {
+	vt := newVarTest(t)
+	defer vt.shutdown()
+
+	vt.write(1, "hello")
+	vt.remove(2)
+	vt.awaitInactive(5 * time.Second)
+	txnId := vt.write(3, "again")
+	vt.awaitInactive(5 * time.Second)
+
+	if onDisk := vt.onDisk(); onDisk == nil || !onDisk.Equal(txnId) {
+		t.Fatalf("Expected var to be written by %v; found %v", txnId, onDisk)
+	}
+	if n := vt.inner.Len(db.Transactions); n != 1 {
+		t.Fatalf("Expected 1 txn on disk; found %v", n)
+	}
+	state := vt.state(NewVarManager(vt.exe, vt.inner, nil, nil, nil))
+	if !state.txnId.Equal(txnId) || state.deleted || state.version != 3 {
+		t.Fatalf("Expected var to be written by %v at version 3; found %+v", txnId, state)
+	}
+}
+
+// expire expires the var's tombstone left by txnId, as happens once
+// the grace period has passed, and waits for it to finish.
+func (vt *varTest) expire(txnId *common.TxnId) {
+	vt.exe.Enqueue(func() { vt.vm.expireTombstone(vt.vUUId, txnId) })
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		result := make(chan bool, 1)
+		vt.exe.Enqueue(func() {
+			_, found := vt.vm.expiring[*vt.vUUId]
+			result <- found
+		})
+		if !<-result {
+			return
+		} else if time.Now().After(deadline) {
+			vt.t.Fatal("Tombstone still expiring after 5s")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestVarTombstoneExpires(t *testing.T) {
+	vt := newVarTest(t)
+	defer vt.shutdown()
+
+	vt.write(1, "hello")
+	deleteTxnId := vt.remove(2)
+	vt.awaitInactive(5 * time.Second)
+	vt.expire(deleteTxnId)
+
+	if onDisk := vt.onDisk(); onDisk != nil {
+		t.Fatalf("Expected tombstone to be gone; found var written by %v", onDisk)
+	}
+	if n := vt.inner.Len(db.Transactions); n != 0 {
+		t.Fatalf("Expected no txns on disk; found %v", n)
+	}
+}
+
+func TestVarTombstoneNotExpiredOnceRewritten(t *testing.T) {
+	vt := newVarTest(t)
+	defer vt.shutdown()
+
+	vt.write(1, "hello")
+	deleteTxnId := vt.remove(2)
+	vt.awaitInactive(5 * time.Second)
+	txnId := vt.write(3, "again")
+	vt.awaitInactive(5 * time.Second)
+	vt.expire(deleteTxnId)
+
+	if onDisk := vt.onDisk(); onDisk == nil || !onDisk.Equal(txnId) {
+		t.Fatalf("Expected var to be written by %v; found %v", txnId, onDisk)
+	}
+	if n := vt.inner.Len(db.Transactions); n != 1 {
+		t.Fatalf("Expected 1 txn on disk; found %v", n)
+	}
+}
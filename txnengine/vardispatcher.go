@@ -2,25 +2,28 @@ package txnengine
 
 import (
 	"fmt"
-	mdbs "github.com/msackman/gomdb/server"
 	"goshawkdb.io/common"
 	msgs "goshawkdb.io/common/capnp"
 	"goshawkdb.io/server"
+	"goshawkdb.io/server/db"
 	"goshawkdb.io/server/dispatcher"
 )
 
 type VarDispatcher struct {
 	dispatcher.Dispatcher
+	Barrier     *WriteBarrier
 	varmanagers []*VarManager
 }
 
-func NewVarDispatcher(count uint8, server *mdbs.MDBServer, lc LocalConnection) *VarDispatcher {
+func NewVarDispatcher(count uint8, server db.Store, failures *db.WriteFailures, corruptions *db.Corruptions, lc LocalConnection) *VarDispatcher {
 	vd := &VarDispatcher{
+		Barrier:     NewWriteBarrier(),
 		varmanagers: make([]*VarManager, count),
 	}
 	vd.Dispatcher.Init(count)
 	for idx, exe := range vd.Executors {
-		vd.varmanagers[idx] = NewVarManager(exe, server, lc)
+		vd.varmanagers[idx] = NewVarManager(exe, server, failures, corruptions, lc)
+		vd.varmanagers[idx].barrier = vd.Barrier
 	}
 	return vd
 }
@@ -40,6 +43,61 @@ func (vd *VarDispatcher) Status(sc *server.StatusConsumer) {
 	sc.Join()
 }
 
+func (vd *VarDispatcher) ActiveVarCount() int {
+	results := make(chan int, len(vd.Executors))
+	for idx, executor := range vd.Executors {
+		manager := vd.varmanagers[idx]
+		if !executor.Enqueue(func() { results <- len(manager.active) }) {
+			results <- 0
+		}
+	}
+	count := 0
+	for range vd.Executors {
+		count += <-results
+	}
+	return count
+}
+
+// VarIsUnchanged returns true if the var is not active or being
+// repaired, and our copy was last written by writeTxnId.
+func (vd *VarDispatcher) VarIsUnchanged(vUUId *common.VarUUId, writeTxnId *common.TxnId) (bool, error) {
+	type result struct {
+		unchanged bool
+		err       error
+	}
+	resultChan := make(chan result, 1)
+	enqueued := vd.withVarManager(vUUId, func(vm *VarManager) {
+		unchanged, err := vm.isUnchanged(vUUId, writeTxnId)
+		resultChan <- result{unchanged: unchanged, err: err}
+	})
+	if !enqueued {
+		return false, nil
+	}
+	r := <-resultChan
+	return r.unchanged, r.err
+}
+
+// ReplaceVarIfUnchanged replaces our copy of the var with varBites,
+// last written by writeTxnId whose record is txnBites, provided the
+// var is not active and our copy still has the digest expected (or is
+// missing, if expected is nil).
+func (vd *VarDispatcher) ReplaceVarIfUnchanged(vUUId *common.VarUUId, expected, varBites []byte, writeTxnId *common.TxnId, txnBites []byte) (bool, error) {
+	type result struct {
+		replaced bool
+		err      error
+	}
+	resultChan := make(chan result, 1)
+	enqueued := vd.withVarManager(vUUId, func(vm *VarManager) {
+		replaced, err := vm.replaceIfUnchanged(vUUId, expected, varBites, writeTxnId, txnBites)
+		resultChan <- result{replaced: replaced, err: err}
+	})
+	if !enqueued {
+		return false, nil
+	}
+	r := <-resultChan
+	return r.replaced, r.err
+}
+
 func (vd *VarDispatcher) withVarManager(vUUId *common.VarUUId, fun func(*VarManager)) bool {
 	idx := uint8(vUUId[server.MostRandomByteIndex]) % vd.ExecutorCount
 	executor := vd.Executors[idx]
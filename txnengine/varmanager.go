@@ -1,44 +1,66 @@
 package txnengine
 
 import (
+	"bytes"
 	"fmt"
-	mdb "github.com/msackman/gomdb"
-	mdbs "github.com/msackman/gomdb/server"
 	"goshawkdb.io/common"
+	msgs "goshawkdb.io/common/capnp"
 	"goshawkdb.io/server"
 	"goshawkdb.io/server/db"
 	"goshawkdb.io/server/dispatcher"
+	"log"
 	"math/rand"
 	"time"
 )
 
 type VarManager struct {
 	LocalConnection
-	disk       *mdbs.MDBServer
-	active     map[common.VarUUId]*Var
-	exe        *dispatcher.Executor
-	lc         LocalConnection
-	callbacks  []func()
-	beaterLive bool
+	disk          db.Store
+	writeFailures *db.WriteFailures
+	corruptions   *db.Corruptions
+	barrier       *WriteBarrier
+	active        map[common.VarUUId]*Var
+	repairing     map[common.VarUUId][]func()
+	expiring      map[common.VarUUId][]func()
+	unrepairable  map[common.VarUUId]error
+	exe           *dispatcher.Executor
+	lc            LocalConnection
+	callbacks     []func()
+	beaterLive    bool
 }
 
-func init() {
-	db.DB.Vars = &mdbs.DBISettings{Flags: mdb.CREATE}
-}
-
-func NewVarManager(exe *dispatcher.Executor, server *mdbs.MDBServer, lc LocalConnection) *VarManager {
+func NewVarManager(exe *dispatcher.Executor, server db.Store, failures *db.WriteFailures, corruptions *db.Corruptions, lc LocalConnection) *VarManager {
 	return &VarManager{
 		LocalConnection: lc,
 		disk:            server,
+		writeFailures:   failures,
+		corruptions:     corruptions,
 		active:          make(map[common.VarUUId]*Var),
+		repairing:       make(map[common.VarUUId][]func()),
+		expiring:        make(map[common.VarUUId][]func()),
+		unrepairable:    make(map[common.VarUUId]error),
 		exe:             exe,
 		callbacks:       []func(){},
 	}
 }
 
 func (vm *VarManager) ApplyToVar(fun func(*Var, error), createIfMissing bool, uuid *common.VarUUId) {
+	retry := func() { vm.ApplyToVar(fun, createIfMissing, uuid) }
+	if pending, found := vm.repairing[*uuid]; found {
+		vm.repairing[*uuid] = append(pending, retry)
+		return
+	} else if pending, found := vm.expiring[*uuid]; found {
+		vm.expiring[*uuid] = append(pending, retry)
+		return
+	}
 	v, err := vm.find(uuid)
-	if err == mdb.NotFound && createIfMissing {
+	if ce, corrupt := db.IsCorruption(err); corrupt {
+		vm.corruptions.Report(ce)
+		vm.repairing[*uuid] = []func(){retry}
+		vUUId := *uuid
+		go vm.repair(&vUUId, ce, 0)
+		return
+	} else if err == db.NotFound && createIfMissing {
 		v = NewVar(uuid, vm.exe, vm.disk, vm)
 		vm.active[*v.UUId] = v
 		server.Log(uuid, "New var")
@@ -63,23 +85,89 @@ func (vm *VarManager) SetInactive(v *Var) {
 		panic(fmt.Sprintf("%v inactive but different var! %p %p\n", v.UUId, v, v1))
 	default:
 		//fmt.Printf("%v is now inactive. ", v.UUId)
+		// A deleted var stays on disk as a tombstone, last written by
+		// the txn which deleted it, until it expires (see
+		// TombstoneComplete). Were it removed sooner, the next txn to
+		// use it would find nothing, and create it afresh, with a
+		// clock which has forgotten the delete and everything before.
 		delete(vm.active, *v.UUId)
 	}
 }
 
+// TombstoneComplete is called once every replica of the var has
+// applied txnId, which deleted it. After server.TombstoneGracePeriod,
+// by when nothing should still be using the var, the tombstone is
+// expired.
+func (vm *VarManager) TombstoneComplete(uuid *common.VarUUId, txnId *common.TxnId) {
+	time.AfterFunc(server.TombstoneGracePeriod, func() {
+		vm.exe.Enqueue(func() { vm.expireTombstone(uuid, txnId) })
+	})
+}
+
+// expireTombstone removes the var and the txn which deleted it from
+// disk, provided the var is not active, and is still the tombstone
+// left by txnId. Until that's done, everything applied to the var is
+// queued up, so nothing loads the tombstone as it goes.
+func (vm *VarManager) expireTombstone(uuid *common.VarUUId, txnId *common.TxnId) {
+	_, active := vm.active[*uuid]
+	_, repairing := vm.repairing[*uuid]
+	if active || repairing {
+		// If it's still a tombstone once it's done with, we'll find
+		// out next time.
+		vm.TombstoneComplete(uuid, txnId)
+		return
+	}
+	vm.expiring[*uuid] = []func(){}
+	future := vm.disk.ReadWriteTransaction(false, func(rwtxn db.RWTxn) (interface{}, error) {
+		return deleteTombstone(rwtxn, uuid, txnId)
+	})
+	go func() {
+		if expired, err := future.ResultError(); err != nil {
+			log.Printf("%v Unable to expire tombstone: %v\n", uuid, err)
+		} else if expired.(bool) {
+			server.Log(uuid, "Tombstone expired", txnId)
+		}
+		vm.exe.Enqueue(func() {
+			pending := vm.expiring[*uuid]
+			delete(vm.expiring, *uuid)
+			for _, fun := range pending {
+				fun()
+			}
+		})
+	}()
+}
+
+// deleteTombstone removes the var, and the txn which last wrote it,
+// from disk, if the var was last written by txnId. It returns whether
+// it did.
+func deleteTombstone(rwtxn db.RWTxn, vUUId *common.VarUUId, txnId *common.TxnId) (bool, error) {
+	varCap, err := db.ReadVarFromDisk(rwtxn, vUUId[:])
+	if err == db.NotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	} else if !bytes.Equal(varCap.WriteTxnId(), txnId[:]) {
+		return false, nil
+	}
+	if err = rwtxn.Del(db.Vars, vUUId[:]); err != nil {
+		return false, err
+	}
+	return true, db.DeleteTxnFromDisk(rwtxn, txnId)
+}
+
 func (vm *VarManager) find(uuid *common.VarUUId) (*Var, error) {
 	if v, found := vm.active[*uuid]; found {
 		return v, nil
 	}
 
-	result, err := vm.disk.ReadonlyTransaction(func(rtxn *mdbs.RTxn) (interface{}, error) {
+	result, err := vm.disk.ReadonlyTransaction(func(rtxn db.RTxn) (interface{}, error) {
 		// rtxn.Get returns a copy of the data, so we don't need to
 		// worry about pointers into the disk
-		return rtxn.Get(db.DB.Vars, uuid[:])
+		return rtxn.Get(db.Vars, uuid[:])
 	}).ResultError()
 
 	if err == nil {
-		v, err := VarFromData(result.([]byte), vm.exe, vm.disk, vm)
+		v, err := VarFromData(uuid, result.([]byte), vm.exe, vm.disk, vm)
 		if err == nil {
 			vm.active[*v.UUId] = v
 		}
@@ -89,8 +177,186 @@ func (vm *VarManager) find(uuid *common.VarUUId) (*Var, error) {
 	}
 }
 
+// repair replaces the var, and the txn which last wrote it, with the
+// newest copy held by at least F+1 of the other replicas. Until that
+// succeeds, everything applied to the var is queued up. This runs in
+// its own go-routine, and retries, with exponential backoff, up to
+// server.CorruptionRepairMaxAttempts times. If there are no other
+// replicas, or we run out of attempts, the var is marked unrepairable
+// and the node is shut down: the txns queued up can't go anywhere
+// without it.
+func (vm *VarManager) repair(uuid *common.VarUUId, ce *db.CorruptionError, attempt uint) {
+	err := vm.replaceFromReplicas(uuid)
+	switch {
+	case err == nil:
+		vm.corruptions.Repaired(ce)
+		vm.exe.Enqueue(func() {
+			pending := vm.repairing[*uuid]
+			delete(vm.repairing, *uuid)
+			for _, fun := range pending {
+				fun()
+			}
+		})
+	case err == db.NoReplicas || attempt+1 >= server.CorruptionRepairMaxAttempts:
+		vm.corruptions.Unrepairable(ce, err)
+		vm.exe.Enqueue(func() { vm.unrepairable[*uuid] = err })
+	default:
+		delay := server.CorruptionRepairRetryMin
+		for idx := uint(0); idx < attempt && delay < server.CorruptionRepairRetryMax; idx++ {
+			delay *= 2
+		}
+		if delay > server.CorruptionRepairRetryMax {
+			delay = server.CorruptionRepairRetryMax
+		}
+		log.Printf("%v Unable to repair var from other replicas (attempt %v; retrying in %v): %v\n", uuid, attempt+1, delay, err)
+		time.AfterFunc(delay, func() { vm.repair(uuid, ce, attempt+1) })
+	}
+}
+
+// replaceFromReplicas fetches the var from the other replicas, along
+// with the txn which last wrote the newest copy, and writes them to
+// disk. If our copy of the var is damaged, we can't know which txn it
+// referenced, so that reference is leaked: the txn will never be
+// deleted from disk.
+func (vm *VarManager) replaceFromReplicas(uuid *common.VarUUId) error {
+	copies, quorum, err := vm.corruptions.Fetch(db.Vars, uuid[:])
+	if err != nil {
+		return err
+	}
+	// Only a version held by at least quorum replicas is known to be
+	// committed: pick the newest of those.
+	type version struct {
+		votes      int
+		version    uint64
+		varBites   []byte
+		writeTxnId *common.TxnId
+	}
+	versions := make(map[string]*version)
+	for rmId, bites := range copies {
+		varCap, err := db.DecodeVar(uuid[:], bites)
+		if err != nil {
+			log.Printf("%v Ignoring damaged copy from %v: %v\n", uuid, rmId, err)
+			continue
+		}
+		digest := string(VarDigest(uuid, varCap))
+		if v, found := versions[digest]; found {
+			v.votes++
+		} else {
+			versions[digest] = &version{
+				votes:      1,
+				version:    VectorClockFromCap(varCap.WriteTxnClock()).Clock[*uuid],
+				varBites:   bites,
+				writeTxnId: common.MakeTxnId(varCap.WriteTxnId()),
+			}
+		}
+	}
+	var newest *version
+	for _, v := range versions {
+		if v.votes >= quorum && (newest == nil || v.version > newest.version) {
+			newest = v
+		}
+	}
+	if newest == nil {
+		return fmt.Errorf("No version of var %v is held by F+1 (%v) of the %v other replicas which replied", uuid, quorum, len(copies))
+	}
+
+	txnBites, err := fetchTxnRecord(vm.corruptions.Fetch, uuid, newest.writeTxnId)
+	if err != nil {
+		return err
+	}
+
+	_, err = vm.replaceOnDisk(uuid, newest.varBites, newest.writeTxnId, txnBites, nil)
+	return err
+}
+
+// replaceIfUnchanged replaces our copy of the var with varBites, last
+// written by writeTxnId whose record is txnBites, but only if the var
+// is not active or being repaired, and our copy still has the digest
+// expected (or is missing, if expected is nil). Returns true if the
+// var was replaced.
+func (vm *VarManager) replaceIfUnchanged(uuid *common.VarUUId, expected, varBites []byte, writeTxnId *common.TxnId, txnBites []byte) (bool, error) {
+	if _, found := vm.active[*uuid]; found {
+		return false, nil
+	} else if _, found := vm.repairing[*uuid]; found {
+		return false, nil
+	}
+	return vm.replaceOnDisk(uuid, varBites, writeTxnId, txnBites, func(varCap *msgs.Var) bool {
+		if varCap == nil {
+			return expected == nil
+		}
+		return bytes.Equal(VarDigest(uuid, varCap), expected)
+	})
+}
+
+// replaceOnDisk writes varBites, last written by writeTxnId whose
+// record is txnBites, in place of our copy of the var. If unchanged is
+// not nil, that's only done if it returns true for our copy, which is
+// nil if the var is missing. Returns true if the var was replaced.
+func (vm *VarManager) replaceOnDisk(uuid *common.VarUUId, varBites []byte, writeTxnId *common.TxnId, txnBites []byte, unchanged func(*msgs.Var) bool) (bool, error) {
+	result, err := vm.disk.ReadWriteTransaction(false, func(rwtxn db.RWTxn) (interface{}, error) {
+		varCap, err := db.ReadVarFromDisk(rwtxn, uuid[:])
+		if unchanged != nil {
+			if err != nil && err != db.NotFound {
+				return nil, err
+			}
+			if !unchanged(varCap) {
+				return false, nil
+			}
+		}
+		if err == nil {
+			if oldTxnId := common.MakeTxnId(varCap.WriteTxnId()); !oldTxnId.Equal(writeTxnId) {
+				if err = db.DeleteTxnFromDisk(rwtxn, oldTxnId); err != nil {
+					return nil, err
+				}
+				if err = db.WriteTxnToDisk(rwtxn, writeTxnId, txnBites); err != nil {
+					return nil, err
+				}
+			}
+		} else if err = db.WriteTxnToDisk(rwtxn, writeTxnId, txnBites); err != nil {
+			return nil, err
+		}
+		// Our copy of the txn may be the damaged record, and
+		// WriteTxnToDisk leaves an existing record alone.
+		if err := db.ReplaceTxnOnDisk(rwtxn, writeTxnId, txnBites); err != nil {
+			return nil, err
+		}
+		return true, db.WriteVarToDisk(rwtxn, uuid[:], varBites)
+	}).ResultError()
+	if err != nil {
+		return false, err
+	}
+	return result.(bool), nil
+}
+
+// isUnchanged returns true if the var is not active or being
+// repaired, and was last written by writeTxnId.
+func (vm *VarManager) isUnchanged(uuid *common.VarUUId, writeTxnId *common.TxnId) (bool, error) {
+	if _, found := vm.active[*uuid]; found {
+		return false, nil
+	} else if _, found := vm.repairing[*uuid]; found {
+		return false, nil
+	}
+	result, err := vm.disk.ReadonlyTransaction(func(rtxn db.RTxn) (interface{}, error) {
+		varCap, err := db.ReadVarFromDisk(rtxn, uuid[:])
+		if _, corrupt := db.IsCorruption(err); corrupt || err == db.NotFound {
+			return false, nil
+		} else if err != nil {
+			return nil, err
+		}
+		return common.MakeTxnId(varCap.WriteTxnId()).Equal(writeTxnId), nil
+	}).ResultError()
+	if err != nil {
+		return false, err
+	}
+	return result.(bool), nil
+}
+
 func (vm *VarManager) Status(sc *server.StatusConsumer) {
 	sc.Emit(fmt.Sprintf("- Active Vars: %v", len(vm.active)))
+	sc.Emit(fmt.Sprintf("- Vars Being Repaired: %v", len(vm.repairing)))
+	for vUUId, err := range vm.unrepairable {
+		sc.Emit(fmt.Sprintf("- Unrepairable: %v: %v", &vUUId, err))
+	}
 	sc.Emit(fmt.Sprintf("- Callbacks: %v", len(vm.callbacks)))
 	sc.Emit(fmt.Sprintf("- Beater live? %v", vm.beaterLive))
 	for _, v := range vm.active {
@@ -0,0 +1,164 @@
+package txnengine
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	capn "github.com/glycerine/go-capnproto"
+	"goshawkdb.io/common"
+	msgs "goshawkdb.io/common/capnp"
+	"goshawkdb.io/server/db"
+)
+
+// VarMetadata describes the version of a var held by one node,
+// without its value, so that replicas can be compared whilst the
+// cluster is running. Ids are hex encoded, and vector clocks are keyed
+// by hex encoded var ids. If the var's record is damaged, only VarUUId
+// and Error are set.
+type VarMetadata struct {
+	VarUUId       string
+	Positions     []int
+	WriteTxnId    string
+	WriteTxnClock map[string]uint64
+	WritesClock   map[string]uint64
+	Error         string
+}
+
+// VarMetadataPage is a page of the vars held by a node, in var id
+// order. Next is the id to ask for vars after, or empty if there are
+// no more.
+type VarMetadataPage struct {
+	RMId common.RMId
+	Vars []*VarMetadata
+	Next string
+}
+
+var errPageFull = errors.New("Page full")
+
+// ReadVarMetadataPage reads the metadata of up to limit vars from
+// disk, starting after the var after, or from the first var if after
+// is nil. The scan starts at after, so reading every page costs no
+// more than a single scan.
+func ReadVarMetadataPage(disk db.Store, after *common.VarUUId, limit int) ([]*VarMetadata, bool, error) {
+	vars := make([]*VarMetadata, 0, limit)
+	more := false
+	var from []byte
+	if after != nil {
+		from = after[:]
+	}
+	_, err := disk.ReadonlyTransaction(func(rtxn db.RTxn) (interface{}, error) {
+		err := rtxn.ForEachFrom(db.Vars, from, func(key, data []byte) error {
+			if after != nil && bytes.Equal(key, after[:]) {
+				return nil
+			} else if len(vars) == limit {
+				more = true
+				return errPageFull
+			}
+			vars = append(vars, NewVarMetadata(common.MakeVarUUId(key), data))
+			return nil
+		})
+		if err == errPageFull {
+			err = nil
+		}
+		return nil, err
+	}).ResultError()
+	return vars, more, err
+}
+
+// ReadVarMetadata reads the metadata of one var from disk, returning
+// nil if we don't hold it.
+func ReadVarMetadata(disk db.Store, vUUId *common.VarUUId) (*VarMetadata, error) {
+	result, err := disk.ReadonlyTransaction(func(rtxn db.RTxn) (interface{}, error) {
+		return rtxn.Get(db.Vars, vUUId[:])
+	}).ResultError()
+	if err == db.NotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return NewVarMetadata(vUUId, result.([]byte)), nil
+}
+
+// NewVarMetadata describes the var held on disk as data.
+func NewVarMetadata(vUUId *common.VarUUId, data []byte) *VarMetadata {
+	md := &VarMetadata{VarUUId: hex.EncodeToString(vUUId[:])}
+	varCap, err := db.DecodeVar(vUUId[:], data)
+	if err != nil {
+		md.Error = err.Error()
+		return md
+	}
+	positions := varCap.Positions().ToArray()
+	md.Positions = make([]int, len(positions))
+	for idx, position := range positions {
+		md.Positions[idx] = int(position)
+	}
+	md.WriteTxnId = hex.EncodeToString(varCap.WriteTxnId())
+	md.WriteTxnClock = vectorClockToMetadata(varCap.WriteTxnClock())
+	md.WritesClock = vectorClockToMetadata(varCap.WritesClock())
+	return md
+}
+
+func vectorClockToMetadata(vcCap msgs.VectorClock) map[string]uint64 {
+	clock := VectorClockFromCap(vcCap).Clock
+	result := make(map[string]uint64, len(clock))
+	for vUUId, v := range clock {
+		result[hex.EncodeToString(vUUId[:])] = v
+	}
+	return result
+}
+
+// Parse returns the var's id, positions and the id of the txn which
+// last wrote it.
+func (md *VarMetadata) Parse() (*common.VarUUId, *common.Positions, *common.TxnId, error) {
+	vUUId, err := parseKey(md.VarUUId)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Unable to parse var id '%s': %v", md.VarUUId, err)
+	}
+	if md.Error != "" {
+		return common.MakeVarUUId(vUUId), nil, nil, errors.New(md.Error)
+	}
+	writeTxnId, err := parseKey(md.WriteTxnId)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Unable to parse txn id '%s' of var %x: %v", md.WriteTxnId, vUUId, err)
+	}
+	positionsCap := capn.NewBuffer(nil).NewUInt8List(len(md.Positions))
+	for idx, position := range md.Positions {
+		positionsCap.Set(idx, uint8(position))
+	}
+	positions := common.Positions(positionsCap)
+	return common.MakeVarUUId(vUUId), &positions, common.MakeTxnId(writeTxnId), nil
+}
+
+// Clocks returns the var's writeTxnClock and writesClock.
+func (md *VarMetadata) Clocks() (*VectorClock, *VectorClock, error) {
+	writeTxnClock, err := vectorClockFromMetadata(md.WriteTxnClock)
+	if err != nil {
+		return nil, nil, err
+	}
+	writesClock, err := vectorClockFromMetadata(md.WritesClock)
+	if err != nil {
+		return nil, nil, err
+	}
+	return writeTxnClock, writesClock, nil
+}
+
+func vectorClockFromMetadata(clock map[string]uint64) (*VectorClock, error) {
+	vc := NewVectorClock()
+	for str, v := range clock {
+		vUUId, err := parseKey(str)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse vector clock var id '%s': %v", str, err)
+		}
+		vc.Clock[*common.MakeVarUUId(vUUId)] = v
+	}
+	return vc, nil
+}
+
+func parseKey(str string) ([]byte, error) {
+	key, err := hex.DecodeString(str)
+	if err == nil && len(key) != common.KeyLen {
+		err = fmt.Errorf("Expected %v bytes; got %v", common.KeyLen, len(key))
+	}
+	return key, err
+}
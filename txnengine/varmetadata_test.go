@@ -0,0 +1,89 @@
+package txnengine
+
+import (
+	"goshawkdb.io/common"
+	"goshawkdb.io/server/db"
+	"testing"
+)
+
+// Pages must neither skip nor repeat a var, whether or not the page
+// boundary falls on the last var, and whether or not after is held.
+func TestReadVarMetadataPage(t *testing.T) {
+	disk := db.NewMemoryStore()
+	defer disk.Shutdown()
+	ids := []common.VarUUId{testVarUUId(2), testVarUUId(4), testVarUUId(6), testVarUUId(8)}
+	_, err := disk.ReadWriteTransaction(false, func(rwtxn db.RWTxn) (interface{}, error) {
+		for _, vUUId := range ids {
+			// The records needn't be intact: a damaged var still has
+			// its place in the page.
+			if err := rwtxn.Put(db.Vars, vUUId[:], []byte("damaged")); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	}).ResultError()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, limit := range []int{1, 2, 3, 4, 5} {
+		var after *common.VarUUId
+		seen := []common.VarUUId{}
+		for pages := 0; ; pages++ {
+			if pages > len(ids) {
+				t.Fatalf("Limit %v: too many pages", limit)
+			}
+			vars, more, err := ReadVarMetadataPage(disk, after, limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(vars) > limit {
+				t.Fatalf("Limit %v: page of %v vars", limit, len(vars))
+			}
+			for _, md := range vars {
+				vUUId, _, _, err := md.Parse()
+				if err == nil {
+					t.Fatalf("Expected var %v to be reported as damaged", vUUId)
+				}
+				seen = append(seen, *vUUId)
+				after = vUUId
+			}
+			if !more {
+				break
+			}
+		}
+		if len(seen) != len(ids) {
+			t.Fatalf("Limit %v: expected %v vars; saw %v", limit, len(ids), len(seen))
+		}
+		for idx, vUUId := range seen {
+			if vUUId != ids[idx] {
+				t.Fatalf("Limit %v: expected var %v at %v; saw %v", limit, &ids[idx], idx, &vUUId)
+			}
+		}
+	}
+
+	for _, test := range []struct {
+		after    common.VarUUId
+		expected []common.VarUUId
+	}{
+		{testVarUUId(1), ids},
+		{testVarUUId(4), ids[2:]},
+		{testVarUUId(5), ids[2:]},
+		{testVarUUId(8), nil},
+		{testVarUUId(9), nil},
+	} {
+		after := test.after
+		vars, more, err := ReadVarMetadataPage(disk, &after, len(ids))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if more || len(vars) != len(test.expected) {
+			t.Fatalf("After %v: expected %v vars and no more; got %v (more? %v)", &after, len(test.expected), len(vars), more)
+		}
+		for idx, md := range vars {
+			if vUUId, _, _, _ := md.Parse(); *vUUId != test.expected[idx] {
+				t.Fatalf("After %v: expected var %v at %v; got %v", &after, &test.expected[idx], idx, vUUId)
+			}
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	capn "github.com/glycerine/go-capnproto"
 	"log"
+	"strings"
 )
 
 func CheckFatal(e error) {
@@ -20,6 +21,47 @@ func CheckWarn(e error) bool {
 	return false
 }
 
+// secretFlags are the flags whose values must never reach the logs.
+var secretFlags = []string{"password", "encryptionkeycmd"}
+
+// RedactArgs returns a copy of args, as in os.Args, in which the
+// values of flags which may hold secrets are replaced, so that the
+// result can be logged.
+func RedactArgs(args []string) []string {
+	result := append([]string(nil), args...)
+	for idx := 1; idx < len(result); idx++ {
+		arg := result[idx]
+		if arg == "--" {
+			break
+		} else if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name := strings.TrimLeft(arg, "-")
+		eq := strings.Index(name, "=")
+		if eq >= 0 {
+			name = name[:eq]
+		}
+		if !isSecretFlag(name) {
+			continue
+		} else if eq >= 0 {
+			result[idx] = arg[:strings.Index(arg, "=")+1] + "REDACTED"
+		} else if idx+1 < len(result) {
+			idx++
+			result[idx] = "REDACTED"
+		}
+	}
+	return result
+}
+
+func isSecretFlag(name string) bool {
+	for _, flag := range secretFlags {
+		if name == flag {
+			return true
+		}
+	}
+	return false
+}
+
 type LogFunc func(...interface{})
 
 var Log LogFunc = LogFunc(func(elems ...interface{}) {})